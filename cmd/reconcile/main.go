@@ -0,0 +1,81 @@
+// Command reconcile copies the documents written to the fallback cluster back to the primary cluster.
+//
+//	reconcile -fallback mongodb://standby:27017/logs -primary mongodb://primary:27017/logs
+//
+// Running it again copies nothing twice, the documents keep their IDs and the bucket lines are merged by ID.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/saagie/fluent-bit-mongo/pkg/entry/mongo"
+	mgo "gopkg.in/mgo.v2"
+)
+
+func main() {
+	fallbackURL := flag.String("fallback", "", "URL of the fallback cluster, with the database of the logs")
+	primaryURL := flag.String("primary", "", "URL of the primary cluster, with the database of the logs")
+	driverName := flag.String("driver", string(mongo.DriverMgo), "driver writing to the primary cluster: mgo or official")
+	timeout := flag.Duration("timeout", time.Hour, "time allowed to the whole copy")
+
+	bucket := mongo.DefaultOptions().Bucket
+	flag.DurationVar(&bucket.Window, "bucket-window", bucket.Window, "bucket window of the instance, with the bucket layout")
+	flag.IntVar(&bucket.MaxLines, "bucket-max-lines", bucket.MaxLines, "bucket max lines of the instance, with the bucket layout")
+	flag.IntVar(&bucket.MaxBytes, "bucket-max-bytes", bucket.MaxBytes, "bucket max bytes of the instance, with the bucket layout")
+	flag.Parse()
+
+	if err := run(*fallbackURL, *primaryURL, *driverName, *timeout, bucket); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run(fallbackURL, primaryURL, driverName string, timeout time.Duration, bucket mongo.BucketOptions) error {
+	if fallbackURL == "" || primaryURL == "" {
+		return fmt.Errorf("both -fallback and -primary are needed")
+	}
+
+	driver, err := mongo.ParseDriver(driverName)
+	if err != nil {
+		return err
+	}
+
+	fallbackInfo, err := mgo.ParseURL(fallbackURL)
+	if err != nil {
+		return fmt.Errorf("parse fallback URL: %w", err)
+	}
+
+	primaryInfo, err := mgo.ParseURL(primaryURL)
+	if err != nil {
+		return fmt.Errorf("parse primary URL: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	source, err := mgo.DialWithInfo(fallbackInfo)
+	if err != nil {
+		return fmt.Errorf("dial fallback: %w", err)
+	}
+	defer source.Close()
+
+	connector := mongo.NewConnector(driver, primaryInfo, mongo.DefaultOptions().Session, mongo.NewIndexRegistry())
+	defer connector.Close()
+
+	target, err := connector.Connect(ctx)
+	if err != nil {
+		return fmt.Errorf("connect to primary: %w", err)
+	}
+	defer target.Close()
+
+	stats, err := mongo.Reconcile(ctx, source.DB(mongo.MongoDefaultDB), target, bucket)
+
+	fmt.Printf("collections: %d, documents: %d, summaries: %d, interrupted summaries: %d, contents: %d\n",
+		stats.Collections, stats.Documents, stats.Summaries, stats.Interrupted, stats.Contents)
+
+	return err
+}
@@ -12,9 +12,7 @@ import (
 	"github.com/saagie/fluent-bit-mongo/pkg/config"
 	flbcontext "github.com/saagie/fluent-bit-mongo/pkg/context"
 	"github.com/saagie/fluent-bit-mongo/pkg/entry"
-	"github.com/saagie/fluent-bit-mongo/pkg/entry/mongo"
 	"github.com/saagie/fluent-bit-mongo/pkg/log"
-	mgo "gopkg.in/mgo.v2"
 )
 
 const PluginID = "mongo"
@@ -64,7 +62,42 @@ func FLBPluginInit(ctxPointer unsafe.Pointer) int {
 
 	value.Logger.Info("Initializing plugin", nil)
 
-	value.Config = config.GetConfig(ctxPointer)
+	cfg, err := config.GetConfig(ctxPointer)
+	if err != nil {
+		value.Logger.Error("Invalid configuration", map[string]interface{}{
+			"error": err,
+		})
+
+		return output.FLB_ERROR
+	}
+
+	if err := value.Init(cfg); err != nil {
+		value.Logger.Error("Failed to initialize plugin", map[string]interface{}{
+			"error": err,
+		})
+
+		return output.FLB_ERROR
+	}
+
+	dialInfo := cfg.DialInfo
+
+	value.Logger.Info("Connecting to mongodb on first flush", map[string]interface{}{
+		"hosts":         dialInfo.Addrs,
+		"user":          dialInfo.Username,
+		"source":        dialInfo.Source,
+		"database":      dialInfo.Database,
+		"with_password": dialInfo.Password != "",
+		"driver":        cfg.Driver,
+	})
+
+	for _, m := range cfg.Mirrors {
+		value.Logger.Info("Mirroring the writes to mongodb", map[string]interface{}{
+			"mirror":   m.Name,
+			"policy":   m.Policy,
+			"hosts":    m.Connection.DialInfo.Addrs,
+			"database": m.Connection.DialInfo.Database,
+		})
+	}
 
 	flbcontext.Set(ctxPointer, value)
 
@@ -86,34 +119,15 @@ func FLBPluginFlushCtx(ctxPointer, data unsafe.Pointer, length C.int, tag *C.cha
 	}
 
 	logger := value.Logger
-	ctx := log.WithLogger(context.TODO(), logger)
+	ctx := log.WithLogger(context.Background(), logger)
+	ctx = entry.WithTag(ctx, C.GoString(tag))
 
-	// Open mongo session
-	config := value.Config.(*mgo.DialInfo)
+	dec := output.NewDecoder(data, int(length)) // Create Fluent Bit decoder
 
-	logger.Info("Connecting to mongodb", map[string]interface{}{
-		"hosts":         config.Addrs,
-		"user":          config.Username,
-		"source":        config.Source,
-		"database":      config.Database,
-		"with_password": config.Password != "",
+	err = value.Flush(ctx, func(ctx context.Context, processor entry.Processor) error {
+		return ProcessAll(ctx, dec, processor)
 	})
-
-	session, err := mgo.DialWithInfo(config)
 	if err != nil {
-		logger.Error("Failed to connect to mongodb", map[string]interface{}{
-			"error": err,
-		})
-
-		return output.FLB_RETRY
-	}
-
-	defer session.Close()
-
-	dec := output.NewDecoder(data, int(length)) // Create Fluent Bit decoder
-	processor := mongo.New(session)
-
-	if err := ProcessAll(ctx, dec, processor); err != nil {
 		logger.Error("Failed to process logs", map[string]interface{}{
 			"error": err,
 		})
@@ -142,6 +156,8 @@ func ProcessAll(ctx context.Context, dec *output.FLBDecoder, processor entry.Pro
 		return fmt.Errorf("get logger: %w", err)
 	}
 
+	var errs entry.Errors
+
 	// Iterate Records
 	for {
 		// Extract Record
@@ -156,20 +172,67 @@ func ProcessAll(ctx context.Context, dec *output.FLBDecoder, processor entry.Pro
 				break
 			}
 
-			return fmt.Errorf("get record: %w", err)
+			// The records left cannot be read, the processor is still flushed like below
+			errs = append(errs, fmt.Errorf("get record: %w", err))
+
+			break
+		}
+
+		// The chunk is retried as a whole, the records left are not worth processing.
+		// The processor is still flushed, so that the stages put back what the chunk changed.
+		if err := ctx.Err(); err != nil {
+			errs = append(errs, &entry.ErrRetry{Cause: fmt.Errorf("process records: %w", err)})
+
+			break
 		}
 
 		total++
 
+		// The other records are still written, the chunk is retried or dropped once all the errors are known
 		if err := processor.ProcessRecord(ctx, ts, record); err != nil {
-			return fmt.Errorf("process record: %w", err)
+			errs = append(errs, fmt.Errorf("process record: %w", err))
 		}
 	}
 
-	return nil
+	if err := entry.FlushNext(ctx, processor); err != nil {
+		errs = append(errs, fmt.Errorf("flush: %w", err))
+	}
+
+	return errs.Err()
 }
 
 //export FLBPluginExit
 func FLBPluginExit() int {
+	// The instances are closed by FLBPluginExitCtx
+	return output.FLB_OK
+}
+
+// ExitTimeout bounds the wait for the running flushes and the writes of the held back records on exit.
+const ExitTimeout = 10 * time.Second
+
+//export FLBPluginExitCtx
+func FLBPluginExitCtx(ctxPointer unsafe.Pointer) int {
+	value, err := flbcontext.Get(ctxPointer)
+	if err != nil {
+		fmt.Printf("error getting value: %s\n", err)
+
+		return output.FLB_ERROR
+	}
+
+	value.Logger.Info("Closing plugin", map[string]interface{}{
+		"pending": value.Pending(),
+	})
+
+	ctx, cancel := context.WithTimeout(log.WithLogger(context.Background(), value.Logger), ExitTimeout)
+	defer cancel()
+
+	if err := value.Close(ctx); err != nil {
+		value.Logger.Error("Failed to close plugin", map[string]interface{}{
+			"error": err,
+		})
+
+		return output.FLB_ERROR
+	}
+
 	return output.FLB_OK
 }
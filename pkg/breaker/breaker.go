@@ -0,0 +1,205 @@
+package breaker
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrOpen is returned while the breaker refuses calls.
+var ErrOpen = errors.New("circuit breaker open")
+
+type State string
+
+const (
+	// Closed lets the calls through and counts their consecutive failures.
+	Closed State = "closed"
+	// Open refuses the calls until the cool-down is over.
+	Open State = "open"
+	// HalfOpen lets a single call through at a time to probe the storage.
+	HalfOpen State = "half-open"
+)
+
+var States = []State{Closed, Open, HalfOpen}
+
+// Generation identifies the state a call was let through in, it changes on each state change.
+type Generation uint64
+
+type Options struct {
+	// Failures is the number of consecutive failures opening the breaker, the breaker is disabled when zero.
+	Failures int
+	// Cooldown is the time the breaker stays open before probing.
+	Cooldown time.Duration
+	// Successes is the number of successful probes closing the breaker.
+	Successes int
+}
+
+// DefaultOptions disables the breaker, the cool-down and successes apply once failures are set.
+func DefaultOptions() Options {
+	return Options{
+		Failures:  0,
+		Cooldown:  30 * time.Second,
+		Successes: 1,
+	}
+}
+
+func (o Options) Enabled() bool {
+	return o.Failures > 0
+}
+
+func (o Options) Validate() error {
+	if o.Failures < 0 {
+		return errors.New("breaker failures must not be negative")
+	}
+
+	if !o.Enabled() {
+		return nil
+	}
+
+	if o.Cooldown <= 0 {
+		return errors.New("breaker cooldown must be positive")
+	}
+
+	if o.Successes <= 0 {
+		return errors.New("breaker successes must be positive")
+	}
+
+	return nil
+}
+
+// Breaker stops the calls to a failing storage for a while, it is safe for concurrent use.
+type Breaker struct {
+	options  Options
+	now      func() time.Time
+	onChange func(from, to State)
+
+	lock      sync.Mutex
+	state     State
+	failures  int
+	successes int
+	openedAt  time.Time
+	probing   bool
+	// generation is incremented on each state change, the outcomes of calls let through before are ignored
+	generation Generation
+}
+
+// New returns a closed breaker, onChange is called on each state change and may be nil.
+// onChange runs while the breaker is locked, it must not call the breaker.
+func New(options Options, onChange func(from, to State)) *Breaker {
+	return &Breaker{
+		options:  options,
+		now:      time.Now,
+		onChange: onChange,
+		state:    Closed,
+	}
+}
+
+// State returns the state of the breaker, a nil breaker is always closed.
+func (b *Breaker) State() State {
+	if b == nil {
+		return Closed
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.state
+}
+
+// Allow reports whether a call may go through, Done reports its outcome with the returned generation.
+// A nil breaker lets every call through.
+func (b *Breaker) Allow() (Generation, error) {
+	if b == nil {
+		return 0, nil
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	switch b.state {
+	case Open:
+		if b.now().Sub(b.openedAt) < b.options.Cooldown {
+			return 0, ErrOpen
+		}
+
+		b.set(HalfOpen)
+		b.probing = true
+
+		return b.generation, nil
+	case HalfOpen:
+		if b.probing {
+			return 0, ErrOpen
+		}
+
+		b.probing = true
+
+		return b.generation, nil
+	default:
+		return b.generation, nil
+	}
+}
+
+// Done records the outcome of a call let through in the given generation. The outcomes of the calls let through
+// before the last state change are ignored: a call let through while closed does not decide of a probe.
+func (b *Breaker) Done(generation Generation, failed bool) {
+	if b == nil {
+		return
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if generation != b.generation {
+		return
+	}
+
+	switch b.state {
+	case HalfOpen:
+		b.probing = false
+
+		if failed {
+			b.open()
+
+			return
+		}
+
+		b.successes++
+		if b.successes >= b.options.Successes {
+			b.failures = 0
+			b.set(Closed)
+		}
+	case Closed:
+		if !failed {
+			b.failures = 0
+
+			return
+		}
+
+		b.failures++
+		if b.failures >= b.options.Failures {
+			b.open()
+		}
+	default:
+		// The breaker opened since
+	}
+}
+
+func (b *Breaker) open() {
+	b.openedAt = b.now()
+	b.successes = 0
+	b.set(Open)
+}
+
+func (b *Breaker) set(state State) {
+	from := b.state
+	if from == state {
+		return
+	}
+
+	b.state = state
+	b.generation++
+
+	if b.onChange != nil {
+		b.onChange(from, state)
+	}
+}
@@ -0,0 +1,141 @@
+package breaker_test
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	"github.com/saagie/fluent-bit-mongo/pkg/breaker"
+)
+
+var _ = Describe("Breaker", func() {
+	var b *breaker.Breaker
+	var now time.Time
+	var changes []breaker.State
+
+	start := time.Date(2022, 6, 8, 9, 56, 36, 0, time.UTC)
+
+	allow := func() breaker.Generation {
+		generation, err := b.Allow()
+		Expect(err).ToNot(HaveOccurred())
+
+		return generation
+	}
+
+	call := func(failed bool) {
+		b.Done(allow(), failed)
+	}
+
+	fail := func(times int) {
+		for i := 0; i < times; i++ {
+			call(true)
+		}
+	}
+
+	refused := func() {
+		_, err := b.Allow()
+		Expect(err).To(MatchError(breaker.ErrOpen))
+	}
+
+	BeforeEach(func() {
+		now = start
+		changes = nil
+
+		b = breaker.New(breaker.Options{
+			Failures:  3,
+			Cooldown:  10 * time.Second,
+			Successes: 2,
+		}, func(from, to breaker.State) {
+			changes = append(changes, to)
+		})
+		b.SetNow(func() time.Time {
+			return now
+		})
+	})
+
+	It("Should open after consecutive failures", func() {
+		fail(2)
+		call(false)
+		fail(2)
+		Expect(b.State()).To(Equal(breaker.Closed))
+
+		fail(1)
+		Expect(b.State()).To(Equal(breaker.Open))
+		refused()
+		Expect(changes).To(Equal([]breaker.State{breaker.Open}))
+	})
+
+	It("Should probe one call at a time after the cool-down", func() {
+		fail(3)
+
+		now = now.Add(10 * time.Second)
+		probe := allow()
+		Expect(b.State()).To(Equal(breaker.HalfOpen))
+		refused()
+
+		b.Done(probe, false)
+		Expect(b.State()).To(Equal(breaker.HalfOpen))
+
+		call(false)
+		Expect(b.State()).To(Equal(breaker.Closed))
+		Expect(changes).To(Equal([]breaker.State{breaker.Open, breaker.HalfOpen, breaker.Closed}))
+	})
+
+	It("Should open again when a probe fails", func() {
+		fail(3)
+
+		now = now.Add(10 * time.Second)
+		call(true)
+		Expect(b.State()).To(Equal(breaker.Open))
+
+		now = now.Add(5 * time.Second)
+		refused()
+
+		now = now.Add(5 * time.Second)
+		allow()
+	})
+
+	It("Should ignore the outcomes of the calls let through before a state change", func() {
+		slow := allow()
+		fail(3)
+
+		// The call let through while closed does not decide of the probe
+		now = now.Add(10 * time.Second)
+		probe := allow()
+		b.Done(slow, true)
+		Expect(b.State()).To(Equal(breaker.HalfOpen))
+		refused()
+
+		b.Done(probe, false)
+		call(false)
+		Expect(b.State()).To(Equal(breaker.Closed))
+
+		// Nor counts once the breaker closed again
+		b.Done(slow, true)
+		b.Done(probe, true)
+		fail(2)
+		Expect(b.State()).To(Equal(breaker.Closed))
+
+		fail(1)
+		Expect(b.State()).To(Equal(breaker.Open))
+	})
+
+	It("Should let every call through when nil", func() {
+		var disabled *breaker.Breaker
+
+		generation, err := disabled.Allow()
+		Expect(err).ToNot(HaveOccurred())
+		disabled.Done(generation, true)
+		Expect(disabled.State()).To(Equal(breaker.Closed))
+	})
+
+	DescribeTable("Invalid options", func(options breaker.Options) {
+		Expect(options.Validate()).ToNot(Succeed())
+	},
+		Entry("negative failures", breaker.Options{Failures: -1}),
+		Entry("no cooldown", breaker.Options{Failures: 1, Successes: 1}),
+		Entry("no successes", breaker.Options{Failures: 1, Cooldown: time.Second}),
+	)
+})
@@ -0,0 +1,7 @@
+package breaker
+
+import "time"
+
+func (b *Breaker) SetNow(now func() time.Time) {
+	b.now = now
+}
@@ -1,38 +1,847 @@
 package config
 
 import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
 	"unsafe"
 
 	"github.com/fluent/fluent-bit-go/output"
+	"github.com/saagie/fluent-bit-mongo/pkg/breaker"
+	"github.com/saagie/fluent-bit-mongo/pkg/entry"
+	"github.com/saagie/fluent-bit-mongo/pkg/entry/mongo"
+	"github.com/saagie/fluent-bit-mongo/pkg/metrics"
+	"github.com/saagie/fluent-bit-mongo/pkg/multiline"
+	"github.com/saagie/fluent-bit-mongo/pkg/partial"
+	"github.com/saagie/fluent-bit-mongo/pkg/redact"
+	"github.com/saagie/fluent-bit-mongo/pkg/severity"
+	"github.com/saagie/fluent-bit-mongo/pkg/source"
+	"github.com/saagie/fluent-bit-mongo/pkg/structured"
 	mgo "gopkg.in/mgo.v2"
 )
 
-func GetAddress(ctx unsafe.Pointer) string {
-	return output.FLBPluginConfigKey(ctx, "host_port")
+const (
+	AddressKey  = "host_port"
+	UsernameKey = "username"
+	PasswordKey = "password"
+	SourceKey   = "auth_database"
+	DatabaseKey = "database"
+	DriverKey   = "driver"
+
+	// FallbackPrefix prefixes the connection keys of the fallback cluster, such as fallback_host_port.
+	FallbackPrefix = "fallback_"
+
+	// MirrorsKey lists the names of the mirrors, their connection keys are prefixed with mirror_<name>_.
+	MirrorsKey      = "mirrors"
+	MirrorPrefix    = "mirror_"
+	MirrorPolicyKey = "policy"
+
+	// RoutingProfilesKey lists the names of the clusters of the routing table, their keys are prefixed with profile_<name>_.
+	RoutingTableKey    = "routing_table"
+	RoutingProfilesKey = "routing_profiles"
+	ProfilePrefix      = "profile_"
+
+	AuthMechanismKey = "auth_mechanism"
+	TLSKey           = "tls"
+	TLSCAFileKey     = "tls_ca_file"
+	TLSCertFileKey   = "tls_cert_file"
+	TLSKeyFileKey    = "tls_key_file"
+
+	StorageLayoutKey  = "storage_layout"
+	WriteModeKey      = "write_mode"
+	BucketWindowKey   = "bucket_window"
+	BucketMaxLinesKey = "bucket_max_lines"
+	BucketMaxBytesKey = "bucket_max_bytes"
+
+	ExecutionSummaryKey = "execution_summary"
+
+	PartialReassemblyKey = "partial_reassembly"
+	PartialTimeoutKey    = "partial_timeout"
+	PartialMaxSizeKey    = "partial_max_size"
+
+	MultilineKey             = "multiline"
+	MultilineStartKey        = "multiline_start"
+	MultilineContinuationKey = "multiline_continuation"
+	MultilineTimeoutKey      = "multiline_timeout"
+	MultilineMaxLinesKey     = "multiline_max_lines"
+
+	SeverityKey            = "severity"
+	SeverityPatternKey     = "severity_pattern"
+	SeverityStderrErrorKey = "severity_stderr_error"
+
+	StructuredKey           = "structured"
+	StructuredFormatsKey    = "structured_formats"
+	StructuredMaxDepthKey   = "structured_max_depth"
+	StructuredMaxSizeKey    = "structured_max_size"
+	StructuredMessageKeyKey = "structured_message_key"
+
+	RedactKey            = "redact"
+	RedactPatternKey     = "redact_pattern"
+	RedactReplacementKey = "redact_replacement"
+
+	MetricsListenKey = "metrics_listen"
+
+	TagRuleKey            = "tag_rule"
+	StoreTagKey           = "store_tag"
+	CollectionTemplateKey = "collection_template"
+
+	TypeKeyKey              = "type_key"
+	TypeValuesKey           = "type_values"
+	UnknownTypeKey          = "unknown_type"
+	DeadLetterCollectionKey = "dead_letter_collection"
+
+	MaxLineSizeKey    = "max_line_size"
+	OversizePolicyKey = "oversize_policy"
+
+	CompressionKey        = "compression"
+	CompressionMinSizeKey = "compression_min_size"
+
+	WriteConcurrencyKey = "write_concurrency"
+
+	FlushTimeoutKey  = "flush_timeout"
+	SocketTimeoutKey = "socket_timeout"
+	SyncTimeoutKey   = "sync_timeout"
+
+	WriteConcernKey = "write_concern"
+	JournalKey      = "journal"
+	WTimeoutKey     = "wtimeout"
+
+	BreakerFailuresKey  = "breaker_failures"
+	BreakerCooldownKey  = "breaker_cooldown"
+	BreakerSuccessesKey = "breaker_successes"
+
+	EncryptionKeyringKey    = "encryption_keyring"
+	EncryptionFieldsKey     = "encryption_fields"
+	EncryptionMissingKeyKey = "encryption_missing_key"
+	// EncryptNone encrypts the log content only.
+	EncryptNone = "none"
+
+	// IdentifierSourceKey prefixes the sources of a record key, as in source_project_id_1.
+	IdentifierSourceKey = "source"
+)
+
+// identifierKeys are the record keys which can be read from sources, besides the type key.
+var identifierKeys = []string{
+	mongo.CustomerKey,
+	mongo.PlatformIDKey,
+	mongo.ProjectIDKey,
+	mongo.JobExecutionIDKey,
+	mongo.AppIDKey,
+	mongo.AppExecutionIDKey,
+	mongo.ContainerIDKey,
+	mongo.ConditionExecutionIDKey,
+	mongo.ConditionNodeIDKey,
+	mongo.PipelineExecutionIDKey,
 }
 
-func GetUsername(ctx unsafe.Pointer) string {
-	return output.FLBPluginConfigKey(ctx, "username")
+// Getter returns the raw value of a configuration key, or an empty string when it is not set.
+type Getter func(key string) string
+
+// Connection is how the plugin reaches a cluster besides the primary one.
+type Connection struct {
+	DialInfo *mgo.DialInfo
+	Session  mongo.SessionOptions
 }
 
-func GetPassword(ctx unsafe.Pointer) string {
-	return output.FLBPluginConfigKey(ctx, "password")
+// Mirror is a cluster receiving a copy of the writes.
+type Mirror struct {
+	Name       string
+	Policy     mongo.MirrorPolicy
+	Connection *Connection
 }
 
-func GetSource(ctx unsafe.Pointer) string {
-	return output.FLBPluginConfigKey(ctx, "auth_database")
+// Config holds everything the plugin reads from its [OUTPUT] section.
+type Config struct {
+	DialInfo   *mgo.DialInfo
+	Driver     mongo.Driver
+	Options    mongo.Options
+	Partial    partial.Options
+	Multiline  multiline.Options
+	Severity   severity.Options
+	Structured structured.Options
+	Redact     redact.Options
+	Sources    source.Options
+	// MetricsListen is the address exposing the metrics, they are not exposed when empty.
+	MetricsListen string
+	// FlushTimeout bounds the processing and the writes of a chunk, the chunk is retried when it expires.
+	FlushTimeout time.Duration
+	Breaker      breaker.Options
+	// Fallback receives the flushes while the breaker of the primary cluster is open, it is nil when not configured.
+	Fallback *Connection
+	// Mirrors receive a copy of the writes, in order.
+	Mirrors []Mirror
+	// Routing selects the database and the cluster of the records, they all go to the default database when nil.
+	Routing *mongo.RoutingTable
+	// Profiles are the clusters of the routing table, by name.
+	Profiles map[string]*Connection
 }
 
-func GetDatabase(ctx unsafe.Pointer) string {
-	return output.FLBPluginConfigKey(ctx, "database")
+// Stages returns the processing stages enabled by the configuration, in the order they apply.
+func (c *Config) Stages() []entry.Stage {
+	stages := make([]entry.Stage, 0)
+
+	// First, so that the next stages find the identifiers of the records
+	if c.Sources.Enabled() {
+		stages = append(stages, source.New(c.Sources))
+	}
+
+	if c.Partial.Enabled {
+		stages = append(stages, partial.New(c.Partial))
+	}
+
+	if c.Multiline.Enabled() {
+		stages = append(stages, multiline.New(c.Multiline))
+	}
+
+	return stages
 }
 
-func GetConfig(ctx unsafe.Pointer) *mgo.DialInfo {
-	return &mgo.DialInfo{
-		Addrs:    []string{GetAddress(ctx)},
-		Username: GetUsername(ctx),
-		Password: GetPassword(ctx),
-		Source:   GetSource(ctx),
-		Database: GetDatabase(ctx),
+// Enrichers returns the document enrichers enabled by the configuration, in the order they apply.
+func (c *Config) Enrichers(registry *metrics.Registry) []mongo.Enricher {
+	var enrichers []mongo.Enricher
+
+	if c.Severity.Enabled {
+		enrichers = append(enrichers, severity.New(c.Severity))
+	}
+
+	// After the severity extraction, which may rely on the original content
+	if c.Structured.Enabled {
+		enrichers = append(enrichers, structured.New(c.Structured))
+	}
+
+	// Last, so that the parsed fields are redacted too
+	if c.Redact.Enabled() {
+		enrichers = append(enrichers, redact.New(c.Redact, registry))
+	}
+
+	return enrichers
+}
+
+func GetConfig(ctx unsafe.Pointer) (*Config, error) {
+	return Load(func(key string) string {
+		return output.FLBPluginConfigKey(ctx, key)
+	})
+}
+
+func Load(get Getter) (*Config, error) {
+	config := &Config{
+		DialInfo: &mgo.DialInfo{
+			Addrs:    []string{get(AddressKey)},
+			Username: get(UsernameKey),
+			Password: get(PasswordKey),
+			Source:   get(SourceKey),
+			Database: get(DatabaseKey),
+		},
+		Driver:       mongo.DriverMgo,
+		Options:      mongo.DefaultOptions(),
+		FlushTimeout: 30 * time.Second,
+		Breaker:      breaker.DefaultOptions(),
+		Partial:      partial.DefaultOptions(),
+		Multiline:    multiline.DefaultOptions(),
+		Structured:   structured.DefaultOptions(),
+	}
+
+	var err error
+
+	if value := get(DriverKey); value != "" {
+		config.Driver, err = mongo.ParseDriver(value)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: %w", DriverKey, err)
+		}
+	}
+
+	if err := loadAuth(get, config.Driver, config.DialInfo, &config.Options.Session); err != nil {
+		return nil, err
+	}
+
+	if value := get(StorageLayoutKey); value != "" {
+		config.Options.Layout, err = mongo.ParseLayout(value)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: %w", StorageLayoutKey, err)
+		}
+	}
+
+	if value := get(WriteModeKey); value != "" {
+		config.Options.WriteMode, err = mongo.ParseWriteMode(value)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: %w", WriteModeKey, err)
+		}
+	}
+
+	config.Options.Bucket.Window, err = getDuration(get, BucketWindowKey, config.Options.Bucket.Window)
+	if err != nil {
+		return nil, err
+	}
+
+	config.Options.Bucket.MaxLines, err = getInt(get, BucketMaxLinesKey, config.Options.Bucket.MaxLines)
+	if err != nil {
+		return nil, err
+	}
+
+	config.Options.Bucket.MaxBytes, err = getInt(get, BucketMaxBytesKey, config.Options.Bucket.MaxBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	config.Options.Summary, err = getBool(get, ExecutionSummaryKey, config.Options.Summary)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, value := range getIndexed(get, TagRuleKey) {
+		rule, err := mongo.ParseTagRule(value)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: %w", TagRuleKey, err)
+		}
+
+		config.Options.TagRules = append(config.Options.TagRules, rule)
+	}
+
+	config.Options.StoreTag, err = getBool(get, StoreTagKey, config.Options.StoreTag)
+	if err != nil {
+		return nil, err
+	}
+
+	if value := get(CollectionTemplateKey); value != "" {
+		config.Options.CollectionTemplate, err = mongo.ParseCollectionTemplate(value)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: %w", CollectionTemplateKey, err)
+		}
 	}
+
+	config.Options.Discriminator.Key = get(TypeKeyKey)
+
+	if value := get(TypeValuesKey); value != "" {
+		config.Options.Discriminator.Types, err = mongo.ParseTypes(value)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: %w", TypeValuesKey, err)
+		}
+	}
+
+	if value := get(UnknownTypeKey); value != "" {
+		config.Options.Discriminator.Unknown, err = mongo.ParseUnknownPolicy(value)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: %w", UnknownTypeKey, err)
+		}
+	}
+
+	if value := get(DeadLetterCollectionKey); value != "" {
+		config.Options.Discriminator.DeadLetterCollection = value
+	}
+
+	config.Options.Oversize.MaxSize, err = getInt(get, MaxLineSizeKey, config.Options.Oversize.MaxSize)
+	if err != nil {
+		return nil, err
+	}
+
+	if value := get(OversizePolicyKey); value != "" {
+		config.Options.Oversize.Policy, err = mongo.ParseOversizePolicy(value)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: %w", OversizePolicyKey, err)
+		}
+	}
+
+	if value := get(CompressionKey); value != "" && !strings.EqualFold(value, "off") {
+		config.Options.Compression.Codec, err = mongo.ParseCodec(strings.ToLower(value))
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: %w", CompressionKey, err)
+		}
+	}
+
+	config.Options.Compression.MinSize, err = getInt(get, CompressionMinSizeKey, config.Options.Compression.MinSize)
+	if err != nil {
+		return nil, err
+	}
+
+	config.Options.Concurrency, err = getInt(get, WriteConcurrencyKey, config.Options.Concurrency)
+	if err != nil {
+		return nil, err
+	}
+
+	config.FlushTimeout, err = getDuration(get, FlushTimeoutKey, config.FlushTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.FlushTimeout <= 0 {
+		return nil, fmt.Errorf("validate: %s must be positive", FlushTimeoutKey)
+	}
+
+	config.Options.Session.SocketTimeout, err = getDuration(get, SocketTimeoutKey, config.Options.Session.SocketTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	config.Options.Session.SyncTimeout, err = getDuration(get, SyncTimeoutKey, config.Options.Session.SyncTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := loadWriteConcern(get, &config.Options.Session); err != nil {
+		return nil, err
+	}
+
+	config.Breaker.Failures, err = getInt(get, BreakerFailuresKey, config.Breaker.Failures)
+	if err != nil {
+		return nil, err
+	}
+
+	config.Breaker.Cooldown, err = getDuration(get, BreakerCooldownKey, config.Breaker.Cooldown)
+	if err != nil {
+		return nil, err
+	}
+
+	config.Breaker.Successes, err = getInt(get, BreakerSuccessesKey, config.Breaker.Successes)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := config.Breaker.Validate(); err != nil {
+		return nil, fmt.Errorf("validate: %w", err)
+	}
+
+	config.Fallback, err = loadConnection(get, FallbackPrefix, config.Driver, config.Options.Session)
+	if err != nil {
+		return nil, err
+	}
+
+	// The fallback cluster is used while the breaker is open
+	if config.Fallback != nil && !config.Breaker.Enabled() {
+		return nil, errors.New("validate: the fallback cluster needs the circuit breaker")
+	}
+
+	config.Mirrors, err = loadMirrors(get, config.Driver, config.Options.Session)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := loadRouting(get, config); err != nil {
+		return nil, err
+	}
+
+	if value := get(EncryptionKeyringKey); value != "" {
+		config.Options.Encryption.Keyring, err = mongo.LoadKeyring(value)
+		if err != nil {
+			return nil, fmt.Errorf("load %s: %w", EncryptionKeyringKey, err)
+		}
+	}
+
+	if value := get(EncryptionFieldsKey); value != "" {
+		config.Options.Encryption.Fields = nil
+
+		for _, field := range strings.Split(value, ",") {
+			if field = strings.ToLower(strings.TrimSpace(field)); field != "" && field != EncryptNone {
+				config.Options.Encryption.Fields = append(config.Options.Encryption.Fields, field)
+			}
+		}
+	}
+
+	if value := get(EncryptionMissingKeyKey); value != "" {
+		config.Options.Encryption.MissingKey, err = mongo.ParseMissingKeyPolicy(value)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: %w", EncryptionMissingKeyKey, err)
+		}
+	}
+
+	config.Sources.Sources, err = getSources(get, config.Options.Discriminator.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := config.Options.Validate(); err != nil {
+		return nil, fmt.Errorf("validate: %w", err)
+	}
+
+	config.Partial.Enabled, err = getBool(get, PartialReassemblyKey, config.Partial.Enabled)
+	if err != nil {
+		return nil, err
+	}
+
+	config.Partial.Timeout, err = getDuration(get, PartialTimeoutKey, config.Partial.Timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	config.Partial.MaxSize, err = getInt(get, PartialMaxSizeKey, config.Partial.MaxSize)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := config.Partial.Validate(); err != nil {
+		return nil, fmt.Errorf("validate: %w", err)
+	}
+
+	config.Multiline.Rules, err = multiline.ParseRules(get(MultilineKey), get(MultilineStartKey), get(MultilineContinuationKey))
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %w", MultilineKey, err)
+	}
+
+	config.Multiline.Timeout, err = getDuration(get, MultilineTimeoutKey, config.Multiline.Timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	config.Multiline.MaxLines, err = getInt(get, MultilineMaxLinesKey, config.Multiline.MaxLines)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := config.Multiline.Validate(); err != nil {
+		return nil, fmt.Errorf("validate: %w", err)
+	}
+
+	config.Severity.Enabled, err = getBool(get, SeverityKey, config.Severity.Enabled)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, pattern := range getIndexed(get, SeverityPatternKey) {
+		re, err := severity.ParsePattern(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: %w", SeverityPatternKey, err)
+		}
+
+		config.Severity.Patterns = append(config.Severity.Patterns, re)
+	}
+
+	config.Severity.StderrError, err = getBool(get, SeverityStderrErrorKey, config.Severity.StderrError)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := config.Severity.Validate(); err != nil {
+		return nil, fmt.Errorf("validate: %w", err)
+	}
+
+	config.Structured.Enabled, err = getBool(get, StructuredKey, config.Structured.Enabled)
+	if err != nil {
+		return nil, err
+	}
+
+	if value := get(StructuredFormatsKey); value != "" {
+		config.Structured.Formats, err = structured.ParseFormats(value)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: %w", StructuredFormatsKey, err)
+		}
+	}
+
+	config.Structured.MaxDepth, err = getInt(get, StructuredMaxDepthKey, config.Structured.MaxDepth)
+	if err != nil {
+		return nil, err
+	}
+
+	config.Structured.MaxSize, err = getInt(get, StructuredMaxSizeKey, config.Structured.MaxSize)
+	if err != nil {
+		return nil, err
+	}
+
+	config.Structured.MessageKey = get(StructuredMessageKeyKey)
+
+	if err := config.Structured.Validate(); err != nil {
+		return nil, fmt.Errorf("validate: %w", err)
+	}
+
+	config.Redact.Rules, err = redact.ParseRules(get(RedactKey))
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %w", RedactKey, err)
+	}
+
+	for i, pattern := range getIndexed(get, RedactPatternKey) {
+		replacement := get(fmt.Sprintf("%s_%d", RedactReplacementKey, i+1))
+
+		rule, err := redact.NewRule(fmt.Sprintf("custom_%d", i+1), pattern, replacement)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: %w", RedactPatternKey, err)
+		}
+
+		config.Redact.Rules = append(config.Redact.Rules, rule)
+	}
+
+	if err := config.Redact.Validate(); err != nil {
+		return nil, fmt.Errorf("validate: %w", err)
+	}
+
+	config.MetricsListen = get(MetricsListenKey)
+
+	return config, nil
+}
+
+// loadAuth reads the authentication mechanism and the TLS options, then checks they can be used together.
+func loadAuth(get Getter, driver mongo.Driver, dialInfo *mgo.DialInfo, session *mongo.SessionOptions) error {
+	mechanism, err := mongo.ParseAuthMechanism(get(AuthMechanismKey))
+	if err != nil {
+		return fmt.Errorf("parse %s: %w", AuthMechanismKey, err)
+	}
+
+	dialInfo.Mechanism = string(mechanism)
+
+	options := mongo.TLSOptions{
+		CAFile:   get(TLSCAFileKey),
+		CertFile: get(TLSCertFileKey),
+		KeyFile:  get(TLSKeyFileKey),
+	}
+
+	options.Enabled, err = getBool(get, TLSKey, options.Enabled)
+	if err != nil {
+		return err
+	}
+
+	if err := options.Validate(); err != nil {
+		return fmt.Errorf("validate: %w", err)
+	}
+
+	session.TLS, err = options.Config()
+	if err != nil {
+		return fmt.Errorf("load tls: %w", err)
+	}
+
+	if err := mongo.ValidateAuth(driver, dialInfo, session.TLS); err != nil {
+		return fmt.Errorf("validate: %w", err)
+	}
+
+	return nil
+}
+
+// loadWriteConcern reads the write concern, the unset keys keep the values of the session.
+func loadWriteConcern(get Getter, session *mongo.SessionOptions) error {
+	if value := strings.TrimSpace(get(WriteConcernKey)); value != "" {
+		session.WriteConcern = value
+	}
+
+	var err error
+
+	session.Journal, err = getBool(get, JournalKey, session.Journal)
+	if err != nil {
+		return err
+	}
+
+	session.WTimeout, err = getDuration(get, WTimeoutKey, session.WTimeout)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// loadConnection reads the connection whose keys are prefixed, nil when it has no address.
+// The write concern and the timeouts default to the ones of the session.
+func loadConnection(get Getter, prefix string, driver mongo.Driver, session mongo.SessionOptions) (*Connection, error) {
+	prefixed := func(key string) string {
+		return get(prefix + key)
+	}
+
+	if prefixed(AddressKey) == "" {
+		return nil, nil
+	}
+
+	connection := &Connection{
+		DialInfo: &mgo.DialInfo{
+			Addrs:    []string{prefixed(AddressKey)},
+			Username: prefixed(UsernameKey),
+			Password: prefixed(PasswordKey),
+			Source:   prefixed(SourceKey),
+			Database: prefixed(DatabaseKey),
+		},
+		Session: session,
+	}
+
+	// The TLS options are not inherited, the clusters may be reached differently
+	connection.Session.TLS = nil
+
+	if err := loadWriteConcern(prefixed, &connection.Session); err != nil {
+		return nil, fmt.Errorf("%s: %w", strings.TrimSuffix(prefix, "_"), err)
+	}
+
+	if err := loadAuth(prefixed, driver, connection.DialInfo, &connection.Session); err != nil {
+		return nil, fmt.Errorf("%s: %w", strings.TrimSuffix(prefix, "_"), err)
+	}
+
+	if err := connection.Session.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: validate: %w", strings.TrimSuffix(prefix, "_"), err)
+	}
+
+	return connection, nil
+}
+
+// loadMirrors returns the mirrors listed by the mirrors key, each needs an address.
+func loadMirrors(get Getter, driver mongo.Driver, session mongo.SessionOptions) ([]Mirror, error) {
+	var mirrors []Mirror
+
+	names := map[string]bool{}
+
+	for _, name := range strings.Split(get(MirrorsKey), ",") {
+		if name = strings.ToLower(strings.TrimSpace(name)); name == "" {
+			continue
+		}
+
+		if names[name] {
+			return nil, fmt.Errorf("validate: mirror %s listed twice", name)
+		}
+
+		names[name] = true
+		prefix := MirrorPrefix + name + "_"
+
+		connection, err := loadConnection(get, prefix, driver, session)
+		if err != nil {
+			return nil, err
+		}
+
+		if connection == nil {
+			return nil, fmt.Errorf("validate: mirror %s needs %s", name, prefix+AddressKey)
+		}
+
+		mirror := Mirror{
+			Name:       name,
+			Policy:     mongo.MirrorRequired,
+			Connection: connection,
+		}
+
+		if value := get(prefix + MirrorPolicyKey); value != "" {
+			mirror.Policy, err = mongo.ParseMirrorPolicy(strings.ToLower(value))
+			if err != nil {
+				return nil, fmt.Errorf("parse %s: %w", prefix+MirrorPolicyKey, err)
+			}
+		}
+
+		mirrors = append(mirrors, mirror)
+	}
+
+	return mirrors, nil
+}
+
+// loadRouting reads the profiles then the routing table, whose rules may only use them.
+func loadRouting(get Getter, config *Config) error {
+	var names []string
+
+	for _, name := range strings.Split(get(RoutingProfilesKey), ",") {
+		if name = strings.ToLower(strings.TrimSpace(name)); name == "" {
+			continue
+		}
+
+		if _, ok := config.Profiles[name]; ok {
+			return fmt.Errorf("validate: profile %s listed twice", name)
+		}
+
+		prefix := ProfilePrefix + name + "_"
+
+		connection, err := loadConnection(get, prefix, config.Driver, config.Options.Session)
+		if err != nil {
+			return err
+		}
+
+		if connection == nil {
+			return fmt.Errorf("validate: profile %s needs %s", name, prefix+AddressKey)
+		}
+
+		if config.Profiles == nil {
+			config.Profiles = map[string]*Connection{}
+		}
+
+		config.Profiles[name] = connection
+		names = append(names, name)
+	}
+
+	value := get(RoutingTableKey)
+	if value == "" {
+		if len(names) > 0 {
+			return fmt.Errorf("validate: %s needs %s", RoutingProfilesKey, RoutingTableKey)
+		}
+
+		return nil
+	}
+
+	table, err := mongo.LoadRoutingTable(value, names)
+	if err != nil {
+		return fmt.Errorf("load %s: %w", RoutingTableKey, err)
+	}
+
+	config.Routing = table
+
+	return nil
+}
+
+// getSources returns the sources of the identifier keys and of the type key, nil when there are none.
+func getSources(get Getter, typeKey string) (map[string][]source.Source, error) {
+	keys := identifierKeys
+	if typeKey != "" {
+		keys = append(append([]string{}, keys...), typeKey)
+	}
+
+	sources := map[string][]source.Source{}
+
+	for _, key := range keys {
+		sourceKey := IdentifierSourceKey + "_" + key
+
+		for _, value := range getIndexed(get, sourceKey) {
+			s, err := source.Parse(value)
+			if err != nil {
+				return nil, fmt.Errorf("parse %s: %w", sourceKey, err)
+			}
+
+			sources[key] = append(sources[key], s)
+		}
+	}
+
+	if len(sources) == 0 {
+		return nil, nil
+	}
+
+	return sources, nil
+}
+
+// getIndexed returns the values of the numbered keys key_1, key_2, ... up to the first missing one.
+func getIndexed(get Getter, key string) []string {
+	var values []string
+
+	for i := 1; ; i++ {
+		value := get(fmt.Sprintf("%s_%d", key, i))
+		if value == "" {
+			return values
+		}
+
+		values = append(values, value)
+	}
+}
+
+func getInt(get Getter, key string, defaultValue int) (int, error) {
+	value := strings.TrimSpace(get(key))
+	if value == "" {
+		return defaultValue, nil
+	}
+
+	result, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("parse %s: %w", key, err)
+	}
+
+	return result, nil
+}
+
+func getBool(get Getter, key string, defaultValue bool) (bool, error) {
+	switch value := strings.ToLower(strings.TrimSpace(get(key))); value {
+	case "":
+		return defaultValue, nil
+	case "on", "true", "yes":
+		return true, nil
+	case "off", "false", "no":
+		return false, nil
+	default:
+		return false, fmt.Errorf("parse %s: invalid boolean %q", key, value)
+	}
+}
+
+func getDuration(get Getter, key string, defaultValue time.Duration) (time.Duration, error) {
+	value := strings.TrimSpace(get(key))
+	if value == "" {
+		return defaultValue, nil
+	}
+
+	result, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("parse %s: %w", key, err)
+	}
+
+	return result, nil
 }
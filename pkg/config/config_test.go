@@ -0,0 +1,666 @@
+package config_test
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	mgo "gopkg.in/mgo.v2"
+
+	"github.com/saagie/fluent-bit-mongo/pkg/breaker"
+	"github.com/saagie/fluent-bit-mongo/pkg/config"
+	"github.com/saagie/fluent-bit-mongo/pkg/entry/mongo"
+	"github.com/saagie/fluent-bit-mongo/pkg/metrics"
+	"github.com/saagie/fluent-bit-mongo/pkg/multiline"
+	"github.com/saagie/fluent-bit-mongo/pkg/partial"
+	"github.com/saagie/fluent-bit-mongo/pkg/redact"
+	"github.com/saagie/fluent-bit-mongo/pkg/severity"
+	"github.com/saagie/fluent-bit-mongo/pkg/source"
+	"github.com/saagie/fluent-bit-mongo/pkg/structured"
+)
+
+func getter(values map[string]string) config.Getter {
+	return func(key string) string {
+		return values[key]
+	}
+}
+
+var _ = Describe("Load configuration", func() {
+	var values map[string]string
+
+	BeforeEach(func() {
+		values = map[string]string{
+			config.AddressKey:  "mongo:27017",
+			config.UsernameKey: "user",
+			config.PasswordKey: "password",
+			config.SourceKey:   "admin",
+			config.DatabaseKey: "logs",
+		}
+	})
+
+	Context("With connection keys only", func() {
+		It("Should use default options", func() {
+			c, err := config.Load(getter(values))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(c.DialInfo.Addrs).To(Equal([]string{"mongo:27017"}))
+			Expect(c.DialInfo.Username).To(Equal("user"))
+			Expect(c.DialInfo.Password).To(Equal("password"))
+			Expect(c.DialInfo.Source).To(Equal("admin"))
+			Expect(c.DialInfo.Database).To(Equal("logs"))
+			Expect(c.Driver).To(Equal(mongo.DriverMgo))
+			Expect(c.Options).To(Equal(mongo.DefaultOptions()))
+			Expect(c.Partial).To(Equal(partial.DefaultOptions()))
+			Expect(c.Stages()).To(BeEmpty())
+		})
+	})
+
+	Context("With partial reassembly", func() {
+		BeforeEach(func() {
+			values[config.PartialReassemblyKey] = "On"
+			values[config.PartialTimeoutKey] = "10s"
+			values[config.PartialMaxSizeKey] = "32768"
+		})
+
+		It("Should add the reassembly stage", func() {
+			c, err := config.Load(getter(values))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(c.Partial).To(Equal(partial.Options{
+				Enabled: true,
+				Timeout: 10 * time.Second,
+				MaxSize: 32768,
+			}))
+			Expect(c.Stages()).To(HaveLen(1))
+			Expect(c.Stages()[0]).To(BeAssignableToTypeOf(&partial.Reassembler{}))
+		})
+	})
+
+	Context("With bucket layout", func() {
+		BeforeEach(func() {
+			values[config.StorageLayoutKey] = "bucket"
+			values[config.BucketWindowKey] = "5m"
+			values[config.BucketMaxLinesKey] = "500"
+			values[config.BucketMaxBytesKey] = "65536"
+		})
+
+		It("Should read bucket options", func() {
+			c, err := config.Load(getter(values))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(c.Options.Layout).To(Equal(mongo.LayoutBucket))
+			Expect(c.Options.Bucket).To(Equal(mongo.BucketOptions{
+				Window:   5 * time.Minute,
+				MaxLines: 500,
+				MaxBytes: 65536,
+			}))
+		})
+	})
+
+	Context("With multiline grouping", func() {
+		BeforeEach(func() {
+			values[config.PartialReassemblyKey] = "On"
+			values[config.MultilineKey] = "java,python"
+			values[config.MultilineStartKey] = `^\d{4}-\d{2}-\d{2}`
+			values[config.MultilineContinuationKey] = `^\s`
+			values[config.MultilineTimeoutKey] = "1s"
+		})
+
+		It("Should add the grouping stage after the reassembly", func() {
+			c, err := config.Load(getter(values))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(c.Multiline.Rules).To(HaveLen(3))
+			Expect(c.Multiline.Timeout).To(Equal(time.Second))
+			Expect(c.Multiline.MaxLines).To(Equal(multiline.DefaultOptions().MaxLines))
+
+			stages := c.Stages()
+			Expect(stages).To(HaveLen(2))
+			Expect(stages[0]).To(BeAssignableToTypeOf(&partial.Reassembler{}))
+			Expect(stages[1]).To(BeAssignableToTypeOf(&multiline.Grouper{}))
+		})
+	})
+
+	Context("With severity extraction", func() {
+		BeforeEach(func() {
+			values[config.SeverityKey] = "On"
+			values[config.SeverityPatternKey+"_1"] = `^(?P<level>[IWEF])\d{4}`
+			values[config.SeverityPatternKey+"_2"] = `<(?P<level>\w+)>`
+			values[config.SeverityPatternKey+"_4"] = `ignored after a gap`
+			values[config.SeverityStderrErrorKey] = "On"
+		})
+
+		It("Should add the severity enricher", func() {
+			c, err := config.Load(getter(values))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(c.Severity.Patterns).To(HaveLen(2))
+			Expect(c.Severity.StderrError).To(BeTrue())
+			Expect(c.Enrichers(metrics.NewRegistry())).To(HaveLen(1))
+			Expect(c.Enrichers(metrics.NewRegistry())[0]).To(BeAssignableToTypeOf(&severity.Extractor{}))
+		})
+
+		It("Should require patterns to capture the level", func() {
+			values[config.SeverityPatternKey+"_2"] = `<\w+>`
+
+			_, err := config.Load(getter(values))
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("Should not accept patterns when disabled", func() {
+			values[config.SeverityKey] = "Off"
+
+			_, err := config.Load(getter(values))
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("With structured content parsing", func() {
+		BeforeEach(func() {
+			values[config.SeverityKey] = "On"
+			values[config.StructuredKey] = "On"
+			values[config.StructuredFormatsKey] = "json"
+			values[config.StructuredMaxDepthKey] = "3"
+			values[config.StructuredMessageKeyKey] = "msg"
+		})
+
+		It("Should add the parser after the severity extraction", func() {
+			c, err := config.Load(getter(values))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(c.Structured).To(Equal(structured.Options{
+				Enabled:    true,
+				Formats:    []structured.Format{structured.JSON},
+				MaxDepth:   3,
+				MaxSize:    structured.DefaultOptions().MaxSize,
+				MessageKey: "msg",
+			}))
+			enrichers := c.Enrichers(metrics.NewRegistry())
+			Expect(enrichers).To(HaveLen(2))
+			Expect(enrichers[0]).To(BeAssignableToTypeOf(&severity.Extractor{}))
+			Expect(enrichers[1]).To(BeAssignableToTypeOf(&structured.Parser{}))
+		})
+	})
+
+	Context("With redaction", func() {
+		BeforeEach(func() {
+			values[config.StructuredKey] = "On"
+			values[config.RedactKey] = "email, jwt"
+			values[config.RedactPatternKey+"_1"] = `customer-(\d+)`
+			values[config.RedactReplacementKey+"_1"] = `customer-***`
+			values[config.RedactPatternKey+"_2"] = `secret`
+		})
+
+		It("Should add the redactor last", func() {
+			c, err := config.Load(getter(values))
+			Expect(err).ToNot(HaveOccurred())
+
+			names := make([]string, 0)
+			for _, rule := range c.Redact.Rules {
+				names = append(names, rule.Name)
+			}
+			Expect(names).To(Equal([]string{"email", "jwt", "custom_1", "custom_2"}))
+			Expect(c.Redact.Rules[2].Replacement).To(Equal("customer-***"))
+			Expect(c.Redact.Rules[3].Replacement).To(Equal("[REDACTED:custom_2]"))
+
+			enrichers := c.Enrichers(metrics.NewRegistry())
+			Expect(enrichers).To(HaveLen(2))
+			Expect(enrichers[1]).To(BeAssignableToTypeOf(&redact.Redactor{}))
+		})
+	})
+
+	Context("With tag keys", func() {
+		BeforeEach(func() {
+			values[config.TagRuleKey+"_1"] = "job.* job"
+			values[config.TagRuleKey+"_2"] = "app.* app"
+			values[config.StoreTagKey] = "On"
+			values[config.CollectionTemplateKey] = "{{.Customer}}_{{.Tag}}"
+		})
+
+		It("Should read the tag rules in order", func() {
+			c, err := config.Load(getter(values))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(c.Options.TagRules).To(HaveLen(2))
+			Expect(c.Options.TagRules[0].Pattern).To(Equal("job.*"))
+			Expect(c.Options.TagRules[0].Type).To(Equal(mongo.JobDocument))
+			Expect(c.Options.TagRules[1].Type).To(Equal(mongo.AppDocument))
+			Expect(c.Options.StoreTag).To(BeTrue())
+			Expect(c.Options.CollectionTemplate).ToNot(BeNil())
+		})
+	})
+
+	Context("With type keys", func() {
+		BeforeEach(func() {
+			values[config.TypeKeyKey] = "type"
+			values[config.TypeValuesKey] = "job:job, app:app, pipeline:condition, other:generic"
+			values[config.UnknownTypeKey] = "drop"
+		})
+
+		It("Should read the discriminator", func() {
+			c, err := config.Load(getter(values))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(c.Options.Discriminator).To(Equal(mongo.Discriminator{
+				Key: "type",
+				Types: map[string]mongo.DocumentType{
+					"job":      mongo.JobDocument,
+					"app":      mongo.AppDocument,
+					"pipeline": mongo.ConditionDocument,
+					"other":    mongo.GenericDocument,
+				},
+				Unknown:              mongo.UnknownDrop,
+				DeadLetterCollection: mongo.DefaultDeadLetterCollection,
+			}))
+		})
+
+		It("Should default to the document type names and the dead letters", func() {
+			delete(values, config.TypeValuesKey)
+			delete(values, config.UnknownTypeKey)
+
+			c, err := config.Load(getter(values))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(c.Options.Discriminator.Types).To(Equal(mongo.DefaultTypes()))
+			Expect(c.Options.Discriminator.Unknown).To(Equal(mongo.UnknownDeadLetter))
+		})
+	})
+
+	Context("With identifier sources", func() {
+		BeforeEach(func() {
+			values[config.IdentifierSourceKey+"_project_id_1"] = "$kubernetes['labels']['saagie.io/project-id']"
+			values[config.IdentifierSourceKey+"_project_id_2"] = "$log_file ~ _(?P<value>[^_]+)\\.log$"
+			values[config.IdentifierSourceKey+"_customer_1"] = "$kubernetes['namespace_name']"
+			values[config.TypeKeyKey] = "type"
+			values[config.IdentifierSourceKey+"_type_1"] = "$kubernetes['labels']['saagie.io/type']"
+			values[config.PartialReassemblyKey] = "On"
+		})
+
+		It("Should add the resolver before the other stages", func() {
+			c, err := config.Load(getter(values))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(c.Sources.Sources).To(HaveLen(3))
+			Expect(c.Sources.Sources["project_id"]).To(HaveLen(2))
+			Expect(c.Sources.Sources["project_id"][1].Pattern).ToNot(BeNil())
+			Expect(c.Sources.Sources["type"][0].Accessor).To(Equal(source.Accessor{"kubernetes", "labels", "saagie.io/type"}))
+
+			stages := c.Stages()
+			Expect(stages).To(HaveLen(2))
+			Expect(stages[0]).To(BeAssignableToTypeOf(&source.Resolver{}))
+			Expect(stages[1]).To(BeAssignableToTypeOf(&partial.Reassembler{}))
+		})
+	})
+
+	It("Should read the oversize options", func() {
+		values[config.MaxLineSizeKey] = "65536"
+		values[config.OversizePolicyKey] = "gridfs"
+
+		c, err := config.Load(getter(values))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(c.Options.Oversize).To(Equal(mongo.OversizeOptions{
+			MaxSize: 65536,
+			Policy:  mongo.OversizeGridFS,
+		}))
+	})
+
+	Context("With encryption", func() {
+		var dir string
+
+		BeforeEach(func() {
+			var err error
+			dir, err = os.MkdirTemp("", "keyring")
+			Expect(err).ToNot(HaveOccurred())
+
+			path := filepath.Join(dir, "keyring.json")
+			key := base64.StdEncoding.EncodeToString(make([]byte, 32))
+			Expect(os.WriteFile(path, []byte(`{"*": {"active": "k1", "keys": {"k1": "`+key+`"}}}`), 0o600)).To(Succeed())
+
+			values[config.EncryptionKeyringKey] = path
+			values[config.EncryptionFieldsKey] = "Fields, tag"
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(dir)).To(Succeed())
+		})
+
+		It("Should load the keyring", func() {
+			c, err := config.Load(getter(values))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(c.Options.Encryption.Keyring).ToNot(BeNil())
+			Expect(c.Options.Encryption.Fields).To(Equal([]string{mongo.EncryptFields, mongo.EncryptTag}))
+		})
+
+		It("Should encrypt the fields by default", func() {
+			delete(values, config.EncryptionFieldsKey)
+
+			c, err := config.Load(getter(values))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(c.Options.Encryption.Fields).To(Equal([]string{mongo.EncryptFields}))
+
+			values[config.EncryptionFieldsKey] = "none"
+
+			c, err = config.Load(getter(values))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(c.Options.Encryption.Fields).To(BeEmpty())
+		})
+
+		It("Should store the lines without key in clear by default", func() {
+			c, err := config.Load(getter(values))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(c.Options.Encryption.MissingKey).To(Equal(mongo.MissingKeyClear))
+
+			values[config.EncryptionMissingKeyKey] = "reject"
+
+			c, err = config.Load(getter(values))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(c.Options.Encryption.MissingKey).To(Equal(mongo.MissingKeyReject))
+		})
+
+		It("Should not store the oversized contents in clear", func() {
+			values[config.OversizePolicyKey] = "gridfs"
+
+			_, err := config.Load(getter(values))
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	It("Should read the timeouts", func() {
+		c, err := config.Load(getter(values))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(c.FlushTimeout).To(Equal(30 * time.Second))
+
+		values[config.FlushTimeoutKey] = "1m"
+		values[config.SocketTimeoutKey] = "5s"
+		values[config.SyncTimeoutKey] = "15s"
+
+		c, err = config.Load(getter(values))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(c.FlushTimeout).To(Equal(time.Minute))
+		Expect(c.Options.Session).To(Equal(mongo.SessionOptions{
+			SocketTimeout: 5 * time.Second,
+			SyncTimeout:   15 * time.Second,
+		}))
+	})
+
+	DescribeTable("Write mode", func(value string, expected mongo.WriteMode) {
+		values[config.WriteModeKey] = value
+
+		c, err := config.Load(getter(values))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(c.Options.WriteMode).To(Equal(expected))
+	},
+		Entry("unset", "", mongo.WriteUpsert),
+		Entry("upsert", "upsert", mongo.WriteUpsert),
+		Entry("insert", "insert", mongo.WriteInsert),
+		Entry("replace", "replace", mongo.WriteReplace),
+	)
+
+	DescribeTable("Driver", func(value string, expected mongo.Driver) {
+		values[config.DriverKey] = value
+
+		c, err := config.Load(getter(values))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(c.Driver).To(Equal(expected))
+	},
+		Entry("unset", "", mongo.DriverMgo),
+		Entry("mgo", "mgo", mongo.DriverMgo),
+		Entry("official", "official", mongo.DriverOfficial),
+	)
+
+	It("Should read the authentication mechanism", func() {
+		values[config.DriverKey] = "official"
+		values[config.AuthMechanismKey] = "scram-sha-256"
+		values[config.TLSKey] = "On"
+
+		c, err := config.Load(getter(values))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(c.DialInfo.Mechanism).To(Equal(string(mongo.AuthScramSHA256)))
+		Expect(c.Options.Session.TLS).ToNot(BeNil())
+	})
+
+	It("Should fail to load missing tls files", func() {
+		values[config.TLSKey] = "On"
+		values[config.TLSCertFileKey] = "/nonexistent/client.pem"
+
+		_, err := config.Load(getter(values))
+		Expect(err).To(MatchError(ContainSubstring("load tls")))
+	})
+
+	It("Should read the write concern", func() {
+		values[config.WriteConcernKey] = "majority"
+		values[config.JournalKey] = "On"
+		values[config.WTimeoutKey] = "5s"
+
+		c, err := config.Load(getter(values))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(c.Options.Session.Safe()).To(Equal(&mgo.Safe{WMode: "majority", J: true, WTimeout: 5000}))
+	})
+
+	It("Should read the circuit breaker options", func() {
+		c, err := config.Load(getter(values))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(c.Breaker).To(Equal(breaker.DefaultOptions()))
+		Expect(c.Breaker.Enabled()).To(BeFalse())
+
+		values[config.BreakerFailuresKey] = "5"
+
+		c, err = config.Load(getter(values))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(c.Breaker.Enabled()).To(BeTrue())
+		Expect(c.Breaker.Failures).To(Equal(5))
+	})
+
+	It("Should read the fallback cluster", func() {
+		c, err := config.Load(getter(values))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(c.Fallback).To(BeNil())
+
+		values[config.WriteConcernKey] = "majority"
+		values[config.WTimeoutKey] = "5s"
+		values[config.FallbackPrefix+config.AddressKey] = "fallback:27017"
+		values[config.FallbackPrefix+config.UsernameKey] = "fallbackUser"
+		values[config.FallbackPrefix+config.PasswordKey] = "fallbackPassword"
+		values[config.FallbackPrefix+config.DatabaseKey] = "fallbackLogs"
+		values[config.FallbackPrefix+config.WriteConcernKey] = "1"
+		values[config.BreakerFailuresKey] = "5"
+
+		c, err = config.Load(getter(values))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(c.Fallback).ToNot(BeNil())
+		Expect(c.Fallback.DialInfo.Addrs).To(Equal([]string{"fallback:27017"}))
+		Expect(c.Fallback.DialInfo.Username).To(Equal("fallbackUser"))
+		Expect(c.Fallback.DialInfo.Password).To(Equal("fallbackPassword"))
+		Expect(c.Fallback.DialInfo.Database).To(Equal("fallbackLogs"))
+		Expect(c.Fallback.Session.Safe()).To(Equal(&mgo.Safe{W: 1, WTimeout: 5000}))
+		Expect(c.Options.Session.Safe()).To(Equal(&mgo.Safe{WMode: "majority", WTimeout: 5000}))
+
+		values[config.BreakerFailuresKey] = "0"
+
+		_, err = config.Load(getter(values))
+		Expect(err).To(MatchError(ContainSubstring("needs the circuit breaker")))
+	})
+
+	It("Should read the mirrors", func() {
+		values[config.WriteConcernKey] = "majority"
+		values[config.MirrorsKey] = "new, Old"
+		values[config.MirrorPrefix+"new_"+config.AddressKey] = "new:27017"
+		values[config.MirrorPrefix+"new_"+config.DatabaseKey] = "newLogs"
+		values[config.MirrorPrefix+"old_"+config.AddressKey] = "old:27017"
+		values[config.MirrorPrefix+"old_"+config.WriteConcernKey] = "1"
+		values[config.MirrorPrefix+"old_"+config.MirrorPolicyKey] = "Best-Effort"
+
+		c, err := config.Load(getter(values))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(c.Mirrors).To(HaveLen(2))
+
+		Expect(c.Mirrors[0].Name).To(Equal("new"))
+		Expect(c.Mirrors[0].Policy).To(Equal(mongo.MirrorRequired))
+		Expect(c.Mirrors[0].Connection.DialInfo.Addrs).To(Equal([]string{"new:27017"}))
+		Expect(c.Mirrors[0].Connection.DialInfo.Database).To(Equal("newLogs"))
+		Expect(c.Mirrors[0].Connection.Session.Safe()).To(Equal(&mgo.Safe{WMode: "majority"}))
+
+		Expect(c.Mirrors[1].Name).To(Equal("old"))
+		Expect(c.Mirrors[1].Policy).To(Equal(mongo.MirrorBestEffort))
+		Expect(c.Mirrors[1].Connection.Session.Safe()).To(Equal(&mgo.Safe{W: 1}))
+	})
+
+	It("Should refuse the invalid mirrors", func() {
+		values[config.MirrorsKey] = "new"
+
+		_, err := config.Load(getter(values))
+		Expect(err).To(MatchError(ContainSubstring("mirror_new_host_port")))
+
+		values[config.MirrorPrefix+"new_"+config.AddressKey] = "new:27017"
+		values[config.MirrorsKey] = "new,new"
+
+		_, err = config.Load(getter(values))
+		Expect(err).To(MatchError(ContainSubstring("listed twice")))
+
+		values[config.MirrorsKey] = "new"
+		values[config.MirrorPrefix+"new_"+config.MirrorPolicyKey] = "sometimes"
+
+		_, err = config.Load(getter(values))
+		Expect(err).To(MatchError(ContainSubstring("unknown mirror policy")))
+	})
+
+	Context("With a routing table", func() {
+		var dir string
+
+		BeforeEach(func() {
+			var err error
+			dir, err = os.MkdirTemp("", "routing")
+			Expect(err).ToNot(HaveOccurred())
+
+			path := filepath.Join(dir, "routes.json")
+			Expect(os.WriteFile(path, []byte(`[{"customer": "acme", "database": "acme", "profile": "dedicated"}]`), 0o600)).To(Succeed())
+
+			values[config.RoutingTableKey] = path
+			values[config.RoutingProfilesKey] = "dedicated"
+			values[config.ProfilePrefix+"dedicated_"+config.AddressKey] = "dedicated:27017"
+			values[config.ProfilePrefix+"dedicated_"+config.UsernameKey] = "acme"
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(dir)).To(Succeed())
+		})
+
+		It("Should load the table and its profiles", func() {
+			c, err := config.Load(getter(values))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(c.Routing.Route("acme", "prod")).To(Equal(mongo.Route{Database: "acme", Profile: "dedicated"}))
+			Expect(c.Profiles).To(HaveKey("dedicated"))
+			Expect(c.Profiles["dedicated"].DialInfo.Addrs).To(Equal([]string{"dedicated:27017"}))
+			Expect(c.Profiles["dedicated"].DialInfo.Username).To(Equal("acme"))
+		})
+
+		It("Should refuse the routes to unknown profiles", func() {
+			delete(values, config.RoutingProfilesKey)
+
+			_, err := config.Load(getter(values))
+			Expect(err).To(MatchError(ContainSubstring("unknown profile")))
+		})
+
+		It("Should refuse the profiles without routing table", func() {
+			delete(values, config.RoutingTableKey)
+
+			_, err := config.Load(getter(values))
+			Expect(err).To(MatchError(ContainSubstring("needs " + config.RoutingTableKey)))
+		})
+
+		It("Should refuse the profiles without address", func() {
+			delete(values, config.ProfilePrefix+"dedicated_"+config.AddressKey)
+
+			_, err := config.Load(getter(values))
+			Expect(err).To(MatchError(ContainSubstring("profile_dedicated_host_port")))
+		})
+	})
+
+	DescribeTable("Compression", func(value string, expected mongo.Codec) {
+		values[config.CompressionKey] = value
+
+		c, err := config.Load(getter(values))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(c.Options.Compression.Codec).To(Equal(expected))
+	},
+		Entry("unset", "", mongo.Codec("")),
+		Entry("off", "Off", mongo.Codec("")),
+		Entry("gzip", "gzip", mongo.CodecGzip),
+		Entry("zstd", "ZSTD", mongo.CodecZstd),
+	)
+
+	DescribeTable("Execution summary", func(value string, expected bool) {
+		values[config.ExecutionSummaryKey] = value
+
+		c, err := config.Load(getter(values))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(c.Options.Summary).To(Equal(expected))
+	},
+		Entry("unset", "", false),
+		Entry("on", "On", true),
+		Entry("true", "true", true),
+		Entry("off", "Off", false),
+	)
+
+	DescribeTable("Invalid value", func(key, value string) {
+		values[config.StorageLayoutKey] = "bucket"
+		values[config.BreakerFailuresKey] = "5"
+		values[key] = value
+
+		_, err := config.Load(getter(values))
+		Expect(err).To(HaveOccurred())
+	},
+		Entry("storage layout", config.StorageLayoutKey, "columns"),
+		Entry("driver", config.DriverKey, "mongo"),
+		Entry("auth mechanism", config.AuthMechanismKey, "GSSAPI"),
+		Entry("scram sha 256 with mgo", config.AuthMechanismKey, "SCRAM-SHA-256"),
+		Entry("plain without tls", config.AuthMechanismKey, "PLAIN"),
+		Entry("tls", config.TLSKey, "maybe"),
+		Entry("tls files without tls", config.TLSCAFileKey, "ca.pem"),
+		Entry("bucket window", config.BucketWindowKey, "a minute"),
+		Entry("negative bucket window", config.BucketWindowKey, "-1m"),
+		Entry("bucket max lines", config.BucketMaxLinesKey, "many"),
+		Entry("zero bucket max lines", config.BucketMaxLinesKey, "0"),
+		Entry("bucket max bytes", config.BucketMaxBytesKey, "1MB"),
+		Entry("execution summary", config.ExecutionSummaryKey, "sometimes"),
+		Entry("partial timeout", config.PartialTimeoutKey, "soon"),
+		Entry("partial max size", config.PartialMaxSizeKey, "big"),
+		Entry("multiline rule", config.MultilineKey, "cobol"),
+		Entry("multiline start", config.MultilineStartKey, "("),
+		Entry("multiline timeout", config.MultilineTimeoutKey, "later"),
+		Entry("structured formats", config.StructuredFormatsKey, "yaml"),
+		Entry("structured max depth", config.StructuredMaxDepthKey, "deep"),
+		Entry("redaction rule", config.RedactKey, "phone"),
+		Entry("duplicated redaction rule", config.RedactKey, "email,all"),
+		Entry("redaction pattern", config.RedactPatternKey+"_1", "("),
+		Entry("tag rule", config.TagRuleKey+"_1", "job.*"),
+		Entry("tag rule type", config.TagRuleKey+"_1", "job.* batch"),
+		Entry("store tag", config.StoreTagKey, "maybe"),
+		Entry("collection template", config.CollectionTemplateKey, "{{.Tag"),
+		Entry("type values", config.TypeValuesKey, "job=job"),
+		Entry("type values document type", config.TypeValuesKey, "pipeline:pipeline"),
+		Entry("unknown type policy", config.UnknownTypeKey, "ignore"),
+		Entry("max line size", config.MaxLineSizeKey, "huge"),
+		Entry("max line size above the limit", config.MaxLineSizeKey, "16777216"),
+		Entry("oversize policy", config.OversizePolicyKey, "drop"),
+		Entry("compression", config.CompressionKey, "lz4"),
+		Entry("compression min size", config.CompressionMinSizeKey, "small"),
+		Entry("write concurrency", config.WriteConcurrencyKey, "many"),
+		Entry("zero write concurrency", config.WriteConcurrencyKey, "0"),
+		Entry("flush timeout", config.FlushTimeoutKey, "soon"),
+		Entry("zero flush timeout", config.FlushTimeoutKey, "0s"),
+		Entry("socket timeout", config.SocketTimeoutKey, "soon"),
+		Entry("zero socket timeout", config.SocketTimeoutKey, "0s"),
+		Entry("zero sync timeout", config.SyncTimeoutKey, "0s"),
+		Entry("write mode", config.WriteModeKey, "append"),
+		Entry("bucket write mode", config.WriteModeKey, "insert"),
+		Entry("negative write concern", config.WriteConcernKey, "-1"),
+		Entry("journal", config.JournalKey, "maybe"),
+		Entry("wtimeout", config.WTimeoutKey, "soon"),
+		Entry("negative wtimeout", config.WTimeoutKey, "-1s"),
+		Entry("breaker failures", config.BreakerFailuresKey, "few"),
+		Entry("negative breaker failures", config.BreakerFailuresKey, "-1"),
+		Entry("breaker cooldown", config.BreakerCooldownKey, "a while"),
+		Entry("zero breaker cooldown", config.BreakerCooldownKey, "0s"),
+		Entry("zero breaker successes", config.BreakerSuccessesKey, "0"),
+		Entry("encryption keyring", config.EncryptionKeyringKey, "/nonexistent/keyring.json"),
+		Entry("encryption fields", config.EncryptionFieldsKey, "stream"),
+		Entry("encryption missing key", config.EncryptionMissingKeyKey, "drop"),
+		Entry("identifier source", config.IdentifierSourceKey+"_customer_1", "kubernetes['namespace_name']"),
+		Entry("identifier source pattern", config.IdentifierSourceKey+"_customer_1", "$log_file ~ (.*)"),
+	)
+})
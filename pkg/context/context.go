@@ -1,16 +1,380 @@
 package context
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"net/http"
+	"sync"
 	"unsafe"
 
 	"github.com/fluent/fluent-bit-go/output"
+	"github.com/saagie/fluent-bit-mongo/pkg/breaker"
+	"github.com/saagie/fluent-bit-mongo/pkg/config"
+	"github.com/saagie/fluent-bit-mongo/pkg/entry"
+	"github.com/saagie/fluent-bit-mongo/pkg/entry/mongo"
 	"github.com/saagie/fluent-bit-mongo/pkg/log"
+	"github.com/saagie/fluent-bit-mongo/pkg/metrics"
 )
 
+const (
+	// MetricFlushTimeouts counts the flushes retried because their deadline expired.
+	MetricFlushTimeouts = "flush_timeouts_total"
+	// MetricBreakerState is 1 for the current state of the circuit breaker, 0 for the others.
+	MetricBreakerState = "circuit_breaker_state"
+	// MetricFlushes counts the flushes by cluster.
+	MetricFlushes = "flushes_total"
+)
+
+var (
+	ErrClosed         = errors.New("instance closed")
+	ErrNotInitialized = errors.New("instance not initialized")
+)
+
+// Value is the state of a plugin instance, each [OUTPUT] section has its own.
+// The flushes of an instance run in parallel when fluent-bit workers are enabled.
 type Value struct {
 	Logger log.Logger
-	Config interface{}
+	Config *config.Config
+	// Stages are applied in order to the records before they reach the mongo processor.
+	Stages  []entry.Stage
+	Metrics *metrics.Registry
+	// Connector opens the storage of the flushes with the configured driver.
+	Connector mongo.Connector
+	// Fallback opens the storage of the flushes while the breaker is open, it is nil without fallback cluster.
+	Fallback mongo.Connector
+	// Mirrors receive a copy of the writes of both clusters, their connectors are shared by the two.
+	Mirrors []mongo.Mirror
+	// Profiles open the storages of the clusters of the routing table, by profile name.
+	Profiles map[string]mongo.Connector
+	Indexes  *mongo.IndexRegistry
+	// Breaker stops the flushes while mongo keeps failing, it is nil when disabled.
+	Breaker *breaker.Breaker
+	// Server exposes the metrics, it is nil when they are not exposed.
+	Server *http.Server
+
+	// fallbackOptions are the processor options of the fallback cluster.
+	fallbackOptions mongo.Options
+
+	lock    sync.Mutex
+	closed  bool
+	flushes sync.WaitGroup
+}
+
+// Init sets up the resources of the instance from its configuration.
+func (v *Value) Init(cfg *config.Config) error {
+	v.Config = cfg
+	v.Metrics = metrics.NewRegistry()
+	v.Stages = cfg.Stages()
+	v.Indexes = mongo.NewIndexRegistry()
+	v.Connector = mongo.NewConnector(cfg.Driver, cfg.DialInfo, cfg.Options.Session, v.Indexes)
+
+	if cfg.Breaker.Enabled() {
+		v.Breaker = breaker.New(cfg.Breaker, v.breakerChanged)
+		v.setBreakerState(breaker.Closed)
+	}
+
+	cfg.Options.Enrichers = cfg.Enrichers(v.Metrics)
+	cfg.Options.Metrics = v.Metrics
+
+	// The processors are created for each flush, the summaries they could not save wait in the backlog
+	if cfg.Options.Summary {
+		cfg.Options.SummaryBacklog = mongo.NewSummaryBacklog()
+	}
+
+	if cfg.Fallback != nil {
+		// The documents record the cluster they went to
+		cfg.Options.Cluster = mongo.ClusterPrimary
+
+		v.fallbackOptions = cfg.Options
+		v.fallbackOptions.Cluster = mongo.ClusterFallback
+		v.fallbackOptions.Session = cfg.Fallback.Session
+
+		// The clusters have their own collections and indexes
+		v.Fallback = mongo.NewConnector(cfg.Driver, cfg.Fallback.DialInfo, cfg.Fallback.Session, mongo.NewIndexRegistry())
+	}
+
+	for _, m := range cfg.Mirrors {
+		v.Mirrors = append(v.Mirrors, mongo.Mirror{
+			Name:      m.Name,
+			Policy:    m.Policy,
+			Connector: mongo.NewConnector(cfg.Driver, m.Connection.DialInfo, m.Connection.Session, mongo.NewIndexRegistry()),
+		})
+	}
+
+	if len(v.Mirrors) > 0 {
+		v.Connector = mongo.NewMirrorConnector(v.Connector, v.Mirrors, cfg.Options.Summary, v.Metrics)
+
+		if v.Fallback != nil {
+			v.Fallback = mongo.NewMirrorConnector(v.Fallback, v.Mirrors, cfg.Options.Summary, v.Metrics)
+		}
+	}
+
+	for name, profile := range cfg.Profiles {
+		if v.Profiles == nil {
+			v.Profiles = map[string]mongo.Connector{}
+		}
+
+		v.Profiles[name] = mongo.NewConnector(cfg.Driver, profile.DialInfo, profile.Session, mongo.NewIndexRegistry())
+	}
+
+	if cfg.MetricsListen != "" {
+		server, err := metrics.Serve(cfg.MetricsListen, v.Metrics)
+		if err != nil {
+			return fmt.Errorf("expose metrics: %w", err)
+		}
+
+		v.Server = server
+	}
+
+	return nil
+}
+
+// Begin registers a flush, it fails once the instance is closed. Done is called when the flush ends.
+func (v *Value) Begin() error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if v.closed {
+		return ErrClosed
+	}
+
+	v.flushes.Add(1)
+
+	return nil
+}
+
+func (v *Value) Done() {
+	v.flushes.Done()
+}
+
+// Flush hands the processor of a flush to process, the processor writes to a session of the instance.
+// The flush is bound to the flush timeout, it is retried when the deadline expires.
+func (v *Value) Flush(ctx context.Context, process func(context.Context, entry.Processor) error) error {
+	if err := v.Begin(); err != nil {
+		return err
+	}
+	defer v.Done()
+
+	if v.Config == nil {
+		return ErrNotInitialized
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, v.Config.FlushTimeout)
+	defer cancel()
+
+	// The primary cluster is not dialed while the breaker is open, the fallback cluster is used instead if any
+	generation, err := v.Breaker.Allow()
+	if err != nil {
+		if v.Fallback == nil {
+			return &entry.ErrRetry{Cause: err}
+		}
+
+		v.Metrics.Inc(MetricFlushes, metrics.Labels{"cluster": mongo.ClusterFallback})
+
+		return v.timedOut(ctx, v.flush(ctx, v.Fallback, v.fallbackOptions, process))
+	}
+
+	v.Metrics.Inc(MetricFlushes, metrics.Labels{"cluster": mongo.ClusterPrimary})
+
+	err = v.flush(ctx, v.Connector, v.Config.Options, process)
+
+	// Only the failures to write to the primary cluster open the breaker, not the records which cannot be converted
+	// nor the failures of the mirrors and of the clusters of the routing profiles
+	v.Breaker.Done(generation, mongo.PrimaryFailure(err))
+
+	return v.timedOut(ctx, err)
+}
+
+// timedOut returns the error of a flush, which is retried when the deadline of the flush expired.
+func (v *Value) timedOut(ctx context.Context, err error) error {
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		v.Metrics.Inc(MetricFlushTimeouts, nil)
+
+		// Whatever failed, the chunk was cut short
+		return &entry.ErrRetry{Cause: fmt.Errorf("flush deadline exceeded: %w", err)}
+	}
+
+	return err
+}
+
+func (v *Value) flush(ctx context.Context, connector mongo.Connector, options mongo.Options, process func(context.Context, entry.Processor) error) error {
+	if connector == nil {
+		return ErrNotInitialized
+	}
+
+	storage, err := connector.Connect(ctx)
+	if err != nil {
+		return &entry.ErrRetry{Cause: fmt.Errorf("connect to mongo: %w", err)}
+	}
+	defer storage.Close()
+
+	var processor entry.Processor
+
+	if v.Config.Routing == nil {
+		processor = mongo.New(storage, options)
+	} else {
+		var opened []mongo.Storage
+
+		defer func() {
+			for i := len(opened) - 1; i >= 0; i-- {
+				opened[i].Close()
+			}
+		}()
+
+		processor = mongo.NewRouter(v.Config.Routing, func(ctx context.Context, route mongo.Route) (mongo.Storage, error) {
+			s, err := v.openRoute(ctx, storage, route)
+			if s != nil && s != storage {
+				opened = append(opened, s)
+			}
+
+			return s, err
+		}, options)
+	}
+
+	for i := len(v.Stages) - 1; i >= 0; i-- {
+		processor = v.Stages[i].Wrap(processor)
+	}
+
+	return process(ctx, processor)
+}
+
+// openRoute returns the storage of the route, from the storage of the flush unless the route names a profile.
+// The caller closes the storage unless it is the storage of the flush.
+func (v *Value) openRoute(ctx context.Context, storage mongo.Storage, route mongo.Route) (mongo.Storage, error) {
+	if route.Profile != "" {
+		connector, ok := v.Profiles[route.Profile]
+		if !ok {
+			return nil, fmt.Errorf("unknown profile %s", route.Profile)
+		}
+
+		profile, err := connector.Connect(ctx)
+		if err != nil {
+			return nil, &entry.ErrRetry{Cause: &mongo.ErrSecondary{Cause: fmt.Errorf("connect to profile %s: %w", route.Profile, err)}}
+		}
+
+		if route.Database == "" {
+			return profile, nil
+		}
+
+		defer profile.Close()
+
+		storage = profile
+	}
+
+	if route.Database == "" {
+		return storage, nil
+	}
+
+	return storage.Database(route.Database), nil
+}
+
+func (v *Value) breakerChanged(from, to breaker.State) {
+	fields := map[string]interface{}{
+		"from": from,
+		"to":   to,
+	}
+	if v.Fallback != nil {
+		fields["fallback"] = to == breaker.Open
+	}
+
+	v.Logger.Info("Circuit breaker state changed", fields)
+
+	v.setBreakerState(to)
+}
+
+func (v *Value) setBreakerState(state breaker.State) {
+	for _, s := range breaker.States {
+		value := 0.0
+		if s == state {
+			value = 1
+		}
+
+		v.Metrics.Set(MetricBreakerState, metrics.Labels{"state": string(s)}, value)
+	}
+}
+
+// Pending returns the number of records held back by the stages.
+func (v *Value) Pending() int {
+	pending := 0
+
+	for _, stage := range v.Stages {
+		if holder, ok := stage.(entry.Holder); ok {
+			pending += holder.Pending()
+		}
+	}
+
+	return pending
+}
+
+// Close refuses new flushes and waits for the running ones until the context is done.
+// It then writes the records held back by the stages, stops exposing the metrics and closes the sessions.
+func (v *Value) Close(ctx context.Context) error {
+	v.lock.Lock()
+	if v.closed {
+		v.lock.Unlock()
+
+		return nil
+	}
+	v.closed = true
+	v.lock.Unlock()
+
+	var errs entry.Errors
+
+	done := make(chan struct{})
+	go func() {
+		v.flushes.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		if err := v.drain(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("drain: %w", err))
+		}
+	case <-ctx.Done():
+		errs = append(errs, fmt.Errorf("wait for flushes: %w", ctx.Err()))
+	}
+
+	if v.Server != nil {
+		if err := v.Server.Shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("stop metrics server: %w", err))
+		}
+	}
+
+	if v.Connector != nil {
+		v.Connector.Close()
+	}
+
+	if v.Fallback != nil {
+		v.Fallback.Close()
+	}
+
+	for _, m := range v.Mirrors {
+		m.Connector.Close()
+	}
+
+	for _, profile := range v.Profiles {
+		profile.Close()
+	}
+
+	return errs.Err()
+}
+
+// drain writes the records held back by the stages, mongo is not reached when there are none.
+func (v *Value) drain(ctx context.Context) error {
+	if v.Pending() == 0 {
+		return nil
+	}
+
+	connector, options := v.Connector, v.Config.Options
+	if v.Fallback != nil && v.Breaker.State() == breaker.Open {
+		connector, options = v.Fallback, v.fallbackOptions
+	}
+
+	return v.flush(entry.WithDrain(ctx), connector, options, func(ctx context.Context, processor entry.Processor) error {
+		return entry.FlushNext(ctx, processor)
+	})
 }
 
 func Get(ctxPointer unsafe.Pointer) (*Value, error) {
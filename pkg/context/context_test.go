@@ -0,0 +1,344 @@
+package context_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/saagie/fluent-bit-mongo/pkg/breaker"
+	"github.com/saagie/fluent-bit-mongo/pkg/config"
+	flbcontext "github.com/saagie/fluent-bit-mongo/pkg/context"
+	"github.com/saagie/fluent-bit-mongo/pkg/entry"
+	"github.com/saagie/fluent-bit-mongo/pkg/entry/mongo"
+	"github.com/saagie/fluent-bit-mongo/pkg/log"
+	"github.com/saagie/fluent-bit-mongo/pkg/metrics"
+)
+
+type recorder struct{}
+
+func (r *recorder) ProcessRecord(context.Context, time.Time, map[interface{}]interface{}) error {
+	return nil
+}
+
+var _ = Describe("Instances", func() {
+	var ctx context.Context
+	var first, second *flbcontext.Value
+
+	instance := func(values map[string]string) *flbcontext.Value {
+		logger, err := log.New(log.OutputPlugin, "test")
+		Expect(err).ToNot(HaveOccurred())
+
+		cfg, err := config.Load(func(key string) string {
+			return values[key]
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		value := &flbcontext.Value{Logger: logger}
+		Expect(value.Init(cfg)).To(Succeed())
+
+		return value
+	}
+
+	BeforeEach(func() {
+		logger, err := log.New(log.OutputPlugin, "test")
+		Expect(err).ToNot(HaveOccurred())
+
+		ctx = log.WithLogger(context.TODO(), logger)
+
+		// Nothing listens there, connecting fails fast
+		first = instance(map[string]string{
+			config.AddressKey:       "127.0.0.1:1",
+			config.SyncTimeoutKey:   "50ms",
+			config.MetricsListenKey: "127.0.0.1:0",
+		})
+		second = instance(map[string]string{
+			config.AddressKey:     "127.0.0.1:2",
+			config.SyncTimeoutKey: "50ms",
+			config.MultilineKey:   "java",
+		})
+	})
+
+	AfterEach(func() {
+		_ = first.Close(ctx)
+		_ = second.Close(ctx)
+	})
+
+	It("Should keep the state of each instance apart", func() {
+		Expect(first.Config.DialInfo.Addrs).To(Equal([]string{"127.0.0.1:1"}))
+		Expect(second.Config.DialInfo.Addrs).To(Equal([]string{"127.0.0.1:2"}))
+
+		Expect(first.Metrics).ToNot(BeIdenticalTo(second.Metrics))
+		Expect(first.Connector).ToNot(BeIdenticalTo(second.Connector))
+		Expect(first.Indexes).ToNot(BeIdenticalTo(second.Indexes))
+
+		Expect(first.Stages).To(BeEmpty())
+		Expect(second.Stages).To(HaveLen(1))
+
+		Expect(first.Server).ToNot(BeNil())
+		Expect(second.Server).To(BeNil())
+	})
+
+	It("Should refuse the flushes of a closed instance only", func() {
+		Expect(first.Close(ctx)).To(Succeed())
+		Expect(first.Close(ctx)).To(Succeed())
+
+		err := first.Flush(ctx, func(context.Context, entry.Processor) error {
+			return nil
+		})
+		Expect(err).To(MatchError(flbcontext.ErrClosed))
+
+		err = second.Flush(ctx, func(context.Context, entry.Processor) error {
+			return nil
+		})
+		Expect(err).To(MatchError(&entry.ErrRetry{}))
+		Expect(err).ToNot(MatchError(flbcontext.ErrClosed))
+	})
+
+	It("Should retry the flushes cut short by the deadline", func() {
+		slow := instance(map[string]string{
+			config.AddressKey:      "127.0.0.1:3",
+			config.SyncTimeoutKey:  "10s",
+			config.FlushTimeoutKey: "50ms",
+		})
+		defer slow.Close(ctx)
+
+		start := time.Now()
+		err := slow.Flush(ctx, func(context.Context, entry.Processor) error {
+			return nil
+		})
+		Expect(err).To(MatchError(&entry.ErrRetry{}))
+		Expect(err).To(MatchError(ContainSubstring("flush deadline exceeded")))
+		Expect(time.Since(start)).To(BeNumerically("<", 5*time.Second))
+
+		Expect(slow.Metrics.Get(flbcontext.MetricFlushTimeouts, nil)).To(Equal(1.0))
+		Expect(first.Metrics.Get(flbcontext.MetricFlushTimeouts, nil)).To(BeZero())
+	})
+
+	It("Should stop dialing while the breaker is open", func() {
+		failing := instance(map[string]string{
+			config.AddressKey:         "127.0.0.1:3",
+			config.SyncTimeoutKey:     "50ms",
+			config.BreakerFailuresKey: "2",
+			config.BreakerCooldownKey: "1h",
+		})
+		defer failing.Close(ctx)
+
+		flush := func(value *flbcontext.Value) error {
+			return value.Flush(ctx, func(context.Context, entry.Processor) error {
+				return nil
+			})
+		}
+
+		Expect(failing.Metrics.Get(flbcontext.MetricBreakerState, metrics.Labels{"state": "closed"})).To(Equal(1.0))
+
+		for i := 0; i < 2; i++ {
+			err := flush(failing)
+			Expect(err).To(MatchError(&entry.ErrRetry{}))
+			Expect(err).ToNot(MatchError(breaker.ErrOpen))
+		}
+
+		Expect(failing.Breaker.State()).To(Equal(breaker.Open))
+		Expect(failing.Metrics.Get(flbcontext.MetricBreakerState, metrics.Labels{"state": "open"})).To(Equal(1.0))
+		Expect(failing.Metrics.Get(flbcontext.MetricBreakerState, metrics.Labels{"state": "closed"})).To(BeZero())
+
+		err := flush(failing)
+		Expect(err).To(MatchError(&entry.ErrRetry{}))
+		Expect(err).To(MatchError(breaker.ErrOpen))
+
+		Expect(flush(first)).ToNot(MatchError(breaker.ErrOpen))
+		Expect(first.Breaker.State()).To(Equal(breaker.Closed))
+	})
+
+	It("Should route the records to the database and the cluster of their customer", func() {
+		dir, err := os.MkdirTemp("", "routing")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(dir)
+
+		path := filepath.Join(dir, "routes.json")
+		Expect(os.WriteFile(path, []byte(`[
+			{"customer": "acme", "profile": "dedicated", "database": "acme"},
+			{"customer": "initech", "database": "initech"}
+		]`), 0o600)).To(Succeed())
+
+		routed := instance(map[string]string{
+			config.RoutingTableKey:                                  path,
+			config.RoutingProfilesKey:                               "dedicated",
+			config.ProfilePrefix + "dedicated_" + config.AddressKey: "127.0.0.1:4",
+		})
+		defer routed.Close(ctx)
+
+		primary, dedicated := mongo.NewMemoryStorage(), mongo.NewMemoryStorage()
+		routed.Connector = primary
+		routed.Profiles["dedicated"] = dedicated
+
+		Expect(routed.Flush(ctx, func(ctx context.Context, p entry.Processor) error {
+			for _, customer := range []string{"acme", "initech", "other"} {
+				if err := p.ProcessRecord(ctx, time.Now(), map[interface{}]interface{}{
+					mongo.LogKey:            []uint8("hello"),
+					mongo.StreamKey:         []uint8("stdout"),
+					mongo.TimeKey:           []uint8("2022-06-08T09:56:36.123456789Z"),
+					mongo.JobExecutionIDKey: []uint8("job1"),
+					mongo.ProjectIDKey:      []uint8("projectID"),
+					mongo.CustomerKey:       []uint8(customer),
+					mongo.PlatformIDKey:     []uint8("platformID"),
+				}); err != nil {
+					return err
+				}
+			}
+
+			return entry.FlushNext(ctx, p)
+		})).To(Succeed())
+
+		Expect(dedicated.Database("acme").(*mongo.MemoryStorage).Documents("acme_platformID_projectID")).To(HaveLen(1))
+		Expect(primary.Database("initech").(*mongo.MemoryStorage).Documents("initech_platformID_projectID")).To(HaveLen(1))
+		Expect(primary.Collections()).To(Equal([]string{"other_platformID_projectID"}))
+		Expect(dedicated.Collections()).To(BeEmpty())
+	})
+
+	It("Should set up the mirrors", func() {
+		mirrored := instance(map[string]string{
+			config.MirrorsKey: "new",
+			config.MirrorPrefix + "new_" + config.AddressKey:      "127.0.0.1:4",
+			config.MirrorPrefix + "new_" + config.MirrorPolicyKey: "best-effort",
+		})
+		defer mirrored.Close(ctx)
+
+		Expect(mirrored.Mirrors).To(HaveLen(1))
+		Expect(mirrored.Mirrors[0].Name).To(Equal("new"))
+		Expect(mirrored.Mirrors[0].Policy).To(Equal(mongo.MirrorBestEffort))
+	})
+
+	It("Should write to the fallback cluster while the breaker is open", func() {
+		failing := instance(map[string]string{
+			config.AddressKey:                         "127.0.0.1:3",
+			config.SyncTimeoutKey:                     "50ms",
+			config.BreakerFailuresKey:                 "1",
+			config.BreakerCooldownKey:                 "1h",
+			config.FallbackPrefix + config.AddressKey: "127.0.0.1:4",
+		})
+		defer failing.Close(ctx)
+
+		fallback := mongo.NewMemoryStorage()
+		failing.Fallback = fallback
+
+		flush := func() error {
+			return failing.Flush(ctx, func(ctx context.Context, p entry.Processor) error {
+				if err := p.ProcessRecord(ctx, time.Now(), map[interface{}]interface{}{
+					mongo.LogKey:            []uint8("hello"),
+					mongo.StreamKey:         []uint8("stdout"),
+					mongo.TimeKey:           []uint8("2022-06-08T09:56:36.123456789Z"),
+					mongo.JobExecutionIDKey: []uint8("job1"),
+					mongo.ProjectIDKey:      []uint8("projectID"),
+					mongo.CustomerKey:       []uint8("customer"),
+					mongo.PlatformIDKey:     []uint8("platformID"),
+				}); err != nil {
+					return err
+				}
+
+				return entry.FlushNext(ctx, p)
+			})
+		}
+
+		Expect(flush()).To(MatchError(&entry.ErrRetry{}))
+		Expect(failing.Breaker.State()).To(Equal(breaker.Open))
+		Expect(fallback.Collections()).To(BeEmpty())
+
+		Expect(flush()).To(Succeed())
+		Expect(failing.Metrics.Get(flbcontext.MetricFlushes, metrics.Labels{"cluster": mongo.ClusterPrimary})).To(Equal(1.0))
+		Expect(failing.Metrics.Get(flbcontext.MetricFlushes, metrics.Labels{"cluster": mongo.ClusterFallback})).To(Equal(1.0))
+
+		docs := fallback.Documents("customer_platformID_projectID")
+		Expect(docs).To(HaveLen(1))
+		Expect(docs[0].(mongo.LogEntry).GetLogDocument().Cluster).To(Equal(mongo.ClusterFallback))
+	})
+
+	It("Should wait for the running flushes before closing", func() {
+		Expect(first.Begin()).To(Succeed())
+		Expect(first.Begin()).To(Succeed())
+
+		closed := make(chan error)
+		go func() {
+			closed <- first.Close(ctx)
+		}()
+
+		Eventually(func() error {
+			err := first.Begin()
+			if err == nil {
+				first.Done()
+			}
+
+			return err
+		}).Should(MatchError(flbcontext.ErrClosed))
+
+		first.Done()
+		Consistently(closed, 50*time.Millisecond).ShouldNot(Receive())
+
+		first.Done()
+		Eventually(closed).Should(Receive(BeNil()))
+
+		Expect(second.Begin()).To(Succeed())
+		second.Done()
+	})
+
+	It("Should stop waiting for the running flushes at the deadline", func() {
+		Expect(first.Begin()).To(Succeed())
+		defer first.Done()
+
+		deadline, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+		defer cancel()
+
+		Expect(first.Close(deadline)).To(MatchError(context.DeadlineExceeded))
+	})
+
+	It("Should write the records held back when closing", func() {
+		p := second.Stages[0].Wrap(&recorder{})
+		Expect(p.ProcessRecord(ctx, time.Now(), map[interface{}]interface{}{
+			mongo.LogKey: []uint8("java.lang.IllegalStateException: boom\n"),
+		})).To(Succeed())
+		Expect(second.Pending()).To(Equal(1))
+
+		// Mongo cannot be reached, the records stay held back
+		err := second.Close(ctx)
+		Expect(err).To(MatchError(&entry.ErrRetry{}))
+		Expect(second.Pending()).To(Equal(1))
+
+		Expect(first.Pending()).To(BeZero())
+		Expect(first.Close(ctx)).To(Succeed())
+	})
+
+	It("Should run the flushes of several instances in parallel", func() {
+		var wg sync.WaitGroup
+
+		for _, value := range []*flbcontext.Value{first, second} {
+			for i := 0; i < 8; i++ {
+				wg.Add(1)
+
+				go func(value *flbcontext.Value) {
+					defer GinkgoRecover()
+					defer wg.Done()
+
+					for j := 0; j < 10; j++ {
+						if err := value.Begin(); err != nil {
+							Expect(err).To(MatchError(flbcontext.ErrClosed))
+
+							return
+						}
+
+						value.Done()
+					}
+				}(value)
+			}
+		}
+
+		Expect(first.Close(ctx)).To(Succeed())
+		wg.Wait()
+
+		Expect(second.Begin()).To(Succeed())
+		second.Done()
+	})
+})
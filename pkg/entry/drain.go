@@ -0,0 +1,23 @@
+package entry
+
+import "context"
+
+var drainContextKey = "drain"
+
+// Holder is implemented by stages holding back records between flushes.
+type Holder interface {
+	// Pending returns the number of records held back.
+	Pending() int
+}
+
+// WithDrain returns a context asking the stages to hand all the records they hold back when flushed.
+func WithDrain(ctx context.Context) context.Context {
+	return context.WithValue(ctx, &drainContextKey, true)
+}
+
+// Draining reports whether the stages must hand all the records they hold back.
+func Draining(ctx context.Context) bool {
+	drain, _ := ctx.Value(&drainContextKey).(bool)
+
+	return drain
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/fluent/fluent-bit-go/output"
@@ -13,6 +14,26 @@ type Processor interface {
 	ProcessRecord(context.Context, time.Time, map[interface{}]interface{}) error
 }
 
+// Flusher is implemented by processors holding back work until the whole chunk has been processed.
+type Flusher interface {
+	Flush(context.Context) error
+}
+
+// Stage is a processing step whose state is kept between flushes.
+// It wraps the processor of each flush, records it holds back are handed to a later one.
+type Stage interface {
+	Wrap(Processor) Processor
+}
+
+// FlushNext flushes the processor if it holds back work.
+func FlushNext(ctx context.Context, next Processor) error {
+	if flusher, ok := next.(Flusher); ok {
+		return flusher.Flush(ctx)
+	}
+
+	return nil
+}
+
 var ErrNoRecord = errors.New("failed to decode entry")
 
 type ErrRetry struct {
@@ -33,6 +54,50 @@ func (err *ErrRetry) Is(err2 error) bool {
 	return ok
 }
 
+// Errors aggregates the errors of independent operations, it matches any error it holds.
+type Errors []error
+
+func (errs Errors) Error() string {
+	messages := make([]string, 0, len(errs))
+	for _, err := range errs {
+		messages = append(messages, err.Error())
+	}
+
+	return strings.Join(messages, "; ")
+}
+
+func (errs Errors) Is(target error) bool {
+	for _, err := range errs {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (errs Errors) As(target interface{}) bool {
+	for _, err := range errs {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Err returns nil without errors, the error itself when there is only one.
+func (errs Errors) Err() error {
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	default:
+		return errs
+	}
+}
+
 func GetRecord(dec *output.FLBDecoder) (time.Time, map[interface{}]interface{}, error) {
 	ret, ts, record := output.GetRecord(dec)
 
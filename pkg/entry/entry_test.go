@@ -1,7 +1,9 @@
 package entry_test
 
 import (
+	"context"
 	"errors"
+	"fmt"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -22,3 +24,43 @@ var _ = Describe("ErrRetry", func() {
 		})
 	})
 })
+
+var _ = Describe("Tag", func() {
+	It("Should be empty by default", func() {
+		Expect(entry.GetTag(context.TODO())).To(BeEmpty())
+	})
+
+	It("Should be read from the context", func() {
+		ctx := entry.WithTag(context.TODO(), "job.logs")
+		Expect(entry.GetTag(ctx)).To(Equal("job.logs"))
+		Expect(entry.GetTag(entry.WithTag(ctx, "app.logs"))).To(Equal("app.logs"))
+	})
+})
+
+var _ = Describe("Errors", func() {
+	It("Should be nil without errors", func() {
+		var errs entry.Errors
+		Expect(errs.Err()).To(BeNil())
+	})
+
+	It("Should be the error itself when alone", func() {
+		err := errors.New("alone")
+		Expect(entry.Errors{err}.Err()).To(BeIdenticalTo(err))
+	})
+
+	It("Should match any of its errors", func() {
+		cause := errors.New("connection reset")
+		err := entry.Errors{
+			errors.New("invalid record"),
+			fmt.Errorf("write logs: %w", &entry.ErrRetry{Cause: cause}),
+		}.Err()
+
+		Expect(err).To(MatchError("invalid record; write logs: retry: connection reset"))
+		Expect(errors.Is(err, &entry.ErrRetry{})).To(BeTrue())
+		Expect(errors.Is(err, cause)).To(BeTrue())
+
+		var retry *entry.ErrRetry
+		Expect(errors.As(err, &retry)).To(BeTrue())
+		Expect(retry.Cause).To(BeIdenticalTo(cause))
+	})
+})
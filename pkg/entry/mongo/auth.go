@@ -0,0 +1,165 @@
+package mongo
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	mgo "gopkg.in/mgo.v2"
+)
+
+// AuthMechanism is the protocol used to authenticate to mongo.
+type AuthMechanism string
+
+const (
+	// AuthDefault lets the driver negotiate the mechanism with the server.
+	AuthDefault     AuthMechanism = ""
+	AuthScramSHA1   AuthMechanism = "SCRAM-SHA-1"
+	AuthScramSHA256 AuthMechanism = "SCRAM-SHA-256"
+	// AuthX509 authenticates with the client certificate of the TLS connection.
+	AuthX509 AuthMechanism = "MONGODB-X509"
+	// AuthPlain sends the password to the server, which checks it against LDAP.
+	AuthPlain AuthMechanism = "PLAIN"
+)
+
+// ExternalSource is the authentication database of the users defined outside of mongo.
+const ExternalSource = "$external"
+
+func ParseAuthMechanism(value string) (AuthMechanism, error) {
+	switch mechanism := AuthMechanism(strings.ToUpper(strings.TrimSpace(value))); mechanism {
+	case AuthDefault, AuthScramSHA1, AuthScramSHA256, AuthX509, AuthPlain:
+		return mechanism, nil
+	default:
+		return "", fmt.Errorf("unknown auth mechanism %q", value)
+	}
+}
+
+// External reports whether the users of the mechanism are defined outside of mongo.
+func (m AuthMechanism) External() bool {
+	return m == AuthX509 || m == AuthPlain
+}
+
+// TLSOptions encrypt the connections to mongo.
+type TLSOptions struct {
+	Enabled bool
+	// CAFile holds the PEM certificates of the authorities of the servers, the system ones are used when empty.
+	CAFile string
+	// CertFile holds the PEM client certificate, with its key unless KeyFile is set.
+	CertFile string
+	KeyFile  string
+}
+
+func (o TLSOptions) Validate() error {
+	if !o.Enabled && (o.CAFile != "" || o.CertFile != "" || o.KeyFile != "") {
+		return errors.New("tls files need tls")
+	}
+
+	if o.KeyFile != "" && o.CertFile == "" {
+		return errors.New("tls key file needs a certificate file")
+	}
+
+	return nil
+}
+
+// Config returns the TLS configuration of the connections, nil when TLS is disabled.
+func (o TLSOptions) Config() (*tls.Config, error) {
+	if !o.Enabled {
+		return nil, nil
+	}
+
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if o.CAFile != "" {
+		data, err := os.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read %s: %w", o.CAFile, err)
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("read %s: no certificate", o.CAFile)
+		}
+	}
+
+	if o.CertFile != "" {
+		keyFile := o.KeyFile
+		if keyFile == "" {
+			keyFile = o.CertFile
+		}
+
+		cert, err := tls.LoadX509KeyPair(o.CertFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load %s: %w", o.CertFile, err)
+		}
+
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+// tlsDialer returns the dial function of mgo for TLS connections.
+func tlsDialer(config *tls.Config, timeout time.Duration) func(*mgo.ServerAddr) (net.Conn, error) {
+	return func(addr *mgo.ServerAddr) (net.Conn, error) {
+		return tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", addr.String(), config)
+	}
+}
+
+// ValidateAuth checks that the mechanism, the credentials, TLS and the driver can be used together.
+func ValidateAuth(driver Driver, dialInfo *mgo.DialInfo, tlsConfig *tls.Config) error {
+	mechanism := AuthMechanism(dialInfo.Mechanism)
+
+	if dialInfo.Username == "" && dialInfo.Password != "" {
+		return errors.New("password needs a username")
+	}
+
+	if mechanism.External() {
+		if dialInfo.Source != "" && dialInfo.Source != ExternalSource {
+			return fmt.Errorf("%s users are authenticated against %s", mechanism, ExternalSource)
+		}
+	} else if dialInfo.Source == ExternalSource {
+		return fmt.Errorf("only %s and %s users are authenticated against %s", AuthX509, AuthPlain, ExternalSource)
+	}
+
+	switch mechanism {
+	case AuthX509:
+		if tlsConfig == nil || len(tlsConfig.Certificates) == 0 {
+			return fmt.Errorf("%s needs tls with a client certificate", mechanism)
+		}
+
+		if dialInfo.Password != "" {
+			return fmt.Errorf("%s does not take a password", mechanism)
+		}
+
+		// mgo does not log in without a username, the official driver takes it from the certificate
+		if driver == DriverMgo && dialInfo.Username == "" {
+			return fmt.Errorf("%s with %s needs the certificate subject as username", mechanism, driver)
+		}
+	case AuthPlain:
+		if dialInfo.Username == "" || dialInfo.Password == "" {
+			return fmt.Errorf("%s needs a username and a password", mechanism)
+		}
+
+		// The password is sent as is
+		if tlsConfig == nil {
+			return fmt.Errorf("%s needs tls", mechanism)
+		}
+	case AuthScramSHA1, AuthScramSHA256:
+		if dialInfo.Username == "" || dialInfo.Password == "" {
+			return fmt.Errorf("%s needs a username and a password", mechanism)
+		}
+
+		if mechanism == AuthScramSHA256 && driver == DriverMgo {
+			return fmt.Errorf("%s needs the %s driver", mechanism, DriverOfficial)
+		}
+	}
+
+	return nil
+}
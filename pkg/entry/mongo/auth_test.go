@@ -0,0 +1,612 @@
+package mongo_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"github.com/ory/dockertest/v3"
+	"github.com/ory/dockertest/v3/docker"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/saagie/fluent-bit-mongo/pkg/entry/mongo"
+)
+
+// writeCertificate writes a self-signed certificate and its key to the directory, it returns their paths.
+func writeCertificate(dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).ToNot(HaveOccurred())
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "fluent-bit", Organization: []string{"saagie"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IsCA:         true,
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	Expect(err).ToNot(HaveOccurred())
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	Expect(err).ToNot(HaveOccurred())
+
+	certFile := filepath.Join(dir, "client.crt")
+	keyFile := filepath.Join(dir, "client.key")
+	Expect(os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)).To(Succeed())
+	Expect(os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)).To(Succeed())
+
+	return certFile, keyFile
+}
+
+const (
+	authDatabase = "fluent_bit_mongo_auth"
+	authUser     = "user"
+	authPassword = "secret"
+	// x509Subject is the subject of the client certificate, the name of its user.
+	x509Subject = "CN=fluent-bit,OU=client,O=saagie"
+	// ldapUser is mapped to the administrator of the LDAP server, which exists from the start.
+	ldapUser = "admin"
+	ldapDN   = "cn=admin,dc=example,dc=org"
+	// fixturesPath is where the fixtures are mounted in the mongod containers.
+	fixturesPath = "/fixtures"
+)
+
+// tlsFixtures are the TLS files of a mongod requiring TLS, in a directory mounted in its container.
+type tlsFixtures struct {
+	dir string
+	// CAFile signs the server and client certificates.
+	CAFile string
+	// ServerFile and ClientFile hold the certificate and its key.
+	ServerFile string
+	ClientFile string
+}
+
+// newCertificate signs the certificate with the parent, it is self-signed without parent.
+// It returns the certificate, its key, and both in PEM.
+func newCertificate(template, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).ToNot(HaveOccurred())
+
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	Expect(err).ToNot(HaveOccurred())
+
+	cert, err := x509.ParseCertificate(der)
+	Expect(err).ToNot(HaveOccurred())
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	Expect(err).ToNot(HaveOccurred())
+
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	data = append(data, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})...)
+
+	return cert, key, data
+}
+
+// writeTLSFixtures writes an authority, the certificate of the server on localhost and the one of the client.
+// The files are readable by the mongod of the containers, which does not run as the user of the tests.
+func writeTLSFixtures() *tlsFixtures {
+	dir, err := os.MkdirTemp("", "mongod")
+	Expect(err).ToNot(HaveOccurred())
+	Expect(os.Chmod(dir, 0o755)).To(Succeed())
+
+	ca, caKey, _ := newCertificate(&x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "fluent-bit-mongo tests", Organization: []string{"saagie"}},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}, nil, nil)
+
+	_, _, server := newCertificate(&x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "localhost", OrganizationalUnit: []string{"server"}, Organization: []string{"saagie"}},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, caKey)
+
+	client, _, clientData := newCertificate(&x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "fluent-bit", OrganizationalUnit: []string{"client"}, Organization: []string{"saagie"}},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+	Expect(client.Subject.String()).To(Equal(x509Subject))
+
+	f := &tlsFixtures{
+		dir:        dir,
+		CAFile:     filepath.Join(dir, "ca.crt"),
+		ServerFile: filepath.Join(dir, "server.pem"),
+		ClientFile: filepath.Join(dir, "client.pem"),
+	}
+
+	Expect(os.WriteFile(f.CAFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}), 0o644)).To(Succeed())
+	Expect(os.WriteFile(f.ServerFile, server, 0o644)).To(Succeed())
+	Expect(os.WriteFile(f.ClientFile, clientData, 0o644)).To(Succeed())
+
+	return f
+}
+
+// run returns the options of a mongod requiring TLS, with the extra arguments.
+// The connections without certificate are accepted for the mechanisms other than X.509.
+func (f *tlsFixtures) run(repository, tag string, args ...string) *dockertest.RunOptions {
+	return &dockertest.RunOptions{
+		Repository: repository,
+		Tag:        tag,
+		Mounts:     []string{f.dir + ":" + fixturesPath + ":ro"},
+		Cmd: append([]string{
+			"mongod", "--bind_ip_all",
+			"--tlsMode", "requireTLS",
+			"--tlsCertificateKeyFile", path.Join(fixturesPath, filepath.Base(f.ServerFile)),
+			"--tlsCAFile", path.Join(fixturesPath, filepath.Base(f.CAFile)),
+			"--tlsAllowConnectionsWithoutCertificates",
+		}, args...),
+	}
+}
+
+// config returns the TLS configuration of the clients, with the client certificate or not.
+func (f *tlsFixtures) config(certificate bool) *tls.Config {
+	options := mongo.TLSOptions{Enabled: true, CAFile: f.CAFile}
+	if certificate {
+		options.CertFile = f.ClientFile
+	}
+
+	config, err := options.Config()
+	Expect(err).ToNot(HaveOccurred())
+
+	// The mongod may be reached through another name than localhost, such as the host of docker
+	config.ServerName = "localhost"
+
+	return config
+}
+
+// dial connects with the client certificate, without authenticating.
+func (f *tlsFixtures) dial(address string) (*mgo.Session, error) {
+	options := mongo.TLSOptions{Enabled: true, CAFile: f.CAFile, CertFile: f.ClientFile}
+
+	config, err := options.Config()
+	if err != nil {
+		return nil, err
+	}
+	config.ServerName = "localhost"
+
+	return mgo.DialWithInfo(&mgo.DialInfo{
+		Addrs:   []string{address},
+		Timeout: time.Second,
+		DialServer: func(addr *mgo.ServerAddr) (net.Conn, error) {
+			return tls.DialWithDialer(&net.Dialer{Timeout: time.Second}, "tcp", addr.String(), config)
+		},
+	})
+}
+
+// ready pings the mongod over TLS.
+func (f *tlsFixtures) ready(address string) error {
+	session, err := f.dial(address)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	return session.Ping()
+}
+
+// createExternalUser creates the user defined outside of mongo, the mongods of the external mechanisms do not
+// require authentication to manage their users but do check who authenticates.
+func (f *tlsFixtures) createExternalUser(address, username string) {
+	session, err := f.dial(address)
+	Expect(err).ToNot(HaveOccurred())
+	defer session.Close()
+
+	Expect(session.DB(mongo.ExternalSource).Run(bson.D{
+		{Name: "createUser", Value: username},
+		{Name: "roles", Value: []bson.M{{"role": "readWrite", "db": authDatabase}}},
+	}, nil)).To(Succeed())
+}
+
+func (f *tlsFixtures) remove() error {
+	return os.RemoveAll(f.dir)
+}
+
+// scramMongod requires authentication, its root user has the SCRAM-SHA-1 and SCRAM-SHA-256 credentials.
+func scramMongod() *mongod {
+	return sharedMongod("scram", func() *mongod {
+		return startMongod(&dockertest.RunOptions{
+			Env: []string{"MONGO_INITDB_ROOT_USERNAME=" + authUser, "MONGO_INITDB_ROOT_PASSWORD=" + authPassword},
+		}, func(address string) error {
+			// The image restarts the mongod once the user is created
+			session, err := mgo.DialWithInfo(&mgo.DialInfo{
+				Addrs:    []string{address},
+				Username: authUser,
+				Password: authPassword,
+				Source:   "admin",
+				Timeout:  time.Second,
+			})
+			if err != nil {
+				return err
+			}
+			defer session.Close()
+
+			return session.Ping()
+		})
+	})
+}
+
+// x509Mongod requires TLS, and knows the subject of the client certificate.
+func x509Mongod() *mongod {
+	return sharedMongod("x509", func() *mongod {
+		requireDocker()
+
+		fixtures := writeTLSFixtures()
+		started := false
+		defer func() {
+			if !started {
+				_ = fixtures.remove()
+			}
+		}()
+
+		m := startMongod(fixtures.run("mongo", mongoTag), fixtures.ready)
+		m.fixtures = fixtures
+		m.cleanups = append(m.cleanups, fixtures.remove)
+		started = true
+
+		fixtures.createExternalUser(m.Address, x509Subject)
+
+		return m
+	})
+}
+
+// plainMongod requires TLS, and checks the passwords of the PLAIN mechanism against an LDAP server.
+// PLAIN is only supported by MongoDB Enterprise, in 5.0 which still speaks the protocol of mgo.
+func plainMongod() *mongod {
+	return sharedMongod("plain", func() *mongod {
+		requireDocker()
+
+		ldap, err := dockerPool.RunWithOptions(&dockertest.RunOptions{
+			Repository:   "osixia/openldap",
+			Tag:          "1.5.0",
+			Env:          []string{"LDAP_DOMAIN=example.org", "LDAP_ADMIN_PASSWORD=" + authPassword, "LDAP_TLS=false"},
+			ExposedPorts: []string{"389/tcp"},
+		}, func(config *docker.HostConfig) {
+			config.RestartPolicy = docker.RestartPolicy{Name: "no"}
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		fixtures := writeTLSFixtures()
+		started := false
+		defer func() {
+			if !started {
+				_ = fixtures.remove()
+				_ = dockerPool.Purge(ldap)
+			}
+		}()
+
+		Expect(dockerPool.Retry(func() error {
+			return ldapBind(ldap.GetHostPort("389/tcp"), ldapDN, authPassword)
+		})).To(Succeed())
+
+		// The mongod reaches the LDAP server on the network of docker
+		m := startMongod(fixtures.run("mongodb/mongodb-enterprise-server", "5.0-ubuntu2004",
+			"--setParameter", "authenticationMechanisms=PLAIN,SCRAM-SHA-256",
+			"--ldapServers", ldap.Container.NetworkSettings.IPAddress+":389",
+			"--ldapTransportSecurity", "none",
+			"--ldapBindMethod", "simple",
+			"--ldapUserToDNMapping", `[{"match": "(.+)", "substitution": "cn={0},dc=example,dc=org"}]`,
+		), fixtures.ready)
+		m.fixtures = fixtures
+		m.cleanups = append(m.cleanups, fixtures.remove, func() error { return dockerPool.Purge(ldap) })
+		started = true
+
+		fixtures.createExternalUser(m.Address, ldapUser)
+
+		return m
+	})
+}
+
+// ldapBind binds to the LDAP server with the password of the DN, it fails until the server knows the DN.
+func ldapBind(address, dn, password string) error {
+	conn, err := net.DialTimeout("tcp", address, time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(time.Second)); err != nil {
+		return err
+	}
+
+	// BER with short lengths: LDAPMessage{messageID 1, BindRequest{version 3, name, simple password}}
+	tlv := func(tag byte, content ...[]byte) []byte {
+		value := bytes.Join(content, nil)
+
+		return append([]byte{tag, byte(len(value))}, value...)
+	}
+
+	request := tlv(0x30, tlv(0x02, []byte{1}), tlv(0x60, tlv(0x02, []byte{3}), tlv(0x04, []byte(dn)), tlv(0x80, []byte(password))))
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+
+	response := make([]byte, 512)
+	n, err := conn.Read(response)
+	if err != nil {
+		return err
+	}
+
+	// LDAPMessage{messageID, BindResponse{resultCode, ...}}, the lengths may use the long form
+	message, _, err := readTLV(response[:n], 0x30)
+	if err != nil {
+		return err
+	}
+
+	_, message, err = readTLV(message, 0x02)
+	if err != nil {
+		return err
+	}
+
+	bind, _, err := readTLV(message, 0x61)
+	if err != nil {
+		return err
+	}
+
+	code, _, err := readTLV(bind, 0x0a)
+	if err != nil {
+		return err
+	}
+
+	if len(code) != 1 || code[0] != 0 {
+		return fmt.Errorf("bind %s: result code %v", dn, code)
+	}
+
+	return nil
+}
+
+// readTLV reads a BER value of the tag, it returns its content and what follows.
+func readTLV(data []byte, tag byte) ([]byte, []byte, error) {
+	if len(data) < 2 || data[0] != tag {
+		return nil, nil, fmt.Errorf("no BER value of tag %#x", tag)
+	}
+
+	length, data := int(data[1]), data[2:]
+	if length&0x80 != 0 {
+		size := length & 0x7f
+		if size > 4 || len(data) < size {
+			return nil, nil, errors.New("invalid BER length")
+		}
+
+		length = 0
+		for _, b := range data[:size] {
+			length = length<<8 | int(b)
+		}
+		data = data[size:]
+	}
+
+	if len(data) < length {
+		return nil, nil, errors.New("truncated BER value")
+	}
+
+	return data[:length], data[length:], nil
+}
+
+var _ = Describe("Authentication", func() {
+	DescribeTable("Mechanism", func(value string, expected mongo.AuthMechanism) {
+		Expect(mongo.ParseAuthMechanism(value)).To(Equal(expected))
+	},
+		Entry("unset", "", mongo.AuthDefault),
+		Entry("scram sha 1", "SCRAM-SHA-1", mongo.AuthScramSHA1),
+		Entry("scram sha 256", "scram-sha-256", mongo.AuthScramSHA256),
+		Entry("x509", "MONGODB-X509", mongo.AuthX509),
+		Entry("plain", "plain", mongo.AuthPlain),
+	)
+
+	It("Should not accept unknown mechanisms", func() {
+		_, err := mongo.ParseAuthMechanism("GSSAPI")
+		Expect(err).To(HaveOccurred())
+	})
+
+	withCert := &tls.Config{Certificates: []tls.Certificate{{}}}
+
+	dialInfo := func(mechanism mongo.AuthMechanism, username, password, source string) *mgo.DialInfo {
+		return &mgo.DialInfo{
+			Mechanism: string(mechanism),
+			Username:  username,
+			Password:  password,
+			Source:    source,
+		}
+	}
+
+	DescribeTable("Valid combination", func(driver mongo.Driver, info *mgo.DialInfo, tlsConfig *tls.Config) {
+		Expect(mongo.ValidateAuth(driver, info, tlsConfig)).To(Succeed())
+	},
+		Entry("no credentials", mongo.DriverMgo, dialInfo(mongo.AuthDefault, "", "", ""), nil),
+		Entry("negotiated", mongo.DriverMgo, dialInfo(mongo.AuthDefault, "user", "secret", "admin"), nil),
+		Entry("scram sha 1", mongo.DriverMgo, dialInfo(mongo.AuthScramSHA1, "user", "secret", ""), nil),
+		Entry("scram sha 256", mongo.DriverOfficial, dialInfo(mongo.AuthScramSHA256, "user", "secret", "admin"), nil),
+		Entry("x509 with mgo", mongo.DriverMgo, dialInfo(mongo.AuthX509, "CN=fluent-bit", "", ""), withCert),
+		Entry("x509 subject from the certificate", mongo.DriverOfficial, dialInfo(mongo.AuthX509, "", "", mongo.ExternalSource), withCert),
+		Entry("plain", mongo.DriverMgo, dialInfo(mongo.AuthPlain, "user", "secret", ""), &tls.Config{}),
+	)
+
+	DescribeTable("Invalid combination", func(driver mongo.Driver, info *mgo.DialInfo, tlsConfig *tls.Config) {
+		Expect(mongo.ValidateAuth(driver, info, tlsConfig)).ToNot(Succeed())
+	},
+		Entry("password without username", mongo.DriverMgo, dialInfo(mongo.AuthDefault, "", "secret", ""), nil),
+		Entry("scram without password", mongo.DriverOfficial, dialInfo(mongo.AuthScramSHA256, "user", "", ""), nil),
+		Entry("scram sha 256 with mgo", mongo.DriverMgo, dialInfo(mongo.AuthScramSHA256, "user", "secret", ""), nil),
+		Entry("scram against external", mongo.DriverMgo, dialInfo(mongo.AuthScramSHA1, "user", "secret", mongo.ExternalSource), nil),
+		Entry("x509 without tls", mongo.DriverOfficial, dialInfo(mongo.AuthX509, "", "", ""), nil),
+		Entry("x509 without certificate", mongo.DriverOfficial, dialInfo(mongo.AuthX509, "", "", ""), &tls.Config{}),
+		Entry("x509 with password", mongo.DriverOfficial, dialInfo(mongo.AuthX509, "CN=fluent-bit", "secret", ""), withCert),
+		Entry("x509 without subject with mgo", mongo.DriverMgo, dialInfo(mongo.AuthX509, "", "", ""), withCert),
+		Entry("x509 against a database", mongo.DriverOfficial, dialInfo(mongo.AuthX509, "", "", "admin"), withCert),
+		Entry("plain without tls", mongo.DriverMgo, dialInfo(mongo.AuthPlain, "user", "secret", ""), nil),
+		Entry("plain without password", mongo.DriverMgo, dialInfo(mongo.AuthPlain, "user", "", ""), &tls.Config{}),
+	)
+
+	It("Should authenticate against external with the official driver", func() {
+		o := mongo.ClientOptions(dialInfo(mongo.AuthX509, "", "", ""), mongo.SessionOptions{TLS: withCert})
+
+		Expect(o.Auth.AuthMechanism).To(Equal(string(mongo.AuthX509)))
+		Expect(o.Auth.AuthSource).To(Equal(mongo.ExternalSource))
+		Expect(o.TLSConfig).To(BeIdenticalTo(withCert))
+	})
+
+	Context("TLS", func() {
+		var dir string
+
+		BeforeEach(func() {
+			var err error
+			dir, err = os.MkdirTemp("", "tls")
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(dir)).To(Succeed())
+		})
+
+		It("Should be disabled by default", func() {
+			Expect(mongo.TLSOptions{}.Config()).To(BeNil())
+		})
+
+		It("Should load the authorities and the client certificate", func() {
+			certFile, keyFile := writeCertificate(dir)
+
+			config, err := mongo.TLSOptions{Enabled: true, CAFile: certFile, CertFile: certFile, KeyFile: keyFile}.Config()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(config.RootCAs).ToNot(BeNil())
+			Expect(config.Certificates).To(HaveLen(1))
+		})
+
+		It("Should read the key with the certificate", func() {
+			certFile, keyFile := writeCertificate(dir)
+
+			cert, err := os.ReadFile(certFile)
+			Expect(err).ToNot(HaveOccurred())
+			key, err := os.ReadFile(keyFile)
+			Expect(err).ToNot(HaveOccurred())
+
+			pemFile := filepath.Join(dir, "client.pem")
+			Expect(os.WriteFile(pemFile, append(cert, key...), 0o600)).To(Succeed())
+
+			config, err := mongo.TLSOptions{Enabled: true, CertFile: pemFile}.Config()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(config.Certificates).To(HaveLen(1))
+		})
+
+		It("Should fail without certificate in the authorities file", func() {
+			caFile := filepath.Join(dir, "ca.pem")
+			Expect(os.WriteFile(caFile, []byte("not a certificate"), 0o600)).To(Succeed())
+
+			_, err := mongo.TLSOptions{Enabled: true, CAFile: caFile}.Config()
+			Expect(err).To(MatchError(ContainSubstring("no certificate")))
+		})
+
+		It("Should need tls for the files", func() {
+			Expect(mongo.TLSOptions{CAFile: "ca.pem"}.Validate()).ToNot(Succeed())
+			Expect(mongo.TLSOptions{Enabled: true, KeyFile: "client.key"}.Validate()).ToNot(Succeed())
+		})
+	})
+
+	type authCase struct {
+		mongod    func() *mongod
+		mechanism mongo.AuthMechanism
+		username  string
+		password  string
+		source    string
+		tls       bool
+	}
+
+	DescribeTable("Against a mongod", func(driver mongo.Driver, c authCase) {
+		m := c.mongod()
+
+		info := &mgo.DialInfo{
+			Addrs:     []string{m.Address},
+			Mechanism: string(c.mechanism),
+			Username:  c.username,
+			Password:  c.password,
+			Source:    c.source,
+			Database:  authDatabase,
+		}
+
+		options := mongo.DefaultOptions().Session
+		if c.tls {
+			options.TLS = m.fixtures.config(c.mechanism == mongo.AuthX509)
+		}
+
+		Expect(mongo.ValidateAuth(driver, info, options.TLS)).To(Succeed())
+
+		write := func(info *mgo.DialInfo) error {
+			connector := mongo.NewConnector(driver, info, options, nil)
+			defer connector.Close()
+
+			storage, err := connector.Connect(context.TODO())
+			if err != nil {
+				return err
+			}
+			defer storage.Close()
+
+			_, err = storage.Write("auth_"+string(driver), mongo.WriteUpsert, []mongo.Document{{Id: bson.NewObjectId(), Doc: bson.M{"log": "hello"}}})
+
+			return err
+		}
+
+		Expect(write(info)).To(Succeed())
+
+		if c.password != "" {
+			wrong := *info
+			wrong.Password = "wrong"
+
+			Expect(write(&wrong)).ToNot(Succeed())
+		}
+	},
+		Entry("scram sha 1 with mgo", mongo.DriverMgo, authCase{
+			mongod: scramMongod, mechanism: mongo.AuthScramSHA1, username: authUser, password: authPassword, source: "admin",
+		}),
+		Entry("negotiated with mgo", mongo.DriverMgo, authCase{
+			mongod: scramMongod, username: authUser, password: authPassword, source: "admin",
+		}),
+		Entry("scram sha 256 with the official driver", mongo.DriverOfficial, authCase{
+			mongod: scramMongod, mechanism: mongo.AuthScramSHA256, username: authUser, password: authPassword, source: "admin",
+		}),
+		Entry("x509 with mgo", mongo.DriverMgo, authCase{
+			mongod: x509Mongod, mechanism: mongo.AuthX509, username: x509Subject, tls: true,
+		}),
+		Entry("x509 with the official driver", mongo.DriverOfficial, authCase{
+			mongod: x509Mongod, mechanism: mongo.AuthX509, tls: true,
+		}),
+		Entry("plain with mgo", mongo.DriverMgo, authCase{
+			mongod: plainMongod, mechanism: mongo.AuthPlain, username: ldapUser, password: authPassword, tls: true,
+		}),
+		Entry("plain with the official driver", mongo.DriverOfficial, authCase{
+			mongod: plainMongod, mechanism: mongo.AuthPlain, username: ldapUser, password: authPassword, tls: true,
+		}),
+	)
+})
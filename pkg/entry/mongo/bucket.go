@@ -0,0 +1,220 @@
+package mongo
+
+import (
+	"sort"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// BucketCollectionSuffix is appended to the document collection name to get the bucket collection name.
+const BucketCollectionSuffix = "_buckets"
+
+const (
+	BucketStartKey = "start"
+	BucketLinesKey = "lines"
+	BucketCountKey = "count"
+	BucketSizeKey  = "size"
+)
+
+// Bucket groups the lines of an execution written during the same time window.
+type Bucket struct {
+	Id    bson.ObjectId `bson:"_id,omitempty"`
+	Start time.Time     `bson:"start"`
+	Count int           `bson:"count"`
+	Size  int           `bson:"size"`
+	Lines []BucketLine  `bson:"lines"`
+}
+
+// BucketLine is a log line stored in a bucket, its ID is the one the line would have as a document.
+type BucketLine struct {
+	Id      bson.ObjectId `bson:"_id"`
+	Time    string        `bson:"time"`
+	Stream  string        `bson:"stream"`
+	Log     string        `bson:"log"`
+	Level   string        `bson:"level,omitempty"`
+	Fields  bson.M        `bson:"fields,omitempty"`
+	Cluster string        `bson:"cluster,omitempty"`
+
+	OriginalSize int           `bson:"original_size,omitempty"`
+	Part         int           `bson:"part,omitempty"`
+	Parts        int           `bson:"parts,omitempty"`
+	ContentId    bson.ObjectId `bson:"content_id,omitempty"`
+
+	LogData []byte `bson:"log_data,omitempty"`
+	Codec   Codec  `bson:"log_codec,omitempty"`
+
+	Ciphertext []byte `bson:"ciphertext,omitempty"`
+	KeyId      string `bson:"key_id,omitempty"`
+}
+
+// Size returns the stored size of the line content.
+func (l BucketLine) Size() int {
+	return len(l.Log) + len(l.LogData) + len(l.Ciphertext)
+}
+
+func BucketCollectionName(doc LogEntry) string {
+	return doc.CollectionName() + BucketCollectionSuffix
+}
+
+// BucketStart returns the start of the window the document belongs to.
+func BucketStart(doc LogEntry, window time.Duration) time.Time {
+	return doc.GetLogDocument().GetTime().UTC().Truncate(window)
+}
+
+func newBucketLine(doc LogEntry) BucketLine {
+	d := doc.GetLogDocument()
+
+	return BucketLine{
+		Id:     d.Id,
+		Time:   d.Time,
+		Stream: d.Stream,
+		Log:    d.Log,
+		Level:  d.Level,
+		Fields: d.Fields,
+
+		Cluster: d.Cluster,
+
+		OriginalSize: d.OriginalSize,
+		Part:         d.Part,
+		Parts:        d.Parts,
+		ContentId:    d.ContentId,
+
+		LogData: d.LogData,
+		Codec:   d.Codec,
+
+		Ciphertext: d.Ciphertext,
+		KeyId:      d.KeyId,
+	}
+}
+
+// BucketSelector returns the query matching a bucket of the document window with enough room left for the line,
+// which does not hold the line yet. The room is checked by the update itself, so that concurrent writers cannot
+// fill a bucket past its limits.
+func BucketSelector(doc LogEntry, options BucketOptions) bson.D {
+	line := newBucketLine(doc)
+
+	selector := append(bson.D{}, doc.ExecutionKey()...)
+
+	return append(selector,
+		bson.DocElem{Name: BucketStartKey, Value: BucketStart(doc, options.Window)},
+		bson.DocElem{Name: BucketCountKey, Value: bson.M{"$lt": options.MaxLines}},
+		bson.DocElem{Name: BucketSizeKey, Value: bson.M{"$lte": options.MaxBytes - line.Size()}},
+		bson.DocElem{Name: BucketLinesKey + "._id", Value: bson.M{"$ne": line.Id}},
+	)
+}
+
+// BucketUpdate returns the update pushing the document line into the bucket matched by BucketSelector.
+func BucketUpdate(doc LogEntry) bson.M {
+	line := newBucketLine(doc)
+
+	return bson.M{
+		"$push": bson.M{BucketLinesKey: line},
+		"$inc":  bson.M{BucketCountKey: 1, BucketSizeKey: line.Size()},
+	}
+}
+
+// BucketLineSelector returns the query matching the bucket holding the document line.
+func BucketLineSelector(doc LogEntry) bson.M {
+	return bson.M{BucketLinesKey: bson.M{"$elemMatch": bson.M{"_id": doc.GetID()}}}
+}
+
+// NewBucketUpdate returns the update creating a bucket holding the document line, when no bucket has room left.
+// It is upserted with BucketLineSelector, so that a line stored meanwhile by a concurrent writer is not stored again.
+func NewBucketUpdate(doc LogEntry, options BucketOptions) bson.M {
+	d := doc.GetLogDocument()
+	line := newBucketLine(doc)
+
+	bucket := bson.M{
+		ProjectIDKey:   d.ProjectId,
+		CustomerKey:    d.Customer,
+		PlatformIDKey:  d.PlatformId,
+		BucketStartKey: BucketStart(doc, options.Window),
+		BucketCountKey: 1,
+		BucketSizeKey:  line.Size(),
+		BucketLinesKey: []BucketLine{line},
+	}
+	for k, v := range doc.ExecutionMetadata() {
+		bucket[k] = v
+	}
+	for _, elem := range doc.ExecutionKey() {
+		bucket[elem.Name] = elem.Value
+	}
+
+	return bson.M{"$setOnInsert": bucket}
+}
+
+// BucketIndexes returns the keys of the indexes of the bucket collection.
+func BucketIndexes(doc LogEntry) [][]string {
+	key := make([]string, 0, len(doc.ExecutionKey())+1)
+	for _, elem := range doc.ExecutionKey() {
+		key = append(key, elem.Name)
+	}
+
+	return [][]string{
+		append(key, BucketStartKey),
+		{BucketLinesKey + "._id"},
+	}
+}
+
+// FlattenBuckets returns the lines of the buckets in time order, without duplicates.
+func FlattenBuckets(buckets []Bucket) []BucketLine {
+	sorted := append([]Bucket{}, buckets...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Start.Before(sorted[j].Start)
+	})
+
+	seen := map[bson.ObjectId]struct{}{}
+	lines := make([]BucketLine, 0)
+
+	for _, bucket := range sorted {
+		for _, line := range bucket.Lines {
+			if _, ok := seen[line.Id]; ok {
+				continue
+			}
+
+			seen[line.Id] = struct{}{}
+			lines = append(lines, line)
+		}
+	}
+
+	sort.SliceStable(lines, func(i, j int) bool {
+		ti, erri := time.Parse(TimeFormat, lines[i].Time)
+		tj, errj := time.Parse(TimeFormat, lines[j].Time)
+		if erri != nil || errj != nil {
+			return false
+		}
+
+		return ti.Before(tj)
+	})
+
+	return lines
+}
+
+// BucketReader reads the buckets of a collection matching the selector, in window order.
+// The storages of both drivers are bucket readers.
+type BucketReader interface {
+	FindBuckets(collection string, selector interface{}) ([]Bucket, error)
+}
+
+// FindBucketLines reads the buckets matching the selector and returns their lines in order.
+func FindBucketLines(reader BucketReader, collection string, selector interface{}) ([]BucketLine, error) {
+	buckets, err := reader.FindBuckets(collection, selector)
+	if err != nil {
+		return nil, err
+	}
+
+	lines := FlattenBuckets(buckets)
+	for i := range lines {
+		// Encrypted lines are decoded once decrypted
+		if lines[i].Ciphertext != nil {
+			continue
+		}
+
+		if err := lines[i].Decode(); err != nil {
+			return nil, err
+		}
+	}
+
+	return lines, nil
+}
@@ -0,0 +1,210 @@
+package mongo_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/saagie/fluent-bit-mongo/pkg/entry/mongo"
+	"github.com/saagie/fluent-bit-mongo/pkg/log"
+)
+
+var _ = Describe("Bucket", func() {
+	var ctx context.Context
+	var doc mongo.LogEntry
+
+	lineTime := time.Date(2022, 6, 8, 9, 56, 36, 183000000, time.UTC)
+
+	options := mongo.BucketOptions{
+		Window:   time.Minute,
+		MaxLines: 10,
+		MaxBytes: 100,
+	}
+
+	BeforeEach(func() {
+		logger, err := log.New(log.OutputPlugin, "test")
+		Expect(err).ToNot(HaveOccurred())
+
+		ctx = log.WithLogger(context.TODO(), logger)
+
+		doc, err = mongo.Convert(ctx, time.Now(), map[interface{}]interface{}{
+			mongo.LogKey:            stringEntry("log"),
+			mongo.StreamKey:         stringEntry("stderr"),
+			mongo.TimeKey:           stringEntry(lineTime.Format(mongo.TimeFormat)),
+			mongo.AppIDKey:          stringEntry("appID"),
+			mongo.AppExecutionIDKey: stringEntry("appExecutionID"),
+			mongo.ContainerIDKey:    stringEntry("containerID"),
+			mongo.ProjectIDKey:      stringEntry("projectID"),
+			mongo.CustomerKey:       stringEntry("customer"),
+			mongo.PlatformIDKey:     stringEntry("platformID"),
+		})
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("Should be stored in a dedicated collection", func() {
+		Expect(mongo.BucketCollectionName(doc)).To(Equal(doc.CollectionName() + "_buckets"))
+	})
+
+	It("Should start at the beginning of the window", func() {
+		Expect(mongo.BucketStart(doc, time.Minute)).To(Equal(time.Date(2022, 6, 8, 9, 56, 0, 0, time.UTC)))
+		Expect(mongo.BucketStart(doc, time.Hour)).To(Equal(time.Date(2022, 6, 8, 9, 0, 0, 0, time.UTC)))
+	})
+
+	It("Should select a bucket of the execution with room left", func() {
+		Expect(mongo.BucketSelector(doc, options)).To(Equal(bson.D{
+			{Name: mongo.AppExecutionIDKey, Value: "appExecutionID"},
+			{Name: mongo.ContainerIDKey, Value: "containerID"},
+			{Name: mongo.BucketStartKey, Value: time.Date(2022, 6, 8, 9, 56, 0, 0, time.UTC)},
+			{Name: mongo.BucketCountKey, Value: bson.M{"$lt": 10}},
+			{Name: mongo.BucketSizeKey, Value: bson.M{"$lte": 97}},
+			{Name: mongo.BucketLinesKey + "._id", Value: bson.M{"$ne": doc.GetID()}},
+		}))
+	})
+
+	It("Should push the line with its document ID", func() {
+		update := mongo.BucketUpdate(doc)
+
+		Expect(update["$push"]).To(Equal(bson.M{
+			mongo.BucketLinesKey: mongo.BucketLine{
+				Id:     doc.GetID(),
+				Time:   lineTime.Format(mongo.TimeFormat),
+				Stream: "stderr",
+				Log:    "log",
+			},
+		}))
+		Expect(update["$inc"]).To(Equal(bson.M{mongo.BucketCountKey: 1, mongo.BucketSizeKey: 3}))
+	})
+
+	It("Should create a bucket holding the line when no bucket has room left", func() {
+		update := mongo.NewBucketUpdate(doc, options)
+
+		bucket, ok := update["$setOnInsert"].(bson.M)
+		Expect(ok).To(BeTrue())
+		Expect(bucket).To(HaveKeyWithValue(mongo.AppIDKey, "appID"))
+		Expect(bucket).To(HaveKeyWithValue(mongo.CustomerKey, "customer"))
+		Expect(bucket).To(HaveKeyWithValue(mongo.AppExecutionIDKey, "appExecutionID"))
+		Expect(bucket).To(HaveKeyWithValue(mongo.BucketStartKey, time.Date(2022, 6, 8, 9, 56, 0, 0, time.UTC)))
+		Expect(bucket).To(HaveKeyWithValue(mongo.BucketCountKey, 1))
+		Expect(bucket).To(HaveKeyWithValue(mongo.BucketLinesKey, HaveLen(1)))
+	})
+
+	Describe("Flatten", func() {
+		line := func(id string, t time.Time) mongo.BucketLine {
+			return mongo.BucketLine{
+				Id:   bson.ObjectIdHex(id),
+				Time: t.Format(mongo.TimeFormat),
+			}
+		}
+
+		It("Should order lines and remove duplicates", func() {
+			first := line("000000000000000000000001", lineTime)
+			second := line("000000000000000000000002", lineTime.Add(time.Second))
+			third := line("000000000000000000000003", lineTime.Add(time.Minute))
+
+			lines := mongo.FlattenBuckets([]mongo.Bucket{
+				{Start: lineTime.Truncate(time.Minute).Add(time.Minute), Lines: []mongo.BucketLine{third}},
+				{Start: lineTime.Truncate(time.Minute), Lines: []mongo.BucketLine{second, first}},
+				{Start: lineTime.Truncate(time.Minute), Lines: []mongo.BucketLine{first}},
+			})
+
+			Expect(lines).To(Equal([]mongo.BucketLine{first, second, third}))
+		})
+	})
+
+	DescribeTable("Against a mongod", func(driver mongo.Driver) {
+		m := localMongod()
+		session := m.Dial("fluent_bit_mongo_bucket")
+		defer session.Close()
+
+		connector := mongo.NewConnector(driver, &mgo.DialInfo{
+			Addrs:    []string{m.Address},
+			Database: "fluent_bit_mongo_bucket",
+			Timeout:  10 * time.Second,
+		}, mongo.DefaultOptions().Session, mongo.NewIndexRegistry())
+		defer connector.Close()
+
+		storage, err := connector.Connect(ctx)
+		Expect(err).ToNot(HaveOccurred())
+		defer storage.Close()
+
+		options := mongo.BucketOptions{Window: time.Minute, MaxLines: 3, MaxBytes: 1000}
+		collection := mongo.BucketCollectionName(doc)
+
+		docs := make([]mongo.LogEntry, 10)
+		for i := range docs {
+			docs[i], err = mongo.Convert(ctx, time.Now(), map[interface{}]interface{}{
+				mongo.LogKey:            stringEntry(fmt.Sprintf("line %d", i)),
+				mongo.StreamKey:         stringEntry("stdout"),
+				mongo.TimeKey:           stringEntry(lineTime.Add(time.Duration(i) * time.Millisecond).Format(mongo.TimeFormat)),
+				mongo.AppIDKey:          stringEntry("appID"),
+				mongo.AppExecutionIDKey: stringEntry("appExecutionID"),
+				mongo.ContainerIDKey:    stringEntry("containerID"),
+				mongo.ProjectIDKey:      stringEntry("projectID"),
+				mongo.CustomerKey:       stringEntry("customer"),
+				mongo.PlatformIDKey:     stringEntry("platformID"),
+			})
+			Expect(err).ToNot(HaveOccurred())
+		}
+
+		By("Pushing the lines concurrently", func() {
+			var wg sync.WaitGroup
+
+			for _, d := range docs {
+				wg.Add(1)
+
+				go func(d mongo.LogEntry) {
+					defer wg.Done()
+					defer GinkgoRecover()
+
+					s := storage.Copy(ctx)
+					defer s.Close()
+
+					inserted, err := s.PushLine(collection, d, options)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(inserted).To(BeTrue())
+				}(d)
+			}
+
+			wg.Wait()
+		})
+
+		By("Pushing the lines again", func() {
+			for _, d := range docs {
+				Expect(storage.PushLine(collection, d, options)).To(BeFalse())
+			}
+		})
+
+		reader, ok := storage.(mongo.BucketReader)
+		Expect(ok).To(BeTrue())
+
+		buckets, err := reader.FindBuckets(collection, nil)
+		Expect(err).ToNot(HaveOccurred())
+
+		count := 0
+		for _, bucket := range buckets {
+			Expect(bucket.Count).To(BeNumerically("<=", options.MaxLines))
+			Expect(bucket.Lines).To(HaveLen(bucket.Count))
+			count += bucket.Count
+		}
+		Expect(count).To(Equal(len(docs)))
+
+		lines, err := mongo.FindBucketLines(reader, collection, bson.M{mongo.AppExecutionIDKey: "appExecutionID"})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(lines).To(HaveLen(len(docs)))
+
+		for i, line := range lines {
+			Expect(line.Id).To(Equal(docs[i].GetID()))
+			Expect(line.Log).To(Equal(fmt.Sprintf("line %d", i)))
+		}
+	},
+		Entry("mgo", mongo.DriverMgo),
+		Entry("official driver", mongo.DriverOfficial),
+	)
+})
@@ -0,0 +1,650 @@
+package mongo
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	driverbson "go.mongodb.org/mongo-driver/bson"
+	driver "go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// defaultDatabase is the database mgo writes to when the dial information has none.
+const defaultDatabase = "test"
+
+// marshal encodes the value with mgo, so that both drivers write the same bytes and the IDs stay object IDs.
+func marshal(value interface{}) (driverbson.Raw, error) {
+	data, err := bson.Marshal(value)
+	if err != nil {
+		return nil, fmt.Errorf("marshal: %w", err)
+	}
+
+	return driverbson.Raw(data), nil
+}
+
+func byID(id interface{}) (driverbson.Raw, error) {
+	return marshal(bson.M{"_id": id})
+}
+
+// indexKeys returns the index keys in the mgo notation, where a leading - sorts the field in descending order.
+func indexKeys(key []string) driverbson.D {
+	keys := make(driverbson.D, 0, len(key))
+
+	for _, field := range key {
+		if strings.HasPrefix(field, "-") {
+			keys = append(keys, driverbson.E{Key: field[1:], Value: -1})
+		} else {
+			keys = append(keys, driverbson.E{Key: field, Value: 1})
+		}
+	}
+
+	return keys
+}
+
+// ClientWriteConcern returns the write concern of the official driver, nil for the server default.
+func (o SessionOptions) ClientWriteConcern() *writeconcern.WriteConcern {
+	if o.Unacknowledged() {
+		return writeconcern.New(writeconcern.W(0))
+	}
+
+	var opts []writeconcern.Option
+
+	if w, err := strconv.Atoi(o.WriteConcern); err == nil {
+		opts = append(opts, writeconcern.W(w))
+	} else if o.WriteConcern == "majority" {
+		opts = append(opts, writeconcern.WMajority())
+	} else if o.WriteConcern != "" {
+		opts = append(opts, writeconcern.WTagSet(o.WriteConcern))
+	}
+
+	if o.Journal {
+		opts = append(opts, writeconcern.J(true))
+	}
+
+	if o.WTimeout > 0 {
+		opts = append(opts, writeconcern.WTimeout(o.WTimeout))
+	}
+
+	if len(opts) == 0 {
+		return nil
+	}
+
+	return writeconcern.New(opts...)
+}
+
+// ClientOptions returns the options of the official driver matching the dial information used with mgo.
+func ClientOptions(dialInfo *mgo.DialInfo, o SessionOptions) *options.ClientOptions {
+	clientOptions := options.Client().
+		SetHosts(dialInfo.Addrs).
+		SetSocketTimeout(o.SocketTimeout).
+		SetServerSelectionTimeout(o.SyncTimeout)
+
+	mechanism := AuthMechanism(dialInfo.Mechanism)
+
+	if dialInfo.Username != "" || mechanism == AuthX509 {
+		// Like mgo, the credentials are checked against the database when there is no source
+		source := dialInfo.Source
+		if source == "" && mechanism.External() {
+			source = ExternalSource
+		} else if source == "" {
+			source = dialInfo.Database
+		}
+
+		clientOptions.SetAuth(options.Credential{
+			AuthMechanism: dialInfo.Mechanism,
+			AuthSource:    source,
+			Username:      dialInfo.Username,
+			Password:      dialInfo.Password,
+		})
+	}
+
+	if o.TLS != nil {
+		clientOptions.SetTLSConfig(o.TLS)
+	}
+
+	if wc := o.ClientWriteConcern(); wc != nil {
+		clientOptions.SetWriteConcern(wc)
+	}
+
+	return clientOptions
+}
+
+// isClientWriteConcernTimeout reports whether the error of the official driver is a write concern not satisfied in time.
+func isClientWriteConcernTimeout(err error) bool {
+	var serverError driver.ServerError
+
+	return errors.As(err, &serverError) && serverError.HasErrorCode(writeConcernFailed)
+}
+
+// ClientStorage writes to the database of a client of the official driver, in the context it was copied for.
+type ClientStorage struct {
+	ctx      context.Context
+	client   *driver.Client
+	database string
+	indexes  *IndexRegistry
+	options  SessionOptions
+}
+
+var (
+	_ Storage           = &ClientStorage{}
+	_ SummaryReconciler = &ClientStorage{}
+)
+
+// NewClientStorage returns a storage writing to the client, which stays connected when the storage is closed.
+// The indexes and the collections are created once per registry, a nil registry creates them every time.
+func NewClientStorage(ctx context.Context, client *driver.Client, database string, indexes *IndexRegistry, options SessionOptions) *ClientStorage {
+	if database == "" {
+		database = defaultDatabase
+	}
+
+	return &ClientStorage{
+		ctx:      ctx,
+		client:   client,
+		database: database,
+		indexes:  indexes,
+		options:  options,
+	}
+}
+
+func (s *ClientStorage) Copy(ctx context.Context) Storage {
+	return NewClientStorage(ctx, s.client, s.database, s.indexes, s.options)
+}
+
+func (s *ClientStorage) Close() {}
+
+func (s *ClientStorage) Database(name string) Storage {
+	return NewClientStorage(s.ctx, s.client, name, s.indexes, s.options)
+}
+
+// operation returns the context of an operation, which times out like the operations of mgo.
+func (s *ClientStorage) operation() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(s.ctx, s.options.SocketTimeout)
+}
+
+func (s *ClientStorage) collection(name string) *driver.Collection {
+	return s.client.Database(s.database).Collection(name)
+}
+
+func (s *ClientStorage) CreateCollection(collection string) error {
+	name := s.database + "." + collection
+
+	return s.indexes.once(name, func() error {
+		ctx, cancel := s.operation()
+		defer cancel()
+
+		err := s.client.Database(s.database).CreateCollection(ctx, collection)
+
+		var serverError driver.ServerError
+		if errors.As(err, &serverError) && serverError.HasErrorCode(namespaceExists) {
+			return nil
+		}
+
+		if err != nil {
+			return fmt.Errorf("create collection %s: %w", name, err)
+		}
+
+		return nil
+	})
+}
+
+func (s *ClientStorage) EnsureIndex(collection string, key []string) error {
+	return s.indexes.once(indexName(s.database+"."+collection, key), func() error {
+		ctx, cancel := s.operation()
+		defer cancel()
+
+		if _, err := s.collection(collection).Indexes().CreateOne(ctx, driver.IndexModel{Keys: indexKeys(key)}); err != nil {
+			return fmt.Errorf("ensure indexes %v: %w", key, err)
+		}
+
+		return nil
+	})
+}
+
+// Write writes the documents one by one, so that the documents newly stored are known.
+func (s *ClientStorage) Write(collection string, mode WriteMode, docs []Document) ([]bool, error) {
+	c := s.collection(collection)
+	inserted := make([]bool, 0, len(docs))
+
+	for _, doc := range docs {
+		ok, err := s.write(c, doc, mode)
+		if err != nil {
+			return inserted, err
+		}
+
+		inserted = append(inserted, ok)
+	}
+
+	return inserted, nil
+}
+
+// write writes the document with the mode like writeDocument, it reports whether the document was not already stored.
+func (s *ClientStorage) write(collection *driver.Collection, doc Document, mode WriteMode) (bool, error) {
+	ctx, cancel := s.operation()
+	defer cancel()
+
+	raw, err := marshal(doc.Doc)
+	if err != nil {
+		return false, fmt.Errorf("write %s: %w", doc.Id, err)
+	}
+
+	filter, err := byID(doc.Id)
+	if err != nil {
+		return false, fmt.Errorf("write %s: %w", doc.Id, err)
+	}
+
+	switch mode {
+	case WriteInsert, WriteReplace:
+		_, err := collection.InsertOne(ctx, raw)
+		if errors.Is(err, driver.ErrUnacknowledgedWrite) {
+			return false, nil
+		}
+
+		if err == nil {
+			return true, nil
+		}
+
+		if !driver.IsDuplicateKeyError(err) {
+			return false, fmt.Errorf("insert %s: %w", doc.Id, err)
+		}
+
+		if mode == WriteInsert {
+			return false, nil
+		}
+
+		if _, err := collection.ReplaceOne(ctx, filter, raw); err != nil && !errors.Is(err, driver.ErrUnacknowledgedWrite) {
+			return false, fmt.Errorf("replace %s: %w", doc.Id, err)
+		}
+
+		return false, nil
+	default:
+		result, err := collection.ReplaceOne(ctx, filter, raw, options.Replace().SetUpsert(true))
+		if errors.Is(err, driver.ErrUnacknowledgedWrite) {
+			return false, nil
+		}
+
+		if err != nil {
+			return false, fmt.Errorf("upsert %s: %w", doc.Id, err)
+		}
+
+		return result.UpsertedID != nil, nil
+	}
+}
+
+// PushLine pushes the line into a bucket with room left, or else into a new bucket, like SessionStorage.PushLine.
+func (s *ClientStorage) PushLine(collection string, doc LogEntry, options BucketOptions) (bool, error) {
+	c := s.collection(collection)
+
+	ctx, cancel := s.operation()
+	defer cancel()
+
+	filter, err := marshal(BucketLineSelector(doc))
+	if err != nil {
+		return false, fmt.Errorf("find line %s: %w", doc.GetID(), err)
+	}
+
+	count, err := c.CountDocuments(ctx, filter)
+	if err != nil {
+		return false, fmt.Errorf("find line %s: %w", doc.GetID(), err)
+	}
+
+	if count > 0 {
+		return false, nil
+	}
+
+	pushed, err := s.update(ctx, c, BucketSelector(doc, options), BucketUpdate(doc), false)
+	if err != nil {
+		return false, fmt.Errorf("push line %s: %w", doc.GetID(), err)
+	}
+
+	if pushed {
+		return true, nil
+	}
+
+	pushed, err = s.update(ctx, c, BucketLineSelector(doc), NewBucketUpdate(doc, options), true)
+	if err != nil {
+		return false, fmt.Errorf("push line %s: %w", doc.GetID(), err)
+	}
+
+	return pushed, nil
+}
+
+// update applies the update to the document matching the selector, it reports whether a document was updated, or
+// inserted with upsert. An unacknowledged update is reported as applied.
+func (s *ClientStorage) update(ctx context.Context, collection *driver.Collection, selector interface{}, update bson.M, upsert bool) (bool, error) {
+	filter, err := marshal(selector)
+	if err != nil {
+		return false, err
+	}
+
+	raw, err := marshal(update)
+	if err != nil {
+		return false, err
+	}
+
+	result, err := collection.UpdateOne(ctx, filter, raw, options.Update().SetUpsert(upsert))
+	if errors.Is(err, driver.ErrUnacknowledgedWrite) {
+		return true, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	if upsert {
+		return result.UpsertedID != nil, nil
+	}
+
+	return result.ModifiedCount > 0, nil
+}
+
+// FindBuckets reads the buckets matching the selector, in window order.
+func (s *ClientStorage) FindBuckets(collection string, selector interface{}) ([]Bucket, error) {
+	ctx, cancel := s.operation()
+	defer cancel()
+
+	if selector == nil {
+		selector = bson.M{}
+	}
+
+	filter, err := marshal(selector)
+	if err != nil {
+		return nil, fmt.Errorf("find buckets: %w", err)
+	}
+
+	sort := driverbson.D{{Key: BucketStartKey, Value: 1}, {Key: "_id", Value: 1}}
+
+	cursor, err := s.collection(collection).Find(ctx, filter, options.Find().SetSort(sort))
+	if err != nil {
+		return nil, fmt.Errorf("find buckets: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	var buckets []Bucket
+
+	for cursor.Next(ctx) {
+		// The documents are decoded with mgo, like they are encoded
+		var bucket Bucket
+		if err := bson.Unmarshal(cursor.Current, &bucket); err != nil {
+			return nil, fmt.Errorf("decode bucket: %w", err)
+		}
+
+		buckets = append(buckets, bucket)
+	}
+
+	if err := cursor.Err(); err != nil {
+		return nil, fmt.Errorf("find buckets: %w", err)
+	}
+
+	return buckets, nil
+}
+
+func (s *ClientStorage) AddSummary(collection string, key bson.D, summary Summary, onInsert bson.M) error {
+	ctx, cancel := s.operation()
+	defer cancel()
+
+	if err := s.upsert(ctx, s.collection(collection), key, SummaryUpdate(summary, onInsert)); err != nil {
+		return fmt.Errorf("upsert summary %v: %w", key, err)
+	}
+
+	return nil
+}
+
+// ReconcileSummary adds the summary unless the summary of the execution lists the ID, like SessionStorage.
+func (s *ClientStorage) ReconcileSummary(collection string, key bson.D, summary Summary, onInsert bson.M, id interface{}) (bool, error) {
+	c := s.collection(collection)
+
+	ctx, cancel := s.operation()
+	defer cancel()
+
+	filter, err := marshal(ReconciledSummarySelector(key, id, true))
+	if err != nil {
+		return false, fmt.Errorf("find summary %v: %w", key, err)
+	}
+
+	count, err := c.CountDocuments(ctx, filter)
+	if err != nil {
+		return false, fmt.Errorf("find summary %v: %w", key, err)
+	}
+
+	if count > 0 {
+		return false, nil
+	}
+
+	if err := s.upsert(ctx, c, ReconciledSummarySelector(key, id, false), ReconciledSummaryUpdate(summary, onInsert, id)); err != nil {
+		return false, fmt.Errorf("upsert summary %v: %w", key, err)
+	}
+
+	return true, nil
+}
+
+func (s *ClientStorage) upsert(ctx context.Context, collection *driver.Collection, selector interface{}, update bson.M) error {
+	filter, err := marshal(selector)
+	if err != nil {
+		return err
+	}
+
+	raw, err := marshal(update)
+	if err != nil {
+		return err
+	}
+
+	_, err = collection.UpdateOne(ctx, filter, raw, options.Update().SetUpsert(true))
+	if err != nil && !errors.Is(err, driver.ErrUnacknowledgedWrite) {
+		return err
+	}
+
+	return nil
+}
+
+// gridFSChunkSize is the chunk size of the GridFS files of mgo.
+const gridFSChunkSize = 255 * 1024
+
+// gridFSFile is the files document of mgo's GridFS.
+type gridFSFile struct {
+	Id          bson.ObjectId `bson:"_id"`
+	ChunkSize   int           `bson:"chunkSize"`
+	UploadDate  time.Time     `bson:"uploadDate"`
+	Length      int64         `bson:"length,minsize"`
+	MD5         string        `bson:"md5"`
+	Filename    string        `bson:"filename,omitempty"`
+	ContentType string        `bson:"contentType,omitempty"`
+}
+
+// gridFSChunk is the chunks document of mgo's GridFS.
+type gridFSChunk struct {
+	Id      bson.ObjectId `bson:"_id"`
+	FilesId bson.ObjectId `bson:"files_id"`
+	N       int           `bson:"n"`
+	Data    []byte        `bson:"data"`
+}
+
+// newGridFSFile returns the files document and the chunks of the content, as mgo's GridFS writes them.
+func newGridFSFile(id bson.ObjectId, content []byte, uploadDate time.Time) (gridFSFile, []gridFSChunk) {
+	sum := md5.Sum(content)
+
+	file := gridFSFile{
+		Id:          id,
+		ChunkSize:   gridFSChunkSize,
+		UploadDate:  uploadDate,
+		Length:      int64(len(content)),
+		MD5:         hex.EncodeToString(sum[:]),
+		Filename:    id.Hex(),
+		ContentType: "text/plain",
+	}
+
+	chunks := make([]gridFSChunk, 0, len(content)/gridFSChunkSize+1)
+	for n := 0; n == 0 || len(content) > 0; n++ {
+		size := len(content)
+		if size > gridFSChunkSize {
+			size = gridFSChunkSize
+		}
+
+		chunks = append(chunks, gridFSChunk{Id: bson.NewObjectId(), FilesId: id, N: n, Data: content[:size]})
+		content = content[size:]
+	}
+
+	return file, chunks
+}
+
+// SaveContent writes the content to GridFS with the file layout of mgo, as SessionStorage.SaveContent does.
+// The chunks are written before the file, and removed when the file is not written.
+func (s *ClientStorage) SaveContent(prefix string, id bson.ObjectId, content []byte) error {
+	files, chunks := s.collection(prefix+".files"), s.collection(prefix+".chunks")
+
+	ctx, cancel := s.operation()
+	defer cancel()
+
+	filter, err := byID(id)
+	if err != nil {
+		return fmt.Errorf("open %s: %w", id.Hex(), err)
+	}
+
+	count, err := files.CountDocuments(ctx, filter)
+	if err != nil {
+		return fmt.Errorf("open %s: %w", id.Hex(), err)
+	}
+
+	if count > 0 {
+		return nil
+	}
+
+	file, fileChunks := newGridFSFile(id, content, time.Now())
+
+	docs := make([]interface{}, 0, len(fileChunks))
+	ids := make([]bson.ObjectId, 0, len(fileChunks))
+
+	for _, chunk := range fileChunks {
+		raw, err := marshal(chunk)
+		if err != nil {
+			return fmt.Errorf("write %s: %w", id.Hex(), err)
+		}
+
+		docs = append(docs, raw)
+		ids = append(ids, chunk.Id)
+	}
+
+	raw, err := marshal(file)
+	if err != nil {
+		return fmt.Errorf("write %s: %w", id.Hex(), err)
+	}
+
+	if _, err = chunks.InsertMany(ctx, docs); err == nil || errors.Is(err, driver.ErrUnacknowledgedWrite) {
+		_, err = files.InsertOne(ctx, raw)
+	}
+
+	if err != nil && !errors.Is(err, driver.ErrUnacknowledgedWrite) {
+		// The chunks of the file written in the meantime are kept
+		if byIDs, marshalErr := marshal(bson.M{"_id": bson.M{"$in": ids}}); marshalErr == nil {
+			_, _ = chunks.DeleteMany(ctx, byIDs)
+		}
+
+		if !driver.IsDuplicateKeyError(err) {
+			return fmt.Errorf("write %s: %w", id.Hex(), err)
+		}
+	}
+
+	if _, err := chunks.Indexes().CreateOne(ctx, driver.IndexModel{
+		Keys:    indexKeys([]string{"files_id", "n"}),
+		Options: options.Index().SetUnique(true),
+	}); err != nil {
+		return fmt.Errorf("ensure indexes of %s: %w", prefix, err)
+	}
+
+	return nil
+}
+
+// ClientPool holds the client of an instance with the official driver, it connects on first use.
+// The flushes of the instance share the connections of the client.
+type ClientPool struct {
+	dialInfo *mgo.DialInfo
+	options  SessionOptions
+	indexes  *IndexRegistry
+
+	lock   sync.Mutex
+	client *driver.Client
+	closed bool
+}
+
+var _ Connector = &ClientPool{}
+
+func NewClientPool(dialInfo *mgo.DialInfo, options SessionOptions, indexes *IndexRegistry) *ClientPool {
+	return &ClientPool{
+		dialInfo: dialInfo,
+		options:  options,
+		indexes:  indexes,
+	}
+}
+
+func (p *ClientPool) Connect(ctx context.Context) (Storage, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.closed {
+		return nil, ErrSessionPoolClosed
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if p.client == nil {
+		client, err := p.connect(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("connect %v: %w", p.dialInfo.Addrs, err)
+		}
+
+		p.client = client
+	}
+
+	return NewClientStorage(ctx, p.client, p.dialInfo.Database, p.indexes, p.options), nil
+}
+
+// connect connects the client and waits for a primary, like mgo when dialing.
+func (p *ClientPool) connect(ctx context.Context) (*driver.Client, error) {
+	client, err := driver.NewClient(ClientOptions(p.dialInfo, p.options))
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, untilDeadline(ctx, p.options.SyncTimeout))
+	defer cancel()
+
+	if err := client.Connect(ctx); err != nil {
+		return nil, err
+	}
+
+	if err := client.Ping(ctx, readpref.Primary()); err != nil {
+		_ = client.Disconnect(context.Background())
+
+		return nil, err
+	}
+
+	return client, nil
+}
+
+// Close disconnects the client, the operations in progress are given the socket timeout to end.
+func (p *ClientPool) Close() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.client != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), p.options.SocketTimeout)
+		defer cancel()
+
+		_ = p.client.Disconnect(ctx)
+		p.client = nil
+	}
+
+	p.closed = true
+}
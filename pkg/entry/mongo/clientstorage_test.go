@@ -0,0 +1,137 @@
+package mongo_test
+
+import (
+	"context"
+	"crypto/md5"
+	"fmt"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	driverbson "go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/saagie/fluent-bit-mongo/pkg/entry/mongo"
+)
+
+var _ = Describe("Client storage", func() {
+	It("Should write the documents encoded by mgo", func() {
+		doc, err := mongo.Convert(loggerContext(), time.Now(), map[interface{}]interface{}{
+			mongo.LogKey:            stringEntry("hello"),
+			mongo.StreamKey:         stringEntry("stdout"),
+			mongo.TimeKey:           stringEntry("2022-06-08T09:56:36.123456789Z"),
+			mongo.JobExecutionIDKey: stringEntry("job1"),
+			mongo.ProjectIDKey:      stringEntry("projectID"),
+			mongo.CustomerKey:       stringEntry("customer"),
+			mongo.PlatformIDKey:     stringEntry("platformID"),
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		expected, err := bson.Marshal(doc)
+		Expect(err).ToNot(HaveOccurred())
+
+		raw, err := mongo.Marshal(doc)
+		Expect(err).ToNot(HaveOccurred())
+		Expect([]byte(raw)).To(Equal(expected))
+
+		// The IDs are object IDs for the official driver too
+		var decoded struct {
+			Id primitive.ObjectID `bson:"_id"`
+		}
+		Expect(driverbson.Unmarshal(raw, &decoded)).To(Succeed())
+		Expect(decoded.Id.Hex()).To(Equal(doc.GetID().Hex()))
+	})
+
+	It("Should lay out the GridFS files as mgo", func() {
+		id := bson.NewObjectId()
+		uploadDate := time.Date(2022, 6, 8, 9, 56, 36, 0, time.UTC)
+		content := []byte(strings.Repeat("a", 255*1024+1))
+
+		file, chunks := mongo.NewGridFSFile(id, content, uploadDate)
+
+		raw, err := mongo.Marshal(file)
+		Expect(err).ToNot(HaveOccurred())
+
+		var doc bson.D
+		Expect(bson.Unmarshal(raw, &doc)).To(Succeed())
+		Expect(doc).To(Equal(bson.D{
+			{Name: "_id", Value: id},
+			{Name: "chunkSize", Value: 255 * 1024},
+			{Name: "uploadDate", Value: uploadDate.Local()},
+			{Name: "length", Value: 255*1024 + 1},
+			{Name: "md5", Value: fmt.Sprintf("%x", md5.Sum(content))},
+			{Name: "filename", Value: id.Hex()},
+			{Name: "contentType", Value: "text/plain"},
+		}))
+
+		Expect(chunks).To(HaveLen(2))
+		Expect(chunks[0].FilesId).To(Equal(id))
+		Expect(chunks[1].N).To(Equal(1))
+		Expect(chunks[1].Data).To(Equal([]byte("a")))
+	})
+
+	DescribeTable("Write concern", func(writeConcern string, journal bool, wtimeout time.Duration, expected *writeconcern.WriteConcern) {
+		o := mongo.SessionOptions{
+			WriteConcern: writeConcern,
+			Journal:      journal,
+			WTimeout:     wtimeout,
+		}
+
+		Expect(o.ClientWriteConcern()).To(Equal(expected))
+	},
+		Entry("server default", "", false, time.Duration(0), nil),
+		Entry("unacknowledged", "0", false, time.Duration(0), writeconcern.New(writeconcern.W(0))),
+		Entry("one server", "1", false, time.Duration(0), writeconcern.New(writeconcern.W(1))),
+		Entry("majority", "majority", true, 2*time.Second,
+			writeconcern.New(writeconcern.WMajority(), writeconcern.J(true), writeconcern.WTimeout(2*time.Second))),
+		Entry("tag set", "dc", false, time.Duration(0), writeconcern.New(writeconcern.WTagSet("dc"))),
+	)
+
+	It("Should authenticate against the database without source", func() {
+		o := mongo.ClientOptions(&mgo.DialInfo{
+			Addrs:    []string{"mongo:27017"},
+			Username: "user",
+			Password: "secret",
+			Database: "logs",
+		}, mongo.DefaultOptions().Session)
+
+		Expect(o.Hosts).To(Equal([]string{"mongo:27017"}))
+		Expect(o.Auth.AuthSource).To(Equal("logs"))
+		Expect(o.Auth.Username).To(Equal("user"))
+		Expect(*o.ServerSelectionTimeout).To(Equal(10 * time.Second))
+	})
+
+	Context("Client pool", func() {
+		var pool *mongo.ClientPool
+
+		BeforeEach(func() {
+			pool = mongo.NewClientPool(&mgo.DialInfo{
+				Addrs: []string{"127.0.0.1:1"},
+			}, mongo.SessionOptions{
+				SocketTimeout: time.Second,
+				SyncTimeout:   50 * time.Millisecond,
+			}, mongo.NewIndexRegistry())
+		})
+
+		It("Should connect again after a failure", func() {
+			_, err := pool.Connect(context.TODO())
+			Expect(err).To(MatchError(ContainSubstring("connect [127.0.0.1:1]")))
+
+			_, err = pool.Connect(context.TODO())
+			Expect(err).To(MatchError(ContainSubstring("connect [127.0.0.1:1]")))
+		})
+
+		It("Should refuse storages once closed", func() {
+			pool.Close()
+			pool.Close()
+
+			_, err := pool.Connect(context.TODO())
+			Expect(err).To(MatchError(mongo.ErrSessionPoolClosed))
+		})
+	})
+})
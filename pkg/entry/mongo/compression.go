@@ -0,0 +1,202 @@
+package mongo
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Codec is the compression of the log content, stored in the log_codec field.
+type Codec string
+
+const (
+	CodecGzip Codec = "gzip"
+	CodecZstd Codec = "zstd"
+)
+
+func ParseCodec(value string) (Codec, error) {
+	switch codec := Codec(value); codec {
+	case CodecGzip, CodecZstd:
+		return codec, nil
+	default:
+		return "", fmt.Errorf("unknown compression %q", value)
+	}
+}
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+	zstdErr     error
+)
+
+func zstdCodec() (*zstd.Encoder, *zstd.Decoder, error) {
+	zstdOnce.Do(func() {
+		zstdEncoder, zstdErr = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		if zstdErr != nil {
+			return
+		}
+
+		zstdDecoder, zstdErr = zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+	})
+
+	return zstdEncoder, zstdDecoder, zstdErr
+}
+
+func (c Codec) Compress(data []byte) ([]byte, error) {
+	switch c {
+	case CodecGzip:
+		var buffer bytes.Buffer
+
+		writer := gzip.NewWriter(&buffer)
+		if _, err := writer.Write(data); err != nil {
+			return nil, fmt.Errorf("gzip: %w", err)
+		}
+
+		if err := writer.Close(); err != nil {
+			return nil, fmt.Errorf("gzip: %w", err)
+		}
+
+		return buffer.Bytes(), nil
+	case CodecZstd:
+		encoder, _, err := zstdCodec()
+		if err != nil {
+			return nil, fmt.Errorf("zstd: %w", err)
+		}
+
+		return encoder.EncodeAll(data, nil), nil
+	default:
+		return nil, fmt.Errorf("unknown compression %q", c)
+	}
+}
+
+func (c Codec) Decompress(data []byte) ([]byte, error) {
+	switch c {
+	case CodecGzip:
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("gzip: %w", err)
+		}
+
+		result, err := io.ReadAll(reader)
+		if err != nil {
+			return nil, fmt.Errorf("gzip: %w", err)
+		}
+
+		return result, nil
+	case CodecZstd:
+		_, decoder, err := zstdCodec()
+		if err != nil {
+			return nil, fmt.Errorf("zstd: %w", err)
+		}
+
+		result, err := decoder.DecodeAll(data, nil)
+		if err != nil {
+			return nil, fmt.Errorf("zstd: %w", err)
+		}
+
+		return result, nil
+	default:
+		return nil, fmt.Errorf("unknown compression %q", c)
+	}
+}
+
+type CompressionOptions struct {
+	// Codec compresses the log content, it is not compressed when empty.
+	Codec Codec
+	// MinSize is the content size from which the content is compressed.
+	MinSize int
+}
+
+func (o CompressionOptions) Validate() error {
+	if o.Codec != "" && o.MinSize < 0 {
+		return errors.New("compression min size must not be negative")
+	}
+
+	return nil
+}
+
+// Compress moves the log content of the document to the compressed log_data field.
+// The content is kept as is when compression does not make it smaller.
+func Compress(doc LogEntry, options CompressionOptions) error {
+	d := doc.GetLogDocument()
+	if options.Codec == "" || d.Codec != "" || len(d.Log) < options.MinSize {
+		return nil
+	}
+
+	data, err := options.Codec.Compress([]byte(d.Log))
+	if err != nil {
+		return fmt.Errorf("compress %s: %w", d.Id.Hex(), err)
+	}
+
+	if len(data) >= len(d.Log) {
+		return nil
+	}
+
+	d.LogData = data
+	d.Codec = options.Codec
+	d.Log = ""
+
+	return nil
+}
+
+// decodeLog returns the log content of a line, decompressed when it has a codec.
+func decodeLog(log string, data []byte, codec Codec) (string, error) {
+	if codec == "" {
+		return log, nil
+	}
+
+	content, err := codec.Decompress(data)
+	if err != nil {
+		return "", fmt.Errorf("decompress: %w", err)
+	}
+
+	return string(content), nil
+}
+
+// Decode restores the log content of a document read from the storage.
+func (d *LogDocument) Decode() error {
+	if d.Ciphertext != nil {
+		return fmt.Errorf("decode %s: %w", d.Id.Hex(), ErrEncrypted)
+	}
+
+	log, err := decodeLog(d.Log, d.LogData, d.Codec)
+	if err != nil {
+		return fmt.Errorf("decode %s: %w", d.Id.Hex(), err)
+	}
+
+	d.Log, d.LogData, d.Codec = log, nil, ""
+
+	return nil
+}
+
+// Decode restores the log content of a bucket line read from the storage.
+func (l *BucketLine) Decode() error {
+	if l.Ciphertext != nil {
+		return fmt.Errorf("decode %s: %w", l.Id.Hex(), ErrEncrypted)
+	}
+
+	log, err := decodeLog(l.Log, l.LogData, l.Codec)
+	if err != nil {
+		return fmt.Errorf("decode %s: %w", l.Id.Hex(), err)
+	}
+
+	l.Log, l.LogData, l.Codec = log, nil, ""
+
+	return nil
+}
+
+// Unmarshal reads a stored document into doc and restores its log content.
+func Unmarshal(data []byte, doc LogEntry) error {
+	if err := bson.Unmarshal(data, doc); err != nil {
+		return fmt.Errorf("unmarshal: %w", err)
+	}
+
+	return doc.GetLogDocument().Decode()
+}
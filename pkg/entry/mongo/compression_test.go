@@ -0,0 +1,87 @@
+package mongo_test
+
+import (
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/saagie/fluent-bit-mongo/pkg/entry/mongo"
+)
+
+var _ = Describe("Compression", func() {
+	content := strings.Repeat("DEBUG verbose line repeated again and again\n", 200)
+
+	line := func(content string) mongo.LogEntry {
+		doc, err := mongo.Convert(loggerContext(), time.Now(), map[interface{}]interface{}{
+			mongo.LogKey:            stringEntry(content),
+			mongo.JobExecutionIDKey: stringEntry("jobExecutionID"),
+			mongo.ProjectIDKey:      stringEntry("projectID"),
+			mongo.CustomerKey:       stringEntry("customer"),
+			mongo.PlatformIDKey:     stringEntry("platformID"),
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		return doc
+	}
+
+	DescribeTable("Codec", func(codec mongo.Codec) {
+		doc := line(content)
+		id := doc.GetID()
+
+		Expect(mongo.Compress(doc, mongo.CompressionOptions{Codec: codec, MinSize: 1024})).To(Succeed())
+
+		d := doc.GetLogDocument()
+		Expect(d.Log).To(BeEmpty())
+		Expect(d.Codec).To(Equal(codec))
+		Expect(len(d.LogData)).To(BeNumerically("<", len(content)))
+		Expect(d.Id).To(Equal(id))
+
+		data, err := bson.Marshal(doc)
+		Expect(err).ToNot(HaveOccurred())
+
+		read := &mongo.JobLogDocument{}
+		Expect(mongo.Unmarshal(data, read)).To(Succeed())
+		Expect(read.Log).To(Equal(strings.TrimSuffix(content, "\n")))
+		Expect(read.Codec).To(BeEmpty())
+		Expect(read.LogData).To(BeNil())
+		Expect(read.JobExecutionId).To(Equal("jobExecutionID"))
+	},
+		Entry("gzip", mongo.CodecGzip),
+		Entry("zstd", mongo.CodecZstd),
+	)
+
+	It("Should not compress small lines", func() {
+		doc := line("small")
+		Expect(mongo.Compress(doc, mongo.CompressionOptions{Codec: mongo.CodecGzip, MinSize: 1024})).To(Succeed())
+		Expect(doc.GetLogDocument().Log).To(Equal("small"))
+		Expect(doc.GetLogDocument().Codec).To(BeEmpty())
+	})
+
+	It("Should not compress when it does not save space", func() {
+		doc := line("a")
+		Expect(mongo.Compress(doc, mongo.CompressionOptions{Codec: mongo.CodecGzip})).To(Succeed())
+		Expect(doc.GetLogDocument().Log).To(Equal("a"))
+		Expect(doc.GetLogDocument().Codec).To(BeEmpty())
+	})
+
+	It("Should decode bucket lines", func() {
+		doc := line(content)
+		Expect(mongo.Compress(doc, mongo.CompressionOptions{Codec: mongo.CodecZstd})).To(Succeed())
+
+		lines := mongo.FlattenBuckets([]mongo.Bucket{{Lines: []mongo.BucketLine{
+			{Id: doc.GetID(), LogData: doc.GetLogDocument().LogData, Codec: mongo.CodecZstd},
+		}}})
+		Expect(lines[0].Size()).To(Equal(len(doc.GetLogDocument().LogData)))
+		Expect(lines[0].Decode()).To(Succeed())
+		Expect(lines[0].Log).To(Equal(strings.TrimSuffix(content, "\n")))
+	})
+
+	It("Should not accept an unknown codec", func() {
+		_, err := mongo.ParseCodec("lz4")
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -10,7 +10,6 @@ import (
 
 	"github.com/saagie/fluent-bit-mongo/pkg/log"
 	"github.com/saagie/fluent-bit-mongo/pkg/parse"
-	mgo "gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 )
 
@@ -19,8 +18,24 @@ const TimeFormat = time.RFC3339Nano
 type LogEntry interface {
 	Populate(ctx context.Context, ts time.Time, record map[interface{}]interface{}) error
 	CollectionName() string
-	SaveTo(collection *mgo.Collection) error
 	GetID() bson.ObjectId
+	GetLogDocument() *LogDocument
+	// Indexes returns the keys of the indexes of the document collection.
+	Indexes() [][]string
+	// ExecutionKey returns the fields identifying the execution the line belongs to.
+	ExecutionKey() bson.D
+	// ExecutionMetadata returns the other execution fields, not part of the key.
+	ExecutionMetadata() bson.M
+}
+
+// Enricher completes or rewrites a document after its conversion.
+type Enricher interface {
+	Enrich(ctx context.Context, doc LogEntry) error
+}
+
+// DeadLetterEnricher is implemented by the enrichers which also rewrite the dead letters.
+type DeadLetterEnricher interface {
+	EnrichDeadLetter(ctx context.Context, d *DeadLetter) error
 }
 
 type LogDocument struct {
@@ -31,12 +46,57 @@ type LogDocument struct {
 	ProjectId  string        `bson:"project_id"`
 	Customer   string        `bson:"customer"`
 	PlatformId string        `bson:"platform_id"`
+
+	// Fields below are not part of the ID, so that enabling them does not duplicate lines already stored.
+	Level      string `bson:"level,omitempty" json:"-"`
+	Fields     bson.M `bson:"fields,omitempty" json:"-"`
+	Redactions int    `bson:"redactions,omitempty" json:"-"`
+	Tag        string `bson:"tag,omitempty" json:"-"`
+	Cluster    string `bson:"cluster,omitempty" json:"-"`
+
+	// Oversized lines, see OversizeOptions.
+	OriginalSize int           `bson:"original_size,omitempty" json:"-"`
+	Part         int           `bson:"part,omitempty" json:"-"`
+	Parts        int           `bson:"parts,omitempty" json:"-"`
+	ContentId    bson.ObjectId `bson:"content_id,omitempty" json:"-"`
+
+	// Compressed lines, see CompressionOptions and Decode.
+	LogData []byte `bson:"log_data,omitempty" json:"-"`
+	Codec   Codec  `bson:"log_codec,omitempty" json:"-"`
+
+	// Encrypted lines, see EncryptionOptions and Decrypt.
+	Ciphertext []byte `bson:"ciphertext,omitempty" json:"-"`
+	KeyId      string `bson:"key_id,omitempty" json:"-"`
+
+	// collection overrides the collection name, see SetCollectionName.
+	collection string
+
+	// timestamp is the fluent-bit record time, used when Time cannot be parsed.
+	timestamp time.Time
 }
 
 func (d *LogDocument) GetID() bson.ObjectId {
 	return d.Id
 }
 
+func (d *LogDocument) GetLogDocument() *LogDocument {
+	return d
+}
+
+// StoredSize returns the stored size of the line content.
+func (d *LogDocument) StoredSize() int {
+	return len(d.Log) + len(d.LogData) + len(d.Ciphertext)
+}
+
+// GetTime returns the time of the line, falling back to the fluent-bit record time.
+func (d *LogDocument) GetTime() time.Time {
+	if t, err := time.Parse(TimeFormat, d.Time); err == nil {
+		return t
+	}
+
+	return d.timestamp
+}
+
 type JobLogDocument struct {
 	LogDocument    `bson:",inline"`
 	JobExecutionId string `bson:"job_execution_id"`
@@ -56,19 +116,118 @@ type ConditionPipelineLogDocument struct {
 	PipelineExecutionId  string `bson:"pipeline_execution_id"`
 }
 
-func Convert(ctx context.Context, ts time.Time, record map[interface{}]interface{}) (LogEntry, error) {
-	var doc LogEntry
+// DocumentType is the kind of execution a log line belongs to.
+type DocumentType string
+
+const (
+	JobDocument       DocumentType = "job"
+	AppDocument       DocumentType = "app"
+	ConditionDocument DocumentType = "condition"
+	// GenericDocument keeps the records which do not belong to a known execution.
+	GenericDocument DocumentType = "generic"
+)
+
+func ParseDocumentType(value string) (DocumentType, error) {
+	switch t := DocumentType(value); t {
+	case JobDocument, AppDocument, ConditionDocument, GenericDocument:
+		return t, nil
+	default:
+		return "", fmt.Errorf("unknown document type %q", value)
+	}
+}
+
+// New returns an empty document of the type.
+func (t DocumentType) New() (LogEntry, error) {
+	switch t {
+	case JobDocument:
+		return &JobLogDocument{}, nil
+	case AppDocument:
+		return &AppLogDocument{}, nil
+	case ConditionDocument:
+		return &ConditionPipelineLogDocument{}, nil
+	case GenericDocument:
+		return &GenericLogDocument{}, nil
+	default:
+		return nil, fmt.Errorf("unknown document type %q", t)
+	}
+}
+
+var commonKeys = []string{ProjectIDKey, CustomerKey, PlatformIDKey}
+
+// RequiredKeys returns the record keys a document of the type cannot be built without.
+func (t DocumentType) RequiredKeys() []string {
+	switch t {
+	case JobDocument:
+		return append([]string{JobExecutionIDKey}, commonKeys...)
+	case AppDocument:
+		return append([]string{AppExecutionIDKey, AppIDKey, ContainerIDKey}, commonKeys...)
+	case ConditionDocument:
+		return append([]string{ConditionExecutionIDKey, ConditionNodeIDKey, PipelineExecutionIDKey}, commonKeys...)
+	default:
+		return nil
+	}
+}
+
+// MissingKeys returns the required keys of the type absent from the record.
+func (t DocumentType) MissingKeys(record map[interface{}]interface{}) []string {
+	missing := make([]string, 0)
+
+	for _, key := range t.RequiredKeys() {
+		if _, ok := record[key]; !ok {
+			missing = append(missing, key)
+		}
+	}
+
+	return missing
+}
 
+// ErrConvert is returned when a record cannot be converted to the document type selected for it.
+type ErrConvert struct {
+	Type    DocumentType
+	Missing []string
+	Cause   error
+}
+
+func (err *ErrConvert) Error() string {
+	if len(err.Missing) > 0 {
+		return fmt.Sprintf("convert record to %s document: missing keys %s: %s", err.Type, strings.Join(err.Missing, ", "), err.Cause)
+	}
+
+	return fmt.Sprintf("convert record to %s document: %s", err.Type, err.Cause)
+}
+
+func (err *ErrConvert) Unwrap() error {
+	return err.Cause
+}
+
+// GuessDocumentType returns the document type from the keys present in the record.
+func GuessDocumentType(record map[interface{}]interface{}) DocumentType {
 	if isJobLog(record) {
-		doc = &JobLogDocument{}
+		return JobDocument
 	} else if isAppLog(record) {
-		doc = &AppLogDocument{}
-	} else {
-		doc = &ConditionPipelineLogDocument{}
+		return AppDocument
+	}
+
+	return ConditionDocument
+}
+
+func Convert(ctx context.Context, ts time.Time, record map[interface{}]interface{}) (LogEntry, error) {
+	return ConvertAs(ctx, ts, record, GuessDocumentType(record))
+}
+
+// ConvertAs converts the record to a document of the given type.
+func ConvertAs(ctx context.Context, ts time.Time, record map[interface{}]interface{}, t DocumentType) (LogEntry, error) {
+	doc, err := t.New()
+	if err != nil {
+		return nil, err
 	}
 
 	if err := doc.Populate(ctx, ts, record); err != nil {
-		return nil, fmt.Errorf("populate document: %w", err)
+		return nil, &ErrConvert{
+			Type:    t,
+			Missing: t.MissingKeys(record),
+			Cause:   fmt.Errorf("populate document: %w", err),
+		}
 	}
 
 	return doc, nil
@@ -168,6 +327,32 @@ func cleanLogContent(content string) string {
 }
 
 func (d *LogDocument) Populate(ctx context.Context, ts time.Time, record map[interface{}]interface{}) error {
+	if err := d.populateContent(ctx, ts, record); err != nil {
+		return err
+	}
+
+	var err error
+
+	d.ProjectId, err = parse.ExtractStringValue(record, ProjectIDKey)
+	if err != nil {
+		return fmt.Errorf("parse %s: %w", ProjectIDKey, err)
+	}
+
+	d.Customer, err = parse.ExtractStringValue(record, CustomerKey)
+	if err != nil {
+		return fmt.Errorf("parse %s: %w", CustomerKey, err)
+	}
+
+	d.PlatformId, err = parse.ExtractStringValue(record, PlatformIDKey)
+	if err != nil {
+		return fmt.Errorf("parse %s: %w", PlatformIDKey, err)
+	}
+
+	return nil
+}
+
+// populateContent reads the fields of the line itself, which all have a default.
+func (d *LogDocument) populateContent(ctx context.Context, ts time.Time, record map[interface{}]interface{}) error {
 	logger, err := log.GetLogger(ctx)
 	if err != nil {
 		return fmt.Errorf("get logger: %w", err)
@@ -243,85 +428,105 @@ func (d *LogDocument) Populate(ctx context.Context, ts time.Time, record map[int
 		d.Time = recordTime
 	}
 
-	d.ProjectId, err = parse.ExtractStringValue(record, ProjectIDKey)
-	if err != nil {
-		return fmt.Errorf("parse %s: %w", ProjectIDKey, err)
-	}
+	d.timestamp = ts
 
-	d.Customer, err = parse.ExtractStringValue(record, CustomerKey)
-	if err != nil {
-		return fmt.Errorf("parse %s: %w", CustomerKey, err)
-	}
+	return nil
+}
 
-	d.PlatformId, err = parse.ExtractStringValue(record, PlatformIDKey)
+func (d *LogDocument) generateObjectID() error {
+	id, err := hashObjectID(d)
 	if err != nil {
-		return fmt.Errorf("parse %s: %w", PlatformIDKey, err)
+		return err
 	}
 
+	d.Id = id
 	return nil
 }
 
-func (d *LogDocument) generateObjectID() error {
-	logJson, err := json.Marshal(d)
+// hashObjectID returns an ID derived from the JSON encoding of the value, so that a retried record keeps its ID.
+func hashObjectID(value interface{}) (bson.ObjectId, error) {
+	logJson, err := json.Marshal(value)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	h64bytes, h32bytes, err := parse.GetHashesFromBytes(logJson)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	id := fmt.Sprintf("%02x%02x%02x%02x%02x%02x%02x%02x%02x%02x%02x%02x",
 		h64bytes[0], h64bytes[1], h64bytes[2], h64bytes[3], h64bytes[4], h64bytes[5], h64bytes[6], h64bytes[7],
 		h32bytes[0], h32bytes[1], h32bytes[2], h32bytes[3],
 	)
-	d.Id = bson.ObjectIdHex(id)
-	return nil
+	return bson.ObjectIdHex(id), nil
 }
 
 func (d *LogDocument) CollectionName() string {
+	if d.collection != "" {
+		return d.collection
+	}
+
 	return strings.Replace(fmt.Sprintf("%s_%s_%s", d.Customer, d.PlatformId, d.ProjectId), "-", "_", -1)
 }
 
-func (d *JobLogDocument) SaveTo(collection *mgo.Collection) error {
-	if _, err := collection.UpsertId(d.Id, d); err != nil {
-		return fmt.Errorf("upsert %s: %w", d.Id, err)
-	}
+// SetCollectionName overrides the name of the collection the document is written to.
+func (d *LogDocument) SetCollectionName(name string) {
+	d.collection = strings.Replace(name, "-", "_", -1)
+}
+
+func (d *JobLogDocument) ExecutionKey() bson.D {
+	return bson.D{{Name: JobExecutionIDKey, Value: d.JobExecutionId}}
+}
 
-	indexes := []string{"job_execution_id", "time"}
+func (d *JobLogDocument) ExecutionMetadata() bson.M {
+	return bson.M{}
+}
 
-	if err := collection.EnsureIndexKey(indexes...); err != nil {
-		return fmt.Errorf("ensure indexes %v: %w", indexes, err)
+func (d *AppLogDocument) ExecutionKey() bson.D {
+	return bson.D{
+		{Name: AppExecutionIDKey, Value: d.AppExecutionId},
+		{Name: ContainerIDKey, Value: d.ContainerId},
 	}
+}
 
-	return nil
+func (d *AppLogDocument) ExecutionMetadata() bson.M {
+	return bson.M{AppIDKey: d.AppId}
 }
 
-func (d *AppLogDocument) SaveTo(collection *mgo.Collection) error {
-	if _, err := collection.UpsertId(d.Id, d); err != nil {
-		return fmt.Errorf("upsert %s: %w", d.Id, err)
+func (d *ConditionPipelineLogDocument) ExecutionKey() bson.D {
+	return bson.D{{Name: ConditionExecutionIDKey, Value: d.ConditionExecutionId}}
+}
+
+func (d *ConditionPipelineLogDocument) ExecutionMetadata() bson.M {
+	return bson.M{
+		ConditionNodeIDKey:     d.ConditionNodeId,
+		PipelineExecutionIDKey: d.PipelineExecutionId,
 	}
+}
+
+// LevelKey is the field holding the normalized severity level, when extracted.
+const LevelKey = "level"
 
-	indexes := []string{"app_execution_id", "container_id", "time"}
+// indexes returns the indexes of a document type from its execution key fields.
+func (d *LogDocument) indexes(key ...string) [][]string {
+	indexes := [][]string{append(append([]string{}, key...), TimeKey)}
 
-	if err := collection.EnsureIndexKey(indexes...); err != nil {
-		return fmt.Errorf("ensure indexes %v: %w", indexes, err)
+	if d.Level != "" {
+		indexes = append(indexes, append(append([]string{}, key...), LevelKey, TimeKey))
 	}
 
-	return nil
+	return indexes
 }
 
-func (d *ConditionPipelineLogDocument) SaveTo(collection *mgo.Collection) error {
-	if _, err := collection.UpsertId(d.Id, d); err != nil {
-		return fmt.Errorf("upsert %s: %w", d.Id, err)
-	}
-
-	indexes := []string{"condition_execution_id", "time"}
+func (d *JobLogDocument) Indexes() [][]string {
+	return d.indexes(JobExecutionIDKey)
+}
 
-	if err := collection.EnsureIndexKey(indexes...); err != nil {
-		return fmt.Errorf("ensure indexes %v: %w", indexes, err)
-	}
+func (d *AppLogDocument) Indexes() [][]string {
+	return d.indexes(AppExecutionIDKey, ContainerIDKey)
+}
 
-	return nil
+func (d *ConditionPipelineLogDocument) Indexes() [][]string {
+	return d.indexes(ConditionExecutionIDKey)
 }
@@ -12,6 +12,13 @@ import (
 	"github.com/saagie/fluent-bit-mongo/pkg/log"
 )
 
+func loggerContext() context.Context {
+	logger, err := log.New(log.OutputPlugin, "test")
+	Expect(err).ToNot(HaveOccurred())
+
+	return log.WithLogger(context.TODO(), logger)
+}
+
 func stringEntry(value string) []uint8 {
 	return []uint8(value)
 }
@@ -225,3 +232,29 @@ var _ = Describe("Convert document", func() {
 		})
 	})
 })
+
+var _ = Describe("Convert document as a type", func() {
+	It("Should not guess the type from the keys", func() {
+		record := map[interface{}]interface{}{
+			mongo.LogKey:            stringEntry("log"),
+			mongo.JobExecutionIDKey: stringEntry("jobExecutionID"),
+			mongo.AppIDKey:          stringEntry("appID"),
+			mongo.AppExecutionIDKey: stringEntry("appExecutionID"),
+			mongo.ContainerIDKey:    stringEntry("containerID"),
+			mongo.ProjectIDKey:      stringEntry("projectID"),
+			mongo.CustomerKey:       stringEntry("customer"),
+			mongo.PlatformIDKey:     stringEntry("platformID"),
+		}
+
+		Expect(mongo.GuessDocumentType(record)).To(Equal(mongo.JobDocument))
+
+		d, err := mongo.ConvertAs(loggerContext(), time.Now(), record, mongo.AppDocument)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(d).To(BeAssignableToTypeOf(&mongo.AppLogDocument{}))
+	})
+
+	It("Should not accept an unknown type", func() {
+		_, err := mongo.ParseDocumentType("pipeline")
+		Expect(err).To(HaveOccurred())
+	})
+})
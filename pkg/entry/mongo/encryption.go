@@ -0,0 +1,467 @@
+package mongo
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// AnyCustomer is the keyring entry of the customers without keys of their own.
+const AnyCustomer = "*"
+
+// Encrypted metadata fields, the log content is always encrypted.
+const (
+	EncryptFields = "fields"
+	EncryptTag    = "tag"
+)
+
+var ErrEncrypted = errors.New("encrypted content, decrypt it first")
+
+// ErrNoKey is returned for the lines of the customers the keyring has no key for, they are left in clear.
+var ErrNoKey = errors.New("no encryption key")
+
+// MetricMissingKey counts the lines and dead letters of the customers the keyring has no key for, by customer and policy.
+const MetricMissingKey = "encryption_missing_key_total"
+
+// MissingKeyPolicy is what is done with the lines and dead letters of the customers the keyring has no key for.
+type MissingKeyPolicy string
+
+const (
+	// MissingKeyClear stores them in clear.
+	MissingKeyClear MissingKeyPolicy = "clear"
+	// MissingKeyReject does not store them, their record fails.
+	MissingKeyReject MissingKeyPolicy = "reject"
+)
+
+func ParseMissingKeyPolicy(value string) (MissingKeyPolicy, error) {
+	switch policy := MissingKeyPolicy(value); policy {
+	case MissingKeyClear, MissingKeyReject:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown missing key policy %q", value)
+	}
+}
+
+type keyringEntry struct {
+	// Active is the ID of the key encrypting new lines, the other keys only decrypt.
+	Active string            `json:"active"`
+	Keys   map[string]string `json:"keys"`
+}
+
+type customerKeys struct {
+	active string
+	keys   map[string]cipher.AEAD
+}
+
+// Keyring holds the AES keys of the customers, it is read from a JSON file written as
+// {"<customer>": {"active": "<key id>", "keys": {"<key id>": "<base64 key>"}}}.
+type Keyring struct {
+	path string
+
+	lock      sync.RWMutex
+	modTime   time.Time
+	customers map[string]customerKeys
+	// reported holds the customers without key reported since the keyring was read.
+	reported map[string]bool
+}
+
+func ParseKeyring(data []byte) (*Keyring, error) {
+	var entries map[string]keyringEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("parse keyring: %w", err)
+	}
+
+	customers := make(map[string]customerKeys, len(entries))
+
+	for customer, entry := range entries {
+		keys := make(map[string]cipher.AEAD, len(entry.Keys))
+
+		for id, value := range entry.Keys {
+			key, err := base64.StdEncoding.DecodeString(value)
+			if err != nil {
+				return nil, fmt.Errorf("key %s of %s: %w", id, customer, err)
+			}
+
+			block, err := aes.NewCipher(key)
+			if err != nil {
+				return nil, fmt.Errorf("key %s of %s: %w", id, customer, err)
+			}
+
+			keys[id], err = cipher.NewGCM(block)
+			if err != nil {
+				return nil, fmt.Errorf("key %s of %s: %w", id, customer, err)
+			}
+		}
+
+		if _, ok := keys[entry.Active]; !ok {
+			return nil, fmt.Errorf("active key %q of %s not found", entry.Active, customer)
+		}
+
+		customers[customer] = customerKeys{
+			active: entry.Active,
+			keys:   keys,
+		}
+	}
+
+	return &Keyring{customers: customers}, nil
+}
+
+func LoadKeyring(path string) (*Keyring, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("stat keyring: %w", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read keyring: %w", err)
+	}
+
+	keyring, err := ParseKeyring(data)
+	if err != nil {
+		return nil, err
+	}
+
+	keyring.path = path
+	keyring.modTime = info.ModTime()
+
+	return keyring, nil
+}
+
+// Refresh reads the keyring file again when it was modified, so that keys can be rotated without restart.
+// The current keys are kept when the file cannot be read.
+func (k *Keyring) Refresh() (bool, error) {
+	if k.path == "" {
+		return false, nil
+	}
+
+	info, err := os.Stat(k.path)
+	if err != nil {
+		return false, fmt.Errorf("stat keyring: %w", err)
+	}
+
+	k.lock.RLock()
+	modified := !info.ModTime().Equal(k.modTime)
+	k.lock.RUnlock()
+
+	if !modified {
+		return false, nil
+	}
+
+	loaded, err := LoadKeyring(k.path)
+	if err != nil {
+		return false, err
+	}
+
+	k.lock.Lock()
+	k.customers, k.modTime = loaded.customers, loaded.modTime
+	k.reported = nil
+	k.lock.Unlock()
+
+	return true, nil
+}
+
+func (k *Keyring) keys(customer string) (customerKeys, bool) {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+
+	keys, ok := k.customers[customer]
+	if !ok {
+		keys, ok = k.customers[AnyCustomer]
+	}
+
+	return keys, ok
+}
+
+// Has reports whether the keyring has a key for the customer.
+func (k *Keyring) Has(customer string) bool {
+	_, ok := k.keys(customer)
+
+	return ok
+}
+
+// Report reports whether the customer without key is to be reported, once until the keyring is read again.
+func (k *Keyring) Report(customer string) bool {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	if k.reported[customer] {
+		return false
+	}
+
+	if k.reported == nil {
+		k.reported = map[string]bool{}
+	}
+
+	k.reported[customer] = true
+
+	return true
+}
+
+// Encrypt encrypts with the active key of the customer, the ciphertext starts with the nonce.
+// It reports false when the customer has no key.
+func (k *Keyring) Encrypt(customer string, plaintext, additionalData []byte) (string, []byte, bool, error) {
+	keys, ok := k.keys(customer)
+	if !ok {
+		return "", nil, false, nil
+	}
+
+	aead := keys.keys[keys.active]
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", nil, false, fmt.Errorf("nonce: %w", err)
+	}
+
+	return keys.active, aead.Seal(nonce, nonce, plaintext, additionalData), true, nil
+}
+
+func (k *Keyring) Decrypt(customer, keyID string, ciphertext, additionalData []byte) ([]byte, error) {
+	keys, ok := k.keys(customer)
+	if !ok {
+		return nil, fmt.Errorf("no key for %s", customer)
+	}
+
+	aead, ok := keys.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("key %s of %s not found", keyID, customer)
+	}
+
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+
+	plaintext, err := aead.Open(nil, ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():], additionalData)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt with key %s of %s: %w", keyID, customer, err)
+	}
+
+	return plaintext, nil
+}
+
+type EncryptionOptions struct {
+	// Keyring encrypts the lines of the customers it has keys for, lines are not encrypted when nil.
+	Keyring *Keyring
+	// Fields are the metadata fields encrypted with the log content: fields, tag.
+	// DefaultOptions encrypts the fields.
+	Fields []string
+	// MissingKey applies to the lines and dead letters of the customers without key, they are stored in clear when empty.
+	MissingKey MissingKeyPolicy
+}
+
+func (o EncryptionOptions) Validate() error {
+	if o.MissingKey != "" {
+		if _, err := ParseMissingKeyPolicy(string(o.MissingKey)); err != nil {
+			return err
+		}
+	}
+
+	for _, field := range o.Fields {
+		if field != EncryptFields && field != EncryptTag {
+			return fmt.Errorf("field %q cannot be encrypted", field)
+		}
+	}
+
+	return nil
+}
+
+func (o EncryptionOptions) encrypts(field string) bool {
+	for _, f := range o.Fields {
+		if f == field {
+			return true
+		}
+	}
+
+	return false
+}
+
+// encryptedContent is the encrypted part of a line.
+type encryptedContent struct {
+	Log     string `bson:"log,omitempty"`
+	LogData []byte `bson:"log_data,omitempty"`
+	Fields  bson.M `bson:"fields,omitempty"`
+	Tag     string `bson:"tag,omitempty"`
+}
+
+// Encrypt moves the log content and the selected fields of the document to the ciphertext field.
+// The IDs, time and stream are left in clear, the ciphertext is bound to the document ID.
+// The document is left in clear with ErrNoKey when the keyring has no key for its customer.
+func Encrypt(doc LogEntry, options EncryptionOptions) error {
+	d := doc.GetLogDocument()
+	if options.Keyring == nil || d.Ciphertext != nil {
+		return nil
+	}
+
+	content := encryptedContent{
+		Log:     d.Log,
+		LogData: d.LogData,
+	}
+	if options.encrypts(EncryptFields) {
+		content.Fields = d.Fields
+	}
+	if options.encrypts(EncryptTag) {
+		content.Tag = d.Tag
+	}
+
+	plaintext, err := bson.Marshal(content)
+	if err != nil {
+		return fmt.Errorf("marshal %s: %w", d.Id.Hex(), err)
+	}
+
+	keyID, ciphertext, ok, err := options.Keyring.Encrypt(d.Customer, plaintext, []byte(d.Id))
+	if err != nil {
+		return fmt.Errorf("encrypt %s: %w", d.Id.Hex(), err)
+	}
+
+	if !ok {
+		return fmt.Errorf("encrypt %s of %q: %w", d.Id.Hex(), d.Customer, ErrNoKey)
+	}
+
+	d.Ciphertext, d.KeyId = ciphertext, keyID
+	d.Log, d.LogData = "", nil
+	if options.encrypts(EncryptFields) {
+		d.Fields = nil
+	}
+	if options.encrypts(EncryptTag) {
+		d.Tag = ""
+	}
+
+	return nil
+}
+
+// EncryptDeadLetter moves the record of the dead letter to its ciphertext field, with the key of its customer.
+// The dead letter is left in clear with ErrNoKey when the keyring has no key for its customer.
+func EncryptDeadLetter(d *DeadLetter, keyring *Keyring) error {
+	if keyring == nil || d.Ciphertext != nil {
+		return nil
+	}
+
+	plaintext, err := bson.Marshal(d.Record)
+	if err != nil {
+		return fmt.Errorf("marshal %s: %w", d.Id.Hex(), err)
+	}
+
+	keyID, ciphertext, ok, err := keyring.Encrypt(d.Customer, plaintext, []byte(d.Id))
+	if err != nil {
+		return fmt.Errorf("encrypt %s: %w", d.Id.Hex(), err)
+	}
+
+	if !ok {
+		return fmt.Errorf("encrypt %s of %q: %w", d.Id.Hex(), d.Customer, ErrNoKey)
+	}
+
+	d.Ciphertext, d.KeyId = ciphertext, keyID
+	d.Record = nil
+
+	return nil
+}
+
+// Decrypt restores the record of a dead letter read from the storage.
+func (d *DeadLetter) Decrypt(keyring *Keyring) error {
+	if d.Ciphertext == nil {
+		return nil
+	}
+
+	if keyring == nil {
+		return errors.New("no keyring")
+	}
+
+	plaintext, err := keyring.Decrypt(d.Customer, d.KeyId, d.Ciphertext, []byte(d.Id))
+	if err != nil {
+		return fmt.Errorf("decrypt %s: %w", d.Id.Hex(), err)
+	}
+
+	record := bson.M{}
+	if err := bson.Unmarshal(plaintext, &record); err != nil {
+		return fmt.Errorf("unmarshal %s: %w", d.Id.Hex(), err)
+	}
+
+	d.Record = record
+	d.Ciphertext, d.KeyId = nil, ""
+
+	return nil
+}
+
+func decrypt(keyring *Keyring, customer, keyID string, id bson.ObjectId, ciphertext []byte) (encryptedContent, error) {
+	var content encryptedContent
+
+	if keyring == nil {
+		return content, errors.New("no keyring")
+	}
+
+	plaintext, err := keyring.Decrypt(customer, keyID, ciphertext, []byte(id))
+	if err != nil {
+		return content, err
+	}
+
+	if err := bson.Unmarshal(plaintext, &content); err != nil {
+		return content, fmt.Errorf("unmarshal: %w", err)
+	}
+
+	return content, nil
+}
+
+// Decrypt restores the encrypted content of a document read from the storage.
+func (d *LogDocument) Decrypt(keyring *Keyring) error {
+	if d.Ciphertext == nil {
+		return nil
+	}
+
+	content, err := decrypt(keyring, d.Customer, d.KeyId, d.Id, d.Ciphertext)
+	if err != nil {
+		return fmt.Errorf("decrypt %s: %w", d.Id.Hex(), err)
+	}
+
+	d.Log, d.LogData = content.Log, content.LogData
+	if content.Fields != nil {
+		d.Fields = content.Fields
+	}
+	if content.Tag != "" {
+		d.Tag = content.Tag
+	}
+	d.Ciphertext, d.KeyId = nil, ""
+
+	return nil
+}
+
+// Decrypt restores the encrypted content of a bucket line, the customer is the one of its bucket.
+func (l *BucketLine) Decrypt(keyring *Keyring, customer string) error {
+	if l.Ciphertext == nil {
+		return nil
+	}
+
+	content, err := decrypt(keyring, customer, l.KeyId, l.Id, l.Ciphertext)
+	if err != nil {
+		return fmt.Errorf("decrypt %s: %w", l.Id.Hex(), err)
+	}
+
+	l.Log, l.LogData = content.Log, content.LogData
+	if content.Fields != nil {
+		l.Fields = content.Fields
+	}
+	l.Ciphertext, l.KeyId = nil, ""
+
+	return nil
+}
+
+// UnmarshalWith reads a stored document into doc and restores its content, decrypted with the keyring.
+func UnmarshalWith(data []byte, doc LogEntry, keyring *Keyring) error {
+	if err := bson.Unmarshal(data, doc); err != nil {
+		return fmt.Errorf("unmarshal: %w", err)
+	}
+
+	if err := doc.GetLogDocument().Decrypt(keyring); err != nil {
+		return err
+	}
+
+	return doc.GetLogDocument().Decode()
+}
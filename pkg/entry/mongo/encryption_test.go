@@ -0,0 +1,281 @@
+package mongo_test
+
+import (
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/saagie/fluent-bit-mongo/pkg/entry"
+	"github.com/saagie/fluent-bit-mongo/pkg/entry/mongo"
+	"github.com/saagie/fluent-bit-mongo/pkg/metrics"
+)
+
+func key(b byte) string {
+	return base64.StdEncoding.EncodeToString([]byte(strings.Repeat(string(rune(b)), 32)))
+}
+
+func keyringJSON(active string) string {
+	return `{
+		"customer": {"active": "` + active + `", "keys": {"k1": "` + key('a') + `", "k2": "` + key('b') + `"}}
+	}`
+}
+
+var _ = Describe("Encryption", func() {
+	var keyring *mongo.Keyring
+
+	line := func(customer string) mongo.LogEntry {
+		doc, err := mongo.Convert(loggerContext(), time.Now(), map[interface{}]interface{}{
+			mongo.LogKey:            stringEntry("password reset for alice"),
+			mongo.StreamKey:         stringEntry("stdout"),
+			mongo.JobExecutionIDKey: stringEntry("jobExecutionID"),
+			mongo.ProjectIDKey:      stringEntry("projectID"),
+			mongo.CustomerKey:       stringEntry(customer),
+			mongo.PlatformIDKey:     stringEntry("platformID"),
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		doc.GetLogDocument().Fields = bson.M{"user": "alice"}
+		doc.GetLogDocument().Tag = "job.alice"
+
+		return doc
+	}
+
+	BeforeEach(func() {
+		var err error
+
+		keyring, err = mongo.ParseKeyring([]byte(keyringJSON("k2")))
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("Should encrypt the content and selected fields with the active key", func() {
+		doc := line("customer")
+		options := mongo.EncryptionOptions{Keyring: keyring, Fields: []string{mongo.EncryptFields}}
+		Expect(mongo.Encrypt(doc, options)).To(Succeed())
+
+		d := doc.GetLogDocument()
+		Expect(d.Log).To(BeEmpty())
+		Expect(d.Fields).To(BeNil())
+		Expect(d.Tag).To(Equal("job.alice"))
+		Expect(d.KeyId).To(Equal("k2"))
+		Expect(d.Ciphertext).ToNot(BeEmpty())
+		Expect(d.Stream).To(Equal("stdout"))
+		Expect(d.Customer).To(Equal("customer"))
+
+		data, err := bson.Marshal(doc)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(data)).ToNot(ContainSubstring("reset for alice"))
+
+		read := &mongo.JobLogDocument{}
+		Expect(mongo.Unmarshal(data, read)).To(MatchError(mongo.ErrEncrypted))
+
+		read = &mongo.JobLogDocument{}
+		Expect(mongo.UnmarshalWith(data, read, keyring)).To(Succeed())
+		Expect(read.Log).To(Equal("password reset for alice"))
+		Expect(read.Fields).To(Equal(bson.M{"user": "alice"}))
+		Expect(read.Ciphertext).To(BeNil())
+	})
+
+	It("Should decrypt with a rotated key", func() {
+		doc := line("customer")
+		Expect(mongo.Encrypt(doc, mongo.EncryptionOptions{Keyring: keyring})).To(Succeed())
+
+		rotated, err := mongo.ParseKeyring([]byte(strings.Replace(keyringJSON("k1"), `"k2": "`+key('b')+`"`, `"k2": "`+key('b')+`", "k3": "`+key('c')+`"`, 1)))
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(doc.GetLogDocument().Decrypt(rotated)).To(Succeed())
+		Expect(doc.GetLogDocument().Log).To(Equal("password reset for alice"))
+	})
+
+	It("Should bind the ciphertext to the document", func() {
+		doc := line("customer")
+		Expect(mongo.Encrypt(doc, mongo.EncryptionOptions{Keyring: keyring})).To(Succeed())
+
+		doc.GetLogDocument().Id = bson.NewObjectId()
+		Expect(doc.GetLogDocument().Decrypt(keyring)).ToNot(Succeed())
+	})
+
+	It("Should report the lines of customers without key, left in clear", func() {
+		doc := line("other")
+		Expect(errors.Is(mongo.Encrypt(doc, mongo.EncryptionOptions{Keyring: keyring}), mongo.ErrNoKey)).To(BeTrue())
+		Expect(doc.GetLogDocument().Log).To(Equal("password reset for alice"))
+		Expect(doc.GetLogDocument().Ciphertext).To(BeNil())
+	})
+
+	DescribeTable("Missing key policy", func(policy mongo.MissingKeyPolicy, stored int) {
+		registry := metrics.NewRegistry()
+
+		options := mongo.DefaultOptions()
+		options.Encryption.Keyring = keyring
+		options.Encryption.MissingKey = policy
+		options.Metrics = registry
+
+		storage := mongo.NewMemoryStorage()
+		p := mongo.New(storage, options)
+
+		for _, log := range []string{"first", "second"} {
+			err := p.ProcessRecord(loggerContext(), time.Now(), map[interface{}]interface{}{
+				mongo.LogKey:            stringEntry(log),
+				mongo.StreamKey:         stringEntry("stdout"),
+				mongo.JobExecutionIDKey: stringEntry("jobExecutionID"),
+				mongo.ProjectIDKey:      stringEntry("projectID"),
+				mongo.CustomerKey:       stringEntry("other"),
+				mongo.PlatformIDKey:     stringEntry("platformID"),
+			})
+			if stored == 0 {
+				Expect(errors.Is(err, mongo.ErrNoKey)).To(BeTrue())
+			} else {
+				Expect(err).ToNot(HaveOccurred())
+			}
+		}
+
+		Expect(entry.FlushNext(loggerContext(), p)).To(Succeed())
+		Expect(storage.Documents("other_platformID_projectID")).To(HaveLen(stored))
+		Expect(registry.Get(mongo.MetricMissingKey, metrics.Labels{"customer": "other", "policy": string(policy)})).To(Equal(2.0))
+
+		// The customer was reported by the first line
+		Expect(keyring.Report("other")).To(BeFalse())
+	},
+		Entry("clear", mongo.MissingKeyClear, 2),
+		Entry("reject", mongo.MissingKeyReject, 0),
+	)
+
+	It("Should parse the missing key policy", func() {
+		Expect(mongo.ParseMissingKeyPolicy("reject")).To(Equal(mongo.MissingKeyReject))
+		Expect(mongo.EncryptionOptions{MissingKey: "drop"}.Validate()).ToNot(Succeed())
+	})
+
+	It("Should encrypt the fields by default", func() {
+		doc := line("customer")
+		options := mongo.DefaultOptions().Encryption
+		options.Keyring = keyring
+		Expect(mongo.Encrypt(doc, options)).To(Succeed())
+		Expect(doc.GetLogDocument().Fields).To(BeNil())
+		Expect(doc.GetLogDocument().Tag).To(Equal("job.alice"))
+
+		Expect(doc.GetLogDocument().Decrypt(keyring)).To(Succeed())
+		Expect(doc.GetLogDocument().Fields).To(Equal(bson.M{"user": "alice"}))
+	})
+
+	It("Should encrypt the record of the dead letters", func() {
+		d, err := mongo.NewDeadLetter(time.Now(), "tag", errors.New("type not found"), map[interface{}]interface{}{
+			mongo.LogKey:      stringEntry("password reset for alice"),
+			mongo.CustomerKey: stringEntry("customer"),
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(mongo.EncryptDeadLetter(d, keyring)).To(Succeed())
+		Expect(d.Record).To(BeNil())
+		Expect(d.KeyId).To(Equal("k2"))
+		Expect(d.Customer).To(Equal("customer"))
+
+		Expect(d.Decrypt(keyring)).To(Succeed())
+		Expect(d.Record).To(Equal(bson.M{mongo.LogKey: "password reset for alice", mongo.CustomerKey: "customer"}))
+
+		other, err := mongo.NewDeadLetter(time.Now(), "tag", errors.New("type not found"), map[interface{}]interface{}{
+			mongo.LogKey: stringEntry("no customer"),
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(errors.Is(mongo.EncryptDeadLetter(other, keyring), mongo.ErrNoKey)).To(BeTrue())
+		Expect(other.Record).ToNot(BeNil())
+	})
+
+	It("Should use the default keys", func() {
+		keyring, err := mongo.ParseKeyring([]byte(`{"*": {"active": "k1", "keys": {"k1": "` + key('a') + `"}}}`))
+		Expect(err).ToNot(HaveOccurred())
+
+		doc := line("other")
+		Expect(mongo.Encrypt(doc, mongo.EncryptionOptions{Keyring: keyring})).To(Succeed())
+		Expect(doc.GetLogDocument().KeyId).To(Equal("k1"))
+	})
+
+	It("Should decrypt compressed bucket lines", func() {
+		doc := line("customer")
+		doc.GetLogDocument().Log = strings.Repeat("compressible ", 1000)
+		Expect(mongo.Compress(doc, mongo.CompressionOptions{Codec: mongo.CodecGzip})).To(Succeed())
+		Expect(mongo.Encrypt(doc, mongo.EncryptionOptions{Keyring: keyring})).To(Succeed())
+
+		d := doc.GetLogDocument()
+		lineDoc := mongo.BucketLine{Id: d.Id, Codec: d.Codec, Ciphertext: d.Ciphertext, KeyId: d.KeyId}
+		Expect(errors.Is(lineDoc.Decode(), mongo.ErrEncrypted)).To(BeTrue())
+		Expect(lineDoc.Decrypt(keyring, "customer")).To(Succeed())
+		Expect(lineDoc.Decode()).To(Succeed())
+		Expect(lineDoc.Log).To(Equal(strings.Repeat("compressible ", 1000)))
+	})
+
+	Describe("Keyring file", func() {
+		var dir, path string
+
+		BeforeEach(func() {
+			var err error
+			dir, err = os.MkdirTemp("", "keyring")
+			Expect(err).ToNot(HaveOccurred())
+
+			path = filepath.Join(dir, "keyring.json")
+			Expect(os.WriteFile(path, []byte(keyringJSON("k1")), 0o600)).To(Succeed())
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(dir)).To(Succeed())
+		})
+
+		It("Should be read again when modified", func() {
+			keyring, err := mongo.LoadKeyring(path)
+			Expect(err).ToNot(HaveOccurred())
+
+			refreshed, err := keyring.Refresh()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(refreshed).To(BeFalse())
+
+			Expect(keyring.Report("other")).To(BeTrue())
+			Expect(keyring.Report("other")).To(BeFalse())
+
+			Expect(os.WriteFile(path, []byte(keyringJSON("k2")), 0o600)).To(Succeed())
+			Expect(os.Chtimes(path, time.Now(), time.Now().Add(time.Minute))).To(Succeed())
+
+			refreshed, err = keyring.Refresh()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(refreshed).To(BeTrue())
+
+			doc := line("customer")
+			Expect(mongo.Encrypt(doc, mongo.EncryptionOptions{Keyring: keyring})).To(Succeed())
+			Expect(doc.GetLogDocument().KeyId).To(Equal("k2"))
+
+			// The customers without key are reported again
+			Expect(keyring.Report("other")).To(BeTrue())
+		})
+
+		It("Should keep the keys when the file becomes invalid", func() {
+			keyring, err := mongo.LoadKeyring(path)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(os.WriteFile(path, []byte("{"), 0o600)).To(Succeed())
+			Expect(os.Chtimes(path, time.Now(), time.Now().Add(time.Minute))).To(Succeed())
+
+			_, err = keyring.Refresh()
+			Expect(err).To(HaveOccurred())
+
+			doc := line("customer")
+			Expect(mongo.Encrypt(doc, mongo.EncryptionOptions{Keyring: keyring})).To(Succeed())
+			Expect(doc.GetLogDocument().KeyId).To(Equal("k1"))
+		})
+	})
+
+	It("Should not accept invalid keyrings", func() {
+		for _, data := range []string{
+			`{"customer": {"active": "k1", "keys": {"k1": "not base64"}}}`,
+			`{"customer": {"active": "k1", "keys": {"k1": "` + base64.StdEncoding.EncodeToString([]byte("short")) + `"}}}`,
+			`{"customer": {"active": "k3", "keys": {"k1": "` + key('a') + `"}}}`,
+		} {
+			_, err := mongo.ParseKeyring([]byte(data))
+			Expect(err).To(HaveOccurred(), data)
+		}
+	})
+})
@@ -0,0 +1,11 @@
+package mongo
+
+import mgo "gopkg.in/mgo.v2"
+
+var Marshal = marshal
+
+var NewGridFSFile = newGridFSFile
+
+func (p *SessionPool) SetDial(dial func(*mgo.DialInfo) (*mgo.Session, error)) {
+	p.dial = dial
+}
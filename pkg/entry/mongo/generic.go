@@ -0,0 +1,232 @@
+package mongo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/saagie/fluent-bit-mongo/pkg/parse"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// GenericCollectionName is the collection of the generic documents missing the identifiers of the default name.
+const GenericCollectionName = "generic_logs"
+
+// GenericLogDocument keeps a record which does not belong to a known execution, with its keys in a sub-document.
+type GenericLogDocument struct {
+	LogDocument `bson:",inline"`
+	Record      bson.M `bson:"record"`
+}
+
+var contentKeys = map[string]struct{}{
+	LogKey:       {},
+	StreamKey:    {},
+	TimeKey:      {},
+	LogPrefixKey: {},
+}
+
+func (d *GenericLogDocument) Populate(ctx context.Context, ts time.Time, record map[interface{}]interface{}) error {
+	if err := d.populateContent(ctx, ts, record); err != nil {
+		return fmt.Errorf("populate: %w", err)
+	}
+
+	for key, field := range map[string]*string{
+		ProjectIDKey:  &d.ProjectId,
+		CustomerKey:   &d.Customer,
+		PlatformIDKey: &d.PlatformId,
+	} {
+		value, err := parse.ExtractScalarValue(record, key)
+		if err != nil && !errors.Is(err, &parse.ErrKeyNotFound{LookingFor: key}) {
+			return fmt.Errorf("parse %s: %w", key, err)
+		}
+
+		*field = value
+	}
+
+	d.Record = bson.M{}
+	for k, v := range parse.RecordMap(record) {
+		if _, ok := contentKeys[k]; !ok {
+			d.Record[k] = v
+		}
+	}
+
+	id, err := hashObjectID(d)
+	if err != nil {
+		return err
+	}
+
+	d.Id = id
+
+	return nil
+}
+
+func (d *GenericLogDocument) CollectionName() string {
+	if d.collection == "" && (d.Customer == "" || d.PlatformId == "" || d.ProjectId == "") {
+		return GenericCollectionName
+	}
+
+	return d.LogDocument.CollectionName()
+}
+
+func (d *GenericLogDocument) ExecutionKey() bson.D {
+	return bson.D{}
+}
+
+func (d *GenericLogDocument) ExecutionMetadata() bson.M {
+	return bson.M{}
+}
+
+func (d *GenericLogDocument) Indexes() [][]string {
+	return d.indexes()
+}
+
+// UnknownPolicy is what is done with the records whose type cannot be determined.
+type UnknownPolicy string
+
+const (
+	// UnknownDrop discards the record.
+	UnknownDrop UnknownPolicy = "drop"
+	// UnknownDeadLetter writes the record as is, with the reason, to the dead letter collection.
+	UnknownDeadLetter UnknownPolicy = "dead_letter"
+	// UnknownGeneric writes the record as a generic document.
+	UnknownGeneric UnknownPolicy = "generic"
+)
+
+func ParseUnknownPolicy(value string) (UnknownPolicy, error) {
+	switch policy := UnknownPolicy(value); policy {
+	case UnknownDrop, UnknownDeadLetter, UnknownGeneric:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown type policy %q", value)
+	}
+}
+
+// Discriminator selects the document type from the value of a record key.
+type Discriminator struct {
+	// Key is the record key holding the type, the type is guessed from the record keys when empty.
+	Key string
+	// Types maps the values of the key to document types.
+	Types map[string]DocumentType
+	// Unknown applies to the records whose value is missing or not in Types.
+	Unknown UnknownPolicy
+	// DeadLetterCollection receives the unknown records with the dead letter policy.
+	DeadLetterCollection string
+}
+
+func DefaultTypes() map[string]DocumentType {
+	return map[string]DocumentType{
+		string(JobDocument):       JobDocument,
+		string(AppDocument):       AppDocument,
+		string(ConditionDocument): ConditionDocument,
+	}
+}
+
+// ErrUnknownType is returned when the discriminator value of a record is missing or not mapped to a document type.
+type ErrUnknownType struct {
+	Key   string
+	Value string
+}
+
+func (err *ErrUnknownType) Error() string {
+	if err.Value == "" {
+		return fmt.Sprintf("no document type: %s not found", err.Key)
+	}
+
+	return fmt.Sprintf("no document type for %s %q", err.Key, err.Value)
+}
+
+// DocumentType returns the document type of the record.
+func (d Discriminator) DocumentType(record map[interface{}]interface{}) (DocumentType, error) {
+	if d.Key == "" {
+		return GuessDocumentType(record), nil
+	}
+
+	value, err := parse.ExtractScalarValue(record, d.Key)
+	if err != nil {
+		if errors.Is(err, &parse.ErrKeyNotFound{LookingFor: d.Key}) {
+			return "", &ErrUnknownType{Key: d.Key}
+		}
+
+		return "", fmt.Errorf("parse %s: %w", d.Key, err)
+	}
+
+	t, ok := d.Types[value]
+	if !ok {
+		return "", &ErrUnknownType{Key: d.Key, Value: value}
+	}
+
+	return t, nil
+}
+
+// ParseTypes parses a value to document type table written as "value:type,value:type".
+func ParseTypes(value string) (map[string]DocumentType, error) {
+	types := map[string]DocumentType{}
+
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("invalid type mapping %q, expected <value>:<type>", pair)
+		}
+
+		t, err := ParseDocumentType(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, err
+		}
+
+		types[strings.TrimSpace(parts[0])] = t
+	}
+
+	return types, nil
+}
+
+// DefaultDeadLetterCollection is the default collection of the dead letter policy.
+const DefaultDeadLetterCollection = "dead_letters"
+
+// DeadLetter is a record which could not be stored as a log document.
+type DeadLetter struct {
+	Id     bson.ObjectId `bson:"_id"`
+	Time   string        `bson:"time"`
+	Tag    string        `bson:"tag,omitempty"`
+	Reason string        `bson:"reason"`
+	Record bson.M        `bson:"record,omitempty"`
+	// Cluster is not part of the ID, see Options.Cluster.
+	Cluster string `bson:"cluster,omitempty" json:"-"`
+
+	// Fields below are not part of the ID either, the record is encrypted with the key of the customer, see EncryptDeadLetter.
+	Customer   string `bson:"customer,omitempty" json:"-"`
+	Ciphertext []byte `bson:"ciphertext,omitempty" json:"-"`
+	KeyId      string `bson:"key_id,omitempty" json:"-"`
+}
+
+func NewDeadLetter(ts time.Time, tag string, reason error, record map[interface{}]interface{}) (*DeadLetter, error) {
+	d := &DeadLetter{
+		Time:   ts.Format(TimeFormat),
+		Tag:    tag,
+		Reason: reason.Error(),
+		Record: bson.M(parse.RecordMap(record)),
+	}
+
+	id, err := hashObjectID(d)
+	if err != nil {
+		return nil, fmt.Errorf("dead letter ID: %w", err)
+	}
+
+	d.Id = id
+
+	// The records of unknown type may still name their customer
+	d.Customer, _ = parse.ExtractStringValue(record, CustomerKey)
+
+	return d, nil
+}
+
+// Indexes returns the keys of the indexes of the dead letter collection.
+func (d *DeadLetter) Indexes() [][]string {
+	return [][]string{{TimeKey}}
+}
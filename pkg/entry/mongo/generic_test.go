@@ -0,0 +1,151 @@
+package mongo_test
+
+import (
+	"errors"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	"github.com/saagie/fluent-bit-mongo/pkg/entry/mongo"
+)
+
+var _ = Describe("Discriminator", func() {
+	var discriminator mongo.Discriminator
+
+	BeforeEach(func() {
+		discriminator = mongo.Discriminator{
+			Key: "type",
+			Types: map[string]mongo.DocumentType{
+				"job":      mongo.JobDocument,
+				"pipeline": mongo.ConditionDocument,
+			},
+		}
+	})
+
+	It("Should select the type mapped to the value", func() {
+		t, err := discriminator.DocumentType(map[interface{}]interface{}{
+			"type":                  stringEntry("pipeline"),
+			mongo.JobExecutionIDKey: stringEntry("jobExecutionID"),
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(t).To(Equal(mongo.ConditionDocument))
+	})
+
+	DescribeTable("Unknown type", func(record map[interface{}]interface{}, message string) {
+		_, err := discriminator.DocumentType(record)
+
+		var unknownType *mongo.ErrUnknownType
+		Expect(errors.As(err, &unknownType)).To(BeTrue())
+		Expect(err).To(MatchError(message))
+	},
+		Entry("missing value", map[interface{}]interface{}{}, "no document type: type not found"),
+		Entry("unmapped value", map[interface{}]interface{}{"type": stringEntry("cron")}, `no document type for type "cron"`),
+	)
+
+	It("Should guess the type without key", func() {
+		discriminator.Key = ""
+
+		t, err := discriminator.DocumentType(map[interface{}]interface{}{
+			mongo.AppExecutionIDKey: stringEntry("appExecutionID"),
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(t).To(Equal(mongo.AppDocument))
+	})
+
+	It("Should parse a type table", func() {
+		types, err := mongo.ParseTypes("job:job, pipeline:condition,")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(types).To(Equal(map[string]mongo.DocumentType{
+			"job":      mongo.JobDocument,
+			"pipeline": mongo.ConditionDocument,
+		}))
+	})
+})
+
+var _ = Describe("Conversion error", func() {
+	It("Should name the type and the missing keys", func() {
+		_, err := mongo.ConvertAs(loggerContext(), time.Now(), map[interface{}]interface{}{
+			mongo.LogKey:             stringEntry("log"),
+			mongo.ProjectIDKey:       stringEntry("projectID"),
+			mongo.CustomerKey:        stringEntry("customer"),
+			mongo.PlatformIDKey:      stringEntry("platformID"),
+			mongo.ConditionNodeIDKey: stringEntry("conditionNodeID"),
+		}, mongo.ConditionDocument)
+
+		var convertErr *mongo.ErrConvert
+		Expect(errors.As(err, &convertErr)).To(BeTrue())
+		Expect(convertErr.Type).To(Equal(mongo.ConditionDocument))
+		Expect(convertErr.Missing).To(Equal([]string{mongo.ConditionExecutionIDKey, mongo.PipelineExecutionIDKey}))
+		Expect(err.Error()).To(HavePrefix("convert record to condition document: missing keys condition_execution_id, pipeline_execution_id: "))
+	})
+})
+
+var _ = Describe("Generic document", func() {
+	var record map[interface{}]interface{}
+
+	BeforeEach(func() {
+		record = map[interface{}]interface{}{
+			mongo.LogKey:    stringEntry("log"),
+			mongo.StreamKey: stringEntry("stderr"),
+			"type":          stringEntry("cron"),
+			"k8s.pod":       stringEntry("pod"),
+		}
+	})
+
+	It("Should keep the other keys in the record", func() {
+		d, err := mongo.ConvertAs(loggerContext(), time.Now(), record, mongo.GenericDocument)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(d).To(BeAssignableToTypeOf(&mongo.GenericLogDocument{}))
+
+		document := d.(*mongo.GenericLogDocument)
+		Expect(document.Log).To(Equal("log"))
+		Expect(document.Stream).To(Equal("stderr"))
+		Expect(document.Record).To(HaveLen(2))
+		Expect(document.Record).To(HaveKeyWithValue("type", "cron"))
+		Expect(document.Record).To(HaveKeyWithValue("k8s_pod", "pod"))
+		Expect(document.GetID()).ToNot(BeEmpty())
+		Expect(document.CollectionName()).To(Equal(mongo.GenericCollectionName))
+	})
+
+	It("Should use the default collection when identified", func() {
+		record[mongo.ProjectIDKey] = stringEntry("projectID")
+		record[mongo.CustomerKey] = stringEntry("customer")
+		record[mongo.PlatformIDKey] = stringEntry("platformID")
+
+		d, err := mongo.ConvertAs(loggerContext(), time.Now(), record, mongo.GenericDocument)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(d.CollectionName()).To(Equal("customer_platformID_projectID"))
+	})
+
+	It("Should have a distinct ID per record", func() {
+		ts := time.Now()
+
+		first, err := mongo.ConvertAs(loggerContext(), ts, record, mongo.GenericDocument)
+		Expect(err).ToNot(HaveOccurred())
+
+		record["k8s.pod"] = stringEntry("other")
+
+		second, err := mongo.ConvertAs(loggerContext(), ts, record, mongo.GenericDocument)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(second.GetID()).ToNot(Equal(first.GetID()))
+	})
+})
+
+var _ = Describe("Dead letter", func() {
+	It("Should keep its ID for the same record", func() {
+		ts := time.Now()
+		record := map[interface{}]interface{}{"type": stringEntry("cron")}
+		reason := &mongo.ErrUnknownType{Key: "type", Value: "cron"}
+
+		first, err := mongo.NewDeadLetter(ts, "kube.cron", reason, record)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(first.Reason).To(Equal(`no document type for type "cron"`))
+		Expect(first.Record).To(HaveKeyWithValue("type", "cron"))
+
+		second, err := mongo.NewDeadLetter(ts, "kube.cron", reason, record)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(second.Id).To(Equal(first.Id))
+	})
+})
@@ -0,0 +1,101 @@
+package mongo
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	mgo "gopkg.in/mgo.v2"
+)
+
+// namespaceExists is the code of the error creating a collection which already exists.
+const namespaceExists = 48
+
+// IndexRegistry remembers the collections and indexes already created so that they are created once per instance.
+// It is shared by the flushes of an instance, a nil registry creates them every time.
+type IndexRegistry struct {
+	lock    sync.Mutex
+	ensured map[string]struct{}
+}
+
+func NewIndexRegistry() *IndexRegistry {
+	return &IndexRegistry{
+		ensured: map[string]struct{}{},
+	}
+}
+
+// indexName returns the registry name of an index of the collection, named database.collection.
+func indexName(collection string, key []string) string {
+	return collection + ":" + strings.Join(key, ",")
+}
+
+// Create creates the collection unless it was already created.
+func (r *IndexRegistry) Create(collection *mgo.Collection) error {
+	return r.once(collection.FullName, func() error {
+		return createCollection(collection)
+	})
+}
+
+// Ensure creates the index of the collection unless it was already created.
+func (r *IndexRegistry) Ensure(collection *mgo.Collection, key ...string) error {
+	return r.once(indexName(collection.FullName, key), func() error {
+		return ensureIndex(collection, key)
+	})
+}
+
+func (r *IndexRegistry) once(name string, create func() error) error {
+	if r == nil {
+		return create()
+	}
+
+	r.lock.Lock()
+	_, ok := r.ensured[name]
+	r.lock.Unlock()
+
+	if ok {
+		return nil
+	}
+
+	// Concurrent flushes may create the same index, creating an existing index does nothing
+	if err := create(); err != nil {
+		return err
+	}
+
+	r.lock.Lock()
+	r.ensured[name] = struct{}{}
+	r.lock.Unlock()
+
+	return nil
+}
+
+// Len returns the number of collections and indexes created.
+func (r *IndexRegistry) Len() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return len(r.ensured)
+}
+
+func createCollection(collection *mgo.Collection) error {
+	err := collection.Create(&mgo.CollectionInfo{})
+
+	var queryError *mgo.QueryError
+	if errors.As(err, &queryError) && queryError.Code == namespaceExists {
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("create collection %s: %w", collection.FullName, err)
+	}
+
+	return nil
+}
+
+func ensureIndex(collection *mgo.Collection, key []string) error {
+	if err := collection.EnsureIndexKey(key...); err != nil {
+		return fmt.Errorf("ensure indexes %v: %w", key, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,401 @@
+package mongo
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// MemoryStorage keeps the documents in memory so that the processor is tested without mongo.
+// Unlike mongo, writing to a collection which was not created fails, so that a missing creation is noticed.
+type MemoryStorage struct {
+	lock        sync.Mutex
+	collections map[string]*memoryCollection
+	contents    map[string]map[bson.ObjectId][]byte
+	errors      map[string]error
+	databases   map[string]*MemoryStorage
+}
+
+type memoryCollection struct {
+	indexes   [][]string
+	ids       []interface{}
+	documents map[interface{}]interface{}
+	buckets   []memoryBucket
+	lines     map[bson.ObjectId]struct{}
+	summaries map[string]*memorySummary
+}
+
+type memoryBucket struct {
+	key    string
+	bucket Bucket
+}
+
+type memorySummary struct {
+	summary  Summary
+	onInsert bson.M
+	// reconciled lists the IDs of the summaries added by Reconcile.
+	reconciled []interface{}
+}
+
+var (
+	_ Storage           = &MemoryStorage{}
+	_ Connector         = &MemoryStorage{}
+	_ SummaryReconciler = &MemoryStorage{}
+)
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{
+		collections: map[string]*memoryCollection{},
+		contents:    map[string]map[bson.ObjectId][]byte{},
+		errors:      map[string]error{},
+		databases:   map[string]*MemoryStorage{},
+	}
+}
+
+// Copy returns the storage itself, the copies share the documents.
+func (s *MemoryStorage) Copy(context.Context) Storage {
+	return s
+}
+
+func (s *MemoryStorage) Close() {}
+
+// Database returns the storage of the database, created on first use, the default database being the storage itself.
+func (s *MemoryStorage) Database(name string) Storage {
+	if name == MongoDefaultDB {
+		return s
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	database, ok := s.databases[name]
+	if !ok {
+		database = NewMemoryStorage()
+		s.databases[name] = database
+	}
+
+	return database
+}
+
+// Connect returns the storage itself, so that the storage is also the connector of an instance.
+func (s *MemoryStorage) Connect(context.Context) (Storage, error) {
+	return s, nil
+}
+
+// SetError makes the operations on the collection, or on the contents with the prefix, fail with the error.
+// A nil error makes them succeed again.
+func (s *MemoryStorage) SetError(collection string, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err == nil {
+		delete(s.errors, collection)
+	} else {
+		s.errors[collection] = err
+	}
+}
+
+// collection returns the collection, it fails when the collection was not created or an error is set.
+func (s *MemoryStorage) collection(name string) (*memoryCollection, error) {
+	if err := s.errors[name]; err != nil {
+		return nil, err
+	}
+
+	c, ok := s.collections[name]
+	if !ok {
+		return nil, fmt.Errorf("collection %s not created", name)
+	}
+
+	return c, nil
+}
+
+func (s *MemoryStorage) CreateCollection(collection string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := s.errors[collection]; err != nil {
+		return err
+	}
+
+	if _, ok := s.collections[collection]; !ok {
+		s.collections[collection] = &memoryCollection{
+			documents: map[interface{}]interface{}{},
+			lines:     map[bson.ObjectId]struct{}{},
+			summaries: map[string]*memorySummary{},
+		}
+	}
+
+	return nil
+}
+
+func (s *MemoryStorage) EnsureIndex(collection string, key []string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	c, err := s.collection(collection)
+	if err != nil {
+		return err
+	}
+
+	for _, index := range c.indexes {
+		if strings.Join(index, ",") == strings.Join(key, ",") {
+			return nil
+		}
+	}
+
+	c.indexes = append(c.indexes, append([]string{}, key...))
+
+	return nil
+}
+
+func (s *MemoryStorage) Write(collection string, mode WriteMode, docs []Document) ([]bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	c, err := s.collection(collection)
+	if err != nil {
+		return nil, err
+	}
+
+	inserted := make([]bool, 0, len(docs))
+
+	for _, doc := range docs {
+		_, ok := c.documents[doc.Id]
+		switch {
+		case !ok:
+			c.ids = append(c.ids, doc.Id)
+			c.documents[doc.Id] = doc.Doc
+		case mode != WriteInsert:
+			c.documents[doc.Id] = doc.Doc
+		}
+
+		inserted = append(inserted, !ok)
+	}
+
+	return inserted, nil
+}
+
+// PushLine pushes the line into the first bucket of the execution window with room left, like BucketSelector.
+func (s *MemoryStorage) PushLine(collection string, doc LogEntry, options BucketOptions) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	c, err := s.collection(collection)
+	if err != nil {
+		return false, err
+	}
+
+	line := newBucketLine(doc)
+	if _, ok := c.lines[line.Id]; ok {
+		return false, nil
+	}
+
+	key := fmt.Sprint(doc.ExecutionKey())
+	start := BucketStart(doc, options.Window)
+
+	var bucket *Bucket
+
+	for i := range c.buckets {
+		b := &c.buckets[i].bucket
+		if c.buckets[i].key == key && b.Start.Equal(start) &&
+			b.Count < options.MaxLines && b.Size <= options.MaxBytes-line.Size() {
+			bucket = b
+
+			break
+		}
+	}
+
+	if bucket == nil {
+		c.buckets = append(c.buckets, memoryBucket{
+			key:    key,
+			bucket: Bucket{Id: bson.NewObjectId(), Start: start},
+		})
+		bucket = &c.buckets[len(c.buckets)-1].bucket
+	}
+
+	bucket.Lines = append(bucket.Lines, line)
+	bucket.Count++
+	bucket.Size += line.Size()
+	c.lines[line.Id] = struct{}{}
+
+	return true, nil
+}
+
+func (s *MemoryStorage) AddSummary(collection string, key bson.D, summary Summary, onInsert bson.M) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	c, err := s.collection(collection)
+	if err != nil {
+		return err
+	}
+
+	c.addSummary(key, summary, onInsert)
+
+	return nil
+}
+
+// ReconcileSummary adds the summary unless the summary of the execution lists the ID.
+func (s *MemoryStorage) ReconcileSummary(collection string, key bson.D, summary Summary, onInsert bson.M, id interface{}) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	c, err := s.collection(collection)
+	if err != nil {
+		return false, err
+	}
+
+	if stored, ok := c.summaries[fmt.Sprint(key)]; ok {
+		for _, reconciled := range stored.reconciled {
+			if reconciled == id {
+				return false, nil
+			}
+		}
+	}
+
+	stored := c.addSummary(key, summary, onInsert)
+	stored.reconciled = append(stored.reconciled, id)
+
+	return true, nil
+}
+
+func (c *memoryCollection) addSummary(key bson.D, summary Summary, onInsert bson.M) *memorySummary {
+	stored, ok := c.summaries[fmt.Sprint(key)]
+	if !ok {
+		stored = &memorySummary{summary: summary, onInsert: onInsert}
+		c.summaries[fmt.Sprint(key)] = stored
+
+		return stored
+	}
+
+	if summary.FirstTime.Before(stored.summary.FirstTime) {
+		stored.summary.FirstTime = summary.FirstTime
+	}
+
+	if summary.LastTime.After(stored.summary.LastTime) {
+		stored.summary.LastTime = summary.LastTime
+	}
+
+	stored.summary.LineCount += summary.LineCount
+	stored.summary.StderrCount += summary.StderrCount
+	stored.summary.Bytes += summary.Bytes
+
+	return stored
+}
+
+func (s *MemoryStorage) SaveContent(prefix string, id bson.ObjectId, content []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := s.errors[prefix]; err != nil {
+		return err
+	}
+
+	if _, ok := s.contents[prefix]; !ok {
+		s.contents[prefix] = map[bson.ObjectId][]byte{}
+	}
+
+	if _, ok := s.contents[prefix][id]; !ok {
+		s.contents[prefix][id] = append([]byte{}, content...)
+	}
+
+	return nil
+}
+
+// Collections returns the names of the collections created, sorted.
+func (s *MemoryStorage) Collections() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	names := make([]string, 0, len(s.collections))
+	for name := range s.collections {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// Indexes returns the keys of the indexes of the collection, in creation order.
+func (s *MemoryStorage) Indexes(collection string) [][]string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	c, ok := s.collections[collection]
+	if !ok {
+		return nil
+	}
+
+	return append([][]string{}, c.indexes...)
+}
+
+// Documents returns the documents of the collection, in the order they were first written.
+func (s *MemoryStorage) Documents(collection string) []interface{} {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	c, ok := s.collections[collection]
+	if !ok {
+		return nil
+	}
+
+	docs := make([]interface{}, 0, len(c.ids))
+	for _, id := range c.ids {
+		docs = append(docs, c.documents[id])
+	}
+
+	return docs
+}
+
+// Buckets returns the buckets of the collection, in the order they were created.
+func (s *MemoryStorage) Buckets(collection string) []Bucket {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	c, ok := s.collections[collection]
+	if !ok {
+		return nil
+	}
+
+	buckets := make([]Bucket, 0, len(c.buckets))
+	for _, b := range c.buckets {
+		bucket := b.bucket
+		bucket.Lines = append([]BucketLine{}, b.bucket.Lines...)
+		buckets = append(buckets, bucket)
+	}
+
+	return buckets
+}
+
+// Summary returns the summary of the execution and the values set when it was created.
+func (s *MemoryStorage) Summary(collection string, key bson.D) (Summary, bson.M, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	c, ok := s.collections[collection]
+	if !ok {
+		return Summary{}, nil, false
+	}
+
+	stored, ok := c.summaries[fmt.Sprint(key)]
+	if !ok {
+		return Summary{}, nil, false
+	}
+
+	return stored.summary, stored.onInsert, true
+}
+
+// Content returns the content stored under the ID.
+func (s *MemoryStorage) Content(prefix string, id bson.ObjectId) ([]byte, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	content, ok := s.contents[prefix][id]
+
+	return content, ok
+}
@@ -0,0 +1,306 @@
+package mongo
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/saagie/fluent-bit-mongo/pkg/log"
+	"github.com/saagie/fluent-bit-mongo/pkg/metrics"
+)
+
+// MetricMirrorFailures counts the failed operations of the best-effort mirrors, by mirror.
+const MetricMirrorFailures = "mirror_failures_total"
+
+// MirrorPolicy tells what a failure to write to a mirror does.
+type MirrorPolicy string
+
+const (
+	// MirrorRequired fails the chunk, which is retried.
+	MirrorRequired MirrorPolicy = "required"
+	// MirrorBestEffort logs and counts the failure, the mirror is skipped until the end of the flush.
+	MirrorBestEffort MirrorPolicy = "best-effort"
+)
+
+func ParseMirrorPolicy(value string) (MirrorPolicy, error) {
+	switch policy := MirrorPolicy(value); policy {
+	case MirrorRequired, MirrorBestEffort:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown mirror policy %q", value)
+	}
+}
+
+// Mirror is an additional destination receiving a copy of the writes.
+type Mirror struct {
+	Name      string
+	Policy    MirrorPolicy
+	Connector Connector
+}
+
+type mirrorConnector struct {
+	connector Connector
+	mirrors   []Mirror
+	summary   bool
+	registry  *metrics.Registry
+}
+
+// NewMirrorConnector returns a connector whose storages write to the storage of the connector, then to the mirrors.
+// The storage of the connector decides what was written, the mirrors get the same operations.
+// With summary, each mirror summarizes the lines it newly stored, the summaries of the storage are not mirrored.
+// Closing it closes the connector only, the connectors of the mirrors may be shared and are closed by their owner.
+func NewMirrorConnector(connector Connector, mirrors []Mirror, summary bool, registry *metrics.Registry) Connector {
+	return &mirrorConnector{
+		connector: connector,
+		mirrors:   mirrors,
+		summary:   summary,
+		registry:  registry,
+	}
+}
+
+func (c *mirrorConnector) Connect(ctx context.Context) (Storage, error) {
+	storage, err := c.connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &mirrorStorage{
+		ctx:     ctx,
+		Storage: storage,
+		shared: &mirrorShared{
+			summary:  c.summary,
+			registry: c.registry,
+			skipped:  map[string]bool{},
+		},
+	}
+
+	for _, mirror := range c.mirrors {
+		target, err := mirror.Connector.Connect(ctx)
+		if err == nil {
+			s.targets = append(s.targets, mirrorTarget{mirror: mirror, storage: target})
+
+			continue
+		}
+
+		if err := s.shared.failed(ctx, mirror, "connect", err); err != nil {
+			s.Close()
+
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+func (c *mirrorConnector) Close() {
+	c.connector.Close()
+}
+
+// mirrorShared is the state of a flush, shared by the copies of its storage.
+type mirrorShared struct {
+	summary  bool
+	registry *metrics.Registry
+
+	lock    sync.Mutex
+	skipped map[string]bool
+}
+
+// failed handles the failure of an operation of the mirror, it returns the error failing the operation if any.
+// The error is an ErrSecondary, so that the failures of a mirror do not count for the breaker of the flush.
+func (s *mirrorShared) failed(ctx context.Context, mirror Mirror, operation string, err error) error {
+	err = &ErrSecondary{Cause: fmt.Errorf("mirror %s: %s: %w", mirror.Name, operation, err)}
+	if mirror.Policy == MirrorRequired {
+		return err
+	}
+
+	s.lock.Lock()
+	s.skipped[mirror.Name] = true
+	s.lock.Unlock()
+
+	if s.registry != nil {
+		s.registry.Inc(MetricMirrorFailures, metrics.Labels{"mirror": mirror.Name})
+	}
+
+	if logger, logErr := log.GetLogger(ctx); logErr == nil {
+		logger.Error("Failed to write to best-effort mirror, skipping it until the end of the flush", map[string]interface{}{
+			"mirror": mirror.Name,
+			"error":  err,
+		})
+	}
+
+	return nil
+}
+
+func (s *mirrorShared) skip(mirror Mirror) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.skipped[mirror.Name]
+}
+
+type mirrorTarget struct {
+	mirror  Mirror
+	storage Storage
+}
+
+// mirrorStorage writes to its storage then to the storages of the mirrors.
+type mirrorStorage struct {
+	ctx context.Context
+	Storage
+	targets []mirrorTarget
+	shared  *mirrorShared
+}
+
+func (s *mirrorStorage) Copy(ctx context.Context) Storage {
+	c := &mirrorStorage{
+		ctx:     ctx,
+		Storage: s.Storage.Copy(ctx),
+		shared:  s.shared,
+	}
+
+	for _, t := range s.targets {
+		if !s.shared.skip(t.mirror) {
+			c.targets = append(c.targets, mirrorTarget{mirror: t.mirror, storage: t.storage.Copy(ctx)})
+		}
+	}
+
+	return c
+}
+
+// Database returns a storage writing to the database of the storage and of the mirrors.
+func (s *mirrorStorage) Database(name string) Storage {
+	d := &mirrorStorage{
+		ctx:     s.ctx,
+		Storage: s.Storage.Database(name),
+		shared:  s.shared,
+	}
+
+	for _, t := range s.targets {
+		if !s.shared.skip(t.mirror) {
+			d.targets = append(d.targets, mirrorTarget{mirror: t.mirror, storage: t.storage.Database(name)})
+		}
+	}
+
+	return d
+}
+
+func (s *mirrorStorage) Close() {
+	s.Storage.Close()
+
+	for _, t := range s.targets {
+		t.storage.Close()
+	}
+}
+
+// mirror applies the operation to the mirrors once it succeeded on the storage.
+func (s *mirrorStorage) mirror(operation string, f func(Storage) error) error {
+	for _, t := range s.targets {
+		if s.shared.skip(t.mirror) {
+			continue
+		}
+
+		if err := f(t.storage); err != nil {
+			if err := s.shared.failed(s.ctx, t.mirror, operation, err); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// summarize adds the lines newly stored by the mirror to its summaries.
+func (s *mirrorStorage) summarize(storage Storage, docs []LogEntry) error {
+	if !s.shared.summary || len(docs) == 0 {
+		return nil
+	}
+
+	summaries := NewSummaries()
+	for _, doc := range docs {
+		summaries.Add(doc)
+	}
+
+	return summaries.SaveTo(storage)
+}
+
+func (s *mirrorStorage) CreateCollection(collection string) error {
+	if err := s.Storage.CreateCollection(collection); err != nil {
+		return err
+	}
+
+	return s.mirror("create collection", func(storage Storage) error {
+		return storage.CreateCollection(collection)
+	})
+}
+
+func (s *mirrorStorage) EnsureIndex(collection string, key []string) error {
+	if err := s.Storage.EnsureIndex(collection, key); err != nil {
+		return err
+	}
+
+	return s.mirror("ensure index", func(storage Storage) error {
+		return storage.EnsureIndex(collection, key)
+	})
+}
+
+func (s *mirrorStorage) Write(collection string, mode WriteMode, docs []Document) ([]bool, error) {
+	inserted, err := s.Storage.Write(collection, mode, docs)
+	if err != nil {
+		return inserted, err
+	}
+
+	// The storage reports the documents it newly stored, even when a mirror fails, so that they are summarized once.
+	// A mirror may store documents the storage already had, it summarizes them itself.
+	return inserted, s.mirror("write", func(storage Storage) error {
+		mirrored, err := storage.Write(collection, mode, docs)
+
+		var written []LogEntry
+
+		for i, ok := range mirrored {
+			if doc, isEntry := docs[i].Doc.(LogEntry); ok && isEntry {
+				written = append(written, doc)
+			}
+		}
+
+		if summaryErr := s.summarize(storage, written); err == nil {
+			err = summaryErr
+		}
+
+		return err
+	})
+}
+
+func (s *mirrorStorage) PushLine(collection string, doc LogEntry, options BucketOptions) (bool, error) {
+	inserted, err := s.Storage.PushLine(collection, doc, options)
+	if err != nil {
+		return inserted, err
+	}
+
+	return inserted, s.mirror("push line", func(storage Storage) error {
+		pushed, err := storage.PushLine(collection, doc, options)
+		if pushed {
+			if summaryErr := s.summarize(storage, []LogEntry{doc}); err == nil {
+				err = summaryErr
+			}
+		}
+
+		return err
+	})
+}
+
+// AddSummary adds the summary to the storage only, the mirrors summarize the lines they stored.
+func (s *mirrorStorage) AddSummary(collection string, key bson.D, summary Summary, onInsert bson.M) error {
+	return s.Storage.AddSummary(collection, key, summary, onInsert)
+}
+
+func (s *mirrorStorage) SaveContent(prefix string, id bson.ObjectId, content []byte) error {
+	if err := s.Storage.SaveContent(prefix, id, content); err != nil {
+		return err
+	}
+
+	return s.mirror("save content", func(storage Storage) error {
+		return storage.SaveContent(prefix, id, content)
+	})
+}
@@ -0,0 +1,196 @@
+package mongo_test
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/saagie/fluent-bit-mongo/pkg/entry"
+	"github.com/saagie/fluent-bit-mongo/pkg/entry/mongo"
+	"github.com/saagie/fluent-bit-mongo/pkg/metrics"
+)
+
+// failingConnector fails to connect.
+type failingConnector struct{}
+
+func (failingConnector) Connect(context.Context) (mongo.Storage, error) {
+	return nil, errors.New("connection refused")
+}
+
+func (failingConnector) Close() {}
+
+// failingWrites fails the writes of documents while err is set.
+type failingWrites struct {
+	*mongo.MemoryStorage
+	err error
+}
+
+func (s *failingWrites) Connect(context.Context) (mongo.Storage, error) {
+	return s, nil
+}
+
+func (s *failingWrites) Copy(context.Context) mongo.Storage {
+	return s
+}
+
+func (s *failingWrites) Write(collection string, mode mongo.WriteMode, docs []mongo.Document) ([]bool, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	return s.MemoryStorage.Write(collection, mode, docs)
+}
+
+var _ = Describe("Mirror", func() {
+	const collection = "customer_platformID_projectID"
+
+	var ctx context.Context
+	var primary, required, bestEffort *mongo.MemoryStorage
+	var registry *metrics.Registry
+	var options mongo.Options
+
+	BeforeEach(func() {
+		ctx = loggerContext()
+		primary = mongo.NewMemoryStorage()
+		required = mongo.NewMemoryStorage()
+		bestEffort = mongo.NewMemoryStorage()
+		registry = metrics.NewRegistry()
+		options = mongo.DefaultOptions()
+		options.Summary = true
+	})
+
+	connector := func() mongo.Connector {
+		return mongo.NewMirrorConnector(primary, []mongo.Mirror{
+			{Name: "required", Policy: mongo.MirrorRequired, Connector: required},
+			{Name: "besteffort", Policy: mongo.MirrorBestEffort, Connector: bestEffort},
+		}, options.Summary, registry)
+	}
+
+	record := func(log string) map[interface{}]interface{} {
+		return map[interface{}]interface{}{
+			mongo.LogKey:            stringEntry(log),
+			mongo.StreamKey:         stringEntry("stdout"),
+			mongo.TimeKey:           stringEntry("2022-06-08T09:56:36.123456789Z"),
+			mongo.JobExecutionIDKey: stringEntry("job1"),
+			mongo.ProjectIDKey:      stringEntry("projectID"),
+			mongo.CustomerKey:       stringEntry("customer"),
+			mongo.PlatformIDKey:     stringEntry("platformID"),
+		}
+	}
+
+	flush := func(c mongo.Connector, records ...map[interface{}]interface{}) error {
+		storage, err := c.Connect(ctx)
+		if err != nil {
+			return err
+		}
+		defer storage.Close()
+
+		p := mongo.New(storage, options)
+		for _, r := range records {
+			Expect(p.ProcessRecord(ctx, time.Now(), r)).To(Succeed())
+		}
+
+		return entry.FlushNext(ctx, p)
+	}
+
+	lineCount := func(storage *mongo.MemoryStorage) int {
+		summary, _, ok := storage.Summary(collection+mongo.SummaryCollectionSuffix, bson.D{{Name: mongo.JobExecutionIDKey, Value: "job1"}})
+		Expect(ok).To(BeTrue())
+
+		return summary.LineCount
+	}
+
+	It("Should write the same documents to the mirrors", func() {
+		Expect(flush(connector(), record("hello"))).To(Succeed())
+
+		for _, storage := range []*mongo.MemoryStorage{primary, required, bestEffort} {
+			Expect(storage.Documents(collection)).To(HaveLen(1))
+			Expect(storage.Indexes(collection)).To(Equal(primary.Indexes(collection)))
+			Expect(lineCount(storage)).To(Equal(1))
+		}
+	})
+
+	It("Should count the failures of a best-effort mirror and skip it until the end of the flush", func() {
+		bestEffort.SetError(collection, errors.New("not primary"))
+
+		Expect(flush(connector(), record("hello"), record("world"))).To(Succeed())
+
+		Expect(primary.Documents(collection)).To(HaveLen(2))
+		Expect(required.Documents(collection)).To(HaveLen(2))
+		Expect(bestEffort.Collections()).To(BeEmpty())
+		Expect(registry.Get(mongo.MetricMirrorFailures, metrics.Labels{"mirror": "besteffort"})).To(Equal(1.0))
+
+		bestEffort.SetError(collection, nil)
+		Expect(flush(connector(), record("again"))).To(Succeed())
+		Expect(bestEffort.Documents(collection)).To(HaveLen(1))
+	})
+
+	It("Should retry the chunk when a required mirror fails", func() {
+		mirror := &failingWrites{MemoryStorage: required, err: errors.New("not primary")}
+		c := mongo.NewMirrorConnector(primary, []mongo.Mirror{{Name: "required", Policy: mongo.MirrorRequired, Connector: mirror}}, options.Summary, registry)
+
+		err := flush(c, record("hello"))
+		Expect(err).To(MatchError(&entry.ErrRetry{}))
+		Expect(err).To(MatchError(ContainSubstring("mirror required")))
+		Expect(mongo.PrimaryFailure(err)).To(BeFalse())
+		Expect(primary.Documents(collection)).To(HaveLen(1))
+		Expect(required.Documents(collection)).To(BeEmpty())
+
+		mirror.err = nil
+		Expect(flush(c, record("hello"))).To(Succeed())
+		Expect(required.Documents(collection)).To(HaveLen(1))
+
+		// The lines stored by the first attempt are summarized once
+		Expect(lineCount(primary)).To(Equal(1))
+		Expect(lineCount(required)).To(Equal(1))
+	})
+
+	It("Should summarize the lines each mirror stored", func() {
+		Expect(flush(primary, record("hello"))).To(Succeed())
+
+		// The primary already has the line, the mirrors store it for the first time
+		Expect(flush(connector(), record("hello"), record("world"))).To(Succeed())
+
+		Expect(lineCount(primary)).To(Equal(2))
+		Expect(lineCount(required)).To(Equal(2))
+		Expect(lineCount(bestEffort)).To(Equal(2))
+	})
+
+	It("Should apply the policy when a mirror cannot be reached", func() {
+		mirror := mongo.Mirror{Name: "unreachable", Policy: mongo.MirrorBestEffort, Connector: failingConnector{}}
+
+		Expect(flush(mongo.NewMirrorConnector(primary, []mongo.Mirror{mirror}, options.Summary, registry), record("hello"))).To(Succeed())
+		Expect(primary.Documents(collection)).To(HaveLen(1))
+		Expect(registry.Get(mongo.MetricMirrorFailures, metrics.Labels{"mirror": "unreachable"})).To(Equal(1.0))
+
+		mirror.Policy = mongo.MirrorRequired
+		Expect(flush(mongo.NewMirrorConnector(primary, []mongo.Mirror{mirror}, options.Summary, registry), record("hello"))).To(MatchError(ContainSubstring("connection refused")))
+	})
+
+	DescribeTable("Primary failure", func(err error, expected bool) {
+		Expect(mongo.PrimaryFailure(err)).To(Equal(expected))
+	},
+		Entry("no error", nil, false),
+		Entry("not retried", errors.New("invalid record"), false),
+		Entry("primary", &entry.ErrRetry{Cause: errors.New("not primary")}, true),
+		Entry("secondary", &entry.ErrRetry{Cause: &mongo.ErrSecondary{Cause: errors.New("not primary")}}, false),
+		Entry("secondary and primary", entry.Errors{
+			&mongo.ErrSecondary{Cause: &entry.ErrRetry{Cause: errors.New("mirror")}},
+			&entry.ErrRetry{Cause: errors.New("primary")},
+		}, true),
+	)
+
+	DescribeTable("Policy", func(value string, expected mongo.MirrorPolicy) {
+		policy, err := mongo.ParseMirrorPolicy(value)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(policy).To(Equal(expected))
+	},
+		Entry("required", "required", mongo.MirrorRequired),
+		Entry("best effort", "best-effort", mongo.MirrorBestEffort),
+	)
+})
@@ -2,22 +2,46 @@ package mongo
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/saagie/fluent-bit-mongo/pkg/entry"
 	"github.com/saagie/fluent-bit-mongo/pkg/log"
-	mgo "gopkg.in/mgo.v2"
+	"github.com/saagie/fluent-bit-mongo/pkg/metrics"
 )
 
+// write is a document or a dead letter waiting to be written at the end of the chunk.
+type write struct {
+	collection string
+	doc        LogEntry
+	deadLetter *DeadLetter
+}
+
+// processor converts the records of a chunk and writes them when the chunk is flushed.
+// The collections are written in parallel, the documents of a collection in order.
 type processor struct {
-	mongoSession *mgo.Session
+	storage   Storage
+	options   Options
+	summaries *Summaries
+
+	writes      map[string][]write
+	collections []string
 }
 
-func New(session *mgo.Session) entry.Processor {
-	return &processor{
-		mongoSession: session,
+func New(storage Storage, options Options) entry.Processor {
+	p := &processor{
+		storage: storage,
+		options: options,
+		writes:  map[string][]write{},
+	}
+
+	if options.Summary {
+		p.summaries = NewSummaries()
 	}
+
+	return p
 }
 
 const MongoDefaultDB = ""
@@ -28,7 +52,26 @@ func (p *processor) ProcessRecord(ctx context.Context, ts time.Time, record map[
 		return fmt.Errorf("get logger: %w", err)
 	}
 
-	logDoc, err := Convert(ctx, ts, record)
+	tag := entry.GetTag(ctx)
+
+	docType, ok := TagDocumentType(p.options.TagRules, tag)
+	if !ok {
+		var unknownType *ErrUnknownType
+
+		docType, err = p.options.Discriminator.DocumentType(record)
+		if errors.As(err, &unknownType) {
+			if p.options.Discriminator.Unknown != UnknownGeneric {
+				return p.unknown(ctx, ts, record, err)
+			}
+
+			docType, err = GenericDocument, nil
+		}
+		if err != nil {
+			return fmt.Errorf("document type: %w", err)
+		}
+	}
+
+	logDoc, err := ConvertAs(ctx, ts, record, docType)
 	if err != nil {
 		logger.Error("Failed to convert record to document", map[string]interface{}{
 			"error": err,
@@ -37,20 +80,539 @@ func (p *processor) ProcessRecord(ctx context.Context, ts time.Time, record map[
 		return fmt.Errorf("new document: %w", err)
 	}
 
-	collection := p.mongoSession.DB(MongoDefaultDB).C(logDoc.CollectionName())
+	for _, enricher := range p.options.Enrichers {
+		if err := enricher.Enrich(ctx, logDoc); err != nil {
+			return fmt.Errorf("enrich document: %w", err)
+		}
+	}
+
+	if p.options.StoreTag {
+		logDoc.GetLogDocument().Tag = tag
+	}
+
+	logDoc.GetLogDocument().Cluster = p.options.Cluster
 
-	logger.Debug("Flushing to mongo", map[string]interface{}{
+	if p.options.CollectionTemplate != nil {
+		name, err := CollectionNameFromTemplate(p.options.CollectionTemplate, logDoc, tag)
+		if err != nil {
+			return fmt.Errorf("collection name: %w", err)
+		}
+
+		logDoc.GetLogDocument().SetCollectionName(name)
+	}
+
+	if err := p.missingKey(ctx, logDoc.GetLogDocument().Customer); err != nil {
+		return fmt.Errorf("encrypt %s: %w", logDoc.GetID().Hex(), err)
+	}
+
+	docs, err := p.oversize(ctx, logDoc)
+	if err != nil {
+		return err
+	}
+
+	for _, doc := range docs {
+		p.enqueue(write{collection: doc.CollectionName(), doc: doc})
+	}
+
+	return nil
+}
+
+func (p *processor) enqueue(w write) {
+	if _, ok := p.writes[w.collection]; !ok {
+		p.collections = append(p.collections, w.collection)
+	}
+
+	p.writes[w.collection] = append(p.writes[w.collection], w)
+}
+
+// oversize applies the oversize policy to the document, it returns the documents to save.
+func (p *processor) oversize(ctx context.Context, logDoc LogEntry) ([]LogEntry, error) {
+	maxSize := p.options.Oversize.MaxSize
+	if len(logDoc.GetLogDocument().Log) <= maxSize {
+		return []LogEntry{logDoc}, nil
+	}
+
+	logger, err := log.GetLogger(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("get logger: %w", err)
+	}
+
+	logger.Info("Oversized line", map[string]interface{}{
 		"document.id": logDoc.GetID(),
+		"size":        len(logDoc.GetLogDocument().Log),
+		"policy":      p.options.Oversize.Policy,
 	})
 
-	if err := logDoc.SaveTo(collection); err != nil {
-		logger.Error("Failed to save document", map[string]interface{}{
+	switch p.options.Oversize.Policy {
+	case OversizeSplit:
+		docs, err := Split(logDoc, maxSize)
+		if err != nil {
+			return nil, fmt.Errorf("split document: %w", err)
+		}
+
+		return docs, nil
+	case OversizeGridFS:
+		// The content is written to GridFS with the document
+		return []LogEntry{logDoc}, nil
+	default:
+		Truncate(logDoc, maxSize)
+
+		return []LogEntry{logDoc}, nil
+	}
+}
+
+// unknown applies the unknown type policy to a record.
+func (p *processor) unknown(ctx context.Context, ts time.Time, record map[interface{}]interface{}, reason error) error {
+	logger, err := log.GetLogger(ctx)
+	if err != nil {
+		return fmt.Errorf("get logger: %w", err)
+	}
+
+	if p.options.Discriminator.Unknown == UnknownDrop {
+		logger.Debug("Dropping record of unknown type", map[string]interface{}{
+			"error": reason,
+		})
+
+		return nil
+	}
+
+	deadLetter, err := NewDeadLetter(ts, entry.GetTag(ctx), reason, record)
+	if err != nil {
+		return fmt.Errorf("new dead letter: %w", err)
+	}
+
+	for _, enricher := range p.options.Enrichers {
+		if e, ok := enricher.(DeadLetterEnricher); ok {
+			if err := e.EnrichDeadLetter(ctx, deadLetter); err != nil {
+				return fmt.Errorf("enrich dead letter: %w", err)
+			}
+		}
+	}
+
+	if err := p.missingKey(ctx, deadLetter.Customer); err != nil {
+		return fmt.Errorf("encrypt dead letter %s: %w", deadLetter.Id.Hex(), err)
+	}
+
+	// The dead letters of the customers without key are stored in clear once accounted for
+	if err := EncryptDeadLetter(deadLetter, p.options.Encryption.Keyring); err != nil && !errors.Is(err, ErrNoKey) {
+		return fmt.Errorf("new dead letter: %w", err)
+	}
+
+	deadLetter.Cluster = p.options.Cluster
+
+	p.enqueue(write{collection: p.options.Discriminator.DeadLetterCollection, deadLetter: deadLetter})
+
+	return nil
+}
+
+// prepare stores the content of an oversized document, then compresses and encrypts the document.
+func (p *processor) prepare(ctx context.Context, storage Storage, doc LogEntry) error {
+	logger, err := log.GetLogger(ctx)
+	if err != nil {
+		return fmt.Errorf("get logger: %w", err)
+	}
+
+	if p.options.Oversize.Policy == OversizeGridFS {
+		if err := SaveContent(storage, doc, p.options.Oversize.MaxSize); err != nil {
+			logger.Error("Failed to save content", map[string]interface{}{
+				"document.id": doc.GetID(),
+				"error":       err,
+			})
+
+			return writeError(err)
+		}
+	}
+
+	if err := Compress(doc, p.options.Compression); err != nil {
+		return err
+	}
+
+	// The lines of the customers without key were accounted for by ProcessRecord, they are rejected unless a key
+	// was removed since
+	if err := Encrypt(doc, p.options.Encryption); err != nil {
+		if !errors.Is(err, ErrNoKey) || p.options.Encryption.MissingKey == MissingKeyReject {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// missingKey applies the missing key policy when the keyring has no key for the customer: the lines or dead letters
+// are counted, and the customer is logged once until the keyring is read again. It returns ErrNoKey when they are
+// rejected.
+func (p *processor) missingKey(ctx context.Context, customer string) error {
+	keyring := p.options.Encryption.Keyring
+	if keyring == nil || keyring.Has(customer) {
+		return nil
+	}
+
+	policy := p.options.Encryption.MissingKey
+	if policy == "" {
+		policy = MissingKeyClear
+	}
+
+	if p.options.Metrics != nil {
+		p.options.Metrics.Inc(MetricMissingKey, metrics.Labels{"customer": customer, "policy": string(policy)})
+	}
+
+	if keyring.Report(customer) {
+		logger, err := log.GetLogger(ctx)
+		if err != nil {
+			return fmt.Errorf("get logger: %w", err)
+		}
+
+		message := "No encryption key for the customer, storing its lines and dead letters in clear"
+		if policy == MissingKeyReject {
+			message = "No encryption key for the customer, rejecting its lines and dead letters"
+		}
+
+		logger.Error(message, map[string]interface{}{
+			"customer": customer,
+		})
+	}
+
+	if policy == MissingKeyReject {
+		return fmt.Errorf("customer %q: %w", customer, ErrNoKey)
+	}
+
+	return nil
+}
+
+// createCollection creates the collection and its indexes.
+func (p *processor) createCollection(ctx context.Context, storage Storage, collection string, indexes [][]string) error {
+	logger, err := log.GetLogger(ctx)
+	if err != nil {
+		return fmt.Errorf("get logger: %w", err)
+	}
+
+	err = storage.CreateCollection(collection)
+	for i := 0; err == nil && i < len(indexes); i++ {
+		err = storage.EnsureIndex(collection, indexes[i])
+	}
+
+	if err != nil {
+		logger.Error("Failed to create collection", map[string]interface{}{
+			"collection": collection,
+			"error":      err,
+		})
+
+		return writeError(err)
+	}
+
+	return nil
+}
+
+// pushLine pushes the line of the document into its bucket, it reports whether the line was not already pushed.
+// The line may be pushed even when it fails, for instance when a mirror fails after the storage.
+func (p *processor) pushLine(ctx context.Context, storage Storage, logDoc LogEntry) (bool, error) {
+	logger, err := log.GetLogger(ctx)
+	if err != nil {
+		return false, fmt.Errorf("get logger: %w", err)
+	}
+
+	collection := BucketCollectionName(logDoc)
+
+	if err := p.createCollection(ctx, storage, collection, BucketIndexes(logDoc)); err != nil {
+		return false, err
+	}
+
+	logger.Debug("Pushing to mongo bucket", map[string]interface{}{
+		"document.id": logDoc.GetID(),
+	})
+
+	inserted, err := storage.PushLine(collection, logDoc, p.options.Bucket)
+	if err != nil {
+		logger.Error("Failed to push line to bucket", map[string]interface{}{
 			"document":   logDoc,
-			"collection": collection.FullName,
+			"collection": collection,
 			"error":      err,
 		})
 
-		return &entry.ErrRetry{Cause: err}
+		return inserted, writeError(err)
+	}
+
+	return inserted, nil
+}
+
+// writeBatch writes the documents of a collection, it returns the log documents newly stored.
+// The entries are the log documents of the documents, nil for the dead letters.
+func (p *processor) writeBatch(ctx context.Context, storage Storage, collection string, docs []Document, entries []LogEntry) ([]LogEntry, error) {
+	logger, err := log.GetLogger(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("get logger: %w", err)
+	}
+
+	logger.Debug("Flushing to mongo", map[string]interface{}{
+		"collection": collection,
+		"count":      len(docs),
+	})
+
+	inserted, err := storage.Write(collection, p.options.WriteMode, docs)
+
+	var written []LogEntry
+
+	for i, ok := range inserted {
+		if ok && entries[i] != nil {
+			written = append(written, entries[i])
+		}
+	}
+
+	if err != nil {
+		fields := map[string]interface{}{
+			"collection": collection,
+			"error":      err,
+		}
+		if len(inserted) < len(docs) {
+			fields["document.id"] = docs[len(inserted)].Id
+		}
+
+		logger.Error("Failed to save document", fields)
+
+		return written, writeError(err)
+	}
+
+	return written, nil
+}
+
+// writeError returns the error of a failed write, which is retried since the documents are written by ID.
+// A write concern timeout is retried too, the primary already applied the write.
+func writeError(err error) error {
+	if IsWriteConcernTimeout(err) {
+		err = fmt.Errorf("write concern timeout: %w", err)
+	}
+
+	return &entry.ErrRetry{Cause: err}
+}
+
+// collectionResult is the outcome of the writes of a collection.
+type collectionResult struct {
+	inserted []LogEntry
+	err      error
+}
+
+// writeCollection writes the documents of a collection in one batch, the lines of the bucket layout one by one.
+// It stops at the first error or at the deadline.
+func (p *processor) writeCollection(ctx context.Context, collection string, writes []write) collectionResult {
+	var result collectionResult
+
+	fail := func(err error) collectionResult {
+		result.err = fmt.Errorf("write %s: %w", collection, err)
+
+		return result
+	}
+
+	logger, err := log.GetLogger(ctx)
+	if err != nil {
+		return fail(fmt.Errorf("get logger: %w", err))
+	}
+
+	if err := ctx.Err(); err != nil {
+		return fail(&entry.ErrRetry{Cause: err})
+	}
+
+	storage := p.storage.Copy(ctx)
+	defer storage.Close()
+
+	docs := make([]Document, 0, len(writes))
+	entries := make([]LogEntry, 0, len(writes))
+
+	for _, w := range writes {
+		if err := ctx.Err(); err != nil {
+			return fail(&entry.ErrRetry{Cause: err})
+		}
+
+		if w.deadLetter != nil {
+			logger.Debug("Flushing dead letter to mongo", map[string]interface{}{
+				"document.id": w.deadLetter.Id,
+				"reason":      w.deadLetter.Reason,
+			})
+
+			if err := p.createCollection(ctx, storage, collection, w.deadLetter.Indexes()); err != nil {
+				return fail(err)
+			}
+
+			docs = append(docs, Document{Id: w.deadLetter.Id, Doc: w.deadLetter})
+			entries = append(entries, nil)
+
+			continue
+		}
+
+		if err := p.prepare(ctx, storage, w.doc); err != nil {
+			return fail(err)
+		}
+
+		if p.options.Layout == LayoutBucket {
+			inserted, err := p.pushLine(ctx, storage, w.doc)
+			if inserted {
+				result.inserted = append(result.inserted, w.doc)
+			}
+
+			if err != nil {
+				return fail(err)
+			}
+
+			continue
+		}
+
+		if err := p.createCollection(ctx, storage, collection, w.doc.Indexes()); err != nil {
+			return fail(err)
+		}
+
+		docs = append(docs, Document{Id: w.doc.GetID(), Doc: w.doc})
+		entries = append(entries, w.doc)
+	}
+
+	if len(docs) == 0 {
+		return result
+	}
+
+	written, err := p.writeBatch(ctx, storage, collection, docs, entries)
+	result.inserted = append(result.inserted, written...)
+
+	if err != nil {
+		return fail(err)
+	}
+
+	return result
+}
+
+// Flush writes the documents of the chunk and the summaries of their executions, and reads the keyring again when modified.
+// The errors of all the collections are returned together, the writes left at the deadline of the context are retried.
+func (p *processor) Flush(ctx context.Context) error {
+	if err := p.refreshKeyring(ctx); err != nil {
+		return err
+	}
+
+	concurrency := p.options.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	results := make([]collectionResult, len(p.collections))
+	semaphore := make(chan struct{}, concurrency)
+
+	var wg sync.WaitGroup
+
+	for i, collection := range p.collections {
+		select {
+		case semaphore <- struct{}{}:
+		case <-ctx.Done():
+			results[i].err = fmt.Errorf("write %s: %w", collection, &entry.ErrRetry{Cause: ctx.Err()})
+
+			continue
+		}
+
+		wg.Add(1)
+
+		go func(i int, collection string, writes []write) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+
+			results[i] = p.writeCollection(ctx, collection, writes)
+		}(i, collection, p.writes[collection])
+	}
+
+	wg.Wait()
+
+	p.writes = map[string][]write{}
+	p.collections = nil
+
+	var errs entry.Errors
+
+	for _, result := range results {
+		if result.err != nil {
+			errs = append(errs, result.err)
+		}
+
+		// Written lines are counted even when other writes failed, they are not counted again when retried
+		if p.summaries != nil {
+			for _, doc := range result.inserted {
+				p.summaries.Add(doc)
+			}
+		}
+	}
+
+	if err := p.flushSummaries(ctx); err != nil {
+		errs = append(errs, err)
+	}
+
+	return errs.Err()
+}
+
+func (p *processor) flushSummaries(ctx context.Context) error {
+	if p.summaries == nil {
+		return nil
+	}
+
+	if p.summaries.Len() == 0 && (p.options.SummaryBacklog == nil || p.options.SummaryBacklog.Len() == 0) {
+		return nil
+	}
+
+	logger, err := log.GetLogger(ctx)
+	if err != nil {
+		return fmt.Errorf("get logger: %w", err)
+	}
+
+	logger.Debug("Flushing summaries to mongo", map[string]interface{}{
+		"count": p.summaries.Len(),
+	})
+
+	// The lines are stored, the summaries left are saved by the next flush to the destination
+	summaries := p.summaries
+	if p.options.SummaryBacklog != nil {
+		summaries = p.options.SummaryBacklog.Take(p.destination())
+		summaries.merge(p.summaries)
+
+		defer p.options.SummaryBacklog.Keep(p.destination(), summaries)
+	}
+
+	p.summaries = NewSummaries()
+
+	if err := ctx.Err(); err != nil {
+		return &entry.ErrRetry{Cause: fmt.Errorf("save summaries: %w", err)}
+	}
+
+	storage := p.storage.Copy(ctx)
+	defer storage.Close()
+
+	if err := summaries.SaveTo(storage); err != nil {
+		logger.Error("Failed to save summaries", map[string]interface{}{
+			"error": err,
+		})
+
+		return writeError(err)
+	}
+
+	return nil
+}
+
+// destination identifies the database of the processor in the summary backlog.
+func (p *processor) destination() string {
+	return p.options.Cluster + "/" + p.options.Destination
+}
+
+func (p *processor) refreshKeyring(ctx context.Context) error {
+	if p.options.Encryption.Keyring == nil {
+		return nil
+	}
+
+	logger, err := log.GetLogger(ctx)
+	if err != nil {
+		return fmt.Errorf("get logger: %w", err)
+	}
+
+	refreshed, err := p.options.Encryption.Keyring.Refresh()
+	if err != nil {
+		logger.Error("Failed to read the keyring, keeping the current keys", map[string]interface{}{
+			"error": err,
+		})
+
+		return nil
+	}
+
+	if refreshed {
+		logger.Info("Keyring read again", nil)
 	}
 
 	return nil
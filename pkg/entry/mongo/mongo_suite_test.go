@@ -1,13 +1,164 @@
 package mongo_test
 
 import (
+	"fmt"
+	"os"
 	"testing"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"github.com/ory/dockertest/v3"
+	"github.com/ory/dockertest/v3/docker"
+	mgo "gopkg.in/mgo.v2"
 )
 
 func TestMongo(t *testing.T) {
 	RegisterFailHandler(Fail)
 	RunSpecs(t, "Mongo Suite")
 }
+
+const mongoTag = "4.2.12" // Like the end to end tests, https://hub.docker.com/_/mongo?tab=tags
+
+const mongoPort = "27017/tcp"
+
+var dockerPool *dockertest.Pool
+
+// sharedMongods are the mongods shared by the tests by name, started by the first test needing them.
+var sharedMongods = map[string]*mongod{}
+
+// mongod is a mongod started in docker for the tests.
+type mongod struct {
+	resource *dockertest.Resource
+	// cleanups release what was set up for the mongod once it is purged, such as its fixtures.
+	cleanups []func() error
+	// fixtures are the TLS files of the mongods requiring TLS.
+	fixtures *tlsFixtures
+	Address  string
+}
+
+// requireDocker skips the tests needing docker when it cannot be reached, but on CI.
+func requireDocker() {
+	if err := connectDocker(); err != nil {
+		if os.Getenv("CI") == "" {
+			Skip(err.Error())
+		}
+
+		Expect(err).ToNot(HaveOccurred())
+	}
+}
+
+// startMongod runs a mongod container and waits until ready succeeds, by default until the mongod answers a ping.
+func startMongod(options *dockertest.RunOptions, ready func(address string) error) *mongod {
+	requireDocker()
+
+	m, err := runMongod(options, ready)
+	if err != nil {
+		Fail(err.Error())
+	}
+
+	return m
+}
+
+// connectDocker connects to docker once, for the tests and the benchmarks.
+func connectDocker() error {
+	if dockerPool != nil {
+		return nil
+	}
+
+	pool, err := dockertest.NewPool("")
+	if err == nil {
+		err = pool.Client.Ping()
+	}
+
+	if err != nil {
+		return fmt.Errorf("docker is not available: %w", err)
+	}
+
+	dockerPool = pool
+
+	return nil
+}
+
+// runMongod runs a mongod container once connected to docker, like startMongod.
+func runMongod(options *dockertest.RunOptions, ready func(address string) error) (*mongod, error) {
+	if options.Repository == "" {
+		options.Repository = "mongo"
+		options.Tag = mongoTag
+	}
+	options.ExposedPorts = append(options.ExposedPorts, mongoPort)
+
+	resource, err := dockerPool.RunWithOptions(options, func(config *docker.HostConfig) {
+		config.RestartPolicy = docker.RestartPolicy{Name: "no"}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("run mongod: %w", err)
+	}
+
+	m := &mongod{resource: resource, Address: resource.GetHostPort(mongoPort)}
+
+	if ready == nil {
+		ready = func(address string) error {
+			session, err := mgo.DialWithTimeout(address, time.Second)
+			if err != nil {
+				return err
+			}
+			defer session.Close()
+
+			return session.Ping()
+		}
+	}
+
+	if err := dockerPool.Retry(func() error { return ready(m.Address) }); err != nil {
+		_ = dockerPool.Purge(resource)
+
+		return nil, fmt.Errorf("mongod %s is not ready: %w", m.Address, err)
+	}
+
+	return m, nil
+}
+
+// sharedMongod returns the mongod shared under the name, started the first time.
+func sharedMongod(name string, start func() *mongod) *mongod {
+	m, ok := sharedMongods[name]
+	if !ok {
+		m = start()
+		sharedMongods[name] = m
+	}
+
+	return m
+}
+
+// localMongod returns the shared mongod without authentication.
+func localMongod() *mongod {
+	return sharedMongod("local", func() *mongod {
+		return startMongod(&dockertest.RunOptions{}, nil)
+	})
+}
+
+// Dial returns a session to the database of the mongod, dropped first so that each test starts from scratch.
+func (m *mongod) Dial(database string) *mgo.Session {
+	session, err := mgo.DialWithInfo(&mgo.DialInfo{
+		Addrs:    []string{m.Address},
+		Database: database,
+		Timeout:  10 * time.Second,
+	})
+	Expect(err).ToNot(HaveOccurred())
+	Expect(session.DB("").DropDatabase()).To(Succeed())
+
+	return session
+}
+
+func (m *mongod) Close() {
+	Expect(dockerPool.Purge(m.resource)).To(Succeed())
+
+	for _, cleanup := range m.cleanups {
+		Expect(cleanup()).To(Succeed())
+	}
+}
+
+var _ = AfterSuite(func() {
+	for _, m := range sharedMongods {
+		m.Close()
+	}
+})
@@ -0,0 +1,228 @@
+package mongo_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/saagie/fluent-bit-mongo/pkg/entry"
+	"github.com/saagie/fluent-bit-mongo/pkg/entry/mongo"
+)
+
+var _ = Describe("Processor", func() {
+	record := func(jobExecutionID string) map[interface{}]interface{} {
+		return map[interface{}]interface{}{
+			mongo.LogKey:            stringEntry("hello"),
+			mongo.StreamKey:         stringEntry("stdout"),
+			mongo.TimeKey:           stringEntry("2022-06-08T09:56:36.123456789Z"),
+			mongo.JobExecutionIDKey: stringEntry(jobExecutionID),
+			mongo.ProjectIDKey:      stringEntry("projectID"),
+			mongo.CustomerKey:       stringEntry("customer"),
+			mongo.PlatformIDKey:     stringEntry("platformID"),
+		}
+	}
+
+	It("Should retry the writes left at the deadline", func() {
+		ctx := loggerContext()
+
+		// Mongo is never reached once the deadline expired
+		p := mongo.New(nil, mongo.DefaultOptions())
+		Expect(p.ProcessRecord(ctx, time.Now(), record("job1"))).To(Succeed())
+
+		ctx, cancel := context.WithCancel(ctx)
+		cancel()
+
+		err := entry.FlushNext(ctx, p)
+		Expect(err).To(MatchError(&entry.ErrRetry{}))
+		Expect(err).To(MatchError(context.Canceled))
+	})
+
+	Context("With a memory storage", func() {
+		const collection = "customer_platformID_projectID"
+
+		var ctx context.Context
+		var storage *mongo.MemoryStorage
+		var options mongo.Options
+
+		BeforeEach(func() {
+			ctx = loggerContext()
+			storage = mongo.NewMemoryStorage()
+			options = mongo.DefaultOptions()
+		})
+
+		flush := func(records ...map[interface{}]interface{}) error {
+			p := mongo.New(storage, options)
+			for _, r := range records {
+				Expect(p.ProcessRecord(ctx, time.Now(), r)).To(Succeed())
+			}
+
+			return entry.FlushNext(ctx, p)
+		}
+
+		It("Should write the documents to their collection with its indexes", func() {
+			other := record("job2")
+			other[mongo.ProjectIDKey] = stringEntry("otherProjectID")
+
+			Expect(flush(record("job1"), other)).To(Succeed())
+
+			Expect(storage.Collections()).To(Equal([]string{"customer_platformID_otherProjectID", collection}))
+			Expect(storage.Indexes(collection)).To(Equal([][]string{{mongo.JobExecutionIDKey, mongo.TimeKey}}))
+
+			docs := storage.Documents(collection)
+			Expect(docs).To(HaveLen(1))
+			Expect(docs[0]).To(BeAssignableToTypeOf(&mongo.JobLogDocument{}))
+			Expect(docs[0].(*mongo.JobLogDocument).JobExecutionId).To(Equal("job1"))
+		})
+
+		It("Should summarize the documents newly written only", func() {
+			options.Summary = true
+
+			other := record("job2")
+			other[mongo.LogKey] = stringEntry("other")
+
+			Expect(flush(record("job1"), record("job1"), other)).To(Succeed())
+			Expect(storage.Documents(collection)).To(HaveLen(2))
+
+			// The retried chunk is already stored
+			Expect(flush(record("job1"))).To(Succeed())
+
+			summary, onInsert, ok := storage.Summary(collection+mongo.SummaryCollectionSuffix, bson.D{{Name: mongo.JobExecutionIDKey, Value: "job1"}})
+			Expect(ok).To(BeTrue())
+			Expect(summary.LineCount).To(Equal(1))
+			Expect(onInsert).To(HaveKeyWithValue(mongo.ProjectIDKey, "projectID"))
+		})
+
+		It("Should save the summaries left by a failed flush with the next one", func() {
+			options.Summary = true
+			options.SummaryBacklog = mongo.NewSummaryBacklog()
+
+			summaries := collection + mongo.SummaryCollectionSuffix
+			storage.SetError(summaries, errors.New("not primary"))
+
+			Expect(flush(record("job1"))).To(MatchError(&entry.ErrRetry{}))
+			Expect(options.SummaryBacklog.Len()).To(Equal(1))
+
+			// The retried chunk is already stored, its lines are counted by the backlog only
+			storage.SetError(summaries, nil)
+			Expect(flush(record("job1"))).To(Succeed())
+			Expect(options.SummaryBacklog.Len()).To(BeZero())
+
+			summary, _, ok := storage.Summary(summaries, bson.D{{Name: mongo.JobExecutionIDKey, Value: "job1"}})
+			Expect(ok).To(BeTrue())
+			Expect(summary.LineCount).To(Equal(1))
+		})
+
+		It("Should keep the stored documents with the insert write mode", func() {
+			options.WriteMode = mongo.WriteInsert
+			Expect(flush(record("job1"))).To(Succeed())
+
+			stored := storage.Documents(collection)[0]
+			Expect(flush(record("job1"))).To(Succeed())
+			Expect(storage.Documents(collection)).To(Equal([]interface{}{stored}))
+		})
+
+		It("Should write the records of unknown type as dead letters", func() {
+			options.Discriminator.Key = "type"
+
+			Expect(flush(record("job1"))).To(Succeed())
+
+			docs := storage.Documents(mongo.DefaultDeadLetterCollection)
+			Expect(docs).To(HaveLen(1))
+			Expect(docs[0].(*mongo.DeadLetter).Reason).To(ContainSubstring("type not found"))
+			Expect(storage.Indexes(mongo.DefaultDeadLetterCollection)).To(Equal([][]string{{mongo.TimeKey}}))
+		})
+
+		It("Should encrypt the dead letters", func() {
+			keyring, err := mongo.ParseKeyring([]byte(keyringJSON("k1")))
+			Expect(err).ToNot(HaveOccurred())
+
+			options.Discriminator.Key = "type"
+			options.Encryption.Keyring = keyring
+
+			Expect(flush(record("job1"))).To(Succeed())
+
+			deadLetter := storage.Documents(mongo.DefaultDeadLetterCollection)[0].(*mongo.DeadLetter)
+			Expect(deadLetter.Record).To(BeNil())
+			Expect(deadLetter.Decrypt(keyring)).To(Succeed())
+			Expect(deadLetter.Record).To(HaveKeyWithValue(mongo.JobExecutionIDKey, "job1"))
+		})
+
+		It("Should push the lines into buckets with the bucket layout", func() {
+			options.Layout = mongo.LayoutBucket
+			options.Bucket.MaxLines = 2
+
+			first := record("job1")
+			second := record("job1")
+			second[mongo.LogKey] = stringEntry("second")
+			third := record("job1")
+			third[mongo.LogKey] = stringEntry("third")
+
+			Expect(flush(first, second, third, first)).To(Succeed())
+
+			Expect(storage.Documents(collection)).To(BeEmpty())
+
+			buckets := storage.Buckets(collection + mongo.BucketCollectionSuffix)
+			Expect(buckets).To(HaveLen(2))
+			Expect(buckets[0].Count).To(Equal(2))
+			Expect(buckets[1].Count).To(Equal(1))
+			Expect(buckets[1].Lines[0].Log).To(Equal("third"))
+		})
+
+		It("Should store the content of the oversized lines", func() {
+			options.Oversize = mongo.OversizeOptions{MaxSize: 4, Policy: mongo.OversizeGridFS}
+
+			Expect(flush(record("job1"))).To(Succeed())
+
+			doc := storage.Documents(collection)[0].(*mongo.JobLogDocument)
+			Expect(doc.Log).To(Equal("hell"))
+			Expect(doc.OriginalSize).To(Equal(len("hello")))
+
+			content, ok := storage.Content(collection+mongo.ContentSuffix, doc.ContentId)
+			Expect(ok).To(BeTrue())
+			Expect(string(content)).To(Equal("hello"))
+		})
+
+		It("Should store the cluster written to", func() {
+			options.Cluster = mongo.ClusterFallback
+			options.Discriminator.Key = "type"
+
+			typed := record("job1")
+			typed["type"] = stringEntry("job")
+
+			Expect(flush(typed, record("job2"))).To(Succeed())
+
+			Expect(storage.Documents(collection)[0].(*mongo.JobLogDocument).Cluster).To(Equal(mongo.ClusterFallback))
+			Expect(storage.Documents(mongo.DefaultDeadLetterCollection)[0].(*mongo.DeadLetter).Cluster).To(Equal(mongo.ClusterFallback))
+
+			options.Discriminator.Key = ""
+			options.Layout = mongo.LayoutBucket
+
+			Expect(flush(record("job3"))).To(Succeed())
+			Expect(storage.Buckets(collection + mongo.BucketCollectionSuffix)[0].Lines[0].Cluster).To(Equal(mongo.ClusterFallback))
+		})
+
+		It("Should retry a failed write and still write the other collections", func() {
+			failure := errors.New("connection reset")
+			storage.SetError(collection, failure)
+
+			other := record("job2")
+			other[mongo.ProjectIDKey] = stringEntry("otherProjectID")
+
+			err := flush(record("job1"), other)
+			Expect(err).To(MatchError(&entry.ErrRetry{}))
+			Expect(err).To(MatchError(failure))
+			Expect(strings.Contains(err.Error(), collection)).To(BeTrue())
+
+			Expect(storage.Documents("customer_platformID_otherProjectID")).To(HaveLen(1))
+
+			storage.SetError(collection, nil)
+			Expect(flush(record("job1"))).To(Succeed())
+			Expect(storage.Documents(collection)).To(HaveLen(1))
+		})
+	})
+})
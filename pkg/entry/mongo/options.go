@@ -0,0 +1,169 @@
+package mongo
+
+import (
+	"errors"
+	"fmt"
+	"text/template"
+	"time"
+
+	"github.com/saagie/fluent-bit-mongo/pkg/metrics"
+)
+
+// Layout selects how log lines are laid out in the collections.
+type Layout string
+
+const (
+	// LayoutDocument stores one document per log line.
+	LayoutDocument Layout = "document"
+	// LayoutBucket groups the lines of an execution into time window buckets.
+	LayoutBucket Layout = "bucket"
+)
+
+func ParseLayout(value string) (Layout, error) {
+	switch layout := Layout(value); layout {
+	case LayoutDocument, LayoutBucket:
+		return layout, nil
+	default:
+		return "", fmt.Errorf("unknown storage layout %q", value)
+	}
+}
+
+type BucketOptions struct {
+	// Window is the time span covered by a bucket, lines are grouped by truncated time.
+	Window time.Duration
+	// MaxLines is the maximum number of lines pushed into a single bucket.
+	MaxLines int
+	// MaxBytes is the maximum cumulated size of the log content of a single bucket.
+	MaxBytes int
+}
+
+type Options struct {
+	Layout Layout
+	// WriteMode applies to the documents, the bucket lines are pushed into their buckets.
+	WriteMode WriteMode
+	Bucket    BucketOptions
+	// Summary enables the execution summary documents.
+	Summary bool
+	// SummaryBacklog keeps the summaries which could not be saved for the next flushes, they are dropped when nil.
+	SummaryBacklog *SummaryBacklog
+	// Destination tells apart the databases written by the instance in the summary backlog.
+	Destination string
+	// Enrichers are applied in order to each document after its conversion.
+	Enrichers []Enricher
+	// TagRules select the document type from the tag, the type is guessed from the record keys when none matches.
+	TagRules []TagRule
+	// StoreTag stores the tag in the documents.
+	StoreTag bool
+	// Cluster is stored in the documents when set, it names the cluster they are written to.
+	Cluster string
+	// CollectionTemplate renders the collection name, when set.
+	CollectionTemplate *template.Template
+	// Discriminator selects the document type of the records no tag rule matches.
+	Discriminator Discriminator
+	// Oversize applies to the lines whose content is too large to be stored as is.
+	Oversize OversizeOptions
+	// Compression applies to the lines after the oversize policy.
+	Compression CompressionOptions
+	// Encryption applies to the lines after the compression.
+	Encryption EncryptionOptions
+	// Concurrency is the number of collections written in parallel at the end of a chunk.
+	Concurrency int
+	Session     SessionOptions
+	// Metrics counts the lines of the customers without encryption key, when set.
+	Metrics *metrics.Registry
+}
+
+func DefaultOptions() Options {
+	return Options{
+		Layout:    LayoutDocument,
+		WriteMode: WriteUpsert,
+		Bucket: BucketOptions{
+			Window:   time.Minute,
+			MaxLines: 1000,
+			MaxBytes: 1024 * 1024,
+		},
+		Discriminator: Discriminator{
+			Types:                DefaultTypes(),
+			Unknown:              UnknownDeadLetter,
+			DeadLetterCollection: DefaultDeadLetterCollection,
+		},
+		Oversize: OversizeOptions{
+			MaxSize: 8 * 1024 * 1024,
+			Policy:  OversizeTruncate,
+		},
+		Compression: CompressionOptions{
+			MinSize: 4096,
+		},
+		Encryption: EncryptionOptions{
+			Fields:     []string{EncryptFields},
+			MissingKey: MissingKeyClear,
+		},
+		Concurrency: 4,
+		Session: SessionOptions{
+			SocketTimeout: 10 * time.Second,
+			SyncTimeout:   10 * time.Second,
+		},
+	}
+}
+
+func (o Options) Validate() error {
+	if o.Concurrency <= 0 {
+		return errors.New("write concurrency must be positive")
+	}
+
+	if o.Layout == LayoutBucket {
+		if o.WriteMode != WriteUpsert {
+			return errors.New("the bucket layout only supports the upsert write mode")
+		}
+
+		if o.Bucket.Window <= 0 {
+			return errors.New("bucket window must be positive")
+		}
+
+		if o.Bucket.MaxLines <= 0 {
+			return errors.New("bucket max lines must be positive")
+		}
+
+		if o.Bucket.MaxBytes <= 0 {
+			return errors.New("bucket max bytes must be positive")
+		}
+	}
+
+	if err := o.Session.Validate(); err != nil {
+		return err
+	}
+
+	// The lines are counted once their insertion is acknowledged
+	if o.Summary && o.Session.Unacknowledged() {
+		return errors.New("execution summaries need acknowledged writes")
+	}
+
+	if err := o.Oversize.Validate(); err != nil {
+		return err
+	}
+
+	if err := o.Compression.Validate(); err != nil {
+		return err
+	}
+
+	if err := o.Encryption.Validate(); err != nil {
+		return err
+	}
+
+	// GridFS contents would be stored in clear
+	if o.Encryption.Keyring != nil && o.Oversize.Policy == OversizeGridFS {
+		return errors.New("the gridfs oversize policy cannot be used with encryption")
+	}
+
+	if o.Discriminator.Key != "" {
+		if len(o.Discriminator.Types) == 0 {
+			return errors.New("no document type for the type key values")
+		}
+
+		if o.Discriminator.Unknown == UnknownDeadLetter && o.Discriminator.DeadLetterCollection == "" {
+			return errors.New("no dead letter collection")
+		}
+	}
+
+	return nil
+}
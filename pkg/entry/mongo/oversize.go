@@ -0,0 +1,169 @@
+package mongo
+
+import (
+	"fmt"
+	"reflect"
+	"unicode/utf8"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// OversizePolicy is what is done with the lines whose content is above the maximum size.
+type OversizePolicy string
+
+const (
+	// OversizeTruncate cuts the content and appends TruncatedMarker.
+	OversizeTruncate OversizePolicy = "truncate"
+	// OversizeSplit writes the content into several documents, numbered from 1.
+	OversizeSplit OversizePolicy = "split"
+	// OversizeGridFS writes the content to GridFS, the document keeps the beginning of the content.
+	OversizeGridFS OversizePolicy = "gridfs"
+)
+
+func ParseOversizePolicy(value string) (OversizePolicy, error) {
+	switch policy := OversizePolicy(value); policy {
+	case OversizeTruncate, OversizeSplit, OversizeGridFS:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown oversize policy %q", value)
+	}
+}
+
+// MaxBSONSize is the maximum size of a MongoDB document.
+const MaxBSONSize = 16 * 1024 * 1024
+
+// TruncatedMarker ends the content of the truncated lines.
+const TruncatedMarker = " [truncated]"
+
+// ContentSuffix is appended to the document collection name to get the GridFS prefix of the contents.
+const ContentSuffix = "_content"
+
+type OversizeOptions struct {
+	// MaxSize is the content size above which the policy applies.
+	MaxSize int
+	Policy  OversizePolicy
+}
+
+func (o OversizeOptions) Validate() error {
+	// Leave room for the content of the truncated lines
+	if o.MaxSize <= len(TruncatedMarker) {
+		return fmt.Errorf("max line size must be above %d", len(TruncatedMarker))
+	}
+
+	// Leave room for the other fields of the document
+	if o.MaxSize > MaxBSONSize/2 {
+		return fmt.Errorf("max line size must not be above %d", MaxBSONSize/2)
+	}
+
+	return nil
+}
+
+// cut returns the longest prefix of the content not above the size, without splitting a character.
+// A negative size is an empty prefix.
+func cut(content string, size int) string {
+	if len(content) <= size {
+		return content
+	}
+
+	if size < 0 {
+		size = 0
+	}
+
+	for size > 0 && !utf8.RuneStart(content[size]) {
+		size--
+	}
+
+	return content[:size]
+}
+
+// Truncate cuts the content of an oversized document, it keeps the original size.
+// The content is the marker alone when the size leaves no room for it.
+func Truncate(doc LogEntry, maxSize int) {
+	d := doc.GetLogDocument()
+	if len(d.Log) <= maxSize {
+		return
+	}
+
+	d.OriginalSize = len(d.Log)
+	d.Log = cut(d.Log, maxSize-len(TruncatedMarker)) + TruncatedMarker
+}
+
+// cloneEntry returns a shallow copy of the document, of the same type.
+func cloneEntry(doc LogEntry) LogEntry {
+	value := reflect.ValueOf(doc).Elem()
+	clone := reflect.New(value.Type())
+	clone.Elem().Set(value)
+
+	return clone.Interface().(LogEntry)
+}
+
+// Split splits the content of an oversized document into continuation documents.
+// The first part keeps the document ID, the others get an ID derived from it.
+func Split(doc LogEntry, maxSize int) ([]LogEntry, error) {
+	d := doc.GetLogDocument()
+	if len(d.Log) <= maxSize {
+		return []LogEntry{doc}, nil
+	}
+
+	content := d.Log
+
+	var parts []LogEntry
+	for len(content) > 0 {
+		chunk := cut(content, maxSize)
+		if chunk == "" {
+			// A single character above the size
+			chunk = content[:maxSize]
+		}
+
+		part := cloneEntry(doc)
+		partDoc := part.GetLogDocument()
+		partDoc.Log = chunk
+		partDoc.Part = len(parts) + 1
+		partDoc.OriginalSize = len(d.Log)
+
+		if partDoc.Part > 1 {
+			id, err := hashObjectID(struct {
+				Id   bson.ObjectId
+				Part int
+			}{d.Id, partDoc.Part})
+			if err != nil {
+				return nil, fmt.Errorf("part %d ID: %w", partDoc.Part, err)
+			}
+
+			partDoc.Id = id
+		}
+
+		parts = append(parts, part)
+		content = content[len(chunk):]
+	}
+
+	for _, part := range parts {
+		part.GetLogDocument().Parts = len(parts)
+	}
+
+	return parts, nil
+}
+
+// SaveContent stores the content of an oversized document with the document ID, and cuts the document content.
+// The content is not written again when it is already stored.
+func SaveContent(storage Storage, doc LogEntry, maxSize int) error {
+	d := doc.GetLogDocument()
+	if len(d.Log) <= maxSize {
+		return nil
+	}
+
+	if err := storage.SaveContent(ContentPrefix(doc), d.Id, []byte(d.Log)); err != nil {
+		return err
+	}
+
+	d.ContentId = d.Id
+	d.OriginalSize = len(d.Log)
+	d.Log = cut(d.Log, maxSize)
+
+	return nil
+}
+
+// ContentPrefix returns the GridFS prefix of the contents of the document collection.
+func ContentPrefix(doc LogEntry) string {
+	return doc.CollectionName() + ContentSuffix
+}
@@ -0,0 +1,143 @@
+package mongo_test
+
+import (
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	"github.com/saagie/fluent-bit-mongo/pkg/entry/mongo"
+)
+
+var _ = Describe("Oversized lines", func() {
+	ts := time.Date(2022, 6, 8, 9, 56, 36, 0, time.UTC)
+
+	line := func(content string) mongo.LogEntry {
+		doc, err := mongo.Convert(loggerContext(), ts, map[interface{}]interface{}{
+			mongo.LogKey:            stringEntry(content),
+			mongo.StreamKey:         stringEntry("stderr"),
+			mongo.JobExecutionIDKey: stringEntry("jobExecutionID"),
+			mongo.ProjectIDKey:      stringEntry("projectID"),
+			mongo.CustomerKey:       stringEntry("customer"),
+			mongo.PlatformIDKey:     stringEntry("platformID"),
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		return doc
+	}
+
+	Describe("Truncate", func() {
+		It("Should cut the content and keep the original size", func() {
+			doc := line(strings.Repeat("a", 100))
+			mongo.Truncate(doc, 50)
+
+			d := doc.GetLogDocument()
+			Expect(d.Log).To(HaveLen(50))
+			Expect(d.Log).To(HaveSuffix(mongo.TruncatedMarker))
+			Expect(d.OriginalSize).To(Equal(100))
+		})
+
+		It("Should not split a character", func() {
+			doc := line(strings.Repeat("é", 50))
+			mongo.Truncate(doc, 50)
+
+			d := doc.GetLogDocument()
+			Expect(d.Log).To(Equal(strings.Repeat("é", 19) + mongo.TruncatedMarker))
+		})
+
+		It("Should keep the marker alone when the size leaves no room for the content", func() {
+			doc := line(strings.Repeat("a", 100))
+			mongo.Truncate(doc, 5)
+
+			Expect(doc.GetLogDocument().Log).To(Equal(mongo.TruncatedMarker))
+			Expect(doc.GetLogDocument().OriginalSize).To(Equal(100))
+		})
+
+		It("Should keep small lines", func() {
+			doc := line("small")
+			mongo.Truncate(doc, 50)
+
+			Expect(doc.GetLogDocument().Log).To(Equal("small"))
+			Expect(doc.GetLogDocument().OriginalSize).To(BeZero())
+		})
+	})
+
+	Describe("Split", func() {
+		It("Should write the content into numbered parts", func() {
+			content := strings.Repeat("a", 25) + strings.Repeat("b", 25) + "c"
+			doc := line(content)
+			id := doc.GetID()
+
+			parts, err := mongo.Split(doc, 25)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(parts).To(HaveLen(3))
+
+			var joined strings.Builder
+			ids := map[interface{}]struct{}{}
+
+			for i, part := range parts {
+				Expect(part).To(BeAssignableToTypeOf(&mongo.JobLogDocument{}))
+
+				d := part.GetLogDocument()
+				Expect(d.Part).To(Equal(i + 1))
+				Expect(d.Parts).To(Equal(3))
+				Expect(d.OriginalSize).To(Equal(len(content)))
+				Expect(part.(*mongo.JobLogDocument).JobExecutionId).To(Equal("jobExecutionID"))
+
+				joined.WriteString(d.Log)
+				ids[d.Id] = struct{}{}
+			}
+
+			Expect(joined.String()).To(Equal(content))
+			Expect(ids).To(HaveLen(3))
+			Expect(parts[0].GetID()).To(Equal(id))
+		})
+
+		It("Should give the same IDs to a retried line", func() {
+			content := strings.Repeat("a", 60)
+
+			first, err := mongo.Split(line(content), 25)
+			Expect(err).ToNot(HaveOccurred())
+
+			second, err := mongo.Split(line(content), 25)
+			Expect(err).ToNot(HaveOccurred())
+
+			for i := range first {
+				Expect(second[i].GetID()).To(Equal(first[i].GetID()))
+			}
+		})
+
+		It("Should count a split line once in the summary", func() {
+			parts, err := mongo.Split(line(strings.Repeat("a", 60)), 25)
+			Expect(err).ToNot(HaveOccurred())
+
+			summaries := mongo.NewSummaries()
+			for _, part := range parts {
+				summaries.Add(part)
+			}
+
+			summary, ok := summaries.Get(parts[0])
+			Expect(ok).To(BeTrue())
+			Expect(summary.LineCount).To(Equal(1))
+			Expect(summary.StderrCount).To(Equal(1))
+			Expect(summary.Bytes).To(Equal(60))
+		})
+	})
+
+	DescribeTable("Options", func(options mongo.OversizeOptions, ok bool) {
+		err := options.Validate()
+		if ok {
+			Expect(err).ToNot(HaveOccurred())
+		} else {
+			Expect(err).To(HaveOccurred())
+		}
+	},
+		Entry("default", mongo.DefaultOptions().Oversize, true),
+		Entry("zero size", mongo.OversizeOptions{MaxSize: 0, Policy: mongo.OversizeSplit}, false),
+		Entry("size of the marker", mongo.OversizeOptions{MaxSize: len(mongo.TruncatedMarker), Policy: mongo.OversizeTruncate}, false),
+		Entry("size above the marker", mongo.OversizeOptions{MaxSize: len(mongo.TruncatedMarker) + 1, Policy: mongo.OversizeTruncate}, true),
+		Entry("size close to the BSON limit", mongo.OversizeOptions{MaxSize: mongo.MaxBSONSize - 1, Policy: mongo.OversizeSplit}, false),
+	)
+})
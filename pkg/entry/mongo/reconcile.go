@@ -0,0 +1,415 @@
+package mongo
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	// ClusterPrimary names the cluster of the documents written to the primary cluster.
+	ClusterPrimary = "primary"
+	// ClusterFallback names the cluster of the documents written to the fallback cluster.
+	ClusterFallback = "fallback"
+)
+
+// ReconcileStats counts what Reconcile copied to the target.
+type ReconcileStats struct {
+	Collections int
+	// Documents is the number of documents and bucket lines newly stored by the target.
+	Documents int
+	// Summaries is the number of summaries added to the ones of the target.
+	Summaries int
+	// Interrupted is the number of summaries an interrupted run already added, removed without being added again.
+	Interrupted int
+	// Contents is the number of GridFS contents copied, the target keeps the ones it already stores.
+	Contents int
+}
+
+const (
+	gridFSFiles  = ".files"
+	gridFSChunks = ".chunks"
+)
+
+var summaryFields = map[string]struct{}{
+	"_id":                 {},
+	SummaryFirstTimeKey:   {},
+	SummaryLastTimeKey:    {},
+	SummaryLineCountKey:   {},
+	SummaryStderrCountKey: {},
+	SummaryBytesKey:       {},
+	SummaryReconciledKey:  {},
+}
+
+// SummaryReconciler is implemented by the storages Reconcile adds the summaries of the fallback cluster to.
+type SummaryReconciler interface {
+	// ReconcileSummary adds the summary of the ID to the summary of the execution unless it was already added, it
+	// reports whether it was added. The summary of the execution lists the ID in the same update.
+	ReconcileSummary(collection string, key bson.D, summary Summary, onInsert bson.M, id interface{}) (bool, error)
+}
+
+// ReconciledSummarySelector selects the summary of the execution listing the ID, or not listing it.
+func ReconciledSummarySelector(key bson.D, id interface{}, listed bool) bson.D {
+	selector := make(bson.D, 0, len(key)+1)
+	selector = append(selector, key...)
+
+	if listed {
+		return append(selector, bson.DocElem{Name: SummaryReconciledKey, Value: id})
+	}
+
+	return append(selector, bson.DocElem{Name: SummaryReconciledKey, Value: bson.M{"$ne": id}})
+}
+
+// ReconciledSummaryUpdate returns the update adding the summary of the ID, and listing the ID.
+func ReconciledSummaryUpdate(summary Summary, onInsert bson.M, id interface{}) bson.M {
+	update := SummaryUpdate(summary, onInsert)
+	update["$addToSet"] = bson.M{SummaryReconciledKey: id}
+
+	return update
+}
+
+var bucketFields = map[string]struct{}{
+	"_id":          {},
+	BucketStartKey: {},
+	BucketCountKey: {},
+	BucketSizeKey:  {},
+	BucketLinesKey: {},
+	ProjectIDKey:   {},
+	CustomerKey:    {},
+	PlatformIDKey:  {},
+}
+
+// Reconcile copies the documents of the source database, written to the fallback cluster, to the target.
+// The documents and the contents keep their IDs and are only inserted, the bucket lines are pushed into the buckets
+// of the target by line ID with the bucket options: copying them again does nothing.
+// The summaries are added to the ones of the target, which list their IDs, then removed from the source. A summary
+// already listed was added by an interrupted run: it is removed without being added again, so that none is added twice
+// nor lost. The target implements SummaryReconciler.
+func Reconcile(ctx context.Context, source *mgo.Database, target Storage, bucket BucketOptions) (ReconcileStats, error) {
+	var stats ReconcileStats
+
+	names, err := source.CollectionNames()
+	if err != nil {
+		return stats, fmt.Errorf("list collections: %w", err)
+	}
+
+	for _, name := range names {
+		if err := ctx.Err(); err != nil {
+			return stats, err
+		}
+
+		switch {
+		case strings.HasPrefix(name, "system."), strings.HasSuffix(name, gridFSChunks):
+			continue
+		case strings.HasSuffix(name, ContentSuffix+gridFSFiles):
+			err = reconcileContents(ctx, source, strings.TrimSuffix(name, gridFSFiles), target, &stats)
+		case strings.HasSuffix(name, SummaryCollectionSuffix):
+			err = reconcileSummaries(ctx, source.C(name), target, &stats)
+		case strings.HasSuffix(name, BucketCollectionSuffix):
+			err = reconcileBuckets(ctx, source.C(name), target, bucket, &stats)
+		default:
+			err = reconcileDocuments(ctx, source.C(name), target, &stats)
+		}
+
+		if err != nil {
+			return stats, fmt.Errorf("reconcile %s: %w", name, err)
+		}
+
+		stats.Collections++
+	}
+
+	return stats, nil
+}
+
+// createLike creates the collection in the target with the indexes of the source collection.
+func createLike(collection *mgo.Collection, target Storage) error {
+	if err := target.CreateCollection(collection.Name); err != nil {
+		return err
+	}
+
+	indexes, err := collection.Indexes()
+	if err != nil {
+		return fmt.Errorf("list indexes: %w", err)
+	}
+
+	for _, index := range indexes {
+		if len(index.Key) == 1 && index.Key[0] == "_id" {
+			continue
+		}
+
+		if err := target.EnsureIndex(collection.Name, index.Key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func reconcileDocuments(ctx context.Context, collection *mgo.Collection, target Storage, stats *ReconcileStats) error {
+	if err := createLike(collection, target); err != nil {
+		return err
+	}
+
+	iter := collection.Find(nil).Iter()
+
+	var doc bson.D
+	for iter.Next(&doc) {
+		if err := ctx.Err(); err != nil {
+			_ = iter.Close()
+
+			return err
+		}
+
+		inserted, err := target.Write(collection.Name, WriteInsert, []Document{{Id: doc.Map()["_id"], Doc: doc}})
+		if err != nil {
+			_ = iter.Close()
+
+			return err
+		}
+
+		if inserted[0] {
+			stats.Documents++
+		}
+
+		doc = nil
+	}
+
+	return iter.Close()
+}
+
+// reconciledLine is a line of a bucket of the source, pushed into the buckets of the target.
+type reconciledLine struct {
+	LogDocument
+	key bson.D
+}
+
+func (l *reconciledLine) Indexes() [][]string {
+	return nil
+}
+
+func (l *reconciledLine) ExecutionKey() bson.D {
+	return l.key
+}
+
+func (l *reconciledLine) ExecutionMetadata() bson.M {
+	return bson.M{}
+}
+
+func newReconciledLine(bucket bson.M, key bson.D, line BucketLine) *reconciledLine {
+	asString := func(name string) string {
+		value, _ := bucket[name].(string)
+
+		return value
+	}
+
+	return &reconciledLine{
+		LogDocument: LogDocument{
+			Id:         line.Id,
+			Log:        line.Log,
+			Stream:     line.Stream,
+			Time:       line.Time,
+			ProjectId:  asString(ProjectIDKey),
+			Customer:   asString(CustomerKey),
+			PlatformId: asString(PlatformIDKey),
+
+			Level:   line.Level,
+			Fields:  line.Fields,
+			Cluster: line.Cluster,
+
+			OriginalSize: line.OriginalSize,
+			Part:         line.Part,
+			Parts:        line.Parts,
+			ContentId:    line.ContentId,
+
+			LogData: line.LogData,
+			Codec:   line.Codec,
+
+			Ciphertext: line.Ciphertext,
+			KeyId:      line.KeyId,
+		},
+		key: key,
+	}
+}
+
+// reconcileBuckets pushes the lines of the buckets of the source into the buckets of the target, the lines the target
+// already stores are skipped.
+func reconcileBuckets(ctx context.Context, collection *mgo.Collection, target Storage, options BucketOptions, stats *ReconcileStats) error {
+	if err := createLike(collection, target); err != nil {
+		return err
+	}
+
+	iter := collection.Find(nil).Iter()
+
+	var doc bson.D
+	for iter.Next(&doc) {
+		// The execution key selects the buckets of the target
+		var key bson.D
+		for _, elem := range doc {
+			if _, ok := bucketFields[elem.Name]; !ok {
+				key = append(key, elem)
+			}
+		}
+
+		var bucket Bucket
+
+		raw, err := bson.Marshal(doc)
+		if err == nil {
+			err = bson.Unmarshal(raw, &bucket)
+		}
+
+		if err != nil {
+			_ = iter.Close()
+
+			return fmt.Errorf("read bucket %v: %w", doc.Map()["_id"], err)
+		}
+
+		for _, line := range bucket.Lines {
+			if err := ctx.Err(); err != nil {
+				_ = iter.Close()
+
+				return err
+			}
+
+			inserted, err := target.PushLine(collection.Name, newReconciledLine(doc.Map(), key, line), options)
+			if err != nil {
+				_ = iter.Close()
+
+				return err
+			}
+
+			if inserted {
+				stats.Documents++
+			}
+		}
+
+		doc = nil
+	}
+
+	return iter.Close()
+}
+
+func reconcileSummaries(ctx context.Context, collection *mgo.Collection, target Storage, stats *ReconcileStats) error {
+	reconciler, ok := target.(SummaryReconciler)
+	if !ok {
+		return fmt.Errorf("%T does not reconcile summaries", target)
+	}
+
+	if err := createLike(collection, target); err != nil {
+		return err
+	}
+
+	iter := collection.Find(nil).Iter()
+
+	var doc bson.D
+	for iter.Next(&doc) {
+		if err := ctx.Err(); err != nil {
+			_ = iter.Close()
+
+			return err
+		}
+
+		// The execution key and the values set on insert select the summary of the target
+		var key bson.D
+		for _, elem := range doc {
+			if _, ok := summaryFields[elem.Name]; !ok {
+				key = append(key, elem)
+			}
+		}
+
+		values := doc.Map()
+
+		summary := Summary{
+			FirstTime:   asTime(values[SummaryFirstTimeKey]),
+			LastTime:    asTime(values[SummaryLastTimeKey]),
+			LineCount:   asInt(values[SummaryLineCountKey]),
+			StderrCount: asInt(values[SummaryStderrCountKey]),
+			Bytes:       asInt(values[SummaryBytesKey]),
+		}
+
+		added, err := reconciler.ReconcileSummary(collection.Name, key, summary, key.Map(), values["_id"])
+		if err != nil {
+			_ = iter.Close()
+
+			return err
+		}
+
+		if err := collection.RemoveId(values["_id"]); err != nil {
+			_ = iter.Close()
+
+			return fmt.Errorf("remove summary %v: %w", values["_id"], err)
+		}
+
+		if added {
+			stats.Summaries++
+		} else {
+			stats.Interrupted++
+		}
+
+		doc = nil
+	}
+
+	return iter.Close()
+}
+
+func reconcileContents(ctx context.Context, source *mgo.Database, prefix string, target Storage, stats *ReconcileStats) error {
+	gridFS := source.GridFS(prefix)
+	iter := gridFS.Find(nil).Iter()
+
+	var file *mgo.GridFile
+	for gridFS.OpenNext(iter, &file) {
+		if err := ctx.Err(); err != nil {
+			_ = file.Close()
+			_ = iter.Close()
+
+			return err
+		}
+
+		id, ok := file.Id().(bson.ObjectId)
+		if !ok {
+			continue
+		}
+
+		content, err := io.ReadAll(file)
+		if err != nil {
+			_ = file.Close()
+			_ = iter.Close()
+
+			return fmt.Errorf("read %s: %w", id.Hex(), err)
+		}
+
+		if err := target.SaveContent(prefix, id, content); err != nil {
+			_ = file.Close()
+			_ = iter.Close()
+
+			return err
+		}
+
+		stats.Contents++
+	}
+
+	return iter.Close()
+}
+
+func asTime(value interface{}) time.Time {
+	t, _ := value.(time.Time)
+
+	return t
+}
+
+func asInt(value interface{}) int {
+	switch v := value.(type) {
+	case int:
+		return v
+	case int64:
+		return int(v)
+	case float64:
+		return int(v)
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,197 @@
+package mongo_test
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/saagie/fluent-bit-mongo/pkg/entry"
+	"github.com/saagie/fluent-bit-mongo/pkg/entry/mongo"
+)
+
+// lostAcknowledgement adds the summaries, then fails as if the connection was lost before the acknowledgement.
+type lostAcknowledgement struct {
+	mongo.Storage
+}
+
+func (s lostAcknowledgement) ReconcileSummary(collection string, key bson.D, summary mongo.Summary, onInsert bson.M, id interface{}) (bool, error) {
+	if _, err := s.Storage.(mongo.SummaryReconciler).ReconcileSummary(collection, key, summary, onInsert, id); err != nil {
+		return false, err
+	}
+
+	return false, errors.New("connection lost")
+}
+
+var _ = Describe("Reconcile", func() {
+	const database = "fluent_bit_mongo_reconcile"
+	const collection = "customer_platformID_projectID"
+
+	record := func(log string) map[interface{}]interface{} {
+		return map[interface{}]interface{}{
+			mongo.LogKey:            stringEntry(log),
+			mongo.StreamKey:         stringEntry("stdout"),
+			mongo.TimeKey:           stringEntry("2022-06-08T09:56:36.123456789Z"),
+			mongo.JobExecutionIDKey: stringEntry("job1"),
+			mongo.ProjectIDKey:      stringEntry("projectID"),
+			mongo.CustomerKey:       stringEntry("customer"),
+			mongo.PlatformIDKey:     stringEntry("platformID"),
+		}
+	}
+
+	// write writes the records to the session, playing the fallback cluster
+	write := func(ctx context.Context, session *mgo.Session, options mongo.Options, logs ...string) {
+		p := mongo.New(mongo.NewSessionStorage(session, mongo.NewIndexRegistry(), options.Session), options)
+		for _, log := range logs {
+			Expect(p.ProcessRecord(ctx, time.Now(), record(log))).To(Succeed())
+		}
+		Expect(entry.FlushNext(ctx, p)).To(Succeed())
+	}
+
+	fallbackOptions := func() mongo.Options {
+		options := mongo.DefaultOptions()
+		options.Cluster = mongo.ClusterFallback
+		options.Summary = true
+
+		return options
+	}
+
+	It("Should copy the documents of the fallback cluster once", func() {
+		ctx := loggerContext()
+
+		session := localMongod().Dial(database)
+		defer session.Close()
+
+		options := fallbackOptions()
+		write(ctx, session, options, "hello")
+
+		target := mongo.NewMemoryStorage()
+
+		stats, err := mongo.Reconcile(ctx, session.DB(""), target, options.Bucket)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(stats.Documents).To(Equal(1))
+		Expect(stats.Summaries).To(Equal(1))
+
+		docs := target.Documents(collection)
+		Expect(docs).To(HaveLen(1))
+		Expect(docs[0]).To(ContainElement(bson.DocElem{Name: "cluster", Value: mongo.ClusterFallback}))
+
+		stats, err = mongo.Reconcile(ctx, session.DB(""), target, options.Bucket)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(stats.Documents).To(BeZero())
+		Expect(stats.Summaries).To(BeZero())
+	})
+
+	It("Should merge the bucket lines by ID", func() {
+		ctx := loggerContext()
+
+		session := localMongod().Dial(database)
+		defer session.Close()
+
+		options := fallbackOptions()
+		options.Layout = mongo.LayoutBucket
+		write(ctx, session, options, "hello", "world")
+
+		const buckets = collection + mongo.BucketCollectionSuffix
+
+		// A run interrupted after pushing a line of the bucket
+		target := mongo.NewMemoryStorage()
+		Expect(target.CreateCollection(buckets)).To(Succeed())
+
+		var bucket mongo.Bucket
+		Expect(session.DB("").C(buckets).Find(nil).One(&bucket)).To(Succeed())
+
+		doc, err := mongo.Convert(ctx, time.Now(), record("hello"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(doc.GetID()).To(Equal(bucket.Lines[0].Id))
+		doc.GetLogDocument().Cluster = mongo.ClusterFallback
+
+		inserted, err := target.PushLine(buckets, doc, options.Bucket)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(inserted).To(BeTrue())
+
+		stats, err := mongo.Reconcile(ctx, session.DB(""), target, options.Bucket)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(stats.Documents).To(Equal(1))
+		Expect(stats.Summaries).To(Equal(1))
+
+		lines := target.Buckets(buckets)
+		Expect(lines).To(HaveLen(1))
+		Expect(lines[0].Count).To(Equal(2))
+	})
+
+	DescribeTable("Should add each summary once when a run is interrupted", func(driver mongo.Driver) {
+		const targetDatabase = database + "_target"
+		const summaries = collection + mongo.SummaryCollectionSuffix
+
+		ctx := loggerContext()
+		m := localMongod()
+
+		session := m.Dial(database)
+		defer session.Close()
+
+		targetSession := m.Dial(targetDatabase)
+		defer targetSession.Close()
+
+		connector := mongo.NewConnector(driver, &mgo.DialInfo{
+			Addrs:    []string{m.Address},
+			Database: targetDatabase,
+			Timeout:  10 * time.Second,
+		}, mongo.DefaultOptions().Session, mongo.NewIndexRegistry())
+		defer connector.Close()
+
+		target, err := connector.Connect(ctx)
+		Expect(err).ToNot(HaveOccurred())
+		defer target.Close()
+
+		options := fallbackOptions()
+		write(ctx, session, options, "hello", "world")
+
+		stored := func() bson.M {
+			var summary bson.M
+			Expect(targetSession.DB("").C(summaries).Find(nil).One(&summary)).To(Succeed())
+			Expect(targetSession.DB("").C(summaries).Count()).To(Equal(1))
+
+			return summary
+		}
+
+		By("Interrupting a run once the summary is added", func() {
+			_, err := mongo.Reconcile(ctx, session.DB(""), lostAcknowledgement{Storage: target}, options.Bucket)
+			Expect(err).To(MatchError(ContainSubstring("connection lost")))
+
+			Expect(stored()).To(HaveKeyWithValue(mongo.SummaryLineCountKey, BeNumerically("==", 2)))
+			Expect(session.DB("").C(summaries).Count()).To(Equal(1))
+		})
+
+		By("Removing the summary already added", func() {
+			stats, err := mongo.Reconcile(ctx, session.DB(""), target, options.Bucket)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(stats.Summaries).To(BeZero())
+			Expect(stats.Interrupted).To(Equal(1))
+
+			Expect(stored()).To(HaveKeyWithValue(mongo.SummaryLineCountKey, BeNumerically("==", 2)))
+			Expect(session.DB("").C(summaries).Count()).To(BeZero())
+		})
+
+		By("Adding the summaries written since", func() {
+			write(ctx, session, options, "again")
+
+			stats, err := mongo.Reconcile(ctx, session.DB(""), target, options.Bucket)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(stats.Summaries).To(Equal(1))
+			Expect(stats.Interrupted).To(BeZero())
+
+			summary := stored()
+			Expect(summary).To(HaveKeyWithValue(mongo.SummaryLineCountKey, BeNumerically("==", 3)))
+			Expect(summary).To(HaveKeyWithValue(mongo.SummaryReconciledKey, HaveLen(2)))
+		})
+	},
+		Entry("mgo", mongo.DriverMgo),
+		Entry("official driver", mongo.DriverOfficial),
+	)
+})
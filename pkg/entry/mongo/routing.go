@@ -0,0 +1,257 @@
+package mongo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/saagie/fluent-bit-mongo/pkg/entry"
+	"github.com/saagie/fluent-bit-mongo/pkg/log"
+	"github.com/saagie/fluent-bit-mongo/pkg/parse"
+)
+
+// Route is the destination of the records of a customer and platform.
+// The empty route is the default database of the cluster of the instance.
+type Route struct {
+	// Database is the database of the documents, the default one when empty.
+	Database string `json:"database"`
+	// Profile names the connection of the cluster, the cluster of the instance when empty.
+	Profile string `json:"profile"`
+}
+
+type routingRule struct {
+	// Customer and PlatformID are path.Match patterns such as "acme-*", empty matches any.
+	Customer   string `json:"customer"`
+	PlatformID string `json:"platform_id"`
+	Route
+}
+
+func (r routingRule) matches(customer, platformID string) bool {
+	return match(r.Customer, customer) && match(r.PlatformID, platformID)
+}
+
+func match(pattern, value string) bool {
+	if pattern == "" {
+		return true
+	}
+
+	// The patterns are checked when the table is read
+	matched, _ := path.Match(pattern, value)
+
+	return matched
+}
+
+// RoutingTable routes the records by customer and platform, it is read from a JSON file written as
+// [{"customer": "<pattern>", "platform_id": "<pattern>", "database": "<database>", "profile": "<profile>"}].
+// The rules are tried in order, the records matching none keep the empty route.
+type RoutingTable struct {
+	path     string
+	profiles map[string]bool
+
+	lock    sync.RWMutex
+	modTime time.Time
+	rules   []routingRule
+}
+
+// ParseRoutingTable reads the rules of the table, their profiles must be among the given ones.
+func ParseRoutingTable(data []byte, profiles []string) (*RoutingTable, error) {
+	var rules []routingRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("parse routing table: %w", err)
+	}
+
+	known := make(map[string]bool, len(profiles))
+	for _, profile := range profiles {
+		known[profile] = true
+	}
+
+	for i, rule := range rules {
+		for _, pattern := range []string{rule.Customer, rule.PlatformID} {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("rule %d: pattern %q: %w", i+1, pattern, err)
+			}
+		}
+
+		if rule.Route == (Route{}) {
+			return nil, fmt.Errorf("rule %d: no database nor profile", i+1)
+		}
+
+		if rule.Profile != "" && !known[rule.Profile] {
+			return nil, fmt.Errorf("rule %d: unknown profile %q", i+1, rule.Profile)
+		}
+	}
+
+	return &RoutingTable{profiles: known, rules: rules}, nil
+}
+
+func LoadRoutingTable(path string, profiles []string) (*RoutingTable, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("stat routing table: %w", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read routing table: %w", err)
+	}
+
+	table, err := ParseRoutingTable(data, profiles)
+	if err != nil {
+		return nil, err
+	}
+
+	table.path = path
+	table.modTime = info.ModTime()
+
+	return table, nil
+}
+
+// Refresh reads the routing table file again when it was modified, so that tenants can be moved without restart.
+// The current rules are kept when the file cannot be read.
+func (t *RoutingTable) Refresh() (bool, error) {
+	if t.path == "" {
+		return false, nil
+	}
+
+	info, err := os.Stat(t.path)
+	if err != nil {
+		return false, fmt.Errorf("stat routing table: %w", err)
+	}
+
+	t.lock.RLock()
+	modified := !info.ModTime().Equal(t.modTime)
+	t.lock.RUnlock()
+
+	if !modified {
+		return false, nil
+	}
+
+	profiles := make([]string, 0, len(t.profiles))
+	for profile := range t.profiles {
+		profiles = append(profiles, profile)
+	}
+
+	loaded, err := LoadRoutingTable(t.path, profiles)
+	if err != nil {
+		return false, err
+	}
+
+	t.lock.Lock()
+	t.rules, t.modTime = loaded.rules, loaded.modTime
+	t.lock.Unlock()
+
+	return true, nil
+}
+
+// Route returns the route of the first rule matching the customer and the platform.
+func (t *RoutingTable) Route(customer, platformID string) Route {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	for _, rule := range t.rules {
+		if rule.matches(customer, platformID) {
+			return rule.Route
+		}
+	}
+
+	return Route{}
+}
+
+// RouteOpener returns the storage of the route for the flush.
+type RouteOpener func(ctx context.Context, route Route) (Storage, error)
+
+// router hands the records to a processor per route.
+type router struct {
+	table   *RoutingTable
+	open    RouteOpener
+	options Options
+
+	routes     []Route
+	processors map[Route]entry.Processor
+}
+
+// NewRouter returns a processor routing the records with the table, each route is written by its own processor.
+// The storages are opened on the first record of their route.
+func NewRouter(table *RoutingTable, open RouteOpener, options Options) entry.Processor {
+	return &router{
+		table:      table,
+		open:       open,
+		options:    options,
+		processors: map[Route]entry.Processor{},
+	}
+}
+
+func (r *router) ProcessRecord(ctx context.Context, ts time.Time, record map[interface{}]interface{}) error {
+	// The records without identifiers keep the empty route, their processor reports them
+	customer, _ := parse.ExtractStringValue(record, CustomerKey)
+	platformID, _ := parse.ExtractStringValue(record, PlatformIDKey)
+
+	route := r.table.Route(customer, platformID)
+
+	processor, ok := r.processors[route]
+	if !ok {
+		storage, err := r.open(ctx, route)
+		if err != nil {
+			return fmt.Errorf("open route %+v: %w", route, err)
+		}
+
+		options := r.options
+		options.Destination = route.Profile + "/" + route.Database
+
+		processor = New(storage, options)
+		r.processors[route] = processor
+		r.routes = append(r.routes, route)
+	}
+
+	return processor.ProcessRecord(ctx, ts, record)
+}
+
+// Flush flushes the processors of the routes, then reads the routing table again when modified for the next chunks.
+func (r *router) Flush(ctx context.Context) error {
+	var errs entry.Errors
+
+	for _, route := range r.routes {
+		err := entry.FlushNext(ctx, r.processors[route])
+
+		// The clusters of the profiles are not the cluster of the flush
+		if err != nil && route.Profile != "" {
+			err = &ErrSecondary{Cause: fmt.Errorf("profile %s: %w", route.Profile, err)}
+		}
+
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if err := r.refresh(ctx); err != nil {
+		errs = append(errs, err)
+	}
+
+	return errs.Err()
+}
+
+func (r *router) refresh(ctx context.Context) error {
+	logger, err := log.GetLogger(ctx)
+	if err != nil {
+		return fmt.Errorf("get logger: %w", err)
+	}
+
+	refreshed, err := r.table.Refresh()
+	if err != nil {
+		logger.Error("Failed to read the routing table, keeping the current routes", map[string]interface{}{
+			"error": err,
+		})
+
+		return nil
+	}
+
+	if refreshed {
+		logger.Info("Routing table read again", nil)
+	}
+
+	return nil
+}
@@ -0,0 +1,122 @@
+package mongo_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	"github.com/saagie/fluent-bit-mongo/pkg/entry"
+	"github.com/saagie/fluent-bit-mongo/pkg/entry/mongo"
+)
+
+var _ = Describe("Routing", func() {
+	const rules = `[
+		{"customer": "acme", "platform_id": "prod-*", "database": "acme_prod", "profile": "dedicated"},
+		{"customer": "acme", "database": "acme"},
+		{"platform_id": "eu-?", "profile": "dedicated"}
+	]`
+
+	DescribeTable("Route", func(customer, platformID string, expected mongo.Route) {
+		table, err := mongo.ParseRoutingTable([]byte(rules), []string{"dedicated"})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(table.Route(customer, platformID)).To(Equal(expected))
+	},
+		Entry("first rule matching", "acme", "prod-1", mongo.Route{Database: "acme_prod", Profile: "dedicated"}),
+		Entry("any platform", "acme", "dev", mongo.Route{Database: "acme"}),
+		Entry("any customer", "other", "eu-1", mongo.Route{Profile: "dedicated"}),
+		Entry("no rule matching", "other", "us-1", mongo.Route{}),
+	)
+
+	DescribeTable("Invalid table", func(data string) {
+		_, err := mongo.ParseRoutingTable([]byte(data), []string{"dedicated"})
+		Expect(err).To(HaveOccurred())
+	},
+		Entry("not json", `{`),
+		Entry("bad pattern", `[{"customer": "[acme", "database": "acme"}]`),
+		Entry("no destination", `[{"customer": "acme"}]`),
+		Entry("unknown profile", `[{"customer": "acme", "profile": "shared"}]`),
+	)
+
+	It("Should read the file again when modified", func() {
+		dir, err := os.MkdirTemp("", "routing")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(dir)
+
+		path := filepath.Join(dir, "routes.json")
+		Expect(os.WriteFile(path, []byte(`[{"customer": "acme", "database": "acme"}]`), 0o600)).To(Succeed())
+
+		table, err := mongo.LoadRoutingTable(path, nil)
+		Expect(err).ToNot(HaveOccurred())
+
+		refreshed, err := table.Refresh()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(refreshed).To(BeFalse())
+
+		Expect(os.WriteFile(path, []byte(`[{"customer": "acme", "database": "acme_v2"}]`), 0o600)).To(Succeed())
+		Expect(os.Chtimes(path, time.Now(), time.Now().Add(time.Minute))).To(Succeed())
+
+		refreshed, err = table.Refresh()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(refreshed).To(BeTrue())
+		Expect(table.Route("acme", "prod")).To(Equal(mongo.Route{Database: "acme_v2"}))
+
+		// The current rules are kept
+		Expect(os.WriteFile(path, []byte(`[{"customer": "acme", "profile": "unknown"}]`), 0o600)).To(Succeed())
+		Expect(os.Chtimes(path, time.Now(), time.Now().Add(2*time.Minute))).To(Succeed())
+
+		_, err = table.Refresh()
+		Expect(err).To(HaveOccurred())
+		Expect(table.Route("acme", "prod")).To(Equal(mongo.Route{Database: "acme_v2"}))
+	})
+
+	It("Should write the records of each route to its storage", func() {
+		ctx := loggerContext()
+
+		table, err := mongo.ParseRoutingTable([]byte(`[{"customer": "acme", "database": "acme"}]`), nil)
+		Expect(err).ToNot(HaveOccurred())
+
+		storage := mongo.NewMemoryStorage()
+		var opened []mongo.Route
+
+		options := mongo.DefaultOptions()
+		options.Summary = true
+
+		p := mongo.NewRouter(table, func(_ context.Context, route mongo.Route) (mongo.Storage, error) {
+			opened = append(opened, route)
+
+			return storage.Database(route.Database), nil
+		}, options)
+
+		record := func(customer, log string) map[interface{}]interface{} {
+			return map[interface{}]interface{}{
+				mongo.LogKey:            stringEntry(log),
+				mongo.StreamKey:         stringEntry("stdout"),
+				mongo.TimeKey:           stringEntry("2022-06-08T09:56:36.123456789Z"),
+				mongo.JobExecutionIDKey: stringEntry("job1"),
+				mongo.ProjectIDKey:      stringEntry("projectID"),
+				mongo.CustomerKey:       stringEntry(customer),
+				mongo.PlatformIDKey:     stringEntry("platformID"),
+			}
+		}
+
+		for _, r := range []map[interface{}]interface{}{record("acme", "hello"), record("other", "hello"), record("acme", "world")} {
+			Expect(p.ProcessRecord(ctx, time.Now(), r)).To(Succeed())
+		}
+
+		Expect(entry.FlushNext(ctx, p)).To(Succeed())
+
+		Expect(opened).To(Equal([]mongo.Route{{Database: "acme"}, {}}))
+
+		acme := storage.Database("acme").(*mongo.MemoryStorage)
+		Expect(acme.Documents("acme_platformID_projectID")).To(HaveLen(2))
+		Expect(acme.Collections()).To(ContainElement("acme_platformID_projectID" + mongo.SummaryCollectionSuffix))
+
+		Expect(storage.Collections()).ToNot(ContainElement("acme_platformID_projectID"))
+		Expect(storage.Documents("other_platformID_projectID")).To(HaveLen(1))
+	})
+})
@@ -0,0 +1,206 @@
+package mongo
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	mgo "gopkg.in/mgo.v2"
+)
+
+var ErrSessionPoolClosed = errors.New("session pool closed")
+
+// SessionOptions bound the time spent waiting for mongo and set the durability of the writes.
+type SessionOptions struct {
+	// SocketTimeout is the time allowed to each operation on a connection.
+	SocketTimeout time.Duration
+	// SyncTimeout is the time allowed to reach a server, such as the primary during an election.
+	SyncTimeout time.Duration
+
+	// WriteConcern is the number of servers acknowledging the writes, or a mode such as majority.
+	// The server default applies when empty, the writes are not acknowledged when 0.
+	WriteConcern string
+	// Journal waits for the writes to be journaled.
+	Journal bool
+	// WTimeout is the time allowed to satisfy the write concern, there is no limit when zero.
+	WTimeout time.Duration
+
+	// TLS encrypts the connections when set.
+	TLS *tls.Config
+}
+
+// Unacknowledged reports whether the writes are not acknowledged.
+func (o SessionOptions) Unacknowledged() bool {
+	return o.WriteConcern == "0"
+}
+
+// Safe returns the safety mode of the sessions, nil when the writes are not acknowledged.
+func (o SessionOptions) Safe() *mgo.Safe {
+	if o.Unacknowledged() {
+		return nil
+	}
+
+	safe := &mgo.Safe{
+		J:        o.Journal,
+		WTimeout: int(o.WTimeout / time.Millisecond),
+	}
+
+	if w, err := strconv.Atoi(o.WriteConcern); err == nil {
+		safe.W = w
+	} else {
+		safe.WMode = o.WriteConcern
+	}
+
+	return safe
+}
+
+func (o SessionOptions) Validate() error {
+	if o.SocketTimeout <= 0 {
+		return errors.New("socket timeout must be positive")
+	}
+
+	if o.SyncTimeout <= 0 {
+		return errors.New("sync timeout must be positive")
+	}
+
+	if w, err := strconv.Atoi(o.WriteConcern); err == nil && w < 0 {
+		return errors.New("write concern must not be negative")
+	}
+
+	if o.Unacknowledged() && o.Journal {
+		return errors.New("journaled writes must be acknowledged")
+	}
+
+	if o.WTimeout < 0 {
+		return errors.New("wtimeout must not be negative")
+	}
+
+	if o.WTimeout > 0 && o.WTimeout < time.Millisecond {
+		return errors.New("wtimeout must be at least a millisecond")
+	}
+
+	return nil
+}
+
+// writeConcernFailed is the code of the write concern errors, such as a wtimeout.
+const writeConcernFailed = 64
+
+// IsWriteConcernTimeout reports whether the error is a write concern not satisfied in time.
+// The write was applied by the primary, it is safe to retry since the documents are written by ID.
+func IsWriteConcernTimeout(err error) bool {
+	if isClientWriteConcernTimeout(err) {
+		return true
+	}
+
+	var lastError *mgo.LastError
+	if !errors.As(err, &lastError) {
+		return false
+	}
+
+	return lastError.WTimeout || lastError.Code == writeConcernFailed
+}
+
+// untilDeadline returns the timeout shortened to the deadline of the context.
+func untilDeadline(ctx context.Context, timeout time.Duration) time.Duration {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return timeout
+	}
+
+	remaining := time.Until(deadline)
+	if remaining <= 0 {
+		// A zero timeout would wait forever
+		return time.Millisecond
+	}
+
+	if timeout <= 0 || remaining < timeout {
+		return remaining
+	}
+
+	return timeout
+}
+
+// CopySession returns a copy of the session whose operations time out at the deadline of the context at the latest.
+func CopySession(ctx context.Context, session *mgo.Session, options SessionOptions) *mgo.Session {
+	copied := session.Copy()
+	copied.SetSocketTimeout(untilDeadline(ctx, options.SocketTimeout))
+	copied.SetSyncTimeout(untilDeadline(ctx, options.SyncTimeout))
+
+	return copied
+}
+
+// SessionPool holds the connection of an instance to mongo, it dials mongo on first use.
+// The flushes of the instance get copies of the session sharing its connections.
+type SessionPool struct {
+	dialInfo *mgo.DialInfo
+	options  SessionOptions
+	dial     func(*mgo.DialInfo) (*mgo.Session, error)
+
+	lock   sync.Mutex
+	root   *mgo.Session
+	closed bool
+}
+
+func NewSessionPool(dialInfo *mgo.DialInfo, options SessionOptions) *SessionPool {
+	return &SessionPool{
+		dialInfo: dialInfo,
+		options:  options,
+		dial:     mgo.DialWithInfo,
+	}
+}
+
+// Get returns a copy of the instance session bound to the deadline of the context, the caller closes it.
+// A failed dial is tried again by the next call.
+func (p *SessionPool) Get(ctx context.Context) (*mgo.Session, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.closed {
+		return nil, ErrSessionPoolClosed
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if p.root == nil {
+		dialInfo := *p.dialInfo
+		dialInfo.Timeout = untilDeadline(ctx, p.options.SyncTimeout)
+		if p.options.TLS != nil && dialInfo.DialServer == nil {
+			dialInfo.DialServer = tlsDialer(p.options.TLS, dialInfo.Timeout)
+		}
+
+		// mgo checks the credentials against the database when there is no source, like ClientOptions
+		if dialInfo.Source == "" && AuthMechanism(dialInfo.Mechanism).External() {
+			dialInfo.Source = ExternalSource
+		}
+
+		session, err := p.dial(&dialInfo)
+		if err != nil {
+			return nil, fmt.Errorf("dial %v: %w", p.dialInfo.Addrs, err)
+		}
+
+		session.SetSafe(p.options.Safe())
+
+		p.root = session
+	}
+
+	return CopySession(ctx, p.root, p.options), nil
+}
+
+// Close closes the instance session, the copies still in use keep working until closed.
+func (p *SessionPool) Close() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.root != nil {
+		p.root.Close()
+		p.root = nil
+	}
+
+	p.closed = true
+}
@@ -0,0 +1,140 @@
+package mongo_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	driver "go.mongodb.org/mongo-driver/mongo"
+	mgo "gopkg.in/mgo.v2"
+
+	"github.com/saagie/fluent-bit-mongo/pkg/entry/mongo"
+)
+
+var _ = Describe("Session pool", func() {
+	var pool *mongo.SessionPool
+
+	BeforeEach(func() {
+		pool = mongo.NewSessionPool(&mgo.DialInfo{
+			Addrs: []string{"127.0.0.1:1"},
+		}, mongo.SessionOptions{
+			SocketTimeout: time.Second,
+			SyncTimeout:   50 * time.Millisecond,
+		})
+	})
+
+	It("Should dial again after a failure", func() {
+		_, err := pool.Get(context.TODO())
+		Expect(err).To(MatchError(ContainSubstring("dial [127.0.0.1:1]")))
+
+		_, err = pool.Get(context.TODO())
+		Expect(err).To(MatchError(ContainSubstring("dial [127.0.0.1:1]")))
+	})
+
+	DescribeTable("Authentication source", func(mechanism mongo.AuthMechanism, source, expected string) {
+		pool = mongo.NewSessionPool(&mgo.DialInfo{
+			Addrs:     []string{"127.0.0.1:1"},
+			Mechanism: string(mechanism),
+			Username:  "user",
+			Source:    source,
+		}, mongo.SessionOptions{})
+
+		var dialed *mgo.DialInfo
+		pool.SetDial(func(info *mgo.DialInfo) (*mgo.Session, error) {
+			dialed = info
+
+			return nil, errors.New("unreachable")
+		})
+
+		_, err := pool.Get(context.TODO())
+		Expect(err).To(HaveOccurred())
+		Expect(dialed.Source).To(Equal(expected))
+	},
+		Entry("x509", mongo.AuthX509, "", mongo.ExternalSource),
+		Entry("plain", mongo.AuthPlain, "", mongo.ExternalSource),
+		Entry("scram", mongo.AuthScramSHA1, "", ""),
+		Entry("explicit source", mongo.AuthScramSHA1, "admin", "admin"),
+	)
+
+	It("Should refuse sessions once closed", func() {
+		pool.Close()
+		pool.Close()
+
+		_, err := pool.Get(context.TODO())
+		Expect(err).To(MatchError(mongo.ErrSessionPoolClosed))
+	})
+
+	It("Should stop dialing at the deadline", func() {
+		pool = mongo.NewSessionPool(&mgo.DialInfo{
+			Addrs: []string{"127.0.0.1:1"},
+		}, mongo.SessionOptions{
+			SocketTimeout: time.Minute,
+			SyncTimeout:   time.Minute,
+		})
+
+		ctx, cancel := context.WithTimeout(context.TODO(), 50*time.Millisecond)
+		defer cancel()
+
+		start := time.Now()
+		_, err := pool.Get(ctx)
+		Expect(err).To(HaveOccurred())
+		Expect(time.Since(start)).To(BeNumerically("<", 5*time.Second))
+
+		Eventually(ctx.Done()).Should(BeClosed())
+		_, err = pool.Get(ctx)
+		Expect(err).To(MatchError(context.DeadlineExceeded))
+	})
+})
+
+var _ = Describe("Session options", func() {
+	options := func(writeConcern string, journal bool, wtimeout time.Duration) mongo.SessionOptions {
+		return mongo.SessionOptions{
+			SocketTimeout: time.Second,
+			SyncTimeout:   time.Second,
+			WriteConcern:  writeConcern,
+			Journal:       journal,
+			WTimeout:      wtimeout,
+		}
+	}
+
+	DescribeTable("Safety mode", func(o mongo.SessionOptions, expected *mgo.Safe) {
+		Expect(o.Validate()).To(Succeed())
+		Expect(o.Safe()).To(Equal(expected))
+	},
+		Entry("server default", options("", false, 0), &mgo.Safe{}),
+		Entry("unacknowledged", options("0", false, 0), nil),
+		Entry("one server", options("1", false, 0), &mgo.Safe{W: 1}),
+		Entry("majority", options("majority", true, 2*time.Second), &mgo.Safe{WMode: "majority", J: true, WTimeout: 2000}),
+	)
+
+	DescribeTable("Invalid options", func(o mongo.SessionOptions) {
+		Expect(o.Validate()).ToNot(Succeed())
+	},
+		Entry("negative write concern", options("-1", false, 0)),
+		Entry("unacknowledged journaled writes", options("0", true, 0)),
+		Entry("negative wtimeout", options("majority", false, -time.Second)),
+		Entry("wtimeout below a millisecond", options("majority", false, time.Microsecond)),
+	)
+
+	It("Should not count unacknowledged writes", func() {
+		o := mongo.DefaultOptions()
+		o.Summary = true
+		o.Session.WriteConcern = "0"
+
+		Expect(o.Validate()).ToNot(Succeed())
+	})
+
+	DescribeTable("Write concern timeout", func(err error, expected bool) {
+		Expect(mongo.IsWriteConcernTimeout(err)).To(Equal(expected))
+	},
+		Entry("legacy wtimeout", &mgo.LastError{WTimeout: true}, true),
+		Entry("write concern error", fmt.Errorf("upsert: %w", &mgo.LastError{Code: 64, Err: "waiting for replication timed out"}), true),
+		Entry("official driver", fmt.Errorf("upsert: %w", driver.WriteException{WriteConcernError: &driver.WriteConcernError{Code: 64}}), true),
+		Entry("duplicate key", &mgo.LastError{Code: 11000}, false),
+		Entry("other error", errors.New("closed"), false),
+	)
+})
@@ -0,0 +1,208 @@
+package mongo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// SessionStorage writes to a database of a mongo session, the default one unless selected with Database.
+type SessionStorage struct {
+	session  *mgo.Session
+	database string
+	indexes  *IndexRegistry
+	options  SessionOptions
+}
+
+var (
+	_ Storage           = &SessionStorage{}
+	_ SummaryReconciler = &SessionStorage{}
+)
+
+// NewSessionStorage returns a storage writing to the session, which it closes when closed.
+// The indexes and the collections are created once per registry, a nil registry creates them every time.
+func NewSessionStorage(session *mgo.Session, indexes *IndexRegistry, options SessionOptions) *SessionStorage {
+	return &SessionStorage{
+		session:  session,
+		database: MongoDefaultDB,
+		indexes:  indexes,
+		options:  options,
+	}
+}
+
+// sessionConnector opens the storages on copies of the session of a pool.
+type sessionConnector struct {
+	pool    *SessionPool
+	indexes *IndexRegistry
+	options SessionOptions
+}
+
+func (c *sessionConnector) Connect(ctx context.Context) (Storage, error) {
+	session, err := c.pool.Get(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewSessionStorage(session, c.indexes, c.options), nil
+}
+
+func (c *sessionConnector) Close() {
+	c.pool.Close()
+}
+
+func (s *SessionStorage) Copy(ctx context.Context) Storage {
+	c := NewSessionStorage(CopySession(ctx, s.session, s.options), s.indexes, s.options)
+	c.database = s.database
+
+	return c
+}
+
+// Database returns a storage on a clone of the session, which shares its socket.
+func (s *SessionStorage) Database(name string) Storage {
+	c := NewSessionStorage(s.session.Clone(), s.indexes, s.options)
+	c.database = name
+
+	return c
+}
+
+func (s *SessionStorage) Close() {
+	s.session.Close()
+}
+
+func (s *SessionStorage) collection(name string) *mgo.Collection {
+	return s.session.DB(s.database).C(name)
+}
+
+func (s *SessionStorage) CreateCollection(collection string) error {
+	return s.indexes.Create(s.collection(collection))
+}
+
+func (s *SessionStorage) EnsureIndex(collection string, key []string) error {
+	return s.indexes.Ensure(s.collection(collection), key...)
+}
+
+// Write writes the documents one by one, so that the documents newly stored are known.
+func (s *SessionStorage) Write(collection string, mode WriteMode, docs []Document) ([]bool, error) {
+	c := s.collection(collection)
+	inserted := make([]bool, 0, len(docs))
+
+	for _, doc := range docs {
+		ok, err := writeDocument(c, doc.Id, doc.Doc, mode)
+		if err != nil {
+			return inserted, err
+		}
+
+		inserted = append(inserted, ok)
+	}
+
+	return inserted, nil
+}
+
+// PushLine pushes the line into a bucket with room left, or else into a new bucket.
+// Both writes are single updates whose selector checks the room and the line, the read before only skips the lines
+// already stored in a full bucket.
+func (s *SessionStorage) PushLine(collection string, doc LogEntry, options BucketOptions) (bool, error) {
+	c := s.collection(collection)
+
+	count, err := c.Find(BucketLineSelector(doc)).Count()
+	if err != nil {
+		return false, fmt.Errorf("find line %s: %w", doc.GetID(), err)
+	}
+
+	if count > 0 {
+		return false, nil
+	}
+
+	err = c.Update(BucketSelector(doc, options), BucketUpdate(doc))
+	if err == nil {
+		return true, nil
+	}
+
+	if !errors.Is(err, mgo.ErrNotFound) {
+		return false, fmt.Errorf("push line %s: %w", doc.GetID(), err)
+	}
+
+	info, err := c.Upsert(BucketLineSelector(doc), NewBucketUpdate(doc, options))
+	if err != nil {
+		return false, fmt.Errorf("push line %s: %w", doc.GetID(), err)
+	}
+
+	return info == nil || info.UpsertedId != nil, nil
+}
+
+// FindBuckets reads the buckets matching the selector, in window order.
+func (s *SessionStorage) FindBuckets(collection string, selector interface{}) ([]Bucket, error) {
+	var buckets []Bucket
+
+	if err := s.collection(collection).Find(selector).Sort(BucketStartKey, "_id").All(&buckets); err != nil {
+		return nil, fmt.Errorf("find buckets: %w", err)
+	}
+
+	return buckets, nil
+}
+
+func (s *SessionStorage) AddSummary(collection string, key bson.D, summary Summary, onInsert bson.M) error {
+	if _, err := s.collection(collection).Upsert(key, SummaryUpdate(summary, onInsert)); err != nil {
+		return fmt.Errorf("upsert summary %v: %w", key, err)
+	}
+
+	return nil
+}
+
+// ReconcileSummary adds the summary unless the summary of the execution lists the ID, like PushLine the read before
+// only skips the summaries already added.
+func (s *SessionStorage) ReconcileSummary(collection string, key bson.D, summary Summary, onInsert bson.M, id interface{}) (bool, error) {
+	c := s.collection(collection)
+
+	count, err := c.Find(ReconciledSummarySelector(key, id, true)).Count()
+	if err != nil {
+		return false, fmt.Errorf("find summary %v: %w", key, err)
+	}
+
+	if count > 0 {
+		return false, nil
+	}
+
+	if _, err := c.Upsert(ReconciledSummarySelector(key, id, false), ReconciledSummaryUpdate(summary, onInsert, id)); err != nil {
+		return false, fmt.Errorf("upsert summary %v: %w", key, err)
+	}
+
+	return true, nil
+}
+
+// SaveContent writes the content to GridFS.
+func (s *SessionStorage) SaveContent(prefix string, id bson.ObjectId, content []byte) error {
+	gridFS := s.session.DB(s.database).GridFS(prefix)
+
+	file, err := gridFS.OpenId(id)
+	if err == nil {
+		return file.Close()
+	}
+
+	if !errors.Is(err, mgo.ErrNotFound) {
+		return fmt.Errorf("open %s: %w", id.Hex(), err)
+	}
+
+	file, err = gridFS.Create(id.Hex())
+	if err != nil {
+		return fmt.Errorf("create %s: %w", id.Hex(), err)
+	}
+
+	file.SetId(id)
+	file.SetContentType("text/plain")
+
+	if _, err := file.Write(content); err != nil {
+		_ = file.Close()
+
+		return fmt.Errorf("write %s: %w", id.Hex(), err)
+	}
+
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("close %s: %w", id.Hex(), err)
+	}
+
+	return nil
+}
@@ -0,0 +1,118 @@
+package mongo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/saagie/fluent-bit-mongo/pkg/entry"
+)
+
+// Driver is the MongoDB client library the storage is built on.
+type Driver string
+
+const (
+	// DriverMgo writes with mgo.v2.
+	DriverMgo Driver = "mgo"
+	// DriverOfficial writes with the official MongoDB Go driver.
+	DriverOfficial Driver = "official"
+)
+
+func ParseDriver(value string) (Driver, error) {
+	switch driver := Driver(value); driver {
+	case DriverMgo, DriverOfficial:
+		return driver, nil
+	default:
+		return "", fmt.Errorf("unknown driver %q", value)
+	}
+}
+
+// Document is a document written by ID.
+type Document struct {
+	Id  interface{}
+	Doc interface{}
+}
+
+// Storage is where the processor writes the documents, SessionStorage writes to mongo and MemoryStorage keeps them in memory.
+type Storage interface {
+	// Copy returns a storage for a concurrent writer, its operations time out at the deadline of the context.
+	// The copy is closed after use.
+	Copy(ctx context.Context) Storage
+	Close()
+	// Database returns a storage writing to the database of the same cluster.
+	// It is closed after use, independently of the storage.
+	Database(name string) Storage
+
+	// CreateCollection creates the collection unless it exists.
+	CreateCollection(collection string) error
+	// EnsureIndex creates the index of the collection unless it exists.
+	EnsureIndex(collection string, key []string) error
+	// Write writes the documents in order with the write mode, it stops at the first error.
+	// It reports, for each document written, whether it was not already stored.
+	Write(collection string, mode WriteMode, docs []Document) ([]bool, error)
+	// PushLine pushes the document line into a bucket of its execution, it reports whether the line was pushed.
+	// Lines already pushed are skipped so that retried chunks are not duplicated.
+	PushLine(collection string, doc LogEntry, options BucketOptions) (bool, error)
+	// AddSummary adds the summary delta to the summary of the execution, onInsert is set when it is created.
+	AddSummary(collection string, key bson.D, summary Summary, onInsert bson.M) error
+	// SaveContent stores the content under the ID unless already stored.
+	SaveContent(prefix string, id bson.ObjectId, content []byte) error
+}
+
+// Connector opens the storages of an instance, it connects to mongo on first use.
+type Connector interface {
+	// Connect returns a storage whose operations time out at the deadline of the context, the caller closes it.
+	// A failed connection is tried again by the next call.
+	Connect(ctx context.Context) (Storage, error)
+	// Close closes the connections of the instance.
+	Close()
+}
+
+// ErrSecondary is the failure of a storage other than the one of the flush, such as a mirror or the cluster of a
+// routing profile. It tells nothing about the storage of the flush.
+type ErrSecondary struct {
+	Cause error
+}
+
+func (err *ErrSecondary) Error() string {
+	return err.Cause.Error()
+}
+
+func (err *ErrSecondary) Unwrap() error {
+	return err.Cause
+}
+
+// PrimaryFailure reports whether the error holds a failure to write to the storage of the flush,
+// that is a retried error which is not an ErrSecondary.
+func PrimaryFailure(err error) bool {
+	var errs entry.Errors
+	if errors.As(err, &errs) {
+		for _, e := range errs {
+			if PrimaryFailure(e) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	var secondary *ErrSecondary
+
+	return errors.Is(err, &entry.ErrRetry{}) && !errors.As(err, &secondary)
+}
+
+// NewConnector returns the connector of the driver, the collections and indexes are created once per registry.
+func NewConnector(driver Driver, dialInfo *mgo.DialInfo, options SessionOptions, indexes *IndexRegistry) Connector {
+	if driver == DriverOfficial {
+		return NewClientPool(dialInfo, options, indexes)
+	}
+
+	return &sessionConnector{
+		pool:    NewSessionPool(dialInfo, options),
+		indexes: indexes,
+		options: options,
+	}
+}
@@ -0,0 +1,266 @@
+package mongo
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// SummaryCollectionSuffix is appended to the document collection name to get the summary collection name.
+const SummaryCollectionSuffix = "_summaries"
+
+const (
+	SummaryFirstTimeKey   = "first_time"
+	SummaryLastTimeKey    = "last_time"
+	SummaryLineCountKey   = "line_count"
+	SummaryStderrCountKey = "stderr_count"
+	SummaryBytesKey       = "bytes"
+	// SummaryReconciledKey lists the IDs of the summaries of the fallback cluster added to the summary by Reconcile.
+	SummaryReconciledKey = "reconciled"
+)
+
+const stderrStream = "stderr"
+
+// Summary holds the figures of an execution, maintained alongside the log lines.
+type Summary struct {
+	FirstTime   time.Time `bson:"first_time"`
+	LastTime    time.Time `bson:"last_time"`
+	LineCount   int       `bson:"line_count"`
+	StderrCount int       `bson:"stderr_count"`
+	Bytes       int       `bson:"bytes"`
+}
+
+func SummaryCollectionName(doc LogEntry) string {
+	return doc.CollectionName() + SummaryCollectionSuffix
+}
+
+func isStderr(stream string) bool {
+	// The stream may be prefixed by the log prefix, see LogDocument.Populate
+	return stream == stderrStream || strings.HasSuffix(stream, "_"+stderrStream)
+}
+
+func summaryID(doc LogEntry) string {
+	return fmt.Sprintf("%s/%v", SummaryCollectionName(doc), doc.ExecutionKey())
+}
+
+type summaryDelta struct {
+	collection string
+	key        bson.D
+	onInsert   bson.M
+	summary    Summary
+}
+
+// Summaries accumulates the summary of the executions of a chunk so that they are written once per flush.
+type Summaries struct {
+	deltas map[string]*summaryDelta
+	order  []string
+}
+
+func NewSummaries() *Summaries {
+	return &Summaries{
+		deltas: map[string]*summaryDelta{},
+	}
+}
+
+// Add accounts a line newly written to the storage.
+// The documents without execution, such as the generic documents, have no summary.
+func (s *Summaries) Add(doc LogEntry) {
+	key := doc.ExecutionKey()
+	if len(key) == 0 {
+		return
+	}
+
+	d := doc.GetLogDocument()
+	collection := SummaryCollectionName(doc)
+	id := summaryID(doc)
+
+	delta, ok := s.deltas[id]
+	if !ok {
+		onInsert := bson.M{
+			ProjectIDKey:  d.ProjectId,
+			CustomerKey:   d.Customer,
+			PlatformIDKey: d.PlatformId,
+		}
+		for k, v := range doc.ExecutionMetadata() {
+			onInsert[k] = v
+		}
+
+		delta = &summaryDelta{
+			collection: collection,
+			key:        key,
+			onInsert:   onInsert,
+		}
+		s.deltas[id] = delta
+		s.order = append(s.order, id)
+	}
+
+	t := d.GetTime()
+	if delta.summary.FirstTime.IsZero() || t.Before(delta.summary.FirstTime) {
+		delta.summary.FirstTime = t
+	}
+	if t.After(delta.summary.LastTime) {
+		delta.summary.LastTime = t
+	}
+
+	delta.summary.Bytes += d.StoredSize()
+
+	// The continuation parts of a split line are not lines of their own
+	if d.Part > 1 {
+		return
+	}
+
+	delta.summary.LineCount++
+	if isStderr(d.Stream) {
+		delta.summary.StderrCount++
+	}
+}
+
+// merge adds the deltas of the other summaries.
+func (s *Summaries) merge(other *Summaries) {
+	for _, id := range other.order {
+		o := other.deltas[id]
+
+		delta, ok := s.deltas[id]
+		if !ok {
+			c := *o
+			s.deltas[id] = &c
+			s.order = append(s.order, id)
+
+			continue
+		}
+
+		if delta.summary.FirstTime.IsZero() || o.summary.FirstTime.Before(delta.summary.FirstTime) {
+			delta.summary.FirstTime = o.summary.FirstTime
+		}
+		if o.summary.LastTime.After(delta.summary.LastTime) {
+			delta.summary.LastTime = o.summary.LastTime
+		}
+
+		delta.summary.LineCount += o.summary.LineCount
+		delta.summary.StderrCount += o.summary.StderrCount
+		delta.summary.Bytes += o.summary.Bytes
+	}
+}
+
+// Get returns the accumulated summary of the document execution.
+func (s *Summaries) Get(doc LogEntry) (Summary, bool) {
+	delta, ok := s.deltas[summaryID(doc)]
+	if !ok {
+		return Summary{}, false
+	}
+
+	return delta.summary, true
+}
+
+// Len returns the number of executions to update.
+func (s *Summaries) Len() int {
+	return len(s.order)
+}
+
+// SummaryUpdate returns the update applying the summary delta to a summary document.
+func SummaryUpdate(summary Summary, onInsert bson.M) bson.M {
+	return bson.M{
+		"$min": bson.M{SummaryFirstTimeKey: summary.FirstTime},
+		"$max": bson.M{SummaryLastTimeKey: summary.LastTime},
+		"$inc": bson.M{
+			SummaryLineCountKey:   summary.LineCount,
+			SummaryStderrCountKey: summary.StderrCount,
+			SummaryBytesKey:       summary.Bytes,
+		},
+		"$setOnInsert": onInsert,
+	}
+}
+
+// SaveTo adds the accumulated summaries to the stored ones.
+// Each summary is removed once added, so that on failure only the summaries left are saved again.
+func (s *Summaries) SaveTo(storage Storage) error {
+	for len(s.order) > 0 {
+		id := s.order[0]
+		delta := s.deltas[id]
+
+		index := make([]string, 0, len(delta.key))
+		for _, elem := range delta.key {
+			index = append(index, elem.Name)
+		}
+
+		if err := storage.CreateCollection(delta.collection); err != nil {
+			return err
+		}
+
+		if err := storage.EnsureIndex(delta.collection, index); err != nil {
+			return err
+		}
+
+		if err := storage.AddSummary(delta.collection, delta.key, delta.summary, delta.onInsert); err != nil {
+			return err
+		}
+
+		delete(s.deltas, id)
+		s.order = s.order[1:]
+	}
+
+	return nil
+}
+
+// SummaryBacklog keeps the summaries which could not be saved until the next flush to the same destination,
+// the processors being created for each flush.
+type SummaryBacklog struct {
+	lock      sync.Mutex
+	summaries map[string]*Summaries
+}
+
+func NewSummaryBacklog() *SummaryBacklog {
+	return &SummaryBacklog{
+		summaries: map[string]*Summaries{},
+	}
+}
+
+// Take removes and returns the summaries kept for the destination, empty ones when none.
+func (b *SummaryBacklog) Take(destination string) *Summaries {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	summaries, ok := b.summaries[destination]
+	if !ok {
+		return NewSummaries()
+	}
+
+	delete(b.summaries, destination)
+
+	return summaries
+}
+
+// Keep adds the summaries to the ones kept for the destination.
+func (b *SummaryBacklog) Keep(destination string, summaries *Summaries) {
+	if summaries.Len() == 0 {
+		return
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	kept, ok := b.summaries[destination]
+	if !ok {
+		b.summaries[destination] = summaries
+
+		return
+	}
+
+	kept.merge(summaries)
+}
+
+// Len returns the number of executions whose summary is kept, all destinations together.
+func (b *SummaryBacklog) Len() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	count := 0
+	for _, summaries := range b.summaries {
+		count += summaries.Len()
+	}
+
+	return count
+}
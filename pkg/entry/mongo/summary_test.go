@@ -0,0 +1,185 @@
+package mongo_test
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/saagie/fluent-bit-mongo/pkg/entry"
+	"github.com/saagie/fluent-bit-mongo/pkg/entry/mongo"
+	"github.com/saagie/fluent-bit-mongo/pkg/log"
+)
+
+// keyedIndexes rejects the indexes without key, like mongo.
+type keyedIndexes struct {
+	*mongo.MemoryStorage
+}
+
+func (s *keyedIndexes) Copy(context.Context) mongo.Storage {
+	return s
+}
+
+func (s *keyedIndexes) EnsureIndex(collection string, key []string) error {
+	if len(key) == 0 {
+		return errors.New("no index key")
+	}
+
+	return s.MemoryStorage.EnsureIndex(collection, key)
+}
+
+var _ = Describe("Summaries", func() {
+	var ctx context.Context
+	var summaries *mongo.Summaries
+
+	start := time.Date(2022, 6, 8, 9, 56, 36, 0, time.UTC)
+
+	jobLine := func(jobExecutionID string, t time.Time, stream, content string) mongo.LogEntry {
+		doc, err := mongo.Convert(ctx, time.Now(), map[interface{}]interface{}{
+			mongo.LogKey:            stringEntry(content),
+			mongo.StreamKey:         stringEntry(stream),
+			mongo.TimeKey:           stringEntry(t.Format(mongo.TimeFormat)),
+			mongo.JobExecutionIDKey: stringEntry(jobExecutionID),
+			mongo.ProjectIDKey:      stringEntry("projectID"),
+			mongo.CustomerKey:       stringEntry("customer"),
+			mongo.PlatformIDKey:     stringEntry("platformID"),
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		return doc
+	}
+
+	BeforeEach(func() {
+		logger, err := log.New(log.OutputPlugin, "test")
+		Expect(err).ToNot(HaveOccurred())
+
+		ctx = log.WithLogger(context.TODO(), logger)
+		summaries = mongo.NewSummaries()
+	})
+
+	It("Should accumulate lines per execution", func() {
+		first := jobLine("job-1", start.Add(time.Second), "stdout", "first")
+		summaries.Add(first)
+		summaries.Add(jobLine("job-1", start, "stderr", "before"))
+		summaries.Add(jobLine("job-1", start.Add(time.Minute), "orchestration_stderr", "last"))
+		other := jobLine("job-2", start, "stdout", "other")
+		summaries.Add(other)
+
+		Expect(summaries.Len()).To(Equal(2))
+
+		summary, ok := summaries.Get(first)
+		Expect(ok).To(BeTrue())
+		Expect(summary).To(Equal(mongo.Summary{
+			FirstTime:   start,
+			LastTime:    start.Add(time.Minute),
+			LineCount:   3,
+			StderrCount: 2,
+			Bytes:       15,
+		}))
+
+		summary, ok = summaries.Get(other)
+		Expect(ok).To(BeTrue())
+		Expect(summary.LineCount).To(Equal(1))
+		Expect(summary.StderrCount).To(BeZero())
+	})
+
+	It("Should keep the summaries not saved only", func() {
+		first := jobLine("job-1", start, "stdout", "first")
+		summaries.Add(first)
+
+		other := jobLine("job-1", start, "stdout", "other")
+		other.GetLogDocument().ProjectId = "otherProjectID"
+		summaries.Add(other)
+
+		storage := mongo.NewMemoryStorage()
+		storage.SetError(mongo.SummaryCollectionName(other), errors.New("not primary"))
+
+		Expect(summaries.SaveTo(storage)).ToNot(Succeed())
+		Expect(summaries.Len()).To(Equal(1))
+
+		storage.SetError(mongo.SummaryCollectionName(other), nil)
+		Expect(summaries.SaveTo(storage)).To(Succeed())
+		Expect(summaries.Len()).To(BeZero())
+
+		for _, doc := range []mongo.LogEntry{first, other} {
+			summary, _, ok := storage.Summary(mongo.SummaryCollectionName(doc), doc.ExecutionKey())
+			Expect(ok).To(BeTrue())
+			Expect(summary.LineCount).To(Equal(1))
+		}
+	})
+
+	It("Should merge the summaries kept for a destination", func() {
+		backlog := mongo.NewSummaryBacklog()
+
+		doc := jobLine("job-1", start, "stdout", "first")
+		summaries.Add(doc)
+		backlog.Keep("primary/", summaries)
+
+		more := mongo.NewSummaries()
+		more.Add(jobLine("job-1", start.Add(-time.Second), "stderr", "second"))
+		backlog.Keep("primary/", more)
+
+		Expect(backlog.Take("fallback/").Len()).To(BeZero())
+
+		kept := backlog.Take("primary/")
+		summary, ok := kept.Get(doc)
+		Expect(ok).To(BeTrue())
+		Expect(summary.FirstTime).To(Equal(start.Add(-time.Second)))
+		Expect(summary.LineCount).To(Equal(2))
+		Expect(summary.StderrCount).To(Equal(1))
+		Expect(backlog.Len()).To(BeZero())
+	})
+
+	It("Should not summarize the documents without execution", func() {
+		generic, err := mongo.ConvertAs(ctx, time.Now(), map[interface{}]interface{}{
+			mongo.LogKey:    stringEntry("log"),
+			mongo.StreamKey: stringEntry("stdout"),
+			"type":          stringEntry("cron"),
+		}, mongo.GenericDocument)
+		Expect(err).ToNot(HaveOccurred())
+
+		summaries.Add(generic)
+		Expect(summaries.Len()).To(BeZero())
+
+		options := mongo.DefaultOptions()
+		options.Summary = true
+		options.Discriminator.Key = "type"
+		options.Discriminator.Unknown = mongo.UnknownGeneric
+
+		storage := &keyedIndexes{MemoryStorage: mongo.NewMemoryStorage()}
+		p := mongo.New(storage, options)
+		Expect(p.ProcessRecord(ctx, time.Now(), map[interface{}]interface{}{
+			mongo.LogKey:    stringEntry("log"),
+			mongo.StreamKey: stringEntry("stdout"),
+			"type":          stringEntry("cron"),
+		})).To(Succeed())
+		Expect(entry.FlushNext(ctx, p)).To(Succeed())
+
+		Expect(storage.Documents(mongo.GenericCollectionName)).To(HaveLen(1))
+		Expect(storage.Collections()).To(Equal([]string{mongo.GenericCollectionName}))
+	})
+
+	It("Should build an idempotent time update", func() {
+		update := mongo.SummaryUpdate(mongo.Summary{
+			FirstTime:   start,
+			LastTime:    start.Add(time.Minute),
+			LineCount:   3,
+			StderrCount: 1,
+			Bytes:       12,
+		}, bson.M{mongo.CustomerKey: "customer"})
+
+		Expect(update).To(Equal(bson.M{
+			"$min": bson.M{mongo.SummaryFirstTimeKey: start},
+			"$max": bson.M{mongo.SummaryLastTimeKey: start.Add(time.Minute)},
+			"$inc": bson.M{
+				mongo.SummaryLineCountKey:   3,
+				mongo.SummaryStderrCountKey: 1,
+				mongo.SummaryBytesKey:       12,
+			},
+			"$setOnInsert": bson.M{mongo.CustomerKey: "customer"},
+		}))
+	})
+})
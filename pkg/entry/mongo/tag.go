@@ -0,0 +1,82 @@
+package mongo
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// TagRule selects the document type of the records whose tag matches a fluent-bit pattern, where * matches anything.
+type TagRule struct {
+	Pattern string
+	Type    DocumentType
+
+	re *regexp.Regexp
+}
+
+func NewTagRule(pattern string, t DocumentType) TagRule {
+	expression := strings.ReplaceAll(regexp.QuoteMeta(pattern), `\*`, `.*`)
+
+	return TagRule{
+		Pattern: pattern,
+		Type:    t,
+		re:      regexp.MustCompile("^" + expression + "$"),
+	}
+}
+
+// ParseTagRule parses a rule written as "<pattern> <type>".
+func ParseTagRule(value string) (TagRule, error) {
+	fields := strings.Fields(value)
+	if len(fields) != 2 {
+		return TagRule{}, fmt.Errorf("invalid tag rule %q, expected <pattern> <type>", value)
+	}
+
+	t, err := ParseDocumentType(fields[1])
+	if err != nil {
+		return TagRule{}, err
+	}
+
+	return NewTagRule(fields[0], t), nil
+}
+
+func (r TagRule) Match(tag string) bool {
+	return r.re.MatchString(tag)
+}
+
+// TagDocumentType returns the document type of the first rule matching the tag.
+func TagDocumentType(rules []TagRule, tag string) (DocumentType, bool) {
+	for _, rule := range rules {
+		if rule.Match(tag) {
+			return rule.Type, true
+		}
+	}
+
+	return "", false
+}
+
+// CollectionData is the data available to the collection name template.
+type CollectionData struct {
+	*LogDocument
+	Tag string
+}
+
+func ParseCollectionTemplate(value string) (*template.Template, error) {
+	return template.New("collection").Option("missingkey=error").Parse(value)
+}
+
+// CollectionNameFromTemplate returns the collection name of the document rendered by the template.
+func CollectionNameFromTemplate(collectionTemplate *template.Template, doc LogEntry, tag string) (string, error) {
+	var buffer bytes.Buffer
+
+	if err := collectionTemplate.Execute(&buffer, CollectionData{LogDocument: doc.GetLogDocument(), Tag: tag}); err != nil {
+		return "", fmt.Errorf("execute collection template: %w", err)
+	}
+
+	if buffer.Len() == 0 {
+		return "", fmt.Errorf("empty collection name")
+	}
+
+	return buffer.String(), nil
+}
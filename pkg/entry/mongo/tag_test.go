@@ -0,0 +1,97 @@
+package mongo_test
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	"github.com/saagie/fluent-bit-mongo/pkg/entry/mongo"
+)
+
+var _ = Describe("Tag rules", func() {
+	DescribeTable("Match", func(pattern, tag string, expected bool) {
+		rule := mongo.NewTagRule(pattern, mongo.JobDocument)
+		Expect(rule.Match(tag)).To(Equal(expected))
+	},
+		Entry("exact", "job.logs", "job.logs", true),
+		Entry("wildcard", "job.*", "job.var.log.containers", true),
+		Entry("other prefix", "job.*", "app.job", false),
+		Entry("literal dot", "job.*", "jobs", false),
+		Entry("wildcard in the middle", "kube.*.job", "kube.default.job", true),
+	)
+
+	It("Should parse a rule", func() {
+		rule, err := mongo.ParseTagRule("app.*  app")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(rule.Pattern).To(Equal("app.*"))
+		Expect(rule.Type).To(Equal(mongo.AppDocument))
+	})
+
+	DescribeTable("Invalid rule", func(value string) {
+		_, err := mongo.ParseTagRule(value)
+		Expect(err).To(HaveOccurred())
+	},
+		Entry("missing type", "app.*"),
+		Entry("unknown type", "app.* pipeline"),
+		Entry("too many fields", "app.* app job"),
+	)
+
+	It("Should use the first matching rule", func() {
+		rules := []mongo.TagRule{
+			mongo.NewTagRule("job.special", mongo.ConditionDocument),
+			mongo.NewTagRule("job.*", mongo.JobDocument),
+		}
+
+		t, ok := mongo.TagDocumentType(rules, "job.special")
+		Expect(ok).To(BeTrue())
+		Expect(t).To(Equal(mongo.ConditionDocument))
+
+		t, ok = mongo.TagDocumentType(rules, "job.other")
+		Expect(ok).To(BeTrue())
+		Expect(t).To(Equal(mongo.JobDocument))
+
+		_, ok = mongo.TagDocumentType(rules, "app.other")
+		Expect(ok).To(BeFalse())
+	})
+
+	Describe("Collection template", func() {
+		var doc mongo.LogEntry
+
+		BeforeEach(func() {
+			var err error
+
+			doc, err = mongo.ConvertAs(loggerContext(), time.Now(), map[interface{}]interface{}{
+				mongo.LogKey:            stringEntry("log"),
+				mongo.AppIDKey:          stringEntry("appID"),
+				mongo.AppExecutionIDKey: stringEntry("appExecutionID"),
+				mongo.ContainerIDKey:    stringEntry("containerID"),
+				mongo.ProjectIDKey:      stringEntry("projectID"),
+				mongo.CustomerKey:       stringEntry("customer"),
+				mongo.PlatformIDKey:     stringEntry("platformID"),
+			}, mongo.AppDocument)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("Should render the document fields and the tag", func() {
+			collectionTemplate, err := mongo.ParseCollectionTemplate("{{.Customer}}_{{.Tag}}")
+			Expect(err).ToNot(HaveOccurred())
+
+			name, err := mongo.CollectionNameFromTemplate(collectionTemplate, doc, "kube-logs")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(name).To(Equal("customer_kube-logs"))
+
+			doc.GetLogDocument().SetCollectionName(name)
+			Expect(doc.CollectionName()).To(Equal("customer_kube_logs"))
+		})
+
+		It("Should not accept an empty name", func() {
+			collectionTemplate, err := mongo.ParseCollectionTemplate("{{.Tag}}")
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = mongo.CollectionNameFromTemplate(collectionTemplate, doc, "")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
@@ -0,0 +1,66 @@
+package mongo
+
+import (
+	"fmt"
+
+	mgo "gopkg.in/mgo.v2"
+)
+
+// WriteMode selects how the documents are written, all the modes keep the retried writes idempotent.
+type WriteMode string
+
+const (
+	// WriteUpsert replaces the stored document, or inserts it.
+	WriteUpsert WriteMode = "upsert"
+	// WriteInsert inserts the document, a document already stored with the same ID is kept.
+	WriteInsert WriteMode = "insert"
+	// WriteReplace inserts the document, and replaces the stored document with the same ID.
+	WriteReplace WriteMode = "replace"
+)
+
+func ParseWriteMode(value string) (WriteMode, error) {
+	switch mode := WriteMode(value); mode {
+	case WriteUpsert, WriteInsert, WriteReplace:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown write mode %q", value)
+	}
+}
+
+// writeDocument writes the document with the mode, it reports whether the document was not already stored.
+// Unacknowledged writes are never reported as inserted.
+func writeDocument(collection *mgo.Collection, id interface{}, doc interface{}, mode WriteMode) (bool, error) {
+	switch mode {
+	case WriteInsert, WriteReplace:
+		err := collection.Insert(doc)
+		if err == nil {
+			return collection.Database.Session.Safe() != nil, nil
+		}
+
+		if !mgo.IsDup(err) {
+			return false, fmt.Errorf("insert %s: %w", id, err)
+		}
+
+		if mode == WriteInsert {
+			return false, nil
+		}
+
+		if err := collection.UpdateId(id, doc); err != nil {
+			return false, fmt.Errorf("replace %s: %w", id, err)
+		}
+
+		return false, nil
+	default:
+		info, err := collection.UpsertId(id, doc)
+		if err != nil {
+			return false, fmt.Errorf("upsert %s: %w", id, err)
+		}
+
+		// No information without acknowledgement
+		if info == nil {
+			return false, nil
+		}
+
+		return info.UpsertedId != nil, nil
+	}
+}
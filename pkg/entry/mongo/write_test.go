@@ -0,0 +1,180 @@
+package mongo_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"github.com/ory/dockertest/v3"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/saagie/fluent-bit-mongo/pkg/entry/mongo"
+)
+
+// newJobDocs returns n job documents which are not stored yet.
+func newJobDocs(n int) []mongo.LogEntry {
+	docs := make([]mongo.LogEntry, 0, n)
+	for i := 0; i < n; i++ {
+		docs = append(docs, &mongo.JobLogDocument{
+			LogDocument: mongo.LogDocument{
+				Id:         bson.NewObjectId(),
+				Log:        fmt.Sprintf("line %d", i),
+				Stream:     "stdout",
+				Time:       time.Now().UTC().Format(mongo.TimeFormat),
+				ProjectId:  "project",
+				Customer:   "customer",
+				PlatformId: "platform",
+			},
+			JobExecutionId: "job",
+		})
+	}
+
+	return docs
+}
+
+var _ = Describe("Write mode", func() {
+	DescribeTable("Parse", func(value string, expected mongo.WriteMode, valid bool) {
+		mode, err := mongo.ParseWriteMode(value)
+		if !valid {
+			Expect(err).To(HaveOccurred())
+
+			return
+		}
+
+		Expect(err).ToNot(HaveOccurred())
+		Expect(mode).To(Equal(expected))
+	},
+		Entry("upsert", "upsert", mongo.WriteUpsert, true),
+		Entry("insert", "insert", mongo.WriteInsert, true),
+		Entry("replace", "replace", mongo.WriteReplace, true),
+		Entry("unknown", "append", mongo.WriteMode(""), false),
+	)
+
+	DescribeTable("Against a mongod", func(driver mongo.Driver, mode mongo.WriteMode, replaced bool) {
+		const database = "fluent_bit_mongo_write"
+		const collection = "job_logs"
+
+		m := localMongod()
+		session := m.Dial(database)
+		defer session.Close()
+
+		connector := mongo.NewConnector(driver, &mgo.DialInfo{
+			Addrs:    []string{m.Address},
+			Database: database,
+			Timeout:  10 * time.Second,
+		}, mongo.DefaultOptions().Session, mongo.NewIndexRegistry())
+		defer connector.Close()
+
+		storage, err := connector.Connect(context.TODO())
+		Expect(err).ToNot(HaveOccurred())
+		defer storage.Close()
+
+		docs := newJobDocs(2)
+		write := func(docs ...mongo.LogEntry) []bool {
+			written := make([]mongo.Document, 0, len(docs))
+			for _, doc := range docs {
+				written = append(written, mongo.Document{Id: doc.GetID(), Doc: doc})
+			}
+
+			inserted, err := storage.Write(collection, mode, written)
+			Expect(err).ToNot(HaveOccurred())
+
+			return inserted
+		}
+
+		stored := func(id bson.ObjectId) string {
+			var doc mongo.JobLogDocument
+			Expect(session.DB("").C(collection).FindId(id).One(&doc)).To(Succeed())
+
+			return doc.Log
+		}
+
+		By("Writing new documents", func() {
+			Expect(write(docs...)).To(Equal([]bool{true, true}))
+			Expect(stored(docs[0].GetID())).To(Equal("line 0"))
+			Expect(stored(docs[1].GetID())).To(Equal("line 1"))
+		})
+
+		By("Writing them again", func() {
+			retried := *docs[0].(*mongo.JobLogDocument)
+			retried.Log = "line 0 retried"
+
+			Expect(write(&retried, docs[1])).To(Equal([]bool{false, false}))
+
+			expected := "line 0"
+			if replaced {
+				expected = "line 0 retried"
+			}
+
+			Expect(stored(docs[0].GetID())).To(Equal(expected))
+			Expect(stored(docs[1].GetID())).To(Equal("line 1"))
+			Expect(session.DB("").C(collection).Count()).To(Equal(2))
+		})
+	},
+		Entry("upsert with mgo", mongo.DriverMgo, mongo.WriteUpsert, true),
+		Entry("insert with mgo", mongo.DriverMgo, mongo.WriteInsert, false),
+		Entry("replace with mgo", mongo.DriverMgo, mongo.WriteReplace, true),
+		Entry("upsert with the official driver", mongo.DriverOfficial, mongo.WriteUpsert, true),
+		Entry("insert with the official driver", mongo.DriverOfficial, mongo.WriteInsert, false),
+		Entry("replace with the official driver", mongo.DriverOfficial, mongo.WriteReplace, true),
+	)
+})
+
+// BenchmarkWriteModes compares the write modes against a mongod started in docker, it is skipped without docker.
+// The new documents are not stored yet, the retried ones are written a second time.
+func BenchmarkWriteModes(b *testing.B) {
+	if err := connectDocker(); err != nil {
+		b.Skip(err)
+	}
+
+	m, err := runMongod(&dockertest.RunOptions{}, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer func() {
+		if err := dockerPool.Purge(m.resource); err != nil {
+			b.Error(err)
+		}
+	}()
+
+	session, err := mgo.DialWithTimeout(m.Address, 10*time.Second)
+	if err != nil {
+		b.Fatalf("dial %s: %s", m.Address, err)
+	}
+	defer session.Close()
+
+	storage := mongo.NewSessionStorage(session, mongo.NewIndexRegistry(), mongo.SessionOptions{})
+
+	save := func(b *testing.B, collection string, mode mongo.WriteMode, docs []mongo.LogEntry) {
+		for _, doc := range docs {
+			if _, err := storage.Write(collection, mode, []mongo.Document{{Id: doc.GetID(), Doc: doc}}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+
+	for _, mode := range []mongo.WriteMode{mongo.WriteUpsert, mongo.WriteInsert, mongo.WriteReplace} {
+		mode := mode
+		collection := "bench_" + string(mode)
+
+		b.Run(string(mode)+"/new", func(b *testing.B) {
+			docs := newJobDocs(b.N)
+
+			b.ResetTimer()
+			save(b, collection, mode, docs)
+		})
+
+		b.Run(string(mode)+"/retried", func(b *testing.B) {
+			docs := newJobDocs(b.N)
+			save(b, collection, mode, docs)
+
+			b.ResetTimer()
+			save(b, collection, mode, docs)
+		})
+	}
+}
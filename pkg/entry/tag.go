@@ -0,0 +1,17 @@
+package entry
+
+import "context"
+
+var tagContextKey = "tag"
+
+// WithTag returns a context holding the fluent-bit tag of the records being processed.
+func WithTag(ctx context.Context, tag string) context.Context {
+	return context.WithValue(ctx, &tagContextKey, tag)
+}
+
+// GetTag returns the fluent-bit tag of the records being processed, or an empty string.
+func GetTag(ctx context.Context) string {
+	tag, _ := ctx.Value(&tagContextKey).(string)
+
+	return tag
+}
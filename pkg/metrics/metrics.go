@@ -0,0 +1,157 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Prefix is prepended to the name of every metric.
+const Prefix = "fluentbit_mongo_"
+
+type Labels map[string]string
+
+func (l Labels) String() string {
+	if len(l) == 0 {
+		return ""
+	}
+
+	keys := make([]string, 0, len(l))
+	for k := range l {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", k, l[k]))
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+type kind string
+
+const (
+	counter kind = "counter"
+	gauge   kind = "gauge"
+)
+
+// Registry holds counters and gauges, it is safe for concurrent use.
+type Registry struct {
+	lock   sync.Mutex
+	kinds  map[string]kind
+	series map[string]map[string]float64
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		kinds:  map[string]kind{},
+		series: map[string]map[string]float64{},
+	}
+}
+
+func (r *Registry) update(name string, k kind, labels Labels, f func(float64) float64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.kinds[name] = k
+
+	series, ok := r.series[name]
+	if !ok {
+		series = map[string]float64{}
+		r.series[name] = series
+	}
+
+	key := labels.String()
+	series[key] = f(series[key])
+}
+
+// Inc increments a counter.
+func (r *Registry) Inc(name string, labels Labels) {
+	r.Add(name, labels, 1)
+}
+
+// Add adds a value to a counter.
+func (r *Registry) Add(name string, labels Labels, value float64) {
+	r.update(name, counter, labels, func(current float64) float64 {
+		return current + value
+	})
+}
+
+// Set sets the value of a gauge.
+func (r *Registry) Set(name string, labels Labels, value float64) {
+	r.update(name, gauge, labels, func(float64) float64 {
+		return value
+	})
+}
+
+// Get returns the value of a metric, zero when it was never updated.
+func (r *Registry) Get(name string, labels Labels) float64 {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.series[name][labels.String()]
+}
+
+// WriteTo writes the metrics in the Prometheus text format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.lock.Lock()
+
+	names := make([]string, 0, len(r.series))
+	for name := range r.series {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buffer bytes.Buffer
+
+	for _, name := range names {
+		fmt.Fprintf(&buffer, "# TYPE %s%s %s\n", Prefix, name, r.kinds[name])
+
+		keys := make([]string, 0, len(r.series[name]))
+		for key := range r.series[name] {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			fmt.Fprintf(&buffer, "%s%s%s %s\n", Prefix, name, key, strconv.FormatFloat(r.series[name][key], 'g', -1, 64))
+		}
+	}
+
+	r.lock.Unlock()
+
+	return buffer.WriteTo(w)
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	_, _ = r.WriteTo(w)
+}
+
+// Serve exposes the metrics on the /metrics path of the address.
+func Serve(address string, registry *Registry) (*http.Server, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("listen %s: %w", address, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", registry)
+
+	server := &http.Server{Handler: mux}
+
+	go func() {
+		_ = server.Serve(listener)
+	}()
+
+	return server, nil
+}
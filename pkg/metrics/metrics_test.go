@@ -0,0 +1,69 @@
+package metrics_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/saagie/fluent-bit-mongo/pkg/metrics"
+)
+
+var _ = Describe("Registry", func() {
+	var registry *metrics.Registry
+
+	BeforeEach(func() {
+		registry = metrics.NewRegistry()
+	})
+
+	It("Should count by labels", func() {
+		registry.Inc("redactions_total", metrics.Labels{"rule": "email"})
+		registry.Add("redactions_total", metrics.Labels{"rule": "email"}, 2)
+		registry.Inc("redactions_total", metrics.Labels{"rule": "jwt"})
+
+		Expect(registry.Get("redactions_total", metrics.Labels{"rule": "email"})).To(Equal(3.0))
+		Expect(registry.Get("redactions_total", metrics.Labels{"rule": "jwt"})).To(Equal(1.0))
+		Expect(registry.Get("redactions_total", metrics.Labels{"rule": "bearer"})).To(BeZero())
+		Expect(registry.Get("unknown", nil)).To(BeZero())
+	})
+
+	It("Should set gauges", func() {
+		registry.Set("state", nil, 2)
+		registry.Set("state", nil, 1)
+
+		Expect(registry.Get("state", nil)).To(Equal(1.0))
+	})
+
+	It("Should write the Prometheus text format", func() {
+		registry.Inc("redactions_total", metrics.Labels{"rule": "jwt", "instance": "a"})
+		registry.Set("state", nil, 0.5)
+
+		var buffer bytes.Buffer
+		_, err := registry.WriteTo(&buffer)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(buffer.String()).To(Equal(`# TYPE fluentbit_mongo_redactions_total counter
+fluentbit_mongo_redactions_total{instance="a",rule="jwt"} 1
+# TYPE fluentbit_mongo_state gauge
+fluentbit_mongo_state 0.5
+`))
+	})
+
+	It("Should expose the metrics over HTTP", func() {
+		registry.Inc("flushes_total", nil)
+
+		server, err := metrics.Serve("127.0.0.1:18923", registry)
+		Expect(err).ToNot(HaveOccurred())
+		defer server.Close()
+
+		response, err := http.Get(fmt.Sprintf("http://%s/metrics", "127.0.0.1:18923"))
+		Expect(err).ToNot(HaveOccurred())
+		defer response.Body.Close()
+
+		body, err := io.ReadAll(response.Body)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(body)).To(ContainSubstring("fluentbit_mongo_flushes_total 1"))
+	})
+})
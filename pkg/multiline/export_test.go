@@ -0,0 +1,7 @@
+package multiline
+
+import "time"
+
+func (g *Grouper) SetNow(now func() time.Time) {
+	g.now = now
+}
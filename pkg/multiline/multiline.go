@@ -0,0 +1,363 @@
+package multiline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/saagie/fluent-bit-mongo/pkg/entry"
+	"github.com/saagie/fluent-bit-mongo/pkg/entry/mongo"
+	"github.com/saagie/fluent-bit-mongo/pkg/log"
+	"github.com/saagie/fluent-bit-mongo/pkg/parse"
+)
+
+// groupKeys identify the stream a line belongs to, lines are only grouped within a stream.
+var groupKeys = []string{
+	mongo.JobExecutionIDKey,
+	mongo.AppExecutionIDKey,
+	mongo.ContainerIDKey,
+	mongo.ConditionExecutionIDKey,
+	mongo.StreamKey,
+}
+
+type Options struct {
+	Rules []Rule
+	// Timeout is the time after which a group not receiving lines is written.
+	Timeout time.Duration
+	// MaxLines is the number of lines above which a group is written without waiting for the next lines.
+	MaxLines int
+}
+
+func DefaultOptions() Options {
+	return Options{
+		Timeout:  2 * time.Second,
+		MaxLines: 500,
+	}
+}
+
+func (o Options) Enabled() bool {
+	return len(o.Rules) > 0
+}
+
+func (o Options) Validate() error {
+	if !o.Enabled() {
+		return nil
+	}
+
+	if o.Timeout <= 0 {
+		return errors.New("multiline timeout must be positive")
+	}
+
+	if o.MaxLines <= 0 {
+		return errors.New("multiline max lines must be positive")
+	}
+
+	return nil
+}
+
+type group struct {
+	rule      Rule
+	ts        time.Time
+	record    map[interface{}]interface{}
+	lines     []string
+	updatedAt time.Time
+}
+
+// change is what a chunk did to the group of a stream: the lines it added and the groups it took out, complete or
+// expired. It is undone when the chunk is retried.
+type change struct {
+	added   []string
+	removed []*group
+}
+
+// changeOf returns the change of the key, created on first use.
+func changeOf(changes map[string]*change, key string) *change {
+	c, ok := changes[key]
+	if !ok {
+		c = &change{}
+		changes[key] = c
+	}
+
+	return c
+}
+
+func (g *group) join() (time.Time, map[interface{}]interface{}) {
+	record := make(map[interface{}]interface{}, len(g.record))
+	for k, v := range g.record {
+		record[k] = v
+	}
+
+	record[mongo.LogKey] = []uint8(strings.Join(g.lines, "\n"))
+
+	return g.ts, record
+}
+
+// Grouper groups the lines of stack traces into a single record.
+// Groups are kept between flushes until a line not belonging to them is received.
+type Grouper struct {
+	options Options
+	now     func() time.Time
+
+	lock    sync.Mutex
+	pending map[string]*group
+}
+
+var (
+	_ entry.Stage  = &Grouper{}
+	_ entry.Holder = &Grouper{}
+)
+
+func New(options Options) *Grouper {
+	return &Grouper{
+		options: options,
+		now:     time.Now,
+		pending: map[string]*group{},
+	}
+}
+
+func (g *Grouper) Wrap(next entry.Processor) entry.Processor {
+	return &processor{
+		grouper: g,
+		next:    next,
+		changes: map[string]*change{},
+	}
+}
+
+// Pending returns the number of groups waiting for lines.
+func (g *Grouper) Pending() int {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	return len(g.pending)
+}
+
+type processor struct {
+	grouper *Grouper
+	next    entry.Processor
+	// changes holds what the chunk did to the groups, by stream.
+	// It is undone when the chunk is retried, since its lines come again and the groups it wrote may be lost.
+	changes map[string]*change
+	retry   bool
+}
+
+type output struct {
+	ts     time.Time
+	record map[interface{}]interface{}
+}
+
+func (p *processor) ProcessRecord(ctx context.Context, ts time.Time, record map[interface{}]interface{}) error {
+	content, err := parse.ExtractStringValue(record, mongo.LogKey)
+	if err != nil {
+		if !errors.Is(err, &parse.ErrKeyNotFound{LookingFor: mongo.LogKey}) {
+			return fmt.Errorf("parse %s: %w", mongo.LogKey, err)
+		}
+
+		return p.next.ProcessRecord(ctx, ts, record)
+	}
+
+	// The records are all written even when one fails, the grouper no longer holds them
+	var errs entry.Errors
+
+	for _, out := range p.grouper.add(groupKey(record), ts, record, strings.TrimSuffix(content, "\n"), p.changes) {
+		if err := p.next.ProcessRecord(ctx, out.ts, out.record); err != nil {
+			if errors.Is(err, &entry.ErrRetry{}) {
+				p.retry = true
+			}
+
+			errs = append(errs, err)
+		}
+	}
+
+	return errs.Err()
+}
+
+// Flush writes the groups which did not receive lines before the timeout, or all of them when draining, then flushes the next processor.
+// When the chunk is retried, what it did to the groups is undone, keeping the changes of the other flushes.
+func (p *processor) Flush(ctx context.Context) error {
+	err := p.flush(ctx)
+
+	if p.retry || errors.Is(err, &entry.ErrRetry{}) {
+		p.grouper.restore(p.changes)
+	}
+
+	p.changes = map[string]*change{}
+	p.retry = false
+
+	return err
+}
+
+func (p *processor) flush(ctx context.Context) error {
+	logger, err := log.GetLogger(ctx)
+	if err != nil {
+		return fmt.Errorf("get logger: %w", err)
+	}
+
+	for _, expired := range p.grouper.expire(entry.Draining(ctx), p.changes) {
+		ts, record := expired.join()
+
+		logger.Debug("Multiline group timed out", map[string]interface{}{
+			"rule":  expired.rule.Name,
+			"lines": len(expired.lines),
+		})
+
+		if err := p.next.ProcessRecord(ctx, ts, record); err != nil {
+			return fmt.Errorf("process record: %w", err)
+		}
+	}
+
+	return entry.FlushNext(ctx, p.next)
+}
+
+func groupKey(record map[interface{}]interface{}) string {
+	values := make([]string, 0, len(groupKeys))
+
+	for _, k := range groupKeys {
+		value, _ := parse.ExtractScalarValue(record, k)
+		values = append(values, value)
+	}
+
+	return strings.Join(values, "\x00")
+}
+
+func (g *Grouper) startRule(content string) (Rule, bool) {
+	for _, rule := range g.options.Rules {
+		if rule.Start.MatchString(content) {
+			return rule, true
+		}
+	}
+
+	return Rule{}, false
+}
+
+// add handles a line and returns the records to write, in order.
+// The change of the group of the stream is recorded.
+func (g *Grouper) add(key string, ts time.Time, record map[interface{}]interface{}, content string, changes map[string]*change) []output {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	c := changeOf(changes, key)
+	outputs := make([]output, 0, 2)
+
+	if current, ok := g.pending[key]; ok {
+		if current.rule.Continuation.MatchString(content) {
+			current.lines = append(current.lines, content)
+			current.updatedAt = g.now()
+			c.added = append(c.added, content)
+
+			if len(current.lines) >= g.options.MaxLines {
+				delete(g.pending, key)
+				c.removed = append(c.removed, current)
+
+				ts, record := current.join()
+				outputs = append(outputs, output{ts: ts, record: record})
+			}
+
+			return outputs
+		}
+
+		delete(g.pending, key)
+		c.removed = append(c.removed, current)
+
+		ts, record := current.join()
+		outputs = append(outputs, output{ts: ts, record: record})
+	}
+
+	if rule, ok := g.startRule(content); ok {
+		c.added = append(c.added, content)
+		g.pending[key] = &group{
+			rule:      rule,
+			ts:        ts,
+			record:    record,
+			lines:     []string{content},
+			updatedAt: g.now(),
+		}
+
+		return outputs
+	}
+
+	return append(outputs, output{ts: ts, record: record})
+}
+
+// expire removes and returns the groups which did not receive a line before the timeout, or all of them.
+// The removals are recorded.
+func (g *Grouper) expire(all bool, changes map[string]*change) []*group {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	limit := g.now().Add(-g.options.Timeout)
+	expired := make([]*group, 0)
+
+	for key, current := range g.pending {
+		if all || current.updatedAt.Before(limit) {
+			c := changeOf(changes, key)
+			c.removed = append(c.removed, current)
+
+			expired = append(expired, current)
+			delete(g.pending, key)
+		}
+	}
+
+	sort.SliceStable(expired, func(i, j int) bool {
+		return expired[i].ts.Before(expired[j].ts)
+	})
+
+	return expired
+}
+
+// restore undoes the changes of a chunk: the groups it took out are merged back into the pending group of their
+// stream, without the lines it added. The lines added meanwhile by the other flushes are kept.
+func (g *Grouper) restore(changes map[string]*change) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	for key, c := range changes {
+		var base *group
+		var lines []string
+
+		// The lines taken out came first
+		for _, removed := range c.removed {
+			if base == nil {
+				base = removed
+			}
+
+			lines = append(lines, removed.lines...)
+		}
+
+		if current, ok := g.pending[key]; ok {
+			if base == nil {
+				base = current
+			}
+
+			lines = append(lines, current.lines...)
+		}
+
+		for _, line := range c.added {
+			lines = without(lines, line)
+		}
+
+		if len(lines) == 0 {
+			delete(g.pending, key)
+
+			continue
+		}
+
+		restored := *base
+		restored.lines = lines
+		g.pending[key] = &restored
+	}
+}
+
+// without removes the first occurrence of the line.
+func without(lines []string, line string) []string {
+	for i, held := range lines {
+		if held == line {
+			return append(lines[:i:i], lines[i+1:]...)
+		}
+	}
+
+	return lines
+}
@@ -0,0 +1,13 @@
+package multiline_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestMultiline(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Multiline Suite")
+}
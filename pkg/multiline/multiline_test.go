@@ -0,0 +1,223 @@
+package multiline_test
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/saagie/fluent-bit-mongo/pkg/entry"
+	"github.com/saagie/fluent-bit-mongo/pkg/entry/mongo"
+	"github.com/saagie/fluent-bit-mongo/pkg/log"
+	"github.com/saagie/fluent-bit-mongo/pkg/multiline"
+)
+
+type record struct {
+	ts     time.Time
+	record map[interface{}]interface{}
+}
+
+type recorder struct {
+	records []record
+	// err fails the records
+	err error
+	// failures is the number of records failed with err before the records are written again, all of them when zero
+	failures int
+}
+
+func (r *recorder) ProcessRecord(_ context.Context, ts time.Time, m map[interface{}]interface{}) error {
+	if r.err != nil {
+		err := r.err
+
+		if r.failures > 0 {
+			r.failures--
+			if r.failures == 0 {
+				r.err = nil
+			}
+		}
+
+		return err
+	}
+
+	r.records = append(r.records, record{ts: ts, record: m})
+
+	return nil
+}
+
+func (r *recorder) logs() []string {
+	logs := make([]string, 0, len(r.records))
+	for _, rec := range r.records {
+		logs = append(logs, string(rec.record[mongo.LogKey].([]uint8)))
+	}
+
+	return logs
+}
+
+var _ = Describe("Grouper", func() {
+	var ctx context.Context
+	var grouper *multiline.Grouper
+	var next *recorder
+	var p entry.Processor
+	var now time.Time
+
+	start := time.Date(2022, 6, 8, 9, 56, 36, 0, time.UTC)
+
+	line := func(stream, content string) map[interface{}]interface{} {
+		return map[interface{}]interface{}{
+			mongo.LogKey:            []uint8(content + "\n"),
+			mongo.StreamKey:         []uint8(stream),
+			mongo.JobExecutionIDKey: []uint8("job"),
+		}
+	}
+
+	BeforeEach(func() {
+		logger, err := log.New(log.OutputPlugin, "test")
+		Expect(err).ToNot(HaveOccurred())
+
+		ctx = log.WithLogger(context.TODO(), logger)
+		now = start
+
+		grouper = multiline.New(multiline.Options{
+			Rules:    []multiline.Rule{multiline.Java, multiline.Python},
+			Timeout:  2 * time.Second,
+			MaxLines: 4,
+		})
+		grouper.SetNow(func() time.Time {
+			return now
+		})
+
+		next = &recorder{}
+		p = grouper.Wrap(next)
+	})
+
+	It("Should group a stack trace with the first timestamp", func() {
+		Expect(p.ProcessRecord(ctx, start, line("stderr", "starting"))).To(Succeed())
+		Expect(p.ProcessRecord(ctx, start.Add(time.Second), line("stderr", "java.lang.IllegalStateException: boom"))).To(Succeed())
+		Expect(p.ProcessRecord(ctx, start.Add(2*time.Second), line("stderr", "\tat com.example.Main.main(Main.java:12)"))).To(Succeed())
+		Expect(p.ProcessRecord(ctx, start.Add(2*time.Second), line("stdout", "unrelated"))).To(Succeed())
+		Expect(p.ProcessRecord(ctx, start.Add(3*time.Second), line("stderr", "Caused by: java.lang.NullPointerException"))).To(Succeed())
+		Expect(p.ProcessRecord(ctx, start.Add(4*time.Second), line("stderr", "done"))).To(Succeed())
+
+		Expect(next.logs()).To(Equal([]string{
+			"starting\n",
+			"unrelated\n",
+			"java.lang.IllegalStateException: boom\n\tat com.example.Main.main(Main.java:12)\nCaused by: java.lang.NullPointerException",
+			"done\n",
+		}))
+		Expect(next.records[2].ts).To(Equal(start.Add(time.Second)))
+		Expect(grouper.Pending()).To(BeZero())
+	})
+
+	It("Should keep a group between flushes until the timeout", func() {
+		Expect(p.ProcessRecord(ctx, start, line("stderr", "Traceback (most recent call last):"))).To(Succeed())
+		Expect(entry.FlushNext(ctx, p)).To(Succeed())
+		Expect(next.records).To(BeEmpty())
+
+		p = grouper.Wrap(next)
+		Expect(p.ProcessRecord(ctx, start, line("stderr", "ValueError: boom"))).To(Succeed())
+
+		now = now.Add(3 * time.Second)
+		Expect(entry.FlushNext(ctx, p)).To(Succeed())
+		Expect(next.logs()).To(Equal([]string{"Traceback (most recent call last):\nValueError: boom"}))
+	})
+
+	It("Should write a group reaching the maximum lines", func() {
+		Expect(p.ProcessRecord(ctx, start, line("stderr", "java.lang.Error"))).To(Succeed())
+		for i := 0; i < 4; i++ {
+			Expect(p.ProcessRecord(ctx, start, line("stderr", "\tat a.b(C.java:1)"))).To(Succeed())
+		}
+
+		Expect(next.logs()).To(Equal([]string{
+			"java.lang.Error\n\tat a.b(C.java:1)\n\tat a.b(C.java:1)\n\tat a.b(C.java:1)",
+			"\tat a.b(C.java:1)\n",
+		}))
+		Expect(grouper.Pending()).To(BeZero())
+	})
+
+	It("Should write the pending groups when draining", func() {
+		Expect(p.ProcessRecord(ctx, start, line("stderr", "Traceback (most recent call last):"))).To(Succeed())
+		Expect(grouper.Pending()).To(Equal(1))
+
+		Expect(entry.FlushNext(entry.WithDrain(ctx), p)).To(Succeed())
+		Expect(next.logs()).To(Equal([]string{"Traceback (most recent call last):"}))
+		Expect(grouper.Pending()).To(BeZero())
+	})
+
+	It("Should write the line closing a group when the group write fails", func() {
+		Expect(p.ProcessRecord(ctx, start, line("stderr", "java.lang.Error"))).To(Succeed())
+
+		invalid := errors.New("invalid record")
+		next.err, next.failures = invalid, 1
+		Expect(p.ProcessRecord(ctx, start, line("stderr", "done"))).To(MatchError(invalid))
+
+		Expect(next.logs()).To(Equal([]string{"done\n"}))
+	})
+
+	Context("When the chunk is retried", func() {
+		failure := &entry.ErrRetry{Cause: errors.New("connection reset")}
+
+		It("Should put back the group written by the chunk", func() {
+			Expect(p.ProcessRecord(ctx, start, line("stderr", "java.lang.Error"))).To(Succeed())
+			Expect(entry.FlushNext(ctx, p)).To(Succeed())
+
+			next.err = failure
+			p = grouper.Wrap(next)
+			Expect(p.ProcessRecord(ctx, start, line("stderr", "\tat a.b(C.java:1)"))).To(Succeed())
+			Expect(p.ProcessRecord(ctx, start, line("stderr", "done"))).To(MatchError(failure))
+			Expect(entry.FlushNext(ctx, p)).To(Succeed())
+			Expect(grouper.Pending()).To(Equal(1))
+
+			next.err = nil
+			p = grouper.Wrap(next)
+			Expect(p.ProcessRecord(ctx, start, line("stderr", "\tat a.b(C.java:1)"))).To(Succeed())
+			Expect(p.ProcessRecord(ctx, start, line("stderr", "done"))).To(Succeed())
+
+			Expect(next.logs()).To(Equal([]string{"java.lang.Error\n\tat a.b(C.java:1)", "done\n"}))
+		})
+
+		It("Should keep the lines added by the flushes running at the same time", func() {
+			Expect(p.ProcessRecord(ctx, start, line("stderr", "java.lang.Error"))).To(Succeed())
+			Expect(entry.FlushNext(ctx, p)).To(Succeed())
+
+			retried := grouper.Wrap(&recorder{err: failure})
+			concurrent := grouper.Wrap(next)
+
+			Expect(retried.ProcessRecord(ctx, start, line("stderr", "\tat a.b(C.java:1)"))).To(Succeed())
+			Expect(concurrent.ProcessRecord(ctx, start, line("stdout", "Traceback (most recent call last):"))).To(Succeed())
+			Expect(concurrent.ProcessRecord(ctx, start, line("stderr", "\tat d.e(F.java:2)"))).To(Succeed())
+			Expect(entry.FlushNext(ctx, concurrent)).To(Succeed())
+			Expect(retried.ProcessRecord(ctx, start, line("stderr", "done"))).To(MatchError(failure))
+			Expect(entry.FlushNext(ctx, retried)).To(Succeed())
+			Expect(grouper.Pending()).To(Equal(2))
+
+			p = grouper.Wrap(next)
+			Expect(p.ProcessRecord(ctx, start, line("stderr", "done"))).To(Succeed())
+			Expect(entry.FlushNext(entry.WithDrain(ctx), p)).To(Succeed())
+
+			Expect(next.logs()).To(Equal([]string{
+				"java.lang.Error\n\tat d.e(F.java:2)",
+				"done\n",
+				"Traceback (most recent call last):",
+			}))
+		})
+
+		It("Should put back the expired groups when their write fails", func() {
+			Expect(p.ProcessRecord(ctx, start, line("stderr", "Traceback (most recent call last):"))).To(Succeed())
+			Expect(entry.FlushNext(ctx, p)).To(Succeed())
+
+			now = now.Add(3 * time.Second)
+
+			next.err = failure
+			p = grouper.Wrap(next)
+			Expect(entry.FlushNext(ctx, p)).To(MatchError(failure))
+			Expect(grouper.Pending()).To(Equal(1))
+
+			next.err = nil
+			p = grouper.Wrap(next)
+			Expect(entry.FlushNext(ctx, p)).To(Succeed())
+			Expect(next.logs()).To(Equal([]string{"Traceback (most recent call last):"}))
+		})
+	})
+})
@@ -0,0 +1,89 @@
+package multiline
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Rule describes a group of lines: a line matching Start opens a group, following lines
+// matching Continuation are appended to it.
+type Rule struct {
+	Name         string
+	Start        *regexp.Regexp
+	Continuation *regexp.Regexp
+}
+
+// Java groups an exception with its stack frames and causes.
+var Java = Rule{
+	Name:         "java",
+	Start:        regexp.MustCompile(`^(Exception in thread "[^"]*" )?([\w$]+\.)*[\w$]*(Exception|Error|Throwable)(: .*)?$`),
+	Continuation: regexp.MustCompile(`^(\s+at |\s+\.\.\. \d+ (more|common frames omitted)|Caused by: |\s*Suppressed: )`),
+}
+
+// Python groups a traceback with its frames and the exception line.
+var Python = Rule{
+	Name:         "python",
+	Start:        regexp.MustCompile(`^Traceback \(most recent call last\):$`),
+	Continuation: regexp.MustCompile(`^(\s+\S|([\w]+\.)*\w*(Error|Exception|Exit|Interrupt|Warning)(: .*)?$)`),
+}
+
+// Go groups a panic with the goroutine dumps.
+var Go = Rule{
+	Name:         "go",
+	Start:        regexp.MustCompile(`^(panic: |fatal error: )`),
+	Continuation: regexp.MustCompile(`^($|\s+|goroutine \d+ \[|created by |\[signal |[\w./*()\-]+\(.*\)$)`),
+}
+
+// CustomRuleName is the name of the rule built from the configured regular expressions.
+const CustomRuleName = "custom"
+
+var builtinRules = map[string]Rule{
+	Java.Name:   Java,
+	Python.Name: Python,
+	Go.Name:     Go,
+}
+
+// ParseRules returns the built-in rules listed in names, followed by the custom rule when start is set.
+func ParseRules(names, start, continuation string) ([]Rule, error) {
+	rules := make([]Rule, 0)
+
+	for _, name := range strings.Split(names, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+
+		rule, ok := builtinRules[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown multiline rule %q", name)
+		}
+
+		rules = append(rules, rule)
+	}
+
+	if start == "" && continuation == "" {
+		return rules, nil
+	}
+
+	if start == "" || continuation == "" {
+		return nil, errors.New("custom multiline rule requires both a start and a continuation")
+	}
+
+	custom := Rule{Name: CustomRuleName}
+
+	var err error
+
+	custom.Start, err = regexp.Compile(start)
+	if err != nil {
+		return nil, fmt.Errorf("compile start: %w", err)
+	}
+
+	custom.Continuation, err = regexp.Compile(continuation)
+	if err != nil {
+		return nil, fmt.Errorf("compile continuation: %w", err)
+	}
+
+	return append(rules, custom), nil
+}
@@ -0,0 +1,69 @@
+package multiline_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	"github.com/saagie/fluent-bit-mongo/pkg/multiline"
+)
+
+var _ = Describe("Rules", func() {
+	DescribeTable("Built-in rule", func(rule multiline.Rule, start string, continuations ...string) {
+		Expect(rule.Start.MatchString(start)).To(BeTrue(), "start %q", start)
+
+		for _, continuation := range continuations {
+			Expect(rule.Continuation.MatchString(continuation)).To(BeTrue(), "continuation %q", continuation)
+		}
+
+		Expect(rule.Start.MatchString("an ordinary line")).To(BeFalse())
+		Expect(rule.Continuation.MatchString("an ordinary line")).To(BeFalse())
+	},
+		Entry("java", multiline.Java,
+			`Exception in thread "main" java.lang.IllegalStateException: boom`,
+			"\tat com.example.Main.main(Main.java:12)",
+			"Caused by: java.lang.NullPointerException",
+			"\t... 3 more",
+		),
+		Entry("python", multiline.Python,
+			"Traceback (most recent call last):",
+			`  File "main.py", line 3, in <module>`,
+			"    raise ValueError('boom')",
+			"ValueError: boom",
+		),
+		Entry("go", multiline.Go,
+			"panic: runtime error: index out of range [3] with length 2",
+			"",
+			"goroutine 1 [running]:",
+			"main.main()",
+			"\t/app/main.go:8 +0x1d",
+		),
+	)
+
+	Describe("Parsing", func() {
+		It("Should return the listed built-in rules", func() {
+			rules, err := multiline.ParseRules("java, Go", "", "")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(rules).To(Equal([]multiline.Rule{multiline.Java, multiline.Go}))
+		})
+
+		It("Should add the custom rule", func() {
+			rules, err := multiline.ParseRules("", `^\d{4}-`, `^\s`)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(rules).To(HaveLen(1))
+			Expect(rules[0].Name).To(Equal(multiline.CustomRuleName))
+			Expect(rules[0].Start.String()).To(Equal(`^\d{4}-`))
+		})
+
+		DescribeTable("Invalid rules", func(names, start, continuation string) {
+			_, err := multiline.ParseRules(names, start, continuation)
+			Expect(err).To(HaveOccurred())
+		},
+			Entry("unknown rule", "ruby", "", ""),
+			Entry("start only", "", "^a", ""),
+			Entry("continuation only", "", "", "^a"),
+			Entry("invalid start", "", "(", "^a"),
+			Entry("invalid continuation", "", "^a", "("),
+		)
+	})
+})
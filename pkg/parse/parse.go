@@ -3,6 +3,8 @@ package parse
 import (
 	"fmt"
 	"reflect"
+	"strconv"
+	"strings"
 
 	"github.com/saagie/fluent-bit-mongo/pkg/convert"
 	"github.com/spaolacci/murmur3"
@@ -75,3 +77,67 @@ func ExtractStringValue(m map[interface{}]interface{}, k string) (string, error)
 
 	return string(valueBytes), nil
 }
+
+// ExtractScalarValue returns a scalar value as a string, whatever the type it was decoded with.
+func ExtractScalarValue(m map[interface{}]interface{}, k string) (string, error) {
+	value, ok := m[k]
+	if !ok {
+		return "", KeyNotFound(k, m)
+	}
+
+	switch v := value.(type) {
+	case []uint8:
+		return string(v), nil
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case uint64:
+		return strconv.FormatUint(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	default:
+		return "", &ErrValueType{reflect.TypeOf(value), reflect.TypeOf("")}
+	}
+}
+
+// SanitizeKey replaces the characters MongoDB does not accept in field names.
+func SanitizeKey(key string) string {
+	key = strings.ReplaceAll(key, ".", "_")
+	if strings.HasPrefix(key, "$") {
+		key = "_" + key[1:]
+	}
+
+	return key
+}
+
+// RecordMap converts a decoded record to a map which can be stored, byte values become strings.
+func RecordMap(record map[interface{}]interface{}) map[string]interface{} {
+	result := make(map[string]interface{}, len(record))
+
+	for k, v := range record {
+		result[SanitizeKey(fmt.Sprint(k))] = recordValue(v)
+	}
+
+	return result
+}
+
+func recordValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case []uint8:
+		return string(v)
+	case map[interface{}]interface{}:
+		return RecordMap(v)
+	case []interface{}:
+		result := make([]interface{}, 0, len(v))
+		for _, item := range v {
+			result = append(result, recordValue(item))
+		}
+
+		return result
+	default:
+		return v
+	}
+}
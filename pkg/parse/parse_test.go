@@ -62,3 +62,57 @@ var _ = Describe("Extract string value", func() {
 		)
 	})
 })
+
+var _ = Describe("Extract scalar value", func() {
+	const key = "the-key"
+
+	Context("From an empty structure", func() {
+		It("Should fail", func() {
+			_, err := parse.ExtractScalarValue(map[interface{}]interface{}{}, key)
+			Expect(err).To(MatchError(&parse.ErrKeyNotFound{
+				LookingFor: key,
+			}))
+		})
+	})
+
+	DescribeTable("A value", func(value interface{}, expected string, ok bool) {
+		result, err := parse.ExtractScalarValue(map[interface{}]interface{}{key: value}, key)
+		if ok {
+			Expect(err).ToNot(HaveOccurred())
+			Expect(result).To(Equal(expected))
+		} else {
+			Expect(err).To(HaveOccurred())
+		}
+	},
+		Entry("nil", nil, "", false),
+		Entry("bytes", []uint8("a-string"), "a-string", true),
+		Entry("string", "a-string", "a-string", true),
+		Entry("boolean", true, "true", true),
+		Entry("integer", int64(-3), "-3", true),
+		Entry("unsigned integer", uint64(3), "3", true),
+		Entry("float", 1.5, "1.5", true),
+		Entry("map", map[interface{}]interface{}{}, "", false),
+	)
+})
+
+var _ = Describe("Record map", func() {
+	It("Should convert bytes and nested values", func() {
+		result := parse.RecordMap(map[interface{}]interface{}{
+			"log":       []uint8("line"),
+			"count":     int64(2),
+			"k8s.pod":   []uint8("pod"),
+			"$where":    []uint8("x"),
+			"labels":    map[interface{}]interface{}{"app": []uint8("api")},
+			"addresses": []interface{}{[]uint8("a"), []uint8("b")},
+		})
+
+		Expect(result).To(Equal(map[string]interface{}{
+			"log":       "line",
+			"count":     int64(2),
+			"k8s_pod":   "pod",
+			"_where":    "x",
+			"labels":    map[string]interface{}{"app": "api"},
+			"addresses": []interface{}{"a", "b"},
+		}))
+	})
+})
@@ -0,0 +1,7 @@
+package partial
+
+import "time"
+
+func (r *Reassembler) SetNow(now func() time.Time) {
+	r.now = now
+}
@@ -0,0 +1,444 @@
+package partial
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/saagie/fluent-bit-mongo/pkg/entry"
+	"github.com/saagie/fluent-bit-mongo/pkg/entry/mongo"
+	"github.com/saagie/fluent-bit-mongo/pkg/log"
+	"github.com/saagie/fluent-bit-mongo/pkg/parse"
+)
+
+// Keys set by the docker partial message support.
+const (
+	MessageKey = "partial_message"
+	IDKey      = "partial_id"
+	OrdinalKey = "partial_ordinal"
+	LastKey    = "partial_last"
+)
+
+// CRI runtimes flag each line with P (partial) or F (full, the last fragment).
+const (
+	CRIFlagKey     = "logtag"
+	CRIFlagPartial = "P"
+	CRIFlagFull    = "F"
+)
+
+// LogFileKey is the key set by the tail input Path_Key option.
+const LogFileKey = "log_file"
+
+// streamKeys identify the stream of CRI fragments, which carry no partial ID.
+var streamKeys = []string{
+	LogFileKey,
+	mongo.JobExecutionIDKey,
+	mongo.AppExecutionIDKey,
+	mongo.ContainerIDKey,
+	mongo.ConditionExecutionIDKey,
+	mongo.StreamKey,
+}
+
+type Options struct {
+	Enabled bool
+	// Timeout is the time after which an incomplete line is written as is.
+	Timeout time.Duration
+	// MaxSize is the size above which a line is written without waiting for the next fragments.
+	MaxSize int
+}
+
+func DefaultOptions() Options {
+	return Options{
+		Enabled: false,
+		Timeout: 5 * time.Second,
+		MaxSize: 1024 * 1024,
+	}
+}
+
+func (o Options) Validate() error {
+	if !o.Enabled {
+		return nil
+	}
+
+	if o.Timeout <= 0 {
+		return errors.New("partial timeout must be positive")
+	}
+
+	if o.MaxSize <= 0 {
+		return errors.New("partial max size must be positive")
+	}
+
+	return nil
+}
+
+type fragment struct {
+	ordinal int
+	// numbered is set for the fragments carrying an ordinal, the others cannot be told apart
+	numbered bool
+	content  string
+}
+
+type line struct {
+	ts        time.Time
+	record    map[interface{}]interface{}
+	fragments []fragment
+	size      int
+	updatedAt time.Time
+}
+
+// has reports whether the line holds the fragment, which is then a fragment of a retried chunk.
+func (l *line) has(f fragment) bool {
+	return holds(l.fragments, f)
+}
+
+// holds reports whether the fragments hold the fragment, only the numbered fragments can be told apart.
+func holds(fragments []fragment, f fragment) bool {
+	if !f.numbered {
+		return false
+	}
+
+	for _, held := range fragments {
+		if held.numbered && held.ordinal == f.ordinal {
+			return true
+		}
+	}
+
+	return false
+}
+
+// change is what a chunk did to the line of a key: the fragments it added and the lines it took out, complete or
+// expired. It is undone when the chunk is retried.
+type change struct {
+	added   []fragment
+	removed []*line
+}
+
+// changeOf returns the change of the key, created on first use.
+func changeOf(changes map[string]*change, key string) *change {
+	c, ok := changes[key]
+	if !ok {
+		c = &change{}
+		changes[key] = c
+	}
+
+	return c
+}
+
+func (l *line) join() (time.Time, map[interface{}]interface{}) {
+	sort.SliceStable(l.fragments, func(i, j int) bool {
+		return l.fragments[i].ordinal < l.fragments[j].ordinal
+	})
+
+	var builder strings.Builder
+	builder.Grow(l.size)
+
+	for _, f := range l.fragments {
+		builder.WriteString(f.content)
+	}
+
+	record := make(map[interface{}]interface{}, len(l.record))
+	for k, v := range l.record {
+		record[k] = v
+	}
+
+	for _, k := range []string{MessageKey, IDKey, OrdinalKey, LastKey, CRIFlagKey} {
+		delete(record, k)
+	}
+
+	record[mongo.LogKey] = []uint8(builder.String())
+
+	return l.ts, record
+}
+
+// Reassembler joins the fragments of lines split by the container runtime.
+// Fragments are kept between flushes until the last one is received.
+type Reassembler struct {
+	options Options
+	now     func() time.Time
+
+	lock    sync.Mutex
+	pending map[string]*line
+}
+
+var (
+	_ entry.Stage  = &Reassembler{}
+	_ entry.Holder = &Reassembler{}
+)
+
+func New(options Options) *Reassembler {
+	return &Reassembler{
+		options: options,
+		now:     time.Now,
+		pending: map[string]*line{},
+	}
+}
+
+func (r *Reassembler) Wrap(next entry.Processor) entry.Processor {
+	return &processor{
+		reassembler: r,
+		next:        next,
+		changes:     map[string]*change{},
+	}
+}
+
+// Pending returns the number of lines waiting for fragments.
+func (r *Reassembler) Pending() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return len(r.pending)
+}
+
+type processor struct {
+	reassembler *Reassembler
+	next        entry.Processor
+	// changes holds what the chunk did to the lines, by key.
+	// It is undone when the chunk is retried, since its fragments come again and the lines it wrote may be lost.
+	changes map[string]*change
+	retry   bool
+}
+
+func (p *processor) ProcessRecord(ctx context.Context, ts time.Time, record map[interface{}]interface{}) error {
+	key, last, ok := fragmentOf(record)
+	if !ok {
+		return p.next.ProcessRecord(ctx, ts, record)
+	}
+
+	complete, err := p.reassembler.add(key, last, ts, record, p.changes)
+	if err != nil {
+		return fmt.Errorf("add fragment: %w", err)
+	}
+
+	if complete == nil {
+		return nil
+	}
+
+	ts, record = complete.join()
+
+	err = p.next.ProcessRecord(ctx, ts, record)
+	if errors.Is(err, &entry.ErrRetry{}) {
+		p.retry = true
+	}
+
+	return err
+}
+
+// Flush writes the lines whose fragments did not come in time, or all of them when draining, then flushes the next processor.
+// When the chunk is retried, what it did to the lines is undone, keeping the changes of the other flushes.
+func (p *processor) Flush(ctx context.Context) error {
+	err := p.flush(ctx)
+
+	if p.retry || errors.Is(err, &entry.ErrRetry{}) {
+		p.reassembler.restore(p.changes)
+	}
+
+	p.changes = map[string]*change{}
+	p.retry = false
+
+	return err
+}
+
+func (p *processor) flush(ctx context.Context) error {
+	logger, err := log.GetLogger(ctx)
+	if err != nil {
+		return fmt.Errorf("get logger: %w", err)
+	}
+
+	for _, expired := range p.reassembler.expire(entry.Draining(ctx), p.changes) {
+		ts, record := expired.join()
+
+		logger.Debug("Partial line timed out", map[string]interface{}{
+			"fragments": len(expired.fragments),
+		})
+
+		if err := p.next.ProcessRecord(ctx, ts, record); err != nil {
+			return fmt.Errorf("process record: %w", err)
+		}
+	}
+
+	return entry.FlushNext(ctx, p.next)
+}
+
+// fragmentOf returns the key of the line the record is a fragment of and whether it is the last fragment.
+func fragmentOf(record map[interface{}]interface{}) (string, bool, bool) {
+	if flag, err := parse.ExtractScalarValue(record, CRIFlagKey); err == nil {
+		switch flag {
+		case CRIFlagPartial:
+			return streamKey(record), false, true
+		case CRIFlagFull:
+			// A full line without previous fragments is a line of its own, see add
+			return streamKey(record), true, true
+		}
+	}
+
+	if partial, err := parse.ExtractScalarValue(record, MessageKey); err == nil && partial == "true" {
+		id, err := parse.ExtractScalarValue(record, IDKey)
+		if err != nil {
+			id = streamKey(record)
+		}
+
+		last, _ := parse.ExtractScalarValue(record, LastKey)
+
+		return id, last == "true", true
+	}
+
+	return "", false, false
+}
+
+func streamKey(record map[interface{}]interface{}) string {
+	values := make([]string, 0, len(streamKeys))
+
+	for _, k := range streamKeys {
+		value, _ := parse.ExtractScalarValue(record, k)
+		values = append(values, value)
+	}
+
+	return strings.Join(values, "\x00")
+}
+
+// add appends the fragment to its line and returns the line when it is complete.
+// The change is recorded, a fragment the line already holds is not added again.
+func (r *Reassembler) add(key string, last bool, ts time.Time, record map[interface{}]interface{}, changes map[string]*change) (*line, error) {
+	content, err := parse.ExtractStringValue(record, mongo.LogKey)
+	if err != nil && !errors.Is(err, &parse.ErrKeyNotFound{LookingFor: mongo.LogKey}) {
+		return nil, fmt.Errorf("parse %s: %w", mongo.LogKey, err)
+	}
+
+	f := fragment{content: content}
+	if value, err := parse.ExtractScalarValue(record, OrdinalKey); err == nil {
+		if f.ordinal, err = strconv.Atoi(value); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", OrdinalKey, err)
+		}
+
+		f.numbered = true
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	current, ok := r.pending[key]
+	if !ok {
+		current = &line{
+			ts:     ts,
+			record: record,
+		}
+	}
+
+	c := changeOf(changes, key)
+
+	if !current.has(f) {
+		current.fragments = append(current.fragments, f)
+		current.size += len(content)
+		c.added = append(c.added, f)
+	}
+
+	current.updatedAt = r.now()
+
+	if last || current.size >= r.options.MaxSize {
+		delete(r.pending, key)
+		c.removed = append(c.removed, current)
+
+		return current, nil
+	}
+
+	r.pending[key] = current
+
+	return nil, nil
+}
+
+// expire removes and returns the lines which did not receive a fragment before the timeout, or all of them.
+// The removals are recorded.
+func (r *Reassembler) expire(all bool, changes map[string]*change) []*line {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	limit := r.now().Add(-r.options.Timeout)
+	expired := make([]*line, 0)
+
+	for key, l := range r.pending {
+		if all || l.updatedAt.Before(limit) {
+			c := changeOf(changes, key)
+			c.removed = append(c.removed, l)
+
+			expired = append(expired, l)
+			delete(r.pending, key)
+		}
+	}
+
+	sort.SliceStable(expired, func(i, j int) bool {
+		return expired[i].ts.Before(expired[j].ts)
+	})
+
+	return expired
+}
+
+// restore undoes the changes of a chunk: the lines it took out are merged back into the pending lines, without the
+// fragments it added. The fragments added meanwhile by the other flushes are kept.
+func (r *Reassembler) restore(changes map[string]*change) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for key, c := range changes {
+		current := r.pending[key]
+
+		var base *line
+		var fragments []fragment
+
+		// The fragments taken out came first
+		for _, removed := range c.removed {
+			if base == nil {
+				base = removed
+			}
+
+			fragments = append(fragments, removed.fragments...)
+		}
+
+		if current != nil {
+			if base == nil {
+				base = current
+			}
+
+			for _, f := range current.fragments {
+				if !holds(fragments, f) {
+					fragments = append(fragments, f)
+				}
+			}
+		}
+
+		for _, f := range c.added {
+			fragments = without(fragments, f)
+		}
+
+		if len(fragments) == 0 {
+			delete(r.pending, key)
+
+			continue
+		}
+
+		restored := *base
+		restored.fragments = fragments
+		restored.size = 0
+
+		for _, f := range fragments {
+			restored.size += len(f.content)
+		}
+
+		r.pending[key] = &restored
+	}
+}
+
+// without removes the first occurrence of the fragment.
+func without(fragments []fragment, f fragment) []fragment {
+	for i, held := range fragments {
+		if held == f {
+			return append(fragments[:i:i], fragments[i+1:]...)
+		}
+	}
+
+	return fragments
+}
@@ -0,0 +1,302 @@
+package partial_test
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/saagie/fluent-bit-mongo/pkg/entry"
+	"github.com/saagie/fluent-bit-mongo/pkg/entry/mongo"
+	"github.com/saagie/fluent-bit-mongo/pkg/log"
+	"github.com/saagie/fluent-bit-mongo/pkg/partial"
+)
+
+type record struct {
+	ts     time.Time
+	record map[interface{}]interface{}
+}
+
+type recorder struct {
+	records []record
+	flushed int
+	// err fails the flushes
+	err error
+}
+
+func (r *recorder) ProcessRecord(_ context.Context, ts time.Time, m map[interface{}]interface{}) error {
+	r.records = append(r.records, record{ts: ts, record: m})
+
+	return nil
+}
+
+func (r *recorder) Flush(context.Context) error {
+	r.flushed++
+
+	return r.err
+}
+
+func (r *recorder) logs() []string {
+	logs := make([]string, 0, len(r.records))
+	for _, rec := range r.records {
+		logs = append(logs, string(rec.record[mongo.LogKey].([]uint8)))
+	}
+
+	return logs
+}
+
+var _ = Describe("Reassembler", func() {
+	var ctx context.Context
+	var reassembler *partial.Reassembler
+	var next *recorder
+	var now time.Time
+
+	start := time.Date(2022, 6, 8, 9, 56, 36, 0, time.UTC)
+
+	docker := func(id string, ordinal int, last bool, content string) map[interface{}]interface{} {
+		lastValue := "false"
+		if last {
+			lastValue = "true"
+		}
+
+		return map[interface{}]interface{}{
+			mongo.LogKey:            []uint8(content),
+			mongo.StreamKey:         []uint8("stdout"),
+			mongo.JobExecutionIDKey: []uint8("job"),
+			partial.MessageKey:      []uint8("true"),
+			partial.IDKey:           []uint8(id),
+			partial.OrdinalKey:      int64(ordinal),
+			partial.LastKey:         []uint8(lastValue),
+		}
+	}
+
+	cri := func(stream, flag, content string) map[interface{}]interface{} {
+		return map[interface{}]interface{}{
+			mongo.LogKey:            []uint8(content),
+			mongo.StreamKey:         []uint8(stream),
+			mongo.JobExecutionIDKey: []uint8("job"),
+			partial.CRIFlagKey:      []uint8(flag),
+		}
+	}
+
+	BeforeEach(func() {
+		logger, err := log.New(log.OutputPlugin, "test")
+		Expect(err).ToNot(HaveOccurred())
+
+		ctx = log.WithLogger(context.TODO(), logger)
+		now = start
+
+		reassembler = partial.New(partial.Options{
+			Enabled: true,
+			Timeout: 5 * time.Second,
+			MaxSize: 20,
+		})
+		reassembler.SetNow(func() time.Time {
+			return now
+		})
+
+		next = &recorder{}
+	})
+
+	It("Should pass complete records through", func() {
+		p := reassembler.Wrap(next)
+		rec := map[interface{}]interface{}{mongo.LogKey: []uint8("line")}
+
+		Expect(p.ProcessRecord(ctx, start, rec)).To(Succeed())
+		Expect(next.records).To(Equal([]record{{ts: start, record: rec}}))
+	})
+
+	It("Should join docker fragments with the first timestamp", func() {
+		p := reassembler.Wrap(next)
+
+		Expect(p.ProcessRecord(ctx, start, docker("a", 1, false, "hello "))).To(Succeed())
+		Expect(p.ProcessRecord(ctx, start.Add(time.Second), docker("b", 1, true, "other"))).To(Succeed())
+		Expect(p.ProcessRecord(ctx, start.Add(2*time.Second), docker("a", 2, true, "world"))).To(Succeed())
+
+		Expect(next.logs()).To(Equal([]string{"other", "hello world"}))
+		Expect(next.records[1].ts).To(Equal(start))
+		Expect(next.records[1].record).ToNot(HaveKey(partial.MessageKey))
+		Expect(next.records[1].record).ToNot(HaveKey(partial.IDKey))
+		Expect(next.records[1].record).To(HaveKey(mongo.JobExecutionIDKey))
+	})
+
+	It("Should join CRI fragments per stream across flushes", func() {
+		p := reassembler.Wrap(next)
+
+		Expect(p.ProcessRecord(ctx, start, cri("stdout", "P", "out "))).To(Succeed())
+		Expect(p.ProcessRecord(ctx, start, cri("stderr", "P", "err "))).To(Succeed())
+		Expect(entry.FlushNext(ctx, p)).To(Succeed())
+		Expect(next.records).To(BeEmpty())
+		Expect(next.flushed).To(Equal(1))
+		Expect(reassembler.Pending()).To(Equal(2))
+
+		next = &recorder{}
+		p = reassembler.Wrap(next)
+
+		Expect(p.ProcessRecord(ctx, start, cri("stderr", "F", "line"))).To(Succeed())
+		Expect(p.ProcessRecord(ctx, start, cri("stdout", "F", "line"))).To(Succeed())
+		Expect(p.ProcessRecord(ctx, start, cri("stdout", "F", "single"))).To(Succeed())
+
+		Expect(next.logs()).To(Equal([]string{"err line", "out line", "single"}))
+		Expect(next.records[0].record).ToNot(HaveKey(partial.CRIFlagKey))
+		Expect(reassembler.Pending()).To(BeZero())
+	})
+
+	It("Should write incomplete lines after the timeout", func() {
+		p := reassembler.Wrap(next)
+
+		Expect(p.ProcessRecord(ctx, start, cri("stdout", "P", "incomplete"))).To(Succeed())
+		Expect(entry.FlushNext(ctx, p)).To(Succeed())
+		Expect(next.records).To(BeEmpty())
+
+		now = now.Add(6 * time.Second)
+
+		Expect(entry.FlushNext(ctx, p)).To(Succeed())
+		Expect(next.logs()).To(Equal([]string{"incomplete"}))
+		Expect(reassembler.Pending()).To(BeZero())
+	})
+
+	It("Should write lines reaching the maximum size", func() {
+		p := reassembler.Wrap(next)
+
+		Expect(p.ProcessRecord(ctx, start, cri("stdout", "P", "0123456789"))).To(Succeed())
+		Expect(p.ProcessRecord(ctx, start, cri("stdout", "P", "0123456789"))).To(Succeed())
+		Expect(p.ProcessRecord(ctx, start, cri("stdout", "F", "end"))).To(Succeed())
+
+		Expect(next.logs()).To(Equal([]string{"01234567890123456789", "end"}))
+	})
+
+	It("Should write the incomplete lines when draining", func() {
+		p := reassembler.Wrap(next)
+
+		Expect(p.ProcessRecord(ctx, start, cri("stdout", "P", "incomplete"))).To(Succeed())
+		Expect(entry.FlushNext(entry.WithDrain(ctx), p)).To(Succeed())
+		Expect(next.logs()).To(Equal([]string{"incomplete"}))
+		Expect(reassembler.Pending()).To(BeZero())
+	})
+
+	Context("When the chunk is retried", func() {
+		failure := &entry.ErrRetry{Cause: errors.New("connection reset")}
+
+		It("Should not add the fragments of the retried chunk twice", func() {
+			p := reassembler.Wrap(next)
+			Expect(p.ProcessRecord(ctx, start, docker("a", 1, false, "hello "))).To(Succeed())
+			Expect(entry.FlushNext(ctx, p)).To(Succeed())
+
+			next.err = failure
+			p = reassembler.Wrap(next)
+			Expect(p.ProcessRecord(ctx, start, docker("a", 2, false, "big "))).To(Succeed())
+			Expect(entry.FlushNext(ctx, p)).To(MatchError(failure))
+
+			next.err = nil
+			p = reassembler.Wrap(next)
+			Expect(p.ProcessRecord(ctx, start, docker("a", 2, false, "big "))).To(Succeed())
+			Expect(p.ProcessRecord(ctx, start, docker("a", 3, true, "world"))).To(Succeed())
+			Expect(entry.FlushNext(ctx, p)).To(Succeed())
+
+			Expect(next.logs()).To(Equal([]string{"hello big world"}))
+		})
+
+		It("Should skip the fragments already held", func() {
+			p := reassembler.Wrap(next)
+			Expect(p.ProcessRecord(ctx, start, docker("a", 1, false, "hello "))).To(Succeed())
+			Expect(p.ProcessRecord(ctx, start, docker("a", 1, false, "hello "))).To(Succeed())
+			Expect(p.ProcessRecord(ctx, start, docker("a", 2, true, "world"))).To(Succeed())
+
+			Expect(next.logs()).To(Equal([]string{"hello world"}))
+		})
+
+		It("Should keep the fragments of the acknowledged chunks of a line completed by the retried chunk", func() {
+			p := reassembler.Wrap(next)
+			Expect(p.ProcessRecord(ctx, start, cri("stdout", "P", "hello "))).To(Succeed())
+			Expect(entry.FlushNext(ctx, p)).To(Succeed())
+
+			next.err = failure
+			p = reassembler.Wrap(next)
+			Expect(p.ProcessRecord(ctx, start, cri("stdout", "F", "world"))).To(Succeed())
+			Expect(entry.FlushNext(ctx, p)).To(MatchError(failure))
+			Expect(reassembler.Pending()).To(Equal(1))
+
+			next = &recorder{}
+			p = reassembler.Wrap(next)
+			Expect(p.ProcessRecord(ctx, start, cri("stdout", "F", "world"))).To(Succeed())
+			Expect(entry.FlushNext(ctx, p)).To(Succeed())
+
+			Expect(next.logs()).To(Equal([]string{"hello world"}))
+			Expect(reassembler.Pending()).To(BeZero())
+		})
+
+		It("Should put the expired lines back when their write fails", func() {
+			p := reassembler.Wrap(next)
+			Expect(p.ProcessRecord(ctx, start, cri("stdout", "P", "incomplete"))).To(Succeed())
+			Expect(entry.FlushNext(ctx, p)).To(Succeed())
+
+			now = now.Add(6 * time.Second)
+
+			next.err = failure
+			p = reassembler.Wrap(next)
+			Expect(entry.FlushNext(ctx, p)).To(MatchError(failure))
+			Expect(reassembler.Pending()).To(Equal(1))
+
+			next = &recorder{}
+			p = reassembler.Wrap(next)
+			Expect(entry.FlushNext(ctx, p)).To(Succeed())
+			Expect(next.logs()).To(Equal([]string{"incomplete"}))
+		})
+
+		It("Should keep the fragments added by the flushes running at the same time", func() {
+			failing := &recorder{err: failure}
+			retried := reassembler.Wrap(failing)
+			concurrent := reassembler.Wrap(next)
+
+			Expect(retried.ProcessRecord(ctx, start, docker("a", 1, false, "hello "))).To(Succeed())
+			Expect(concurrent.ProcessRecord(ctx, start, docker("b", 1, false, "other "))).To(Succeed())
+			Expect(concurrent.ProcessRecord(ctx, start, docker("a", 2, false, "big "))).To(Succeed())
+			Expect(entry.FlushNext(ctx, concurrent)).To(Succeed())
+			Expect(entry.FlushNext(ctx, retried)).To(MatchError(failure))
+			Expect(reassembler.Pending()).To(Equal(2))
+
+			p := reassembler.Wrap(next)
+			Expect(p.ProcessRecord(ctx, start, docker("a", 1, false, "hello "))).To(Succeed())
+			Expect(p.ProcessRecord(ctx, start, docker("a", 3, true, "world"))).To(Succeed())
+			Expect(p.ProcessRecord(ctx, start, docker("b", 2, true, "line"))).To(Succeed())
+			Expect(entry.FlushNext(ctx, p)).To(Succeed())
+
+			Expect(next.logs()).To(Equal([]string{"hello big world", "other line"}))
+		})
+
+		It("Should put back the fragments of the other flushes in a line completed by the retried chunk", func() {
+			p := reassembler.Wrap(next)
+			Expect(p.ProcessRecord(ctx, start, docker("a", 1, false, "hello "))).To(Succeed())
+			Expect(entry.FlushNext(ctx, p)).To(Succeed())
+
+			failing := &recorder{err: failure}
+			retried := reassembler.Wrap(failing)
+			Expect(retried.ProcessRecord(ctx, start, docker("a", 3, true, "world"))).To(Succeed())
+
+			// A flush running at the same time brings a fragment of the line, once it was taken out
+			concurrent := reassembler.Wrap(next)
+			Expect(concurrent.ProcessRecord(ctx, start, docker("a", 2, false, "big "))).To(Succeed())
+			Expect(entry.FlushNext(ctx, concurrent)).To(Succeed())
+
+			Expect(entry.FlushNext(ctx, retried)).To(MatchError(failure))
+			Expect(reassembler.Pending()).To(Equal(1))
+
+			p = reassembler.Wrap(next)
+			Expect(p.ProcessRecord(ctx, start, docker("a", 3, true, "world"))).To(Succeed())
+			Expect(entry.FlushNext(ctx, p)).To(Succeed())
+
+			Expect(next.logs()).To(Equal([]string{"hello big world"}))
+		})
+
+		It("Should not put the lines back when the chunk is dropped", func() {
+			next.err = errors.New("invalid record")
+			p := reassembler.Wrap(next)
+			Expect(p.ProcessRecord(ctx, start, cri("stdout", "P", "incomplete"))).To(Succeed())
+			Expect(entry.FlushNext(entry.WithDrain(ctx), p)).ToNot(Succeed())
+			Expect(reassembler.Pending()).To(BeZero())
+		})
+	})
+})
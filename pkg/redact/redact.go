@@ -0,0 +1,305 @@
+package redact
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/saagie/fluent-bit-mongo/pkg/entry/mongo"
+	"github.com/saagie/fluent-bit-mongo/pkg/metrics"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// MetricRedactions counts the redacted values, by rule.
+const MetricRedactions = "redactions_total"
+
+// Rule replaces the matches of a pattern by a replacement template, as regexp.Expand does.
+type Rule struct {
+	Name        string
+	Pattern     *regexp.Regexp
+	Replacement string
+	// Valid filters the matches to redact, every match is redacted when nil.
+	Valid func(match string) bool
+}
+
+func placeholder(name string) string {
+	return fmt.Sprintf("[REDACTED:%s]", name)
+}
+
+var (
+	Bearer = Rule{
+		Name:        "bearer",
+		Pattern:     regexp.MustCompile(`(?i)\b(bearer)\s+[A-Za-z0-9\-._~+/]+=*`),
+		Replacement: "$1 " + placeholder("bearer"),
+	}
+	AWSAccessKey = Rule{
+		Name:        "aws_access_key",
+		Pattern:     regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`),
+		Replacement: placeholder("aws_access_key"),
+	}
+	AWSSecretKey = Rule{
+		Name:        "aws_secret_key",
+		Pattern:     regexp.MustCompile(`(?i)(aws_secret_access_key["']?\s*[=:]\s*["']?)[A-Za-z0-9/+=]{40}`),
+		Replacement: "${1}" + placeholder("aws_secret_key"),
+	}
+	JWT = Rule{
+		Name:        "jwt",
+		Pattern:     regexp.MustCompile(`\beyJ[A-Za-z0-9_-]+\.eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`),
+		Replacement: placeholder("jwt"),
+	}
+	Email = Rule{
+		Name:        "email",
+		Pattern:     regexp.MustCompile(`\b[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}\b`),
+		Replacement: placeholder("email"),
+	}
+	CreditCard = Rule{
+		Name:        "credit_card",
+		Pattern:     regexp.MustCompile(`\b\d(?:[ -]?\d){12,18}\b`),
+		Replacement: placeholder("credit_card"),
+		Valid:       Luhn,
+	}
+	Password = Rule{
+		Name:        "password",
+		Pattern:     regexp.MustCompile(`(?i)\b(password|passwd|pwd)(["']?\s*[=:]\s*["']?)[^\s"',;]+`),
+		Replacement: "$1$2" + placeholder("password"),
+	}
+)
+
+var builtinRules = []Rule{Bearer, AWSAccessKey, AWSSecretKey, JWT, Email, CreditCard, Password}
+
+// AllRules selects every built-in rule.
+const AllRules = "all"
+
+// ParseRules returns the built-in rules listed in names.
+func ParseRules(names string) ([]Rule, error) {
+	rules := make([]Rule, 0)
+
+	for _, name := range strings.Split(names, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+
+		if name == AllRules {
+			rules = append(rules, builtinRules...)
+
+			continue
+		}
+
+		found := false
+		for _, rule := range builtinRules {
+			if rule.Name == name {
+				rules = append(rules, rule)
+				found = true
+
+				break
+			}
+		}
+
+		if !found {
+			return nil, fmt.Errorf("unknown redaction rule %q", name)
+		}
+	}
+
+	return rules, nil
+}
+
+// NewRule compiles a custom rule, the replacement defaults to a placeholder naming the rule.
+func NewRule(name, pattern, replacement string) (Rule, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return Rule{}, fmt.Errorf("compile %q: %w", pattern, err)
+	}
+
+	if replacement == "" {
+		replacement = placeholder(name)
+	}
+
+	return Rule{
+		Name:        name,
+		Pattern:     re,
+		Replacement: replacement,
+	}, nil
+}
+
+// Luhn reports whether the digits of the value pass the Luhn checksum.
+func Luhn(value string) bool {
+	sum := 0
+	count := 0
+
+	for i := len(value) - 1; i >= 0; i-- {
+		c := value[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+
+		digit := int(c - '0')
+		if count%2 == 1 {
+			digit *= 2
+			if digit > 9 {
+				digit -= 9
+			}
+		}
+
+		sum += digit
+		count++
+	}
+
+	return count > 0 && sum%10 == 0
+}
+
+// Apply returns the content with the rule matches replaced, and the number of replacements.
+func (rule Rule) Apply(content string) (string, int) {
+	matches := rule.Pattern.FindAllStringSubmatchIndex(content, -1)
+	if len(matches) == 0 {
+		return content, 0
+	}
+
+	var builder strings.Builder
+	count := 0
+	last := 0
+
+	for _, match := range matches {
+		if rule.Valid != nil && !rule.Valid(content[match[0]:match[1]]) {
+			continue
+		}
+
+		builder.WriteString(content[last:match[0]])
+		builder.Write(rule.Pattern.ExpandString(nil, rule.Replacement, content, match))
+		last = match[1]
+		count++
+	}
+
+	if count == 0 {
+		return content, 0
+	}
+
+	builder.WriteString(content[last:])
+
+	return builder.String(), count
+}
+
+type Options struct {
+	Rules []Rule
+}
+
+func (o Options) Enabled() bool {
+	return len(o.Rules) > 0
+}
+
+func (o Options) Validate() error {
+	names := map[string]struct{}{}
+
+	for _, rule := range o.Rules {
+		if _, ok := names[rule.Name]; ok {
+			return errors.New("duplicated redaction rule " + rule.Name)
+		}
+
+		names[rule.Name] = struct{}{}
+	}
+
+	return nil
+}
+
+// Redactor removes secrets and personal data from the documents before they are written.
+type Redactor struct {
+	rules   []Rule
+	metrics *metrics.Registry
+}
+
+var (
+	_ mongo.Enricher           = &Redactor{}
+	_ mongo.DeadLetterEnricher = &Redactor{}
+)
+
+func New(options Options, registry *metrics.Registry) *Redactor {
+	return &Redactor{
+		rules:   options.Rules,
+		metrics: registry,
+	}
+}
+
+// Redact applies the rules to the content and accounts the replacements by rule.
+func (r *Redactor) Redact(content string, counts map[string]int) string {
+	for _, rule := range r.rules {
+		var count int
+
+		content, count = rule.Apply(content)
+		if count > 0 {
+			counts[rule.Name] += count
+		}
+	}
+
+	return content
+}
+
+func (r *Redactor) redactValue(value interface{}, counts map[string]int) interface{} {
+	switch v := value.(type) {
+	case string:
+		return r.Redact(v, counts)
+	case bson.M:
+		for k, item := range v {
+			v[k] = r.redactValue(item, counts)
+		}
+
+		return v
+	case map[string]interface{}:
+		for k, item := range v {
+			v[k] = r.redactValue(item, counts)
+		}
+
+		return v
+	case []interface{}:
+		for i, item := range v {
+			v[i] = r.redactValue(item, counts)
+		}
+
+		return v
+	default:
+		return v
+	}
+}
+
+// Enrich redacts the log content, the parsed fields and the record of the generic documents.
+func (r *Redactor) Enrich(_ context.Context, doc mongo.LogEntry) error {
+	d := doc.GetLogDocument()
+	counts := map[string]int{}
+
+	d.Log = r.Redact(d.Log, counts)
+	if d.Fields != nil {
+		r.redactValue(d.Fields, counts)
+	}
+
+	if generic, ok := doc.(*mongo.GenericLogDocument); ok && generic.Record != nil {
+		r.redactValue(generic.Record, counts)
+	}
+
+	for _, count := range counts {
+		d.Redactions += count
+	}
+
+	r.account(counts)
+
+	return nil
+}
+
+// EnrichDeadLetter redacts the values of the record kept by the dead letter.
+func (r *Redactor) EnrichDeadLetter(_ context.Context, d *mongo.DeadLetter) error {
+	counts := map[string]int{}
+
+	if d.Record != nil {
+		r.redactValue(d.Record, counts)
+	}
+
+	r.account(counts)
+
+	return nil
+}
+
+func (r *Redactor) account(counts map[string]int) {
+	for name, count := range counts {
+		r.metrics.Add(MetricRedactions, metrics.Labels{"rule": name}, float64(count))
+	}
+}
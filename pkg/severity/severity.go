@@ -0,0 +1,142 @@
+package severity
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/saagie/fluent-bit-mongo/pkg/entry/mongo"
+)
+
+// Normalized levels.
+const (
+	Trace = "trace"
+	Debug = "debug"
+	Info  = "info"
+	Warn  = "warn"
+	Error = "error"
+	Fatal = "fatal"
+)
+
+// LevelGroup is the name of the capture group holding the level in a pattern.
+const LevelGroup = "level"
+
+var levels = map[string]string{
+	"t":        Trace,
+	"trace":    Trace,
+	"finest":   Trace,
+	"d":        Debug,
+	"debug":    Debug,
+	"fine":     Debug,
+	"i":        Info,
+	"info":     Info,
+	"notice":   Info,
+	"w":        Warn,
+	"warn":     Warn,
+	"warning":  Warn,
+	"e":        Error,
+	"err":      Error,
+	"error":    Error,
+	"severe":   Error,
+	"f":        Fatal,
+	"fatal":    Fatal,
+	"critical": Fatal,
+	"crit":     Fatal,
+	"panic":    Fatal,
+}
+
+// Normalize returns the normalized level of a level name, or an empty string when it is unknown.
+func Normalize(level string) string {
+	return levels[strings.ToLower(level)]
+}
+
+const levelNames = `TRACE|DEBUG|INFO|NOTICE|WARN|WARNING|ERROR|SEVERE|FATAL|CRITICAL`
+
+// Built-in patterns, tried in order after the custom ones.
+var builtinPatterns = []*regexp.Regexp{
+	// JSON: {"level": "warn"}
+	regexp.MustCompile(`"(?:level|severity|lvl|loglevel)"\s*:\s*"(?P<level>\w+)"`),
+	// logfmt: level=warn
+	regexp.MustCompile(`(?:^|\s)(?:level|severity|lvl)="?(?P<level>\w+)`),
+	// [ERROR]
+	regexp.MustCompile(`(?i)\[(?P<level>` + levelNames + `)\]`),
+	// log4j/logback: 2022-06-08 09:56:36.183 [main] ERROR com.example.Main - message
+	regexp.MustCompile(`^\d{4}-\d{2}-\d{2}[T ]\d{2}:\d{2}:\d{2}(?:[.,]\d+)?\S*\s+(?:\[[^\]]*\]\s+)?(?P<level>` + levelNames + `)\b`),
+	// python logging: ERROR:root:message or 2022-06-08 09:56:36,183 - name - ERROR - message
+	regexp.MustCompile(`^(?P<level>DEBUG|INFO|WARNING|ERROR|CRITICAL):`),
+	regexp.MustCompile(`\s-\s(?P<level>DEBUG|INFO|WARNING|ERROR|CRITICAL)\s-\s`),
+}
+
+// ParsePattern compiles a custom pattern, it must capture the level in a group named level.
+func ParsePattern(pattern string) (*regexp.Regexp, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("compile %q: %w", pattern, err)
+	}
+
+	if re.SubexpIndex(LevelGroup) < 0 {
+		return nil, fmt.Errorf("pattern %q has no %s group", pattern, LevelGroup)
+	}
+
+	return re, nil
+}
+
+type Options struct {
+	Enabled bool
+	// Patterns are custom patterns tried before the built-in ones.
+	Patterns []*regexp.Regexp
+	// StderrError makes lines without detected level written on stderr error lines.
+	StderrError bool
+}
+
+func (o Options) Validate() error {
+	if !o.Enabled && (len(o.Patterns) > 0 || o.StderrError) {
+		return errors.New("severity patterns set while severity extraction is disabled")
+	}
+
+	return nil
+}
+
+// Extractor detects the severity level of log lines.
+type Extractor struct {
+	patterns    []*regexp.Regexp
+	stderrError bool
+}
+
+var _ mongo.Enricher = &Extractor{}
+
+func New(options Options) *Extractor {
+	return &Extractor{
+		patterns:    append(append([]*regexp.Regexp{}, options.Patterns...), builtinPatterns...),
+		stderrError: options.StderrError,
+	}
+}
+
+// Detect returns the normalized level of the content, or an empty string when none is found.
+func (e *Extractor) Detect(content, stream string) string {
+	for _, pattern := range e.patterns {
+		match := pattern.FindStringSubmatch(content)
+		if match == nil {
+			continue
+		}
+
+		if level := Normalize(match[pattern.SubexpIndex(LevelGroup)]); level != "" {
+			return level
+		}
+	}
+
+	if e.stderrError && (stream == "stderr" || strings.HasSuffix(stream, "_stderr")) {
+		return Error
+	}
+
+	return ""
+}
+
+func (e *Extractor) Enrich(_ context.Context, doc mongo.LogEntry) error {
+	d := doc.GetLogDocument()
+	d.Level = e.Detect(d.Log, d.Stream)
+
+	return nil
+}
@@ -0,0 +1,13 @@
+package severity_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestSeverity(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Severity Suite")
+}
@@ -0,0 +1,101 @@
+package severity_test
+
+import (
+	"context"
+	"regexp"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	"github.com/saagie/fluent-bit-mongo/pkg/entry/mongo"
+	"github.com/saagie/fluent-bit-mongo/pkg/log"
+	"github.com/saagie/fluent-bit-mongo/pkg/severity"
+)
+
+var _ = Describe("Extractor", func() {
+	Context("With built-in patterns", func() {
+		extractor := severity.New(severity.Options{Enabled: true})
+
+		DescribeTable("Detect", func(content, expected string) {
+			Expect(extractor.Detect(content, "stdout")).To(Equal(expected))
+		},
+			Entry("bracket", "[ERROR] connection refused", severity.Error),
+			Entry("lower case bracket", "something [warn] happened", severity.Warn),
+			Entry("logfmt", `time=2022-06-08T09:56:36Z level=warn msg="disk almost full"`, severity.Warn),
+			Entry("quoted logfmt", `level="debug" msg=hello`, severity.Debug),
+			Entry("json", `{"time":"2022-06-08T09:56:36Z","level":"ERROR","msg":"boom"}`, severity.Error),
+			Entry("json severity", `{"severity": "critical"}`, severity.Fatal),
+			Entry("log4j", "2022-06-08 09:56:36.183 [main] WARN  com.example.Main - deprecated", severity.Warn),
+			Entry("logback", "2022-06-08T09:56:36,183Z INFO com.example.Main started", severity.Info),
+			Entry("python basic", "WARNING:root:deprecated", severity.Warn),
+			Entry("python format", "2022-06-08 09:56:36,183 - app - ERROR - boom", severity.Error),
+			Entry("no level", "hello world", ""),
+			Entry("unknown level", "level=verbose hello", ""),
+			Entry("level in a word", "errors are counted", ""),
+		)
+
+		It("Should not fall back to stderr", func() {
+			Expect(extractor.Detect("hello", "stderr")).To(BeEmpty())
+		})
+	})
+
+	Context("With custom patterns and stderr fallback", func() {
+		extractor := severity.New(severity.Options{
+			Enabled:     true,
+			Patterns:    []*regexp.Regexp{regexp.MustCompile(`^(?P<level>[IWEF])\d{4} `)},
+			StderrError: true,
+		})
+
+		It("Should try custom patterns first", func() {
+			Expect(extractor.Detect("W0608 09:56:36.183 main.go:12] [INFO] retrying", "stdout")).To(Equal(severity.Warn))
+		})
+
+		It("Should fall back to error on stderr", func() {
+			Expect(extractor.Detect("hello", "stderr")).To(Equal(severity.Error))
+			Expect(extractor.Detect("hello", "orchestration_stderr")).To(Equal(severity.Error))
+			Expect(extractor.Detect("[INFO] hello", "stderr")).To(Equal(severity.Info))
+			Expect(extractor.Detect("hello", "stdout")).To(BeEmpty())
+		})
+	})
+
+	Describe("Custom pattern", func() {
+		It("Should require a level group", func() {
+			_, err := severity.ParsePattern(`^[IWEF]\d{4}`)
+			Expect(err).To(HaveOccurred())
+
+			_, err = severity.ParsePattern(`^(?P<level>[IWEF]\d{4}`)
+			Expect(err).To(HaveOccurred())
+
+			_, err = severity.ParsePattern(`^(?P<level>[IWEF])\d{4}`)
+			Expect(err).ToNot(HaveOccurred())
+		})
+	})
+
+	Describe("Enrich", func() {
+		It("Should set the document level and index", func() {
+			logger, err := log.New(log.OutputPlugin, "test")
+			Expect(err).ToNot(HaveOccurred())
+
+			ctx := log.WithLogger(context.TODO(), logger)
+
+			doc, err := mongo.Convert(ctx, time.Now(), map[interface{}]interface{}{
+				mongo.LogKey:            []uint8("[ERROR] boom"),
+				mongo.JobExecutionIDKey: []uint8("jobExecutionID"),
+				mongo.ProjectIDKey:      []uint8("projectID"),
+				mongo.CustomerKey:       []uint8("customer"),
+				mongo.PlatformIDKey:     []uint8("platformID"),
+			})
+			Expect(err).ToNot(HaveOccurred())
+
+			id := doc.GetID()
+			Expect(doc.Indexes()).To(HaveLen(1))
+
+			Expect(severity.New(severity.Options{Enabled: true}).Enrich(ctx, doc)).To(Succeed())
+			Expect(doc.GetLogDocument().Level).To(Equal(severity.Error))
+			Expect(doc.GetID()).To(Equal(id))
+			Expect(doc.Indexes()).To(ContainElement([]string{mongo.JobExecutionIDKey, mongo.LevelKey, mongo.TimeKey}))
+		})
+	})
+})
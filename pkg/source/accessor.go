@@ -0,0 +1,81 @@
+package source
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/saagie/fluent-bit-mongo/pkg/parse"
+)
+
+// Accessor is the path of a nested record key, written as $kubernetes['labels']['app'].
+type Accessor []string
+
+func ParseAccessor(value string) (Accessor, error) {
+	if !strings.HasPrefix(value, "$") {
+		return nil, fmt.Errorf("invalid accessor %q, expected $key['sub-key']", value)
+	}
+
+	rest := value[1:]
+
+	end := strings.IndexByte(rest, '[')
+	if end < 0 {
+		end = len(rest)
+	}
+
+	if end == 0 {
+		return nil, fmt.Errorf("invalid accessor %q, no key", value)
+	}
+
+	accessor := Accessor{rest[:end]}
+	rest = rest[end:]
+
+	for rest != "" {
+		if len(rest) < 4 || rest[0] != '[' || (rest[1] != '\'' && rest[1] != '"') {
+			return nil, fmt.Errorf("invalid accessor %q at %q", value, rest)
+		}
+
+		quote := rest[1]
+
+		end := strings.IndexByte(rest[2:], quote)
+		if end < 0 || len(rest) < end+4 || rest[end+3] != ']' {
+			return nil, fmt.Errorf("invalid accessor %q at %q", value, rest)
+		}
+
+		accessor = append(accessor, rest[2:end+2])
+		rest = rest[end+4:]
+	}
+
+	return accessor, nil
+}
+
+func (a Accessor) String() string {
+	var builder strings.Builder
+
+	builder.WriteString("$" + a[0])
+	for _, key := range a[1:] {
+		builder.WriteString("['" + key + "']")
+	}
+
+	return builder.String()
+}
+
+// Lookup returns the scalar value at the path of the accessor in the record.
+func (a Accessor) Lookup(record map[interface{}]interface{}) (string, bool) {
+	current := record
+
+	for _, key := range a[:len(a)-1] {
+		next, ok := current[key].(map[interface{}]interface{})
+		if !ok {
+			return "", false
+		}
+
+		current = next
+	}
+
+	value, err := parse.ExtractScalarValue(current, a[len(a)-1])
+	if err != nil {
+		return "", false
+	}
+
+	return value, true
+}
@@ -0,0 +1,134 @@
+package source
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/saagie/fluent-bit-mongo/pkg/entry"
+)
+
+// ValueGroup is the name of the capture group holding the value in a source pattern.
+const ValueGroup = "value"
+
+// Source reads a value from a record key, optionally captured from it by a pattern.
+type Source struct {
+	Accessor Accessor
+	Pattern  *regexp.Regexp
+}
+
+// Parse parses a source written as "<accessor>" or "<accessor> ~ <pattern>".
+// The pattern must capture the value in a group named value.
+func Parse(value string) (Source, error) {
+	accessorValue, pattern, hasPattern := strings.Cut(value, "~")
+
+	accessor, err := ParseAccessor(strings.TrimSpace(accessorValue))
+	if err != nil {
+		return Source{}, err
+	}
+
+	source := Source{Accessor: accessor}
+
+	if hasPattern {
+		pattern = strings.TrimSpace(pattern)
+
+		source.Pattern, err = regexp.Compile(pattern)
+		if err != nil {
+			return Source{}, fmt.Errorf("compile %q: %w", pattern, err)
+		}
+
+		if source.Pattern.SubexpIndex(ValueGroup) < 0 {
+			return Source{}, fmt.Errorf("pattern %q has no %s group", pattern, ValueGroup)
+		}
+	}
+
+	return source, nil
+}
+
+// Value returns the value of the source in the record, false when it is not found or empty.
+func (s Source) Value(record map[interface{}]interface{}) (string, bool) {
+	value, ok := s.Accessor.Lookup(record)
+	if !ok {
+		return "", false
+	}
+
+	if s.Pattern != nil {
+		match := s.Pattern.FindStringSubmatch(value)
+		if match == nil {
+			return "", false
+		}
+
+		value = match[s.Pattern.SubexpIndex(ValueGroup)]
+	}
+
+	return value, value != ""
+}
+
+type Options struct {
+	// Sources are the sources of record keys, tried in order.
+	Sources map[string][]Source
+}
+
+func (o Options) Enabled() bool {
+	return len(o.Sources) > 0
+}
+
+// Resolver sets record keys from their first source found in the record, before any other processing.
+// Records none of the sources of a key is found in are left as is.
+type Resolver struct {
+	keys    []string
+	sources map[string][]Source
+}
+
+var _ entry.Stage = &Resolver{}
+
+func New(options Options) *Resolver {
+	keys := make([]string, 0, len(options.Sources))
+	for key := range options.Sources {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return &Resolver{
+		keys:    keys,
+		sources: options.Sources,
+	}
+}
+
+// Resolve sets the keys of the record found in their sources.
+func (r *Resolver) Resolve(record map[interface{}]interface{}) {
+	for _, key := range r.keys {
+		for _, source := range r.sources[key] {
+			if value, ok := source.Value(record); ok {
+				record[key] = []uint8(value)
+
+				break
+			}
+		}
+	}
+}
+
+func (r *Resolver) Wrap(next entry.Processor) entry.Processor {
+	return &processor{
+		resolver: r,
+		next:     next,
+	}
+}
+
+type processor struct {
+	resolver *Resolver
+	next     entry.Processor
+}
+
+func (p *processor) ProcessRecord(ctx context.Context, ts time.Time, record map[interface{}]interface{}) error {
+	p.resolver.Resolve(record)
+
+	return p.next.ProcessRecord(ctx, ts, record)
+}
+
+func (p *processor) Flush(ctx context.Context) error {
+	return entry.FlushNext(ctx, p.next)
+}
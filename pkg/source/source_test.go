@@ -0,0 +1,158 @@
+package source_test
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	"github.com/saagie/fluent-bit-mongo/pkg/entry"
+	"github.com/saagie/fluent-bit-mongo/pkg/source"
+)
+
+type recorder struct {
+	records []map[interface{}]interface{}
+}
+
+func (r *recorder) ProcessRecord(_ context.Context, _ time.Time, record map[interface{}]interface{}) error {
+	r.records = append(r.records, record)
+
+	return nil
+}
+
+func kubernetesRecord() map[interface{}]interface{} {
+	return map[interface{}]interface{}{
+		"log":      []uint8("line"),
+		"log_file": []uint8("/var/log/containers/job-7f9c_customer-a_main-0123.log"),
+		"kubernetes": map[interface{}]interface{}{
+			"namespace_name": []uint8("customer-a"),
+			"labels": map[interface{}]interface{}{
+				"saagie.io/project-id": []uint8("project-1"),
+				"replicas":             int64(2),
+			},
+		},
+	}
+}
+
+func mustParse(value string) source.Source {
+	s, err := source.Parse(value)
+	Expect(err).ToNot(HaveOccurred())
+
+	return s
+}
+
+var _ = Describe("Accessor", func() {
+	DescribeTable("Parse", func(value string, expected source.Accessor) {
+		accessor, err := source.ParseAccessor(value)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(accessor).To(Equal(expected))
+		Expect(accessor.String()).To(Equal(expected.String()))
+	},
+		Entry("top level key", "$log_file", source.Accessor{"log_file"}),
+		Entry("nested keys", "$kubernetes['labels']['saagie.io/project-id']", source.Accessor{"kubernetes", "labels", "saagie.io/project-id"}),
+		Entry("double quotes", `$kubernetes["namespace_name"]`, source.Accessor{"kubernetes", "namespace_name"}),
+	)
+
+	DescribeTable("Invalid accessor", func(value string) {
+		_, err := source.ParseAccessor(value)
+		Expect(err).To(HaveOccurred())
+	},
+		Entry("without $", "kubernetes['labels']"),
+		Entry("without key", "$['labels']"),
+		Entry("unquoted sub-key", "$kubernetes[labels]"),
+		Entry("unterminated sub-key", "$kubernetes['labels"),
+		Entry("trailing characters", "$kubernetes['labels']x"),
+	)
+
+	DescribeTable("Lookup", func(value string, expected string, ok bool) {
+		accessor, err := source.ParseAccessor(value)
+		Expect(err).ToNot(HaveOccurred())
+
+		result, found := accessor.Lookup(kubernetesRecord())
+		Expect(found).To(Equal(ok))
+		Expect(result).To(Equal(expected))
+	},
+		Entry("top level key", "$log", "line", true),
+		Entry("nested key", "$kubernetes['labels']['saagie.io/project-id']", "project-1", true),
+		Entry("number", "$kubernetes['labels']['replicas']", "2", true),
+		Entry("missing key", "$kubernetes['annotations']['owner']", "", false),
+		Entry("map value", "$kubernetes['labels']", "", false),
+		Entry("through a scalar", "$log['sub']", "", false),
+	)
+})
+
+var _ = Describe("Source", func() {
+	It("Should capture the value from a path", func() {
+		s := mustParse(`$log_file ~ ^/var/log/containers/(?P<value>[^_]+)_`)
+
+		value, ok := s.Value(kubernetesRecord())
+		Expect(ok).To(BeTrue())
+		Expect(value).To(Equal("job-7f9c"))
+	})
+
+	It("Should not find a value the pattern does not match", func() {
+		s := mustParse(`$log_file ~ ^/var/log/pods/(?P<value>[^_]+)`)
+
+		_, ok := s.Value(kubernetesRecord())
+		Expect(ok).To(BeFalse())
+	})
+
+	DescribeTable("Invalid source", func(value string) {
+		_, err := source.Parse(value)
+		Expect(err).To(HaveOccurred())
+	},
+		Entry("accessor", "log_file"),
+		Entry("pattern", "$log_file ~ ("),
+		Entry("pattern without value group", "$log_file ~ ^/var/log/(.*)"),
+	)
+})
+
+var _ = Describe("Resolver", func() {
+	var (
+		next *recorder
+		p    entry.Processor
+	)
+
+	BeforeEach(func() {
+		next = &recorder{}
+		p = source.New(source.Options{
+			Sources: map[string][]source.Source{
+				"project_id": {
+					mustParse("$project_id"),
+					mustParse("$kubernetes['labels']['saagie.io/project-id']"),
+				},
+				"customer": {
+					mustParse("$kubernetes['labels']['saagie.io/customer']"),
+					mustParse("$kubernetes['namespace_name']"),
+				},
+				"job_execution_id": {
+					mustParse(`$log_file ~ ^/var/log/containers/(?P<value>[^_]+)_`),
+				},
+				"platform_id": {
+					mustParse("$kubernetes['labels']['saagie.io/platform-id']"),
+				},
+			},
+		}).Wrap(next)
+	})
+
+	It("Should set the keys from their first source found", func() {
+		record := kubernetesRecord()
+		record["project_id"] = []uint8("project-0")
+
+		Expect(p.ProcessRecord(context.TODO(), time.Now(), record)).To(Succeed())
+		Expect(next.records).To(HaveLen(1))
+
+		resolved := next.records[0]
+		Expect(resolved).To(HaveKeyWithValue("project_id", []uint8("project-0")))
+		Expect(resolved).To(HaveKeyWithValue("customer", []uint8("customer-a")))
+		Expect(resolved).To(HaveKeyWithValue("job_execution_id", []uint8("job-7f9c")))
+		Expect(resolved).ToNot(HaveKey("platform_id"))
+	})
+
+	It("Should fall back to the next source", func() {
+		Expect(p.ProcessRecord(context.TODO(), time.Now(), kubernetesRecord())).To(Succeed())
+		Expect(next.records[0]).To(HaveKeyWithValue("project_id", []uint8("project-1")))
+	})
+})
@@ -0,0 +1,82 @@
+package structured
+
+import (
+	"strconv"
+	"strings"
+)
+
+// parseLogfmt parses key=value pairs separated by spaces, values may be double quoted.
+// The content is not considered as logfmt unless every token is a key=value pair.
+func parseLogfmt(content string) (map[string]interface{}, bool) {
+	fields := map[string]interface{}{}
+
+	for i := 0; i < len(content); {
+		if content[i] == ' ' || content[i] == '\t' {
+			i++
+
+			continue
+		}
+
+		end := strings.IndexAny(content[i:], "= \t\"")
+		if end <= 0 || content[i+end] != '=' {
+			return nil, false
+		}
+
+		key := content[i : i+end]
+		i += end + 1
+
+		if i < len(content) && content[i] == '"' {
+			value, n, ok := unquote(content[i:])
+			if !ok {
+				return nil, false
+			}
+
+			fields[key] = value
+			i += n
+
+			if i < len(content) && content[i] != ' ' && content[i] != '\t' {
+				return nil, false
+			}
+
+			continue
+		}
+
+		end = strings.IndexAny(content[i:], " \t")
+		if end < 0 {
+			end = len(content) - i
+		}
+
+		value := content[i : i+end]
+		if strings.ContainsAny(value, "=\"") {
+			return nil, false
+		}
+
+		fields[key] = value
+		i += end
+	}
+
+	if len(fields) == 0 {
+		return nil, false
+	}
+
+	return fields, true
+}
+
+// unquote reads a double quoted value at the beginning of the content and returns it with its quoted length.
+func unquote(content string) (string, int, bool) {
+	for i := 1; i < len(content); i++ {
+		switch content[i] {
+		case '\\':
+			i++
+		case '"':
+			value, err := strconv.Unquote(content[:i+1])
+			if err != nil {
+				return "", 0, false
+			}
+
+			return value, i + 1, true
+		}
+	}
+
+	return "", 0, false
+}
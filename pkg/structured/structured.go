@@ -0,0 +1,211 @@
+package structured
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/saagie/fluent-bit-mongo/pkg/entry/mongo"
+	"github.com/saagie/fluent-bit-mongo/pkg/parse"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Format is a structured content format.
+type Format string
+
+const (
+	JSON   Format = "json"
+	Logfmt Format = "logfmt"
+)
+
+func ParseFormats(value string) ([]Format, error) {
+	formats := make([]Format, 0, 2)
+
+	for _, name := range strings.Split(value, ",") {
+		switch format := Format(strings.ToLower(strings.TrimSpace(name))); format {
+		case "":
+			continue
+		case JSON, Logfmt:
+			formats = append(formats, format)
+		default:
+			return nil, fmt.Errorf("unknown structured format %q", name)
+		}
+	}
+
+	return formats, nil
+}
+
+type Options struct {
+	Enabled bool
+	Formats []Format
+	// MaxDepth is the depth above which nested values are kept as JSON strings.
+	MaxDepth int
+	// MaxSize is the content size above which the content is not parsed.
+	MaxSize int
+	// MessageKey is the field replacing the log content, when set and found.
+	MessageKey string
+}
+
+func DefaultOptions() Options {
+	return Options{
+		Enabled:  false,
+		Formats:  []Format{JSON, Logfmt},
+		MaxDepth: 5,
+		MaxSize:  64 * 1024,
+	}
+}
+
+func (o Options) Validate() error {
+	if !o.Enabled {
+		return nil
+	}
+
+	if len(o.Formats) == 0 {
+		return errors.New("no structured format")
+	}
+
+	if o.MaxDepth <= 0 {
+		return errors.New("structured max depth must be positive")
+	}
+
+	if o.MaxSize <= 0 {
+		return errors.New("structured max size must be positive")
+	}
+
+	return nil
+}
+
+// Parser parses structured log content into the document fields.
+type Parser struct {
+	options Options
+}
+
+var _ mongo.Enricher = &Parser{}
+
+func New(options Options) *Parser {
+	return &Parser{
+		options: options,
+	}
+}
+
+// Parse returns the fields of the content, or false when the content is not structured.
+func (p *Parser) Parse(content string) (bson.M, bool) {
+	content = strings.TrimSpace(content)
+	if content == "" || len(content) > p.options.MaxSize {
+		return nil, false
+	}
+
+	for _, format := range p.options.Formats {
+		var fields map[string]interface{}
+		var ok bool
+
+		switch format {
+		case JSON:
+			fields, ok = parseJSON(content)
+		case Logfmt:
+			fields, ok = parseLogfmt(content)
+		}
+
+		if ok {
+			return p.convert(fields, 1), true
+		}
+	}
+
+	return nil, false
+}
+
+func (p *Parser) Enrich(_ context.Context, doc mongo.LogEntry) error {
+	d := doc.GetLogDocument()
+
+	fields, ok := p.Parse(d.Log)
+	if !ok {
+		return nil
+	}
+
+	if p.options.MessageKey != "" {
+		if message, ok := fields[parse.SanitizeKey(p.options.MessageKey)].(string); ok {
+			d.Log = message
+			delete(fields, parse.SanitizeKey(p.options.MessageKey))
+		}
+	}
+
+	d.Fields = fields
+
+	return nil
+}
+
+func parseJSON(content string) (map[string]interface{}, bool) {
+	if !strings.HasPrefix(content, "{") || !strings.HasSuffix(content, "}") {
+		return nil, false
+	}
+
+	decoder := json.NewDecoder(strings.NewReader(content))
+	decoder.UseNumber()
+
+	var fields map[string]interface{}
+	if err := decoder.Decode(&fields); err != nil {
+		return nil, false
+	}
+
+	return fields, true
+}
+
+func (p *Parser) convert(fields map[string]interface{}, depth int) bson.M {
+	result := make(bson.M, len(fields))
+
+	for k, v := range fields {
+		result[parse.SanitizeKey(k)] = p.convertValue(v, depth)
+	}
+
+	return result
+}
+
+func (p *Parser) convertValue(value interface{}, depth int) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+
+		if f, err := v.Float64(); err == nil {
+			return f
+		}
+
+		return v.String()
+	case map[string]interface{}:
+		if depth >= p.options.MaxDepth {
+			return marshal(v)
+		}
+
+		return p.convert(v, depth+1)
+	case []interface{}:
+		if depth >= p.options.MaxDepth {
+			return marshal(v)
+		}
+
+		result := make([]interface{}, 0, len(v))
+		for _, item := range v {
+			result = append(result, p.convertValue(item, depth+1))
+		}
+
+		return result
+	default:
+		return v
+	}
+}
+
+func marshal(value interface{}) string {
+	var buffer bytes.Buffer
+
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+
+	if err := encoder.Encode(value); err != nil {
+		return fmt.Sprint(value)
+	}
+
+	return strings.TrimSuffix(buffer.String(), "\n")
+}
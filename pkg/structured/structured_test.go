@@ -0,0 +1,123 @@
+package structured_test
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/saagie/fluent-bit-mongo/pkg/entry/mongo"
+	"github.com/saagie/fluent-bit-mongo/pkg/log"
+	"github.com/saagie/fluent-bit-mongo/pkg/structured"
+)
+
+var _ = Describe("Parser", func() {
+	var parser *structured.Parser
+
+	BeforeEach(func() {
+		options := structured.DefaultOptions()
+		options.Enabled = true
+		options.MaxDepth = 2
+		options.MaxSize = 200
+
+		parser = structured.New(options)
+	})
+
+	DescribeTable("Structured content", func(content string, expected bson.M) {
+		fields, ok := parser.Parse(content)
+		Expect(ok).To(BeTrue())
+		Expect(fields).To(Equal(expected))
+	},
+		Entry("json", `{"msg":"hello","request_id":"abc","status":200,"ratio":0.5,"ok":true,"nothing":null}`, bson.M{
+			"msg":        "hello",
+			"request_id": "abc",
+			"status":     int64(200),
+			"ratio":      0.5,
+			"ok":         true,
+			"nothing":    nil,
+		}),
+		Entry("json with nested values", `{"a":{"b":{"c":1}},"list":[1,{"d":2}]}`, bson.M{
+			"a":    bson.M{"b": `{"c":1}`},
+			"list": []interface{}{int64(1), `{"d":2}`},
+		}),
+		Entry("json with reserved keys", `{"user.name":"me","$where":"x"}`, bson.M{
+			"user_name": "me",
+			"_where":    "x",
+		}),
+		Entry("logfmt", `level=info msg="hello \"world\"" request_id=abc duration=12ms`, bson.M{
+			"level":      "info",
+			"msg":        `hello "world"`,
+			"request_id": "abc",
+			"duration":   "12ms",
+		}),
+		Entry("logfmt with empty value", `a= b=1`, bson.M{
+			"a": "",
+			"b": "1",
+		}),
+	)
+
+	DescribeTable("Unstructured content", func(content string) {
+		_, ok := parser.Parse(content)
+		Expect(ok).To(BeFalse())
+	},
+		Entry("empty", ""),
+		Entry("plain text", "hello world"),
+		Entry("text with a pair", "starting with timeout=3s"),
+		Entry("invalid json", `{"msg":`),
+		Entry("json array", `[1, 2]`),
+		Entry("unterminated quote", `msg="hello`),
+		Entry("too large", `{"msg":"`+strings.Repeat("a", 200)+`"}`),
+	)
+
+	Describe("Enrich", func() {
+		var ctx context.Context
+		var doc mongo.LogEntry
+
+		BeforeEach(func() {
+			logger, err := log.New(log.OutputPlugin, "test")
+			Expect(err).ToNot(HaveOccurred())
+
+			ctx = log.WithLogger(context.TODO(), logger)
+
+			doc, err = mongo.Convert(ctx, time.Now(), map[interface{}]interface{}{
+				mongo.LogKey:            []uint8(`{"message":"hello","request_id":"abc"}` + "\n"),
+				mongo.JobExecutionIDKey: []uint8("jobExecutionID"),
+				mongo.ProjectIDKey:      []uint8("projectID"),
+				mongo.CustomerKey:       []uint8("customer"),
+				mongo.PlatformIDKey:     []uint8("platformID"),
+			})
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("Should keep the original content", func() {
+			Expect(parser.Enrich(ctx, doc)).To(Succeed())
+			Expect(doc.GetLogDocument().Log).To(Equal(`{"message":"hello","request_id":"abc"}`))
+			Expect(doc.GetLogDocument().Fields).To(Equal(bson.M{"message": "hello", "request_id": "abc"}))
+		})
+
+		It("Should use the message key as content", func() {
+			options := structured.DefaultOptions()
+			options.Enabled = true
+			options.MessageKey = "message"
+
+			id := doc.GetID()
+
+			Expect(structured.New(options).Enrich(ctx, doc)).To(Succeed())
+			Expect(doc.GetLogDocument().Log).To(Equal("hello"))
+			Expect(doc.GetLogDocument().Fields).To(Equal(bson.M{"request_id": "abc"}))
+			Expect(doc.GetID()).To(Equal(id))
+		})
+
+		It("Should leave unstructured content unchanged", func() {
+			doc.GetLogDocument().Log = "hello world"
+
+			Expect(parser.Enrich(ctx, doc)).To(Succeed())
+			Expect(doc.GetLogDocument().Log).To(Equal("hello world"))
+			Expect(doc.GetLogDocument().Fields).To(BeNil())
+		})
+	})
+})